@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -11,62 +12,149 @@ import (
 	"os/exec"
 	"strings"
 
+	"p2p-messenger/internal/config"
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/groups"
+	"p2p-messenger/internal/history"
+	"p2p-messenger/internal/lobby"
+	"p2p-messenger/internal/logging"
 	"p2p-messenger/internal/network"
+	"p2p-messenger/internal/outbox"
+	"p2p-messenger/internal/presence"
 	"p2p-messenger/internal/proto"
+	"p2p-messenger/internal/repository"
+	"p2p-messenger/internal/transfer"
+	"p2p-messenger/internal/transport"
 	"p2p-messenger/internal/ui"
 )
 
-const (
-	Port = "25042"
-)
+var logger = logging.For("main")
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		err := runTranscript(os.Args[1], os.Args[2:])
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	f, err := os.OpenFile("p2p-chat.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		log.Fatal(err)
 	}
-	defer f.Close()
 
-	log.SetOutput(f)
-
-	fmt.Print("Please type in your name: ")
-	reader := bufio.NewReader(os.Stdin)
-	username, err := reader.ReadString('\n')
+	logFile, err := logging.Setup(cfg.Log)
 	if err != nil {
-		log.Fatalf("Failed to read username: %v", err)
+		log.Fatalf("error opening log file: %v", err)
 	}
-	username = strings.TrimSpace(username)
+	defer logFile.Close()
 
-	p, err := proto.NewProto(Port)
+	identity, err := crypto.LoadOrCreateIdentity(cfg.IdentityPath)
 	if err != nil {
-		log.Fatalf("Failed to create proto: %v", err)
+		log.Fatalf("Failed to load identity: %v", err)
+	}
+
+	username := cfg.Username
+	if username == "" {
+		fmt.Print("Please type in your name: ")
+		reader := bufio.NewReader(os.Stdin)
+		username, err = reader.ReadString('\n')
+		if err != nil {
+			log.Fatalf("Failed to read username: %v", err)
+		}
+		username = strings.TrimSpace(username)
 	}
+
+	peers := repository.NewPeerRepositoryWithValidation(
+		cfg.Discovery.PeerValidationInterval.Std(),
+		cfg.Discovery.PeerValidationRetries)
+	p := proto.New(cfg.PortString(), identity.Keypair(), peers)
+	p.SigningKey = identity.SigningKey()
 	p.SetUsername(username)
+	p.Hybrid = cfg.HybridHandshake
+	transport.SetPreferred(transport.Kind(cfg.Transports.Chat))
+	transport.SetPreferredInternet(transport.Kind(cfg.Transports.InternetChat))
+	transport.SetICEServers(cfg.Transports.ICEServers)
+	if (cfg.Transports.Chat == "webrtc" || cfg.Transports.InternetChat == "webrtc") && !cfg.Relay.Enabled {
+		logger.Warn("WebRTC is signalled through the relay, which is disabled; peers are dialled over websocket")
+	}
+	p.SessionPolicy = crypto.RekeyPolicy{
+		RekeyInterval: cfg.Session.RekeyInterval.Std(),
+		RekeyMessages: uint64(cfg.Session.RekeyMessages),
+		MaxAge:        cfg.Session.MaxAge.Std(),
+		MaxMessages:   uint64(cfg.Session.MaxMessages),
+	}
+	if cfg.Workspace.Enabled() {
+		secret, err := cfg.Workspace.LoadSecret()
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.Workspace, err = crypto.DeriveWorkspaceKeys(secret)
+		if err != nil {
+			log.Fatalf("Failed to derive workspace keys: %v", err)
+		}
+		logger.Info("workspace mode enabled")
+	}
+
+	networkManager := network.NewManager(p, cfg)
+	p.NetworkManager = networkManager
+	// Opened before the outbox so that restored conversations come first
+	p.History, err = history.Open(cfg.History.Dir, peers, networkManager.SendEnvelope)
+	if err != nil {
+		log.Fatalf("Failed to open history: %v", err)
+	}
+	defer p.History.Close()
+	p.Outbox, err = outbox.Open(cfg.Outbox.Path, cfg.Outbox.Expiry.Std(), peers, networkManager.SendEnvelope)
+	if err != nil {
+		log.Fatalf("Failed to open outbox: %v", err)
+	}
+	p.Presence = presence.New(networkManager.SendEnvelope, cfg.Privacy.TypingIndicators, cfg.Privacy.ReadReceipts)
+	self := entity.Member{PeerID: crypto.PeerID(p.PublicKey), PublicKey: p.PublicKey, Username: p.Username}
+	p.Groups, err = groups.Open(cfg.Groups.Path, self, p.SigningKey, peers, networkManager.SendGroup)
+	if err != nil {
+		log.Fatalf("Failed to open groups: %v", err)
+	}
+	defer p.Groups.Close()
+	if cfg.Lobby.Enabled {
+		p.Lobby = lobby.New(peers, networkManager.SendLobby)
+	}
+	p.Transfers = transfer.New(cfg.Files.Dir, peers, networkManager.SendFileControl, networkManager.DialFile)
+	err = p.Transfers.LoadShares(cfg.Files.SharesPath, func(groupID, peerID string) bool {
+		group, ok := p.Groups.Get(groupID)
+		return ok && p.Groups.Joined(group) && group.IsMember(peerID)
+	})
+	if err != nil {
+		log.Fatalf("Failed to load shared folders: %v", err)
+	}
 
 	// Launch network manager and set terminal font size via AppleScript
-	runNetworkManager(p)
-	fontCmd := exec.Command("osascript", "-e", `tell application "Terminal" to set font size of window 1 to 14`)
-	if err := fontCmd.Run(); err != nil {
-		log.Printf("Failed to set font size: %v", err)
+	networkManager.Start()
+	if cfg.UI.FontSize > 0 {
+		script := fmt.Sprintf(`tell application "Terminal" to set font size of window 1 to %d`, cfg.UI.FontSize)
+		fontCmd := exec.Command("osascript", "-e", script)
+		if err := fontCmd.Run(); err != nil {
+			logger.Warn("failed to set font size", "err", err)
+		}
 	}
 
-	// Resize terminal window to 39 rows × 139 columns
-	fmt.Print("\033[8;39;139t")
+	if cfg.UI.ResizeTerminal {
+		// Resize terminal window to 39 rows × 139 columns
+		fmt.Print("\033[8;39;139t")
+	}
 
-	if err := runUI(p); err != nil {
+	if err := runUI(p, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func runNetworkManager(p *proto.Proto) *network.Manager {
-	networkManager := network.NewManager(p)
-	p.NetworkManager = networkManager
-	networkManager.Start()
-	return networkManager
-}
-
-func runUI(p *proto.Proto) error {
-	return ui.NewApp(p).Run()
+func runUI(p *proto.Proto, cfg *config.Config) error {
+	return ui.NewApp(p, cfg.UI).Run()
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"p2p-messenger/internal/config"
+	"p2p-messenger/internal/history"
+	"p2p-messenger/internal/repository"
+	"p2p-messenger/internal/transcript"
+)
+
+// runTranscript runs "localchat export" or "localchat import", which work
+// on the history files without starting the messenger. The history dir is
+// taken from the config file (-config) and environment unless -history-dir
+// is given.
+func runTranscript(command string, args []string) error {
+	flags := flag.NewFlagSet("localchat "+command, flag.ContinueOnError)
+	configPath := flags.String("config", "", fmt.Sprintf("path of the JSON config file (default %s)", config.DefaultPath()))
+	dir := flags.String("history-dir", "", "directory keeping conversations across restarts (default from the config)")
+	format := flags.String("format", string(transcript.JSONLines), "transcript format: jsonl, md or txt")
+	peer := flags.String("peer", "", "export only the conversation with this peer ID")
+	output := flags.String("o", "", "file to write the transcript to, standard output if empty")
+	if command == "import" {
+		flags.Usage = func() {
+			fmt.Fprintln(flags.Output(), "Usage: localchat import [-config file] [-history-dir dir] <transcript.jsonl>...")
+			fmt.Fprintln(flags.Output(), "Run it while localchat is not running, or use /import in the UI.")
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var configArgs []string
+	if *configPath != "" {
+		configArgs = []string{"-config", *configPath}
+	}
+	cfg, err := config.Load(configArgs)
+	if err != nil {
+		return err
+	}
+	if *dir == "" {
+		*dir = cfg.History.Dir
+	}
+
+	store, err := history.Open(*dir, repository.NewPeerRepository(), nil)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if command == "import" {
+		if flags.NArg() == 0 {
+			flags.Usage()
+			return flag.ErrHelp
+		}
+		for _, path := range flags.Args() {
+			if err := importTranscript(store, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := transcript.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+	convs, err := store.Conversations(*peer)
+	if err != nil {
+		return err
+	}
+	if *peer != "" && len(convs) == 0 {
+		return fmt.Errorf("no conversation with %s", *peer)
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return transcript.Write(w, f, convs)
+}
+
+func importTranscript(store *history.Store, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	convs, err := transcript.Read(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, conv := range convs {
+		added, err := store.Import(conv)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Printf("%s: %d of %d messages added\n", conv.PeerID, added, len(conv.Messages))
+	}
+	return nil
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
-	"log"
 	"os/exec"
 	"strings"
 	"time"
@@ -14,6 +13,7 @@ import (
 
 	"p2p-messenger/internal/crypto"
 	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
 )
 
 const (
@@ -21,8 +21,13 @@ const (
 	bleMetaCharacteristic = "6e400002-b5a3-f393-e0a9-e50e24dcca9e"
 
 	connectionTimeout = 5 * time.Second
+
+	// sealedMetadataPrefix marks metadata sealed with the workspace key
+	sealedMetadataPrefix = "me0s:"
 )
 
+var logger = logging.For("bluetooth")
+
 // Manager hosts a BLE GATT service that advertises peer metadata and scans for
 // nearby peers to support offline/local discovery.
 type Manager struct {
@@ -31,6 +36,7 @@ type Manager struct {
 	proto       *entityProto
 	stop        context.CancelFunc
 	Available   bool
+	workspace   *crypto.WorkspaceKeys
 }
 
 // entityProto is a minimal subset of proto.Proto to avoid import cycles.
@@ -119,26 +125,32 @@ func NewManager(publicKeyStr string, port string, username string, peers peerRep
 	}
 }
 
+// SetWorkspace restricts the advertised metadata to members of a workspace:
+// our metadata is sealed with its key and unsealed metadata is ignored
+func (m *Manager) SetWorkspace(keys *crypto.WorkspaceKeys) {
+	m.workspace = keys
+}
+
 // Start begins advertising and scanning; errors are logged but not fatal.
 func (m *Manager) Start() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Recovered from panic in bluetooth.Manager.Start: %v", r)
+			logger.Error("recovered from panic in Start", "panic", r)
 			m.Available = false
 		}
 	}()
 
 	dev, err := darwin.NewDevice()
 	if err != nil {
-		log.Printf("bluetooth: skipping BLE, unable to init device: %v", err)
+		logger.Warn("skipping BLE, unable to init device", "err", err)
 		m.Available = false
 		return
 	}
 	ble.SetDefaultDevice(dev)
-	log.Printf("bluetooth: default BLE device set")
+	logger.Debug("default BLE device set")
 
 	if err := m.addService(); err != nil {
-		log.Printf("bluetooth: unable to register service: %v", err)
+		logger.Warn("unable to register service", "err", err)
 		m.Available = false
 		return
 	}
@@ -163,7 +175,7 @@ func (m *Manager) advertise(ctx context.Context) {
 	advertiseName := "P2P"
 
 	if err := ble.AdvertiseNameAndServices(ctx, advertiseName, m.serviceUUID); err != nil {
-		log.Printf("bluetooth: advertise stopped: %v", err)
+		logger.Warn("advertise stopped", "err", err)
 		m.Available = false
 	}
 }
@@ -178,7 +190,7 @@ func (m *Manager) scan(ctx context.Context) {
 	for {
 		err := ble.Scan(ctx, false, m.handleAdvertisement, filter)
 		if err != nil && ctx.Err() == nil {
-			log.Printf("bluetooth: scan error: %v", err)
+			logger.Warn("scan error", "err", err)
 			m.Available = false
 			time.Sleep(time.Second)
 		}
@@ -193,7 +205,7 @@ func (m *Manager) handleAdvertisement(a ble.Advertisement) {
 	defer func() {
 		if r := recover(); r != nil {
 			// Handle UUID parsing panics gracefully (e.g., "invalid UUID string: DAF55501")
-			log.Printf("bluetooth: recovered from panic in handleAdvertisement: %v", r)
+			logger.Warn("recovered from panic in handleAdvertisement", "panic", r)
 		}
 	}()
 
@@ -239,7 +251,7 @@ func (m *Manager) handleAdvertisement(a ble.Advertisement) {
 
 	// If we found metadata in advertisement, parse it directly
 	if metaPayload != "" {
-		meta, err := parseMetadata(metaPayload)
+		meta, err := m.decodeMetadata(metaPayload)
 		if err == nil {
 			// Ignore our own advertisements
 			if meta.PubKeyStr == m.proto.PublicKeyStr {
@@ -263,7 +275,7 @@ func (m *Manager) handleAdvertisement(a ble.Advertisement) {
 			}
 			peer.AddConnectionType(entity.ConnectionBLE)
 
-			log.Printf("bluetooth: discovered BLE peer %s at %s", peerID, a.Addr().String())
+			logger.Debug("discovered BLE peer", "peer", peerID, "addr", a.Addr().String())
 			m.proto.Peers.Add(peer)
 			return
 		}
@@ -274,41 +286,41 @@ func (m *Manager) handleAdvertisement(a ble.Advertisement) {
 	if !a.Connectable() {
 		// Only log verbose if we haven't seen this peer recently to avoid spam,
 		// but for now we want to debug why we aren't connecting
-		// log.Printf("bluetooth: device %s not connectable", a.Addr())
+		// logger.Debug("device not connectable", "addr", a.Addr())
 		return
 	}
 
-	log.Printf("bluetooth: found connectable device %s, attempting connection to read metadata...", a.Addr())
+	logger.Debug("found connectable device, reading metadata", "addr", a.Addr())
 
 	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
 	defer cancel()
 
 	client, err := ble.Dial(ctx, a.Addr())
 	if err != nil {
-		log.Printf("bluetooth: failed to dial device %s: %v", a.Addr(), err)
+		logger.Debug("failed to dial device", "addr", a.Addr(), "err", err)
 		return
 	}
 	defer client.CancelConnection()
 
-	log.Printf("bluetooth: connected to %s, looking for characteristic...", a.Addr())
+	logger.Debug("connected, looking for characteristic", "addr", a.Addr())
 
 	characteristic, err := m.findMetaCharacteristic(ctx, client)
 	if err != nil || characteristic == nil {
-		log.Printf("bluetooth: failed to find characteristic on %s: %v", a.Addr(), err)
+		logger.Debug("failed to find characteristic", "addr", a.Addr(), "err", err)
 		return
 	}
 
 	data, err := client.ReadCharacteristic(characteristic)
 	if err != nil || len(data) == 0 {
-		log.Printf("bluetooth: failed to read characteristic from %s: %v", a.Addr(), err)
+		logger.Debug("failed to read characteristic", "addr", a.Addr(), "err", err)
 		return
 	}
 
-	log.Printf("bluetooth: successfully read metadata from %s (len=%d)", a.Addr(), len(data))
+	logger.Debug("read metadata", "addr", a.Addr(), "len", len(data))
 
-	meta, err := parseMetadata(string(data))
+	meta, err := m.decodeMetadata(string(data))
 	if err != nil {
-		log.Printf("bluetooth: failed to parse metadata from %s: %v", a.Addr(), err)
+		logger.Debug("failed to parse metadata", "addr", a.Addr(), "err", err)
 		return
 	}
 
@@ -334,7 +346,7 @@ func (m *Manager) handleAdvertisement(a ble.Advertisement) {
 	}
 	peer.AddConnectionType(entity.ConnectionBLE)
 
-	log.Printf("bluetooth: discovered BLE peer %s at %s", peerID, a.Addr().String())
+	logger.Debug("discovered BLE peer", "peer", peerID, "addr", a.Addr().String())
 	m.proto.Peers.Add(peer)
 }
 
@@ -372,11 +384,41 @@ func (m *Manager) addService() error {
 
 func (m *Manager) metadataPayload() string {
 	// Include username in metadata
-	return strings.Join([]string{
+	payload := strings.Join([]string{
 		m.proto.PublicKeyStr,
 		m.proto.Port,
 		m.proto.Username,
 	}, "|")
+	if m.workspace == nil {
+		return payload
+	}
+
+	sealed, err := m.workspace.SealAnnouncement([]byte(payload), time.Now())
+	if err != nil {
+		logger.Warn("failed to seal metadata", "err", err)
+		return ""
+	}
+	return sealedMetadataPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// decodeMetadata unseals the payload when in a workspace and parses it
+func (m *Manager) decodeMetadata(payload string) (*metadata, error) {
+	if m.workspace != nil {
+		encoded, ok := strings.CutPrefix(payload, sealedMetadataPrefix)
+		if !ok {
+			return nil, crypto.ErrBadAnnouncement
+		}
+		sealed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, crypto.ErrBadAnnouncement
+		}
+		opened, err := m.workspace.OpenAnnouncement(sealed, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		payload = string(opened)
+	}
+	return parseMetadata(payload)
 }
 
 type metadata struct {
@@ -409,7 +451,7 @@ func hasService(a ble.Advertisement, uuid ble.UUID) bool {
 	defer func() {
 		if r := recover(); r != nil {
 			// Handle UUID parsing panics gracefully
-			log.Printf("bluetooth: recovered from UUID panic in hasService: %v", r)
+			logger.Debug("recovered from UUID panic in hasService", "panic", r)
 		}
 	}()
 
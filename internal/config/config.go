@@ -0,0 +1,536 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// appDirName is the directory under the user config dir holding our files
+	appDirName = "localchat"
+
+	DefaultPort               = 25042
+	DefaultMulticastIP        = "224.0.0.1"
+	DefaultMulticastFrequency = 1 * time.Second
+	DefaultLogPath            = "p2p-chat.log"
+
+	// MaxNoiseMessageSize is the largest message the Noise protocol allows
+	MaxNoiseMessageSize = 65535
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid config")
+)
+
+// Config holds every setting of the messenger. It is assembled from built-in
+// defaults, the config file, LOCALCHAT_* environment variables and
+// command-line flags, each layer overriding the previous one.
+type Config struct {
+	// IdentityPath is where the long-term identity key is stored
+	IdentityPath string `json:"identity_path"`
+	// Username is the display name; empty means prompt on startup
+	Username string `json:"username"`
+	// Port is the chat listener port, also used for multicast discovery
+	Port int `json:"port"`
+	// DHTPort is the libp2p port; 0 means Port+1
+	DHTPort    int             `json:"dht_port"`
+	Transports TransportConfig `json:"transports"`
+	Discovery  DiscoveryConfig `json:"discovery"`
+	Limits     LimitsConfig    `json:"limits"`
+	Session    SessionConfig   `json:"session"`
+	Workspace  WorkspaceConfig `json:"workspace"`
+	// HybridHandshake offers and accepts the ML-KEM-768 hybrid handshake;
+	// peers without support fall back to the classic one
+	HybridHandshake bool          `json:"hybrid_handshake"`
+	Outbox          OutboxConfig  `json:"outbox"`
+	History         HistoryConfig `json:"history"`
+	Relay           RelayConfig   `json:"relay"`
+	Groups          GroupsConfig  `json:"groups"`
+	Lobby           LobbyConfig   `json:"lobby"`
+	Files           FilesConfig   `json:"files"`
+	Privacy         PrivacyConfig `json:"privacy"`
+	Log             LogConfig     `json:"log"`
+	UI              UIConfig      `json:"ui"`
+}
+
+// TransportConfig switches individual discovery transports on or off and
+// picks the transport for outgoing chat connections
+type TransportConfig struct {
+	Multicast bool `json:"multicast"`
+	BLE       bool `json:"ble"`
+	DHT       bool `json:"dht"`
+	// Chat is "websocket", "tcp", "quic" or "webrtc". The listener accepts
+	// websocket and TCP on Port and QUIC on UDP Port+1. With "webrtc" the
+	// listener is dialled over websocket, and WebRTC signalled through the
+	// relay is tried when that fails.
+	Chat string `json:"chat"`
+	// InternetChat is the chat transport for peers only reachable over the
+	// internet. "webrtc" traverses NATs only with the relay enabled, which
+	// carries its signalling, and with ICEServers set.
+	InternetChat string `json:"internet_chat"`
+	// ICEServers are the STUN/TURN URLs used to gather WebRTC candidates.
+	// There are none by default, since a server sees the address of every
+	// node that asks it.
+	ICEServers []string `json:"ice_servers"`
+}
+
+type DiscoveryConfig struct {
+	MulticastIP            string   `json:"multicast_ip"`
+	MulticastFrequency     Duration `json:"multicast_frequency"`
+	PeerValidationInterval Duration `json:"peer_validation_interval"`
+	PeerValidationRetries  int      `json:"peer_validation_retries"`
+	AvailabilityInterval   Duration `json:"availability_interval"`
+}
+
+// LimitsConfig bounds what remote hosts may cost the chat listener
+type LimitsConfig struct {
+	MaxConnections      int `json:"max_connections"`
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+	// MaxFrameSize caps a single chat message on any transport; a Noise
+	// message is at most 65535 bytes
+	MaxFrameSize     int      `json:"max_frame_size"`
+	HandshakeTimeout Duration `json:"handshake_timeout"`
+	IdleTimeout      Duration `json:"idle_timeout"`
+	// MessagesPerSecond and MessageBurst configure a per-connection token bucket
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	MessageBurst      int     `json:"message_burst"`
+}
+
+// SessionConfig limits how long encryption keys are used. Zero disables a limit.
+type SessionConfig struct {
+	// RekeyInterval and RekeyMessages switch to a new transport key in-band
+	RekeyInterval Duration `json:"rekey_interval"`
+	RekeyMessages int      `json:"rekey_messages"`
+	// MaxAge and MaxMessages replace the session with a fresh handshake
+	MaxAge      Duration `json:"max_age"`
+	MaxMessages int      `json:"max_messages"`
+}
+
+// WorkspaceConfig restricts discovery and chat to nodes sharing a secret.
+// At most one of Secret and SecretFile may be set; neither means open mode.
+type WorkspaceConfig struct {
+	Secret string `json:"secret"`
+	// SecretFile holds the secret so that it stays out of the config file,
+	// the environment and the process list
+	SecretFile string `json:"secret_file"`
+}
+
+// Enabled reports whether a workspace secret is configured
+func (w WorkspaceConfig) Enabled() bool {
+	return w.Secret != "" || w.SecretFile != ""
+}
+
+// LoadSecret returns Secret, or the trimmed contents of SecretFile
+func (w WorkspaceConfig) LoadSecret() (string, error) {
+	if w.SecretFile == "" {
+		return w.Secret, nil
+	}
+	data, err := os.ReadFile(w.SecretFile)
+	if err != nil {
+		return "", fmt.Errorf("workspace secret: %w", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("workspace secret: %s is empty", w.SecretFile)
+	}
+	return secret, nil
+}
+
+// OutboxConfig controls messages kept for peers that cannot be reached
+type OutboxConfig struct {
+	// Path is the file holding queued messages across restarts
+	Path string `json:"path"`
+	// Expiry drops queued messages older than this; 0 keeps them until sent
+	Expiry Duration `json:"expiry"`
+}
+
+// HistoryConfig controls the conversations kept across restarts
+type HistoryConfig struct {
+	// Dir holds a file per peer conversation
+	Dir string `json:"dir"`
+}
+
+// GroupsConfig controls group chats
+type GroupsConfig struct {
+	// Path is the file holding group members and sender keys
+	Path string `json:"path"`
+}
+
+// LobbyConfig controls the public room shared by every node on the LAN
+type LobbyConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// FilesConfig controls file transfers
+type FilesConfig struct {
+	// Dir is where accepted files are kept, next to the partial files of
+	// transfers in progress
+	Dir string `json:"dir"`
+	// SharesPath is the file holding the shared folders and who may browse
+	// them
+	SharesPath string `json:"shares_path"`
+}
+
+// PrivacyConfig controls what peers learn about our activity in a chat
+type PrivacyConfig struct {
+	// TypingIndicators tells peers while we write to them
+	TypingIndicators bool `json:"typing_indicators"`
+	// ReadReceipts tells peers which of their messages we read
+	ReadReceipts bool `json:"read_receipts"`
+}
+
+// RelayConfig controls forwarding messages between peers that cannot reach
+// each other directly
+type RelayConfig struct {
+	// Enabled forwards envelopes for others, advertises routes and uses
+	// routes learned from neighbours
+	Enabled bool `json:"enabled"`
+	// MaxHops bounds the connections an envelope may take to its recipient
+	MaxHops int `json:"max_hops"`
+}
+
+type LogConfig struct {
+	Path string `json:"path"`
+	// Level is the default level: debug, info, warn or error
+	Level string `json:"level"`
+	// Components overrides Level per component, e.g. {"network": "debug"}
+	Components map[string]string `json:"components"`
+	// Format is "text" or "json"
+	Format string `json:"format"`
+	// Redact hides message bodies and key material
+	Redact bool `json:"redact"`
+	// MaxSizeMB rotates the file once it reaches this size; 0 disables rotation
+	MaxSizeMB  int `json:"max_size_mb"`
+	MaxBackups int `json:"max_backups"`
+}
+
+type UIConfig struct {
+	ShowTutorial    bool     `json:"show_tutorial"`
+	RefreshInterval Duration `json:"refresh_interval"`
+	TimeFormat      string   `json:"time_format"`
+	// ResizeTerminal asks the terminal to resize itself to fit the layout
+	ResizeTerminal bool `json:"resize_terminal"`
+	// FontSize is applied to Terminal.app via AppleScript; 0 leaves it alone
+	FontSize int `json:"font_size"`
+}
+
+// Duration is a time.Duration that reads and writes as "1s", "500ms", etc.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Std returns the value as a time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+// Default returns the configuration used when nothing else is specified
+func Default() *Config {
+	return &Config{
+		IdentityPath: filepath.Join(Dir(), "identity.key"),
+		Port:         DefaultPort,
+		Transports: TransportConfig{
+			Multicast:    true,
+			BLE:          true,
+			DHT:          true,
+			Chat:         "websocket",
+			InternetChat: "websocket",
+		},
+		Discovery: DiscoveryConfig{
+			MulticastIP:            DefaultMulticastIP,
+			MulticastFrequency:     Duration(DefaultMulticastFrequency),
+			PeerValidationInterval: Duration(10 * time.Second),
+			PeerValidationRetries:  3,
+			AvailabilityInterval:   Duration(1 * time.Second),
+		},
+		Session: SessionConfig{
+			RekeyInterval: Duration(10 * time.Minute),
+			RekeyMessages: 10000,
+			MaxAge:        Duration(time.Hour),
+			MaxMessages:   100000,
+		},
+		HybridHandshake: true,
+		Outbox: OutboxConfig{
+			Path:   filepath.Join(Dir(), "outbox.json"),
+			Expiry: Duration(7 * 24 * time.Hour),
+		},
+		History: HistoryConfig{
+			Dir: filepath.Join(Dir(), "history"),
+		},
+		Relay: RelayConfig{
+			MaxHops: 3,
+		},
+		Groups: GroupsConfig{
+			Path: filepath.Join(Dir(), "groups.json"),
+		},
+		Lobby: LobbyConfig{
+			Enabled: true,
+		},
+		Files: FilesConfig{
+			Dir:        filepath.Join(Dir(), "downloads"),
+			SharesPath: filepath.Join(Dir(), "shares.json"),
+		},
+		Privacy: PrivacyConfig{
+			TypingIndicators: true,
+			ReadReceipts:     true,
+		},
+		Limits: LimitsConfig{
+			MaxConnections:      64,
+			MaxConnectionsPerIP: 4,
+			MaxFrameSize:        MaxNoiseMessageSize,
+			HandshakeTimeout:    Duration(10 * time.Second),
+			IdleTimeout:         Duration(10 * time.Minute),
+			MessagesPerSecond:   20,
+			MessageBurst:        40,
+		},
+		Log: LogConfig{
+			Path:       DefaultLogPath,
+			Level:      "info",
+			Format:     "text",
+			Redact:     true,
+			MaxSizeMB:  10,
+			MaxBackups: 3,
+		},
+		UI: UIConfig{
+			ShowTutorial:    false,
+			RefreshInterval: Duration(50 * time.Millisecond),
+			TimeFormat:      "15:04:05",
+			ResizeTerminal:  true,
+			FontSize:        14,
+		},
+	}
+}
+
+// Dir returns the directory holding the config file, identity key, outbox and groups
+func Dir() string {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return appDirName
+	}
+	return filepath.Join(base, appDirName)
+}
+
+// DefaultPath returns the config file location used when none is given
+func DefaultPath() string {
+	return filepath.Join(Dir(), "config.json")
+}
+
+// PortString returns the chat port in the form used by proto.Proto
+func (c *Config) PortString() string {
+	return strconv.Itoa(c.Port)
+}
+
+// DHTPortOrDefault returns the DHT port, deriving it from Port when unset
+func (c *Config) DHTPortOrDefault() int {
+	if c.DHTPort == 0 {
+		return c.Port + 1
+	}
+	return c.DHTPort
+}
+
+// LoadFile overlays the JSON file at path onto c. Unknown keys are rejected
+// so that typos do not silently fall back to defaults.
+func (c *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks every field and reports all problems at once
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if strings.TrimSpace(c.IdentityPath) == "" {
+		fail("identity_path", "must not be empty")
+	}
+	if strings.ContainsAny(c.Username, ":|\n") {
+		fail("username", "must not contain ':', '|' or newlines, got %q", c.Username)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		fail("port", "must be between 1 and 65535, got %d", c.Port)
+	}
+	if dhtPort := c.DHTPortOrDefault(); c.DHTPort < 0 || dhtPort > 65535 {
+		fail("dht_port", "must be between 1 and 65535, got %d", dhtPort)
+	} else if c.Transports.DHT && dhtPort == c.Port {
+		fail("dht_port", "must differ from port %d", c.Port)
+	}
+
+	chatTransports := []struct{ field, kind string }{
+		{"transports.chat", c.Transports.Chat},
+		{"transports.internet_chat", c.Transports.InternetChat},
+	}
+	for _, transport := range chatTransports {
+		switch transport.kind {
+		case "websocket", "tcp", "quic", "webrtc":
+		default:
+			fail(transport.field, "must be websocket, tcp, quic or webrtc, got %q", transport.kind)
+		}
+	}
+	for _, url := range c.Transports.ICEServers {
+		if !strings.HasPrefix(url, "stun:") && !strings.HasPrefix(url, "turn:") && !strings.HasPrefix(url, "turns:") {
+			fail("transports.ice_servers", "must be stun:, turn: or turns: URLs, got %q", url)
+		}
+	}
+	if c.Port == 65535 {
+		fail("port", "must leave room for the QUIC port %d+1", c.Port)
+	}
+
+	if ip := net.ParseIP(c.Discovery.MulticastIP); ip == nil || !ip.IsMulticast() {
+		fail("discovery.multicast_ip", "must be a multicast address, got %q", c.Discovery.MulticastIP)
+	}
+	if c.Discovery.MulticastFrequency <= 0 {
+		fail("discovery.multicast_frequency", "must be positive, got %s", c.Discovery.MulticastFrequency.Std())
+	}
+	if c.Discovery.PeerValidationInterval <= 0 {
+		fail("discovery.peer_validation_interval", "must be positive, got %s", c.Discovery.PeerValidationInterval.Std())
+	}
+	if c.Discovery.PeerValidationRetries < 1 {
+		fail("discovery.peer_validation_retries", "must be at least 1, got %d", c.Discovery.PeerValidationRetries)
+	}
+	if c.Discovery.AvailabilityInterval <= 0 {
+		fail("discovery.availability_interval", "must be positive, got %s", c.Discovery.AvailabilityInterval.Std())
+	}
+
+	if c.Limits.MaxConnections < 1 {
+		fail("limits.max_connections", "must be at least 1, got %d", c.Limits.MaxConnections)
+	}
+	if c.Limits.MaxConnectionsPerIP < 1 || c.Limits.MaxConnectionsPerIP > c.Limits.MaxConnections {
+		fail("limits.max_connections_per_ip", "must be between 1 and max_connections (%d), got %d", c.Limits.MaxConnections, c.Limits.MaxConnectionsPerIP)
+	}
+	if c.Limits.MaxFrameSize < 1 || c.Limits.MaxFrameSize > MaxNoiseMessageSize {
+		fail("limits.max_frame_size", "must be between 1 and %d, got %d", MaxNoiseMessageSize, c.Limits.MaxFrameSize)
+	}
+	if c.Limits.HandshakeTimeout <= 0 {
+		fail("limits.handshake_timeout", "must be positive, got %s", c.Limits.HandshakeTimeout.Std())
+	}
+	if c.Limits.IdleTimeout <= 0 {
+		fail("limits.idle_timeout", "must be positive, got %s", c.Limits.IdleTimeout.Std())
+	}
+	if c.Limits.MessagesPerSecond <= 0 {
+		fail("limits.messages_per_second", "must be positive, got %g", c.Limits.MessagesPerSecond)
+	}
+	if c.Limits.MessageBurst < 1 {
+		fail("limits.message_burst", "must be at least 1, got %d", c.Limits.MessageBurst)
+	}
+
+	if c.Session.RekeyInterval < 0 {
+		fail("session.rekey_interval", "must not be negative, got %s", c.Session.RekeyInterval.Std())
+	}
+	if c.Session.RekeyMessages < 0 {
+		fail("session.rekey_messages", "must not be negative, got %d", c.Session.RekeyMessages)
+	}
+	if c.Session.MaxAge < 0 {
+		fail("session.max_age", "must not be negative, got %s", c.Session.MaxAge.Std())
+	}
+	if c.Session.MaxMessages < 0 {
+		fail("session.max_messages", "must not be negative, got %d", c.Session.MaxMessages)
+	}
+
+	if c.Workspace.Secret != "" && c.Workspace.SecretFile != "" {
+		fail("workspace", "set either secret or secret_file, not both")
+	}
+
+	if strings.TrimSpace(c.Outbox.Path) == "" {
+		fail("outbox.path", "must not be empty")
+	}
+	if c.Outbox.Expiry < 0 {
+		fail("outbox.expiry", "must not be negative, got %s", c.Outbox.Expiry.Std())
+	}
+
+	if c.Relay.MaxHops < 2 || c.Relay.MaxHops > 8 {
+		fail("relay.max_hops", "must be between 2 and 8, got %d", c.Relay.MaxHops)
+	}
+
+	if strings.TrimSpace(c.Groups.Path) == "" {
+		fail("groups.path", "must not be empty")
+	}
+
+	if strings.TrimSpace(c.History.Dir) == "" {
+		fail("history.dir", "must not be empty")
+	}
+
+	if strings.TrimSpace(c.Files.Dir) == "" {
+		fail("files.dir", "must not be empty")
+	}
+	if strings.TrimSpace(c.Files.SharesPath) == "" {
+		fail("files.shares_path", "must not be empty")
+	}
+
+	if strings.TrimSpace(c.Log.Path) == "" {
+		fail("log.path", "must not be empty")
+	}
+	if !validLogLevel(c.Log.Level) {
+		fail("log.level", "must be one of debug, info, warn, error, got %q", c.Log.Level)
+	}
+	for component, level := range c.Log.Components {
+		if !validLogLevel(level) {
+			fail("log.components."+component, "must be one of debug, info, warn, error, got %q", level)
+		}
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		fail("log.format", "must be text or json, got %q", c.Log.Format)
+	}
+	if c.Log.MaxSizeMB < 0 {
+		fail("log.max_size_mb", "must not be negative, got %d", c.Log.MaxSizeMB)
+	}
+	if c.Log.MaxBackups < 0 {
+		fail("log.max_backups", "must not be negative, got %d", c.Log.MaxBackups)
+	}
+
+	if c.UI.RefreshInterval <= 0 {
+		fail("ui.refresh_interval", "must be positive, got %s", c.UI.RefreshInterval.Std())
+	}
+	if c.UI.TimeFormat == "" {
+		fail("ui.time_format", "must not be empty")
+	}
+	if c.UI.FontSize < 0 || c.UI.FontSize > 72 {
+		fail("ui.font_size", "must be between 0 and 72, got %d", c.UI.FontSize)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w:\n%w", ErrInvalidConfig, errors.Join(errs...))
+	}
+	return nil
+}
+
+func validLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
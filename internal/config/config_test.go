@@ -0,0 +1,121 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := Load([]string{"-config", writeConfig(t, "{}")})
+	require.NoError(t, err)
+
+	assert.Equal(t, DefaultPort, cfg.Port)
+	assert.Equal(t, DefaultPort+1, cfg.DHTPortOrDefault())
+	assert.Equal(t, DefaultMulticastIP, cfg.Discovery.MulticastIP)
+	assert.True(t, cfg.Transports.BLE)
+	assert.True(t, cfg.Lobby.Enabled)
+	assert.True(t, cfg.Privacy.TypingIndicators)
+	assert.True(t, cfg.Privacy.ReadReceipts)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeConfig(t, `{
+		"username": "from-file",
+		"port": 26000,
+		"transports": {"ble": false},
+		"discovery": {"multicast_frequency": "5s"}
+	}`)
+	t.Setenv("LOCALCHAT_PORT", "27000")
+	t.Setenv("LOCALCHAT_NAME", "from-env")
+
+	cfg, err := Load([]string{"-config", path, "-name", "from-flag", "-ble"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "from-flag", cfg.Username)
+	assert.Equal(t, 27000, cfg.Port)
+	assert.True(t, cfg.Transports.BLE)
+	assert.Equal(t, 5*time.Second, cfg.Discovery.MulticastFrequency.Std())
+}
+
+func TestLoad_ConfigPathFromEnv(t *testing.T) {
+	t.Setenv(configEnvName, writeConfig(t, `{"username": "env-file"}`))
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "env-file", cfg.Username)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	_, err := Load([]string{"-config", filepath.Join(t.TempDir(), "missing.json")})
+	assert.Error(t, err, "explicit config file must exist")
+
+	_, err = Load([]string{"-config", writeConfig(t, `{"prot": 1}`)})
+	assert.ErrorContains(t, err, "unknown field")
+
+	_, err = Load([]string{"-config", writeConfig(t, "{}"), "-port", "abc"})
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+	assert.ErrorContains(t, err, "-port")
+
+	t.Setenv("LOCALCHAT_MULTICAST_FREQUENCY", "often")
+	_, err = Load([]string{"-config", writeConfig(t, "{}")})
+	assert.ErrorContains(t, err, "LOCALCHAT_MULTICAST_FREQUENCY")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	require.NoError(t, cfg.Validate())
+
+	cfg.Port = 70000
+	cfg.Username = "a:b"
+	cfg.Discovery.MulticastIP = "10.0.0.1"
+	cfg.UI.RefreshInterval = 0
+	cfg.Workspace = WorkspaceConfig{Secret: "s", SecretFile: "secret.txt"}
+	cfg.Session.MaxMessages = -1
+	cfg.Outbox.Expiry = -1
+	cfg.Relay.MaxHops = 1
+	cfg.Groups.Path = " "
+	cfg.Files.Dir = ""
+	cfg.Files.SharesPath = " "
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrInvalidConfig))
+	assert.ErrorContains(t, err, "port: must be between 1 and 65535, got 70000")
+	assert.ErrorContains(t, err, "username")
+	assert.ErrorContains(t, err, "discovery.multicast_ip")
+	assert.ErrorContains(t, err, "ui.refresh_interval")
+	assert.ErrorContains(t, err, "session.max_messages")
+	assert.ErrorContains(t, err, "outbox.expiry")
+	assert.ErrorContains(t, err, "relay.max_hops")
+	assert.ErrorContains(t, err, "groups.path")
+	assert.ErrorContains(t, err, "files.dir")
+	assert.ErrorContains(t, err, "files.shares_path")
+	assert.ErrorContains(t, err, "workspace: set either secret or secret_file")
+}
+
+func TestLoad_ChatTransports(t *testing.T) {
+	assert.Empty(t, Default().Transports.ICEServers, "no third party learns our address unless asked to")
+	cfg, err := Load([]string{"-config", writeConfig(t, "{}"),
+		"-chat-transport", "quic", "-ice-servers", "stun:a.example:3478, turn:b.example"})
+	require.NoError(t, err)
+	assert.Equal(t, "quic", cfg.Transports.Chat)
+	assert.Equal(t, "websocket", cfg.Transports.InternetChat, "WebRTC needs the relay and STUN, both off by default")
+	assert.Equal(t, []string{"stun:a.example:3478", "turn:b.example"}, cfg.Transports.ICEServers)
+
+	_, err = Load([]string{"-config", writeConfig(t, `{"transports": {"chat": "carrier-pigeon", "ice_servers": ["http://x"]}}`)})
+	assert.ErrorContains(t, err, `transports.chat: must be websocket, tcp, quic or webrtc, got "carrier-pigeon"`)
+	assert.ErrorContains(t, err, "transports.ice_servers")
+}
@@ -0,0 +1,304 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envPrefix     = "LOCALCHAT_"
+	configFlag    = "config"
+	configEnvName = envPrefix + "CONFIG"
+)
+
+// option binds one setting to a command-line flag and an environment
+// variable derived from the flag name (-log-file -> LOCALCHAT_LOG_FILE)
+type option struct {
+	name   string
+	usage  string
+	isBool bool
+	get    func(c *Config) string
+	set    func(c *Config, value string) error
+}
+
+var options = []option{
+	stringOption("identity", "path of the identity key file", func(c *Config) *string { return &c.IdentityPath }),
+	stringOption("name", "display name, prompted for when empty", func(c *Config) *string { return &c.Username }),
+	intOption("port", "chat listener and multicast port", func(c *Config) *int { return &c.Port }),
+	intOption("dht-port", "libp2p DHT port, 0 for port+1", func(c *Config) *int { return &c.DHTPort }),
+	boolOption("multicast", "enable UDP multicast discovery", func(c *Config) *bool { return &c.Transports.Multicast }),
+	boolOption("ble", "enable Bluetooth LE discovery", func(c *Config) *bool { return &c.Transports.BLE }),
+	boolOption("dht", "enable libp2p DHT/mDNS discovery", func(c *Config) *bool { return &c.Transports.DHT }),
+	stringOption("chat-transport", "transport for outgoing chat connections: websocket, tcp, quic or webrtc", func(c *Config) *string { return &c.Transports.Chat }),
+	stringOption("internet-chat-transport", "transport for peers only reachable over the internet", func(c *Config) *string { return &c.Transports.InternetChat }),
+	listOption("ice-servers", "comma-separated STUN/TURN URLs for WebRTC", func(c *Config) *[]string { return &c.Transports.ICEServers }),
+	stringOption("multicast-ip", "multicast group used for discovery", func(c *Config) *string { return &c.Discovery.MulticastIP }),
+	durationOption("multicast-frequency", "interval between discovery announcements", func(c *Config) *Duration { return &c.Discovery.MulticastFrequency }),
+	durationOption("peer-validation-interval", "interval between peer liveness checks", func(c *Config) *Duration { return &c.Discovery.PeerValidationInterval }),
+	intOption("peer-validation-retries", "failed liveness checks before a peer is dropped", func(c *Config) *int { return &c.Discovery.PeerValidationRetries }),
+	durationOption("availability-interval", "interval between connection mode checks", func(c *Config) *Duration { return &c.Discovery.AvailabilityInterval }),
+	intOption("max-connections", "maximum simultaneous inbound connections", func(c *Config) *int { return &c.Limits.MaxConnections }),
+	intOption("max-connections-per-ip", "maximum simultaneous inbound connections from one IP", func(c *Config) *int { return &c.Limits.MaxConnectionsPerIP }),
+	intOption("max-frame-size", "largest accepted chat frame in bytes", func(c *Config) *int { return &c.Limits.MaxFrameSize }),
+	durationOption("handshake-timeout", "time allowed to complete the websocket and Noise handshakes", func(c *Config) *Duration { return &c.Limits.HandshakeTimeout }),
+	durationOption("idle-timeout", "close inbound connections idle for this long", func(c *Config) *Duration { return &c.Limits.IdleTimeout }),
+	floatOption("messages-per-second", "sustained inbound message rate per connection", func(c *Config) *float64 { return &c.Limits.MessagesPerSecond }),
+	intOption("message-burst", "inbound message burst allowed per connection", func(c *Config) *int { return &c.Limits.MessageBurst }),
+	durationOption("rekey-interval", "switch to a new session key this often, 0 to disable", func(c *Config) *Duration { return &c.Session.RekeyInterval }),
+	intOption("rekey-messages", "switch to a new session key after this many messages, 0 to disable", func(c *Config) *int { return &c.Session.RekeyMessages }),
+	durationOption("session-max-age", "re-handshake sessions older than this, 0 to disable", func(c *Config) *Duration { return &c.Session.MaxAge }),
+	intOption("session-max-messages", "re-handshake sessions after this many messages, 0 to disable", func(c *Config) *int { return &c.Session.MaxMessages }),
+	stringOption("workspace-secret", "shared secret restricting discovery and chat to a workspace", func(c *Config) *string { return &c.Workspace.Secret }),
+	stringOption("workspace-secret-file", "file containing the workspace secret", func(c *Config) *string { return &c.Workspace.SecretFile }),
+	boolOption("hybrid-handshake", "offer the post-quantum ML-KEM hybrid handshake", func(c *Config) *bool { return &c.HybridHandshake }),
+	stringOption("outbox-file", "path of the file keeping messages for unreachable peers", func(c *Config) *string { return &c.Outbox.Path }),
+	durationOption("outbox-expiry", "drop undelivered messages after this long, 0 to keep them", func(c *Config) *Duration { return &c.Outbox.Expiry }),
+	stringOption("history-dir", "directory keeping conversations across restarts", func(c *Config) *string { return &c.History.Dir }),
+	boolOption("relay", "forward messages for peers that cannot reach each other", func(c *Config) *bool { return &c.Relay.Enabled }),
+	intOption("relay-max-hops", "connections a relayed message may take to its recipient", func(c *Config) *int { return &c.Relay.MaxHops }),
+	boolOption("lobby", "join the public lobby of the LAN", func(c *Config) *bool { return &c.Lobby.Enabled }),
+	stringOption("groups-file", "path of the file keeping group members and sender keys", func(c *Config) *string { return &c.Groups.Path }),
+	stringOption("downloads-dir", "directory where accepted files are kept", func(c *Config) *string { return &c.Files.Dir }),
+	stringOption("shares-file", "path of the file keeping shared folders", func(c *Config) *string { return &c.Files.SharesPath }),
+	boolOption("typing-indicators", "tell peers while you write to them", func(c *Config) *bool { return &c.Privacy.TypingIndicators }),
+	boolOption("read-receipts", "tell peers which of their messages you read", func(c *Config) *bool { return &c.Privacy.ReadReceipts }),
+	stringOption("log-file", "path of the log file", func(c *Config) *string { return &c.Log.Path }),
+	stringOption("log-level", "default log level: debug, info, warn, error", func(c *Config) *string { return &c.Log.Level }),
+	mapOption("log-components", "per-component log levels, e.g. network=debug,ui=warn", func(c *Config) *map[string]string { return &c.Log.Components }),
+	stringOption("log-format", "log format: text or json", func(c *Config) *string { return &c.Log.Format }),
+	boolOption("log-redact", "hide message bodies and keys in the log", func(c *Config) *bool { return &c.Log.Redact }),
+	intOption("log-max-size", "rotate the log at this many MB, 0 to disable", func(c *Config) *int { return &c.Log.MaxSizeMB }),
+	intOption("log-max-backups", "number of rotated log files to keep", func(c *Config) *int { return &c.Log.MaxBackups }),
+	boolOption("tutorial", "show the tutorial on startup", func(c *Config) *bool { return &c.UI.ShowTutorial }),
+	durationOption("refresh-interval", "UI redraw interval", func(c *Config) *Duration { return &c.UI.RefreshInterval }),
+	stringOption("time-format", "Go time layout for message timestamps", func(c *Config) *string { return &c.UI.TimeFormat }),
+	boolOption("resize-terminal", "resize the terminal window on startup", func(c *Config) *bool { return &c.UI.ResizeTerminal }),
+	intOption("font-size", "Terminal.app font size, 0 to leave unchanged", func(c *Config) *int { return &c.UI.FontSize }),
+}
+
+// Load builds the configuration from defaults, the config file, the
+// environment and args (without the program name), in increasing order of
+// precedence. flag.ErrHelp is returned when -h was requested.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	flags := flag.NewFlagSet("localchat", flag.ContinueOnError)
+	configPath := flags.String(configFlag, "", fmt.Sprintf("path of the JSON config file (default %s, env %s)", DefaultPath(), configEnvName))
+	values := make(map[string]*flagValue, len(options))
+	for _, opt := range options {
+		value := &flagValue{isBool: opt.isBool, value: opt.get(cfg)}
+		values[opt.name] = value
+		flags.Var(value, opt.name, fmt.Sprintf("%s (env %s)", opt.usage, envName(opt.name)))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path, explicit := *configPath, true
+	if path == "" {
+		path, explicit = os.LookupEnv(configEnvName)
+	}
+	if path == "" {
+		path, explicit = DefaultPath(), false
+	}
+	if err := cfg.LoadFile(path); err != nil {
+		// The default file is optional, an explicitly requested one is not
+		if explicit || !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	for _, opt := range options {
+		raw, ok := os.LookupEnv(envName(opt.name))
+		if !ok {
+			continue
+		}
+		if err := opt.set(cfg, raw); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidConfig, envName(opt.name), err)
+		}
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		if flagErr != nil || f.Name == configFlag {
+			return
+		}
+		for _, opt := range options {
+			if opt.name == f.Name {
+				if err := opt.set(cfg, values[f.Name].value); err != nil {
+					flagErr = fmt.Errorf("%w: -%s: %w", ErrInvalidConfig, f.Name, err)
+				}
+				return
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// flagValue records the raw flag text; it is applied after the config file
+// and environment so that flags always win
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *flagValue) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func stringOption(name, usage string, field func(c *Config) *string) option {
+	return option{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+func intOption(name, usage string, field func(c *Config) *int) option {
+	return option{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, value string) error {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("not an integer: %q", value)
+			}
+			*field(c) = parsed
+			return nil
+		},
+	}
+}
+
+func floatOption(name, usage string, field func(c *Config) *float64) option {
+	return option{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.FormatFloat(*field(c), 'g', -1, 64) },
+		set: func(c *Config, value string) error {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("not a number: %q", value)
+			}
+			*field(c) = parsed
+			return nil
+		},
+	}
+}
+
+func boolOption(name, usage string, field func(c *Config) *bool) option {
+	return option{
+		name:   name,
+		usage:  usage,
+		isBool: true,
+		get:    func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		set: func(c *Config, value string) error {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("not a boolean: %q", value)
+			}
+			*field(c) = parsed
+			return nil
+		},
+	}
+}
+
+func durationOption(name, usage string, field func(c *Config) *Duration) option {
+	return option{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return field(c).Std().String() },
+		set: func(c *Config, value string) error {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("not a duration: %q", value)
+			}
+			*field(c) = Duration(parsed)
+			return nil
+		},
+	}
+}
+
+// listOption parses "a,b" into a list, replacing any previous list
+func listOption(name, usage string, field func(c *Config) *[]string) option {
+	return option{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strings.Join(*field(c), ",") },
+		set: func(c *Config, value string) error {
+			var parsed []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					parsed = append(parsed, item)
+				}
+			}
+			*field(c) = parsed
+			return nil
+		},
+	}
+}
+
+// mapOption parses "key=value,key=value" into a map, replacing any previous map
+func mapOption(name, usage string, field func(c *Config) *map[string]string) option {
+	return option{
+		name:  name,
+		usage: usage,
+		get: func(c *Config) string {
+			pairs := make([]string, 0, len(*field(c)))
+			for key, value := range *field(c) {
+				pairs = append(pairs, key+"="+value)
+			}
+			sort.Strings(pairs)
+			return strings.Join(pairs, ",")
+		},
+		set: func(c *Config, value string) error {
+			parsed := make(map[string]string)
+			for _, pair := range strings.Split(value, ",") {
+				if strings.TrimSpace(pair) == "" {
+					continue
+				}
+				key, val, ok := strings.Cut(pair, "=")
+				if !ok || strings.TrimSpace(key) == "" {
+					return fmt.Errorf("expected key=value, got %q", pair)
+				}
+				parsed[strings.TrimSpace(key)] = strings.TrimSpace(val)
+			}
+			*field(c) = parsed
+			return nil
+		},
+	}
+}
@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/flynn/noise"
+)
+
+// Mode is the key exchange a session uses
+type Mode string
+
+const (
+	// ModeClassic is plain Noise XX over X25519
+	ModeClassic Mode = "classic"
+	// ModeHybrid additionally mixes an ML-KEM-768 shared secret into the
+	// transport keys, so recorded traffic stays confidential even if X25519
+	// is broken later
+	ModeHybrid Mode = "hybrid-mlkem768"
+)
+
+var ErrHandshakePayload = errors.New("hybrid handshake messages cannot carry a payload")
+
+// kemState holds the ML-KEM exchange of a hybrid handshake. The initiator
+// sends an encapsulation key in message 1, the responder answers with a
+// ciphertext in message 2; both payloads are covered by the handshake hash.
+type kemState struct {
+	decapsulationKey *mlkem.DecapsulationKey768
+	ciphertext       []byte
+	secret           []byte
+}
+
+// WithHybrid allows the hybrid mode to be offered (initiator) or accepted
+// (responder). The mode actually used is set by WithNegotiation.
+func WithHybrid(enabled bool) SessionOption {
+	return func(config *sessionConfig) {
+		config.hybrid = enabled
+	}
+}
+
+// handshakePayload returns what the next handshake message carries
+func (s *Session) handshakePayload(message []byte) ([]byte, error) {
+	if s.mode != ModeHybrid {
+		return message, nil
+	}
+	if len(message) > 0 {
+		return nil, ErrHandshakePayload
+	}
+
+	switch s.handshakeState.MessageIndex() {
+	case 0:
+		key, err := mlkem.GenerateKey768()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ML-KEM key: %w", err)
+		}
+		s.kem.decapsulationKey = key
+		return key.EncapsulationKey().Bytes(), nil
+	case 1:
+		return s.kem.ciphertext, nil
+	default:
+		return nil, nil
+	}
+}
+
+// readHandshakePayload consumes the KEM data of a received handshake
+// message; index is the message's position in the pattern
+func (s *Session) readHandshakePayload(index int, payload []byte) ([]byte, error) {
+	if s.mode != ModeHybrid {
+		return payload, nil
+	}
+
+	switch index {
+	case 0:
+		key, err := mlkem.NewEncapsulationKey768(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ML-KEM encapsulation key: %w", err)
+		}
+		s.kem.secret, s.kem.ciphertext = key.Encapsulate()
+		return nil, nil
+	case 1:
+		if s.kem.decapsulationKey == nil {
+			return nil, errors.New("ML-KEM ciphertext received before the key was sent")
+		}
+		secret, err := s.kem.decapsulationKey.Decapsulate(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ML-KEM ciphertext: %w", err)
+		}
+		s.kem.secret = secret
+		s.kem.decapsulationKey = nil
+		return nil, nil
+	default:
+		return payload, nil
+	}
+}
+
+// mixKEMSecret derives a transport key from both the Noise key and the
+// ML-KEM secret, salted with the handshake hash
+func (s *Session) mixKEMSecret(cs *noise.CipherState, direction string) (*noise.CipherState, error) {
+	if s.kem.secret == nil {
+		return nil, errors.New("hybrid handshake completed without an ML-KEM secret")
+	}
+	key := cs.UnsafeKey()
+	mixed, err := hkdf.Key(sha256.New, append(key[:], s.kem.secret...), s.handshakeState.ChannelBinding(), "localchat hybrid "+direction, 32)
+	if err != nil {
+		return nil, err
+	}
+	return noise.UnsafeNewCipherState(s.cipherSuite, [32]byte(mixed), 0), nil
+}
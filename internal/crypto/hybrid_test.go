@@ -0,0 +1,112 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// negotiate performs the header exchange and returns each side's options
+func negotiate(initiatorHybrid, responderHybrid bool) (initiatorOpts, responderOpts []SessionOption) {
+	initiatorOpts = []SessionOption{WithHybrid(initiatorHybrid)}
+	responderOpts = []SessionOption{WithHybrid(responderHybrid)}
+	offer := Offer(initiatorOpts...)
+	selected := Select(offer, responderOpts...)
+	return append(initiatorOpts, WithNegotiation(offer, selected)),
+		append(responderOpts, WithNegotiation(offer, selected))
+}
+
+func TestHybrid_Negotiation(t *testing.T) {
+	tests := []struct {
+		name                             string
+		initiatorHybrid, responderHybrid bool
+		want                             Mode
+	}{
+		{"both hybrid", true, true, ModeHybrid},
+		{"responder classic", true, false, ModeClassic},
+		{"initiator classic", false, true, ModeClassic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initiatorOpts, responderOpts := negotiate(tt.initiatorHybrid, tt.responderHybrid)
+			initiator, responder, err := handshake(t, initiatorOpts, responderOpts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, initiator.Mode())
+			assert.Equal(t, tt.want, responder.Mode())
+
+			for _, pair := range [][2]*Session{{initiator, responder}, {responder, initiator}} {
+				encrypted, err := pair[0].WriteMessage([]byte("ping"))
+				require.NoError(t, err)
+				decrypted, err := pair[1].ReadMessage(encrypted)
+				require.NoError(t, err)
+				assert.Equal(t, "ping", string(decrypted))
+			}
+		})
+	}
+}
+
+func TestHybrid_LegacyPeers(t *testing.T) {
+	// A responder that predates negotiation answers without a header
+	offer := Offer(WithHybrid(true))
+	initiator, responder, err := handshake(t,
+		[]SessionOption{WithHybrid(true), WithNegotiation(offer, "")}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ModeClassic, initiator.Mode())
+	assert.Equal(t, ModeClassic, responder.Mode())
+
+	// An initiator that predates negotiation sends no header
+	assert.Empty(t, Select("", WithHybrid(true)))
+	_, _, err = handshake(t, nil, []SessionOption{WithHybrid(true), WithNegotiation("", "")})
+	require.NoError(t, err)
+}
+
+func TestHybrid_DowngradeDetected(t *testing.T) {
+	offer := Offer(WithHybrid(true))
+
+	// The offer was rewritten to classic on the way to the responder
+	_, _, err := handshake(t,
+		[]SessionOption{WithHybrid(true), WithNegotiation(offer, string(ModeClassic))},
+		[]SessionOption{WithHybrid(true), WithNegotiation(string(ModeClassic), string(ModeClassic))})
+	assert.Error(t, err)
+
+	// The response header was stripped so the initiator assumes a legacy peer
+	_, _, err = handshake(t,
+		[]SessionOption{WithHybrid(true), WithNegotiation(offer, "")},
+		[]SessionOption{WithHybrid(true), WithNegotiation(offer, string(ModeHybrid))})
+	assert.Error(t, err)
+
+	// The responder selected a mode that was never offered
+	keypair, _, err := GenerateKeypair()
+	require.NoError(t, err)
+	_, err = NewInitiatorSession(keypair, WithNegotiation(string(ModeClassic), string(ModeHybrid)))
+	assert.ErrorIs(t, err, ErrUnsupportedMode)
+
+	// The selection comes from the peer and may name nothing at all
+	for _, selected := range []string{",", " ", " , "} {
+		_, err = NewInitiatorSession(keypair, WithNegotiation(Offer(), selected))
+		assert.ErrorIs(t, err, ErrUnsupportedMode, "%q", selected)
+	}
+}
+
+func TestHybrid_WithWorkspacePSK(t *testing.T) {
+	team, err := DeriveWorkspaceKeys("team secret")
+	require.NoError(t, err)
+
+	initiatorOpts, responderOpts := negotiate(true, true)
+	initiator, _, err := handshake(t,
+		append(initiatorOpts, WithPSK(team.PSK)), append(responderOpts, WithPSK(team.PSK)))
+	require.NoError(t, err)
+	assert.Equal(t, ModeHybrid, initiator.Mode())
+}
+
+func TestHybrid_HandshakePayloadRejected(t *testing.T) {
+	keypair, _, err := GenerateKeypair()
+	require.NoError(t, err)
+	initiatorOpts, _ := negotiate(true, true)
+	session, err := NewInitiatorSession(keypair, initiatorOpts...)
+	require.NoError(t, err)
+
+	_, err = session.WriteMessage([]byte("too early"))
+	assert.ErrorIs(t, err, ErrHandshakePayload)
+}
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalidIdentity = errors.New("invalid identity file")
+)
+
+// Identity is the node's long-term key. It is kept on disk as an Ed25519 seed
+// and the Noise static keypair is derived from it the same way libsodium
+// converts Ed25519 keys to X25519, so the PeerID survives restarts.
+type Identity struct {
+	seed []byte
+}
+
+// NewIdentity generates a fresh random identity
+func NewIdentity() (*Identity, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return &Identity{seed: seed}, nil
+}
+
+// LoadOrCreateIdentity reads the identity at path, creating it with owner-only
+// permissions if it does not exist yet
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidIdentity, path)
+		}
+		return &Identity{seed: seed}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	identity, err := NewIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create identity directory: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(identity.seed) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write identity: %w", err)
+	}
+	return identity, nil
+}
+
+// Keypair returns the Noise static keypair derived from the identity
+func (id *Identity) Keypair() NoiseKeypair {
+	h := sha512.Sum512(id.seed)
+	private := h[:32]
+	private[0] &= 248
+	private[31] &= 127
+	private[31] |= 64
+
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		// X25519 accepts any 32-byte scalar
+		panic(fmt.Sprintf("crypto: deriving X25519 key: %v", err))
+	}
+	return NoiseKeypair{
+		Private: key.Bytes(),
+		Public:  key.PublicKey().Bytes(),
+	}
+}
@@ -0,0 +1,47 @@
+package crypto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "identity.key")
+
+	created, err := LoadOrCreateIdentity(path)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := LoadOrCreateIdentity(path)
+	require.NoError(t, err)
+	assert.Equal(t, created.Keypair(), loaded.Keypair())
+	assert.Equal(t, PeerID(created.Keypair().Public), PeerID(loaded.Keypair().Public))
+
+	require.NoError(t, os.WriteFile(path, []byte("not base64"), 0600))
+	_, err = LoadOrCreateIdentity(path)
+	assert.ErrorIs(t, err, ErrInvalidIdentity)
+}
+
+func TestIdentity_KeypairIsValidX25519(t *testing.T) {
+	identity, err := NewIdentity()
+	require.NoError(t, err)
+	keypair := identity.Keypair()
+
+	other, _, err := GenerateKeypair()
+	require.NoError(t, err)
+
+	// Both sides of a DH must agree for the derived key to be usable by Noise
+	shared1, err := noise.DH25519.DH(keypair.Private, other.Public)
+	require.NoError(t, err)
+	shared2, err := noise.DH25519.DH(other.Private, keypair.Public)
+	require.NoError(t, err)
+	assert.Equal(t, shared1, shared2)
+}
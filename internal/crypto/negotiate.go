@@ -0,0 +1,98 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// FeaturesHeader carries the modes and features offered by the initiator in
+// the websocket upgrade request, and the responder's selection (one mode
+// followed by the accepted features) in the response. Peers that predate
+// negotiation send and answer neither.
+const FeaturesHeader = "X-LocalChat-Features"
+
+// Feature is an optional protocol extension negotiated next to the Mode
+type Feature string
+
+// FeatureRekey prefixes every transport message with a frame type so that
+// the sender can announce in-band that it switches to a new key
+const FeatureRekey Feature = "rekey"
+
+const negotiationPrologue = "localchat negotiation v1"
+
+var ErrUnsupportedMode = errors.New("peer selected a handshake mode or feature that was not offered")
+
+// WithNegotiation applies the outcome of the FeaturesHeader exchange. offer
+// is the initiator's header value, selected the responder's; selected is
+// empty when talking to a peer that predates negotiation, which means
+// ModeClassic without features and with no prologue.
+//
+// Otherwise both values are bound into the handshake prologue, so a
+// man-in-the-middle that rewrites either header makes the handshake fail
+// instead of silently downgrading it.
+func WithNegotiation(offer, selected string) SessionOption {
+	return func(config *sessionConfig) {
+		if selected == "" {
+			config.mode = ModeClassic
+			return
+		}
+		offered, tokens := parseTokens(offer), parseTokens(selected)
+		if len(tokens) == 0 {
+			config.err = fmt.Errorf("%w: %q", ErrUnsupportedMode, selected)
+			return
+		}
+		for _, token := range tokens {
+			if !slices.Contains(offered, token) {
+				config.err = fmt.Errorf("%w: %q", ErrUnsupportedMode, token)
+				return
+			}
+		}
+		mode := Mode(tokens[0])
+		if mode != ModeClassic && (mode != ModeHybrid || !config.hybrid) {
+			config.err = fmt.Errorf("%w: %q", ErrUnsupportedMode, mode)
+			return
+		}
+		config.mode = mode
+		config.framed = slices.Contains(tokens[1:], string(FeatureRekey))
+		config.noise.Prologue = []byte(negotiationPrologue + "\x00" + offer + "\x00" + selected)
+	}
+}
+
+// Offer returns the FeaturesHeader value an initiator with opts sends
+func Offer(opts ...SessionOption) string {
+	tokens := []string{string(ModeClassic), string(FeatureRekey)}
+	if newSessionConfig(opts).hybrid {
+		tokens = slices.Insert(tokens, 0, string(ModeHybrid))
+	}
+	return strings.Join(tokens, ",")
+}
+
+// Select returns the FeaturesHeader value a responder with opts answers
+// offer with, or "" when the initiator did not negotiate at all
+func Select(offer string, opts ...SessionOption) string {
+	if offer == "" {
+		return ""
+	}
+	offered := parseTokens(offer)
+
+	selected := []string{string(ModeClassic)}
+	if newSessionConfig(opts).hybrid && slices.Contains(offered, string(ModeHybrid)) {
+		selected[0] = string(ModeHybrid)
+	}
+	if slices.Contains(offered, string(FeatureRekey)) {
+		selected = append(selected, string(FeatureRekey))
+	}
+	return strings.Join(selected, ",")
+}
+
+func parseTokens(value string) []string {
+	var tokens []string
+	for _, token := range strings.Split(value, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
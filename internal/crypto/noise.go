@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/flynn/noise"
 )
@@ -12,6 +14,8 @@ import (
 const (
 	// Noise_XX_25519_ChaChaPoly_BLAKE2b provides mutual authentication and forward secrecy
 	noisePattern = "Noise_XX_25519_ChaChaPoly_BLAKE2b"
+	// tagSize is the authentication tag ChaChaPoly appends to every message
+	tagSize = 16
 )
 
 var (
@@ -24,66 +28,120 @@ type Session struct {
 	cs1            *noise.CipherState // for sending
 	cs2            *noise.CipherState // for receiving
 	initiator      bool
+	cipherSuite    noise.CipherSuite
+	mode           Mode
+	kem            kemState // only used in ModeHybrid
+
+	framed bool
+	policy RekeyPolicy
+	clock  func() time.Time
+	// established is when the handshake completed
+	established time.Time
+	// lastRekey and sentSinceRekey are only touched by the sending side
+	lastRekey      time.Time
+	sentSinceRekey uint64
+	// messages counts transport messages in both directions
+	messages atomic.Uint64
 }
 
-// NewInitiatorSession creates a new Noise session as the initiator with a static keypair
-func NewInitiatorSession(keypair NoiseKeypair) (*Session, error) {
-	config := noise.Config{
-		CipherSuite:   noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b),
-		Random:        rand.Reader,
-		Pattern:       noise.HandshakeXX,
-		Initiator:     true,
-		StaticKeypair: keypair,
-	}
+// sessionConfig is what SessionOptions modify
+type sessionConfig struct {
+	noise noise.Config
+	// hybrid allows ModeHybrid to be offered or selected
+	hybrid bool
+	mode   Mode
+	framed bool
+	policy RekeyPolicy
+	err    error
+}
 
-	hs, err := noise.NewHandshakeState(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create handshake state: %w", err)
+// SessionOption adjusts the handshake of a new session
+type SessionOption func(config *sessionConfig)
+
+// WithPSK switches the handshake to Noise_XXpsk0 with the given 32-byte
+// pre-shared key. Both sides must use the same key: the responder cannot even
+// decrypt the first handshake message otherwise, so an outsider learns
+// nothing about the responder's identity. A nil key leaves plain XX.
+func WithPSK(psk []byte) SessionOption {
+	return func(config *sessionConfig) {
+		if psk == nil {
+			return
+		}
+		config.noise.PresharedKey = psk
+		config.noise.PresharedKeyPlacement = 0
 	}
+}
 
-	return &Session{
-		handshakeState: hs,
-		initiator:      true,
-	}, nil
+// NewInitiatorSession creates a new Noise session as the initiator with a static keypair
+func NewInitiatorSession(keypair NoiseKeypair, opts ...SessionOption) (*Session, error) {
+	return newSession(keypair, true, opts)
 }
 
 // NewResponderSession creates a new Noise session as the responder
-func NewResponderSession(keypair noise.DHKey) (*Session, error) {
-	config := noise.Config{
-		CipherSuite:   noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b),
-		Random:        rand.Reader,
-		Pattern:       noise.HandshakeXX,
-		Initiator:     false,
-		StaticKeypair: keypair,
+func NewResponderSession(keypair noise.DHKey, opts ...SessionOption) (*Session, error) {
+	return newSession(keypair, false, opts)
+}
+
+func newSession(keypair noise.DHKey, initiator bool, opts []SessionOption) (*Session, error) {
+	config := newSessionConfig(opts)
+	if config.err != nil {
+		return nil, config.err
 	}
+	config.noise.Initiator = initiator
+	config.noise.StaticKeypair = keypair
 
-	hs, err := noise.NewHandshakeState(config)
+	hs, err := noise.NewHandshakeState(config.noise)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create handshake state: %w", err)
 	}
 
 	return &Session{
 		handshakeState: hs,
-		initiator:      false,
+		initiator:      initiator,
+		cipherSuite:    config.noise.CipherSuite,
+		mode:           config.mode,
+		framed:         config.framed,
+		policy:         config.policy,
+		clock:          time.Now,
 	}, nil
 }
 
+func newSessionConfig(opts []SessionOption) *sessionConfig {
+	config := &sessionConfig{
+		noise: noise.Config{
+			CipherSuite: noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b),
+			Random:      rand.Reader,
+			Pattern:     noise.HandshakeXX,
+		},
+		mode: ModeClassic,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+// Mode returns the handshake mode negotiated for this session
+func (s *Session) Mode() Mode {
+	return s.mode
+}
+
 // WriteMessage performs handshake and encrypts a message
 func (s *Session) WriteMessage(message []byte) ([]byte, error) {
 	if s.cs1 == nil {
 		// Still in handshake phase
 		// fmt.Println("crypto: trace - WriteMessage (Handshake)")
-		out, cs1, cs2, err := s.handshakeState.WriteMessage(nil, message)
+		payload, err := s.handshakePayload(message)
+		if err != nil {
+			return nil, err
+		}
+		out, cs1, cs2, err := s.handshakeState.WriteMessage(nil, payload)
 		if err != nil && err != io.EOF {
 			return nil, fmt.Errorf("handshake write failed: %w", err)
 		}
 		if cs1 != nil {
-			if s.initiator {
-				s.cs1 = cs1 // I->R (Send)
-				s.cs2 = cs2 // R->I (Recv)
-			} else {
-				s.cs1 = cs2 // R->I (Send)
-				s.cs2 = cs1 // I->R (Recv)
+			if err := s.split(cs1, cs2); err != nil {
+				return nil, err
 			}
 			// fmt.Println("crypto: trace - Handshake Complete! CipherStates initialized.")
 		}
@@ -92,6 +150,10 @@ func (s *Session) WriteMessage(message []byte) ([]byte, error) {
 
 	// Handshake complete, encrypt message
 	// fmt.Println("crypto: trace - WriteMessage (Transport)")
+	s.messages.Add(1)
+	if s.framed {
+		return s.encryptFrame(message)
+	}
 	return s.cs1.Encrypt(nil, nil, message)
 }
 
@@ -100,17 +162,18 @@ func (s *Session) ReadMessage(message []byte) ([]byte, error) {
 	if s.cs2 == nil {
 		// Still in handshake phase
 		// fmt.Println("crypto: trace - ReadMessage (Handshake)")
+		index := s.handshakeState.MessageIndex()
 		plaintext, cs1, cs2, err := s.handshakeState.ReadMessage(nil, message)
 		if err != nil && err != io.EOF {
 			return nil, fmt.Errorf("handshake read failed: %w", err)
 		}
+		plaintext, err = s.readHandshakePayload(index, plaintext)
+		if err != nil {
+			return nil, err
+		}
 		if cs1 != nil {
-			if s.initiator {
-				s.cs1 = cs1 // I->R (Send)
-				s.cs2 = cs2 // R->I (Recv)
-			} else {
-				s.cs1 = cs2 // R->I (Send)
-				s.cs2 = cs1 // I->R (Recv)
+			if err := s.split(cs1, cs2); err != nil {
+				return nil, err
 			}
 			// fmt.Println("crypto: trace - Handshake Complete! CipherStates initialized.")
 		}
@@ -123,9 +186,81 @@ func (s *Session) ReadMessage(message []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("decrypt failed: %w", err)
 	}
+	s.messages.Add(1)
+	if s.framed {
+		return s.decryptFrame(plaintext)
+	}
 	return plaintext, nil
 }
 
+// split installs the transport CipherStates once the handshake completes.
+// cs1 always encrypts initiator to responder traffic.
+func (s *Session) split(cs1, cs2 *noise.CipherState) error {
+	if s.mode == ModeHybrid {
+		var err error
+		if cs1, err = s.mixKEMSecret(cs1, "i2r"); err != nil {
+			return err
+		}
+		if cs2, err = s.mixKEMSecret(cs2, "r2i"); err != nil {
+			return err
+		}
+	}
+	if s.initiator {
+		s.cs1 = cs1 // I->R (Send)
+		s.cs2 = cs2 // R->I (Recv)
+	} else {
+		s.cs1 = cs2 // R->I (Send)
+		s.cs2 = cs1 // I->R (Recv)
+	}
+	s.established = s.clock()
+	s.lastRekey = s.established
+	return nil
+}
+
+// MessageReadWriter carries whole handshake messages, e.g. a websocket or a
+// length-prefixed stream
+type MessageReadWriter interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(message []byte) error
+}
+
+// Handshake runs the complete handshake over rw with empty payloads. The
+// caller is responsible for deadlines.
+func (s *Session) Handshake(rw MessageReadWriter) error {
+	write := s.initiator
+	for !s.IsHandshakeComplete() {
+		if write {
+			message, err := s.WriteMessage(nil)
+			if err != nil {
+				return err
+			}
+			if err := rw.WriteMessage(message); err != nil {
+				return err
+			}
+		} else {
+			message, err := rw.ReadMessage()
+			if err != nil {
+				return err
+			}
+			if _, err := s.ReadMessage(message); err != nil {
+				return err
+			}
+		}
+		write = !write
+	}
+	return nil
+}
+
+// MaxPayloadSize is the largest plaintext that fits into one transport
+// message of at most noise.MaxMsgLen bytes
+func (s *Session) MaxPayloadSize() int {
+	size := noise.MaxMsgLen - tagSize
+	if s.framed {
+		size--
+	}
+	return size
+}
+
 // GetRemotePublicKey returns the remote peer's public key after handshake completes
 func (s *Session) GetRemotePublicKey() ([]byte, error) {
 	if s.handshakeState == nil {
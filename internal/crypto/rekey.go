@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"time"
+)
+
+// Transport frame types, used when FeatureRekey was negotiated. The type byte
+// is encrypted together with the payload.
+const (
+	frameData byte = iota
+	// frameRekey carries a payload like frameData, after which the sender
+	// switches its key with the Noise REKEY function; the receiver follows
+	// as soon as it has decrypted the frame
+	frameRekey
+)
+
+// RekeyPolicy limits how long transport keys and whole sessions are used.
+// Zero values disable the respective limit.
+type RekeyPolicy struct {
+	// RekeyInterval and RekeyMessages trigger an in-band rekey of the
+	// sending key. This needs FeatureRekey on both sides.
+	RekeyInterval time.Duration
+	RekeyMessages uint64
+	// MaxAge and MaxMessages (sent plus received) make NeedsRehandshake
+	// report true, so that the owner replaces the session with a new one
+	MaxAge      time.Duration
+	MaxMessages uint64
+}
+
+// WithRekeyPolicy sets the limits a session enforces once established
+func WithRekeyPolicy(policy RekeyPolicy) SessionOption {
+	return func(config *sessionConfig) {
+		config.policy = policy
+	}
+}
+
+// Framed reports whether transport messages carry frame types, i.e. whether
+// the session can rekey in-band
+func (s *Session) Framed() bool {
+	return s.framed
+}
+
+// NeedsRehandshake reports whether the session has reached its maximum age
+// or message count. The session keeps working; it is up to the owner to
+// establish a new one and retire this one.
+func (s *Session) NeedsRehandshake() bool {
+	if !s.IsHandshakeComplete() {
+		return false
+	}
+	if s.policy.MaxAge > 0 && s.clock().Sub(s.established) >= s.policy.MaxAge {
+		return true
+	}
+	return s.policy.MaxMessages > 0 && s.messages.Load() >= s.policy.MaxMessages
+}
+
+// rekeyDue reports whether the next outgoing frame should switch keys
+func (s *Session) rekeyDue(now time.Time) bool {
+	if !s.framed {
+		return false
+	}
+	if s.policy.RekeyMessages > 0 && s.sentSinceRekey+1 >= s.policy.RekeyMessages {
+		return true
+	}
+	return s.policy.RekeyInterval > 0 && now.Sub(s.lastRekey) >= s.policy.RekeyInterval
+}
+
+// encryptFrame encrypts message as a transport frame, rekeying the sending
+// CipherState afterwards when due
+func (s *Session) encryptFrame(message []byte) ([]byte, error) {
+	now := s.clock()
+	frameType := frameData
+	if s.rekeyDue(now) {
+		frameType = frameRekey
+	}
+
+	frame := make([]byte, 0, len(message)+1)
+	frame = append(append(frame, frameType), message...)
+	out, err := s.cs1.Encrypt(nil, nil, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sentSinceRekey++
+	if frameType == frameRekey {
+		s.cs1.Rekey()
+		s.sentSinceRekey = 0
+		s.lastRekey = now
+	}
+	return out, nil
+}
+
+// decryptFrame reverses encryptFrame
+func (s *Session) decryptFrame(frame []byte) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, ErrInvalidMessage
+	}
+	switch frame[0] {
+	case frameData:
+	case frameRekey:
+		s.cs2.Rekey()
+	default:
+		return nil, ErrInvalidMessage
+	}
+	return frame[1:], nil
+}
@@ -0,0 +1,99 @@
+package crypto
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func framedSessions(t *testing.T, policy RekeyPolicy) (*Session, *Session) {
+	t.Helper()
+	initiatorOpts, responderOpts := negotiate(false, false)
+	initiatorOpts = append(initiatorOpts, WithRekeyPolicy(policy))
+	responderOpts = append(responderOpts, WithRekeyPolicy(policy))
+	initiator, responder, err := handshake(t, initiatorOpts, responderOpts)
+	require.NoError(t, err)
+	require.True(t, initiator.Framed())
+	require.True(t, responder.Framed())
+	return initiator, responder
+}
+
+func exchange(t *testing.T, from, to *Session, text string) {
+	t.Helper()
+	encrypted, err := from.WriteMessage([]byte(text))
+	require.NoError(t, err)
+	decrypted, err := to.ReadMessage(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, text, string(decrypted))
+}
+
+func TestRekey_ByMessageCount(t *testing.T) {
+	initiator, responder := framedSessions(t, RekeyPolicy{RekeyMessages: 3})
+	firstKey := initiator.cs1.UnsafeKey()
+
+	for i := 0; i < 10; i++ {
+		exchange(t, initiator, responder, fmt.Sprintf("ping %d", i))
+		exchange(t, responder, initiator, fmt.Sprintf("pong %d", i))
+	}
+
+	assert.NotEqual(t, firstKey, initiator.cs1.UnsafeKey(), "sending key must have been replaced")
+	assert.Equal(t, initiator.cs1.UnsafeKey(), responder.cs2.UnsafeKey())
+	assert.Equal(t, responder.cs1.UnsafeKey(), initiator.cs2.UnsafeKey())
+}
+
+func TestRekey_ByInterval(t *testing.T) {
+	initiator, responder := framedSessions(t, RekeyPolicy{RekeyInterval: time.Minute})
+	firstKey := initiator.cs1.UnsafeKey()
+
+	exchange(t, initiator, responder, "before")
+	assert.Equal(t, firstKey, initiator.cs1.UnsafeKey())
+
+	later := time.Now().Add(2 * time.Minute)
+	initiator.clock = func() time.Time { return later }
+	exchange(t, initiator, responder, "rekeyed")
+	assert.NotEqual(t, firstKey, initiator.cs1.UnsafeKey())
+	exchange(t, initiator, responder, "after")
+}
+
+func TestRekey_ReplayedFrameRejected(t *testing.T) {
+	initiator, responder := framedSessions(t, RekeyPolicy{RekeyMessages: 1})
+
+	encrypted, err := initiator.WriteMessage([]byte("once"))
+	require.NoError(t, err)
+	_, err = responder.ReadMessage(encrypted)
+	require.NoError(t, err)
+	_, err = responder.ReadMessage(encrypted)
+	assert.Error(t, err)
+}
+
+func TestSession_NeedsRehandshake(t *testing.T) {
+	initiator, responder := framedSessions(t, RekeyPolicy{MaxMessages: 4})
+	exchange(t, initiator, responder, "one")
+	exchange(t, responder, initiator, "two")
+	assert.False(t, initiator.NeedsRehandshake())
+	exchange(t, initiator, responder, "three")
+	exchange(t, responder, initiator, "four")
+	assert.True(t, initiator.NeedsRehandshake(), "sent and received messages both count")
+
+	initiator, _ = framedSessions(t, RekeyPolicy{MaxAge: time.Hour})
+	assert.False(t, initiator.NeedsRehandshake())
+	later := time.Now().Add(2 * time.Hour)
+	initiator.clock = func() time.Time { return later }
+	assert.True(t, initiator.NeedsRehandshake())
+}
+
+func TestRekey_LegacyPeersUnframed(t *testing.T) {
+	offer := Offer()
+	initiator, responder, err := handshake(t,
+		[]SessionOption{WithNegotiation(offer, ""), WithRekeyPolicy(RekeyPolicy{RekeyMessages: 1})}, nil)
+	require.NoError(t, err)
+	assert.False(t, initiator.Framed())
+
+	// Without framing the policy cannot rekey, so a legacy peer keeps up
+	for i := 0; i < 3; i++ {
+		exchange(t, initiator, responder, "plain")
+	}
+}
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/flynn/noise"
+)
+
+// sealedPrologue separates sealed messages from every other use of the keys
+const sealedPrologue = "localchat sealed v1"
+
+var ErrBadSealedMessage = errors.New("sealed message cannot be opened with this key")
+
+// sealedConfig returns the one-way Noise_X handshake config used for sealed
+// messages. The PSK of opts applies, so workspaces stay closed.
+func sealedConfig(keypair NoiseKeypair, initiator bool, opts []SessionOption) (noise.Config, error) {
+	config := newSessionConfig(opts)
+	if config.err != nil {
+		return noise.Config{}, config.err
+	}
+	config.noise.Pattern = noise.HandshakeX
+	config.noise.Initiator = initiator
+	config.noise.StaticKeypair = keypair
+	config.noise.Prologue = []byte(sealedPrologue)
+	return config.noise, nil
+}
+
+// Seal encrypts plaintext for the holder of remoteStatic in a single Noise_X
+// message that also authenticates keypair as the sender. It needs no reply,
+// so it can travel through nodes that cannot read it.
+func Seal(keypair NoiseKeypair, remoteStatic, plaintext []byte, opts ...SessionOption) ([]byte, error) {
+	config, err := sealedConfig(keypair, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	config.PeerStatic = remoteStatic
+	hs, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create handshake state: %w", err)
+	}
+	sealed, _, _, err := hs.WriteMessage(nil, plaintext)
+	return sealed, err
+}
+
+// OpenSealed decrypts a message from Seal and returns the sender's static
+// public key with the plaintext
+func OpenSealed(keypair NoiseKeypair, sealed []byte, opts ...SessionOption) (sender, plaintext []byte, err error) {
+	config, err := sealedConfig(keypair, false, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create handshake state: %w", err)
+	}
+	plaintext, _, _, err = hs.ReadMessage(nil, sealed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrBadSealedMessage, err)
+	}
+	return hs.PeerStatic(), plaintext, nil
+}
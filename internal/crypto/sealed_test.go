@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealed_RoundTrip(t *testing.T) {
+	sender, _, err := GenerateKeypair()
+	require.NoError(t, err)
+	recipient, _, err := GenerateKeypair()
+	require.NoError(t, err)
+	relay, _, err := GenerateKeypair()
+	require.NoError(t, err)
+
+	sealed, err := Seal(sender, recipient.Public, []byte("hello"))
+	require.NoError(t, err)
+
+	from, plaintext, err := OpenSealed(recipient, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(plaintext))
+	assert.Equal(t, sender.Public, from)
+
+	_, _, err = OpenSealed(relay, sealed)
+	assert.ErrorIs(t, err, ErrBadSealedMessage, "only the recipient can open it")
+
+	sealed[len(sealed)-1] ^= 1
+	_, _, err = OpenSealed(recipient, sealed)
+	assert.ErrorIs(t, err, ErrBadSealedMessage)
+}
+
+func TestSealed_WorkspacePSK(t *testing.T) {
+	sender, _, err := GenerateKeypair()
+	require.NoError(t, err)
+	recipient, _, err := GenerateKeypair()
+	require.NoError(t, err)
+	psk := make([]byte, 32)
+
+	sealed, err := Seal(sender, recipient.Public, []byte("hello"), WithPSK(psk))
+	require.NoError(t, err)
+	_, _, err = OpenSealed(recipient, sealed)
+	assert.ErrorIs(t, err, ErrBadSealedMessage, "outside the workspace")
+	_, plaintext, err := OpenSealed(recipient, sealed, WithPSK(psk))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(plaintext))
+}
@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// senderKeyAD separates group messages from every other use of AES-GCM
+const senderKeyAD = "localchat group v1"
+
+var ErrBadGroupMessage = errors.New("group message is not sealed with this sender key")
+
+// SenderKey encrypts the messages one member sends to a group. The member
+// hands it to every other member over their pairwise sessions and replaces
+// it whenever the membership changes, so former members cannot read on.
+type SenderKey struct {
+	ID  string `json:"id"`
+	Key []byte `json:"key"`
+}
+
+// NewSenderKey returns a random AES-256 sender key
+func NewSenderKey() (SenderKey, error) {
+	id := make([]byte, 8)
+	key := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return SenderKey{}, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return SenderKey{}, err
+	}
+	return SenderKey{ID: hex.EncodeToString(id), Key: key}, nil
+}
+
+func (k SenderKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.Key)
+	if err != nil {
+		return nil, fmt.Errorf("bad sender key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext with AES-256-GCM, binding it to ad, which names
+// the group and the sender
+func (k SenderKey) Seal(ad, plaintext []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, append([]byte(senderKeyAD), ad...)), nil
+}
+
+// Open decrypts a message from Seal with the same ad
+func (k SenderKey) Open(ad, sealed []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrBadGroupMessage
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, append([]byte(senderKeyAD), ad...))
+	if err != nil {
+		return nil, ErrBadGroupMessage
+	}
+	return plaintext, nil
+}
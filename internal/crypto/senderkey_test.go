@@ -0,0 +1,29 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSenderKey_SealOpen(t *testing.T) {
+	key, err := NewSenderKey()
+	require.NoError(t, err)
+	rotated, err := NewSenderKey()
+	require.NoError(t, err)
+	require.NotEqual(t, key.ID, rotated.ID)
+
+	sealed, err := key.Seal([]byte("group/alice"), []byte("hello"))
+	require.NoError(t, err)
+	plaintext, err := key.Open([]byte("group/alice"), sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(plaintext))
+
+	_, err = key.Open([]byte("group/mallory"), sealed)
+	assert.ErrorIs(t, err, ErrBadGroupMessage, "bound to the sender")
+	_, err = rotated.Open([]byte("group/alice"), sealed)
+	assert.ErrorIs(t, err, ErrBadGroupMessage, "unreadable after rotation")
+	_, err = key.Open([]byte("group/alice"), sealed[:4])
+	assert.ErrorIs(t, err, ErrBadGroupMessage)
+}
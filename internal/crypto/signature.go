@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"math/big"
+	"slices"
+)
+
+var ErrBadSignature = errors.New("signature does not match the signer's static key")
+
+// curve25519P is the field prime 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// Signature is an Ed25519 signature by an identity together with its public
+// key. The key is checked against the signer's Noise static key, so no
+// separate key distribution is needed.
+type Signature struct {
+	Key []byte `json:"key"`
+	Sig []byte `json:"sig"`
+}
+
+// SigningKey returns the Ed25519 key of the identity. Its public key maps to
+// the Noise static key, so signatures are tied to the PeerID.
+func (id *Identity) SigningKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(id.seed)
+}
+
+// Sign signs message with key
+func Sign(key ed25519.PrivateKey, message []byte) Signature {
+	return Signature{Key: slices.Clone(key.Public().(ed25519.PublicKey)), Sig: ed25519.Sign(key, message)}
+}
+
+// Signer returns the Noise static key of whoever made the signature, or
+// ErrBadSignature if it is not a valid signature over message
+func (s Signature) Signer(message []byte) ([]byte, error) {
+	if len(s.Key) != ed25519.PublicKeySize || !ed25519.Verify(s.Key, message, s.Sig) {
+		return nil, ErrBadSignature
+	}
+	static, ok := montgomeryU(s.Key)
+	if !ok {
+		return nil, ErrBadSignature
+	}
+	return static, nil
+}
+
+// Verify reports whether the signature is valid over message and made by
+// the holder of the Noise static key staticKey
+func (s Signature) Verify(staticKey, message []byte) error {
+	signer, err := s.Signer(message)
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(signer, staticKey) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// montgomeryU converts an Ed25519 public key to the X25519 public key of the
+// same scalar, u = (1 + y) / (1 - y), as libsodium does
+func montgomeryU(edwards []byte) ([]byte, bool) {
+	le := slices.Clone(edwards)
+	le[31] &= 0x7f // Drop the sign of x
+	slices.Reverse(le)
+	y := new(big.Int).SetBytes(le)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, false
+	}
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, false
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, curve25519P))
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	slices.Reverse(out)
+	return out, true
+}
@@ -0,0 +1,28 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignature_TiedToStaticKey(t *testing.T) {
+	identity, err := NewIdentity()
+	require.NoError(t, err)
+	other, err := NewIdentity()
+	require.NoError(t, err)
+
+	sig := Sign(identity.SigningKey(), []byte("promote bob"))
+	signer, err := sig.Signer([]byte("promote bob"))
+	require.NoError(t, err)
+	assert.Equal(t, identity.Keypair().Public, signer, "maps to the Noise static key")
+	assert.NoError(t, sig.Verify(identity.Keypair().Public, []byte("promote bob")))
+
+	assert.ErrorIs(t, sig.Verify(other.Keypair().Public, []byte("promote bob")), ErrBadSignature)
+	assert.ErrorIs(t, sig.Verify(identity.Keypair().Public, []byte("promote mallory")), ErrBadSignature)
+
+	forged := Sign(other.SigningKey(), []byte("promote bob"))
+	forged.Key = sig.Key
+	assert.ErrorIs(t, forged.Verify(identity.Keypair().Public, []byte("promote bob")), ErrBadSignature)
+}
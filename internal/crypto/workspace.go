@@ -0,0 +1,108 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// workspaceSalt is fixed so that every member derives the same keys from
+	// the same secret; the secret itself is what has to stay private
+	workspaceSalt       = "localchat workspace v1"
+	workspaceIterations = 600000
+
+	announcementAD = "localchat announcement v1"
+	// AnnouncementMaxAge bounds how old (or how far in the future) a sealed
+	// announcement may be before it is rejected as a replay
+	AnnouncementMaxAge = 2 * time.Minute
+)
+
+var (
+	ErrEmptyWorkspaceSecret = errors.New("workspace secret is empty")
+	ErrBadAnnouncement      = errors.New("announcement is not sealed with this workspace key")
+	ErrStaleAnnouncement    = errors.New("announcement is too old or from the future")
+)
+
+// WorkspaceKeys are derived from a secret shared by every member of a
+// workspace. Nodes with different (or no) secrets can neither read each
+// other's announcements nor complete a Noise handshake with each other.
+type WorkspaceKeys struct {
+	// PSK is mixed into the Noise handshake (Noise_XXpsk0)
+	PSK []byte
+	// discovery seals announcements with AES-256-GCM
+	discovery cipher.AEAD
+}
+
+// DeriveWorkspaceKeys stretches secret with PBKDF2 and splits the result into
+// the Noise pre-shared key and the discovery key with HKDF
+func DeriveWorkspaceKeys(secret string) (*WorkspaceKeys, error) {
+	if secret == "" {
+		return nil, ErrEmptyWorkspaceSecret
+	}
+
+	master, err := pbkdf2.Key(sha256.New, secret, []byte(workspaceSalt), workspaceIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stretch workspace secret: %w", err)
+	}
+	psk, err := hkdf.Expand(sha256.New, master, "noise psk", 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive workspace PSK: %w", err)
+	}
+	discoveryKey, err := hkdf.Expand(sha256.New, master, "discovery", 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive workspace discovery key: %w", err)
+	}
+
+	block, err := aes.NewCipher(discoveryKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WorkspaceKeys{PSK: psk, discovery: aead}, nil
+}
+
+// SealAnnouncement encrypts and authenticates a discovery payload together
+// with the current time
+func (k *WorkspaceKeys) SealAnnouncement(payload []byte, now time.Time) ([]byte, error) {
+	nonce := make([]byte, k.discovery.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	plaintext := binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))
+	plaintext = append(plaintext, payload...)
+
+	return k.discovery.Seal(nonce, nonce, plaintext, []byte(announcementAD)), nil
+}
+
+// OpenAnnouncement reverses SealAnnouncement, rejecting payloads sealed with
+// another key and payloads more than AnnouncementMaxAge away from now
+func (k *WorkspaceKeys) OpenAnnouncement(sealed []byte, now time.Time) ([]byte, error) {
+	nonceSize := k.discovery.NonceSize()
+	if len(sealed) < nonceSize+k.discovery.Overhead()+8 {
+		return nil, ErrBadAnnouncement
+	}
+
+	plaintext, err := k.discovery.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(announcementAD))
+	if err != nil {
+		return nil, ErrBadAnnouncement
+	}
+
+	sent := time.Unix(int64(binary.BigEndian.Uint64(plaintext[:8])), 0)
+	if age := now.Sub(sent); age > AnnouncementMaxAge || age < -AnnouncementMaxAge {
+		return nil, ErrStaleAnnouncement
+	}
+	return plaintext[8:], nil
+}
@@ -0,0 +1,93 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handshake runs the three XX messages between a fresh initiator and
+// responder and returns the first error
+func handshake(t *testing.T, initiatorOpts, responderOpts []SessionOption) (*Session, *Session, error) {
+	t.Helper()
+	initiatorKey, _, err := GenerateKeypair()
+	require.NoError(t, err)
+	responderKey, _, err := GenerateKeypair()
+	require.NoError(t, err)
+
+	initiator, err := NewInitiatorSession(initiatorKey, initiatorOpts...)
+	require.NoError(t, err)
+	responder, err := NewResponderSession(responderKey, responderOpts...)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		from, to := initiator, responder
+		if i == 1 {
+			from, to = responder, initiator
+		}
+		msg, err := from.WriteMessage(nil)
+		require.NoError(t, err)
+		if _, err := to.ReadMessage(msg); err != nil {
+			return initiator, responder, err
+		}
+	}
+	return initiator, responder, nil
+}
+
+func TestWorkspacePSK_Handshake(t *testing.T) {
+	team, err := DeriveWorkspaceKeys("correct horse battery staple")
+	require.NoError(t, err)
+	other, err := DeriveWorkspaceKeys("another team")
+	require.NoError(t, err)
+
+	initiator, responder, err := handshake(t, []SessionOption{WithPSK(team.PSK)}, []SessionOption{WithPSK(team.PSK)})
+	require.NoError(t, err)
+	require.True(t, responder.IsHandshakeComplete())
+	encrypted, err := initiator.WriteMessage([]byte("hello team"))
+	require.NoError(t, err)
+	decrypted, err := responder.ReadMessage(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "hello team", string(decrypted))
+
+	_, responder, err = handshake(t, []SessionOption{WithPSK(other.PSK)}, []SessionOption{WithPSK(team.PSK)})
+	assert.Error(t, err, "a different workspace secret must not complete the handshake")
+	_, err = responder.GetRemotePublicKey()
+	assert.Error(t, err, "the responder must reject the first message")
+
+	_, _, err = handshake(t, nil, []SessionOption{WithPSK(team.PSK)})
+	assert.Error(t, err, "a node without the secret must not complete the handshake")
+	_, _, err = handshake(t, []SessionOption{WithPSK(team.PSK)}, nil)
+	assert.Error(t, err)
+}
+
+func TestWorkspaceAnnouncements(t *testing.T) {
+	team, err := DeriveWorkspaceKeys("correct horse battery staple")
+	require.NoError(t, err)
+	again, err := DeriveWorkspaceKeys("correct horse battery staple")
+	require.NoError(t, err)
+	other, err := DeriveWorkspaceKeys("another team")
+	require.NoError(t, err)
+
+	now := time.Now()
+	sealed, err := team.SealAnnouncement([]byte("me0w:key:25042:alice"), now)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "alice")
+
+	payload, err := again.OpenAnnouncement(sealed, now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, "me0w:key:25042:alice", string(payload))
+
+	_, err = other.OpenAnnouncement(sealed, now)
+	assert.ErrorIs(t, err, ErrBadAnnouncement)
+
+	_, err = team.OpenAnnouncement(sealed, now.Add(AnnouncementMaxAge+time.Minute))
+	assert.ErrorIs(t, err, ErrStaleAnnouncement)
+
+	_, err = team.OpenAnnouncement([]byte("short"), now)
+	assert.ErrorIs(t, err, ErrBadAnnouncement)
+
+	_, err = DeriveWorkspaceKeys("")
+	assert.ErrorIs(t, err, ErrEmptyWorkspaceSecret)
+}
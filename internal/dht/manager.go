@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
@@ -15,8 +14,12 @@ import (
 	"github.com/libp2p/go-libp2p/core/peerstore"
 	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 	"github.com/multiformats/go-multiaddr"
+
+	"p2p-messenger/internal/logging"
 )
 
+var logger = logging.For("dht")
+
 const (
 	dhtBootstrapInterval = 5 * time.Minute
 	mdnsServiceName      = "p2p-chat"
@@ -73,7 +76,7 @@ func NewManager(port int, peerFoundCb PeerFoundCallback) (*Manager, error) {
 
 	// Bootstrap DHT
 	if err := dhtInstance.Bootstrap(ctx); err != nil {
-		log.Printf("dht: bootstrap warning: %v", err)
+		logger.Warn("bootstrap failed", "err", err)
 	}
 
 	// Create mDNS service for local discovery
@@ -143,7 +146,7 @@ func (m *Manager) bootstrapPeriodically() {
 		select {
 		case <-ticker.C:
 			if err := m.dht.Bootstrap(m.ctx); err != nil {
-				log.Printf("dht: periodic bootstrap error: %v", err)
+				logger.Warn("periodic bootstrap failed", "err", err)
 			}
 		case <-m.ctx.Done():
 			return
@@ -157,7 +160,7 @@ type peerHandler struct {
 }
 
 func (h *peerHandler) HandlePeerFound(info peer.AddrInfo) {
-	log.Printf("dht: mdns discovered peer %s addrs %v", info.ID.String(), info.Addrs)
+	logger.Debug("mdns discovered peer", "peer", info.ID.String(), "addrs", info.Addrs)
 	h.host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
 	if h.peerFoundCb != nil {
 		h.peerFoundCb(info.ID.String(), info.Addrs)
@@ -0,0 +1,210 @@
+package entity
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"time"
+
+	"p2p-messenger/internal/transport"
+)
+
+const (
+	// maxAddresses caps the addresses kept per peer, so announcements can't
+	// grow the list without bound
+	maxAddresses = 8
+	// addressLifetime is how long an address is kept after it was last seen
+	// or connected to
+	addressLifetime = 30 * time.Minute
+)
+
+// Address is one way of reaching a peer's chat listener, as reported by a
+// discovery source
+type Address struct {
+	IP       string
+	Port     string
+	Source   ConnectionType
+	LastSeen time.Time
+	// RTT is how long the last successful dial and handshake took, 0 until
+	// one succeeded
+	RTT time.Duration
+	// Failures counts failed dials and dropped connections since the last
+	// successful one
+	Failures int
+}
+
+// HostPort returns the address in host:port form
+func (a Address) HostPort() string {
+	return net.JoinHostPort(a.IP, a.Port)
+}
+
+// Transport returns the transport that reaches the address: the one for
+// internet peers on internet addresses, the preferred one otherwise
+func (a Address) Transport() transport.Kind {
+	kind := transport.Preferred()
+	if a.Source == ConnectionInternet {
+		kind = transport.PreferredInternet()
+	}
+	if kind == transport.WebRTC {
+		// A listener we can dial needs no ICE; WebRTC is tried through the
+		// relay once every address failed
+		kind = transport.Websocket
+	}
+	return kind
+}
+
+// compareAddresses orders addresses by policy: working ones before failing
+// ones, then by source (BLE, NAT, Internet), then measured round trip, then
+// the most recently seen
+func compareAddresses(a, b Address) int {
+	if c := cmp.Compare(a.Failures, b.Failures); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.Source, b.Source); c != 0 {
+		return c
+	}
+	// Unmeasured addresses go after measured ones
+	if (a.RTT == 0) != (b.RTT == 0) {
+		if a.RTT == 0 {
+			return 1
+		}
+		return -1
+	}
+	if c := cmp.Compare(a.RTT, b.RTT); c != 0 {
+		return c
+	}
+	return b.LastSeen.Compare(a.LastSeen)
+}
+
+// expired reports whether the address was last seen too long ago. Addresses
+// without a LastSeen never expire.
+func (a Address) expired(now time.Time) bool {
+	return !a.LastSeen.IsZero() && now.Sub(a.LastSeen) > addressLifetime
+}
+
+// AddAddress records an address the peer was seen at. Seeing a known address
+// again refreshes it and keeps the better of the two sources. Expired
+// addresses are dropped, and beyond maxAddresses the one tried last goes.
+func (p *Peer) AddAddress(addr Address) {
+	if addr.IP == "" || addr.Port == "" {
+		return
+	}
+	p.addrLock.Lock()
+	defer p.addrLock.Unlock()
+	now := time.Now()
+	p.addresses = slices.DeleteFunc(p.addresses, func(existing Address) bool { return existing.expired(now) })
+	for i := range p.addresses {
+		existing := &p.addresses[i]
+		if existing.IP != addr.IP || existing.Port != addr.Port {
+			continue
+		}
+		if addr.LastSeen.After(existing.LastSeen) {
+			existing.LastSeen = addr.LastSeen
+		}
+		existing.Source = min(existing.Source, addr.Source)
+		return
+	}
+	p.addresses = append(p.addresses, Address{IP: addr.IP, Port: addr.Port, Source: addr.Source, LastSeen: addr.LastSeen})
+	if len(p.addresses) > maxAddresses {
+		slices.SortStableFunc(p.addresses, compareAddresses)
+		p.addresses = p.addresses[:maxAddresses]
+	}
+}
+
+// Addresses returns every known address of the peer in the order they are
+// tried. A peer without recorded addresses falls back to AddrIP and Port.
+func (p *Peer) Addresses() []Address {
+	p.addrLock.RLock()
+	now := time.Now()
+	var addresses []Address
+	for _, addr := range p.addresses {
+		if !addr.expired(now) {
+			addresses = append(addresses, addr)
+		}
+	}
+	p.addrLock.RUnlock()
+	if len(addresses) == 0 && p.AddrIP != "" && p.Port != "" {
+		addresses = append(addresses, Address{IP: p.AddrIP, Port: p.Port, Source: p.PrimaryConnectionType})
+	}
+	slices.SortStableFunc(addresses, compareAddresses)
+	return addresses
+}
+
+// HasAddress reports whether the peer is known at ip
+func (p *Peer) HasAddress(ip string) bool {
+	return slices.ContainsFunc(p.Addresses(), func(addr Address) bool { return addr.IP == ip })
+}
+
+// recordConnected notes a successful connection to addr
+func (p *Peer) recordConnected(addr Address, rtt time.Duration) {
+	p.updateAddress(addr, func(existing *Address) {
+		existing.RTT = rtt
+		existing.Failures = 0
+		existing.LastSeen = time.Now()
+	})
+}
+
+// recordFailure moves addr behind the addresses that still work
+func (p *Peer) recordFailure(addr Address) {
+	p.updateAddress(addr, func(existing *Address) {
+		existing.Failures++
+	})
+}
+
+func (p *Peer) updateAddress(addr Address, update func(*Address)) {
+	if addr.IP == "" || addr.Port == "" {
+		return
+	}
+	p.addrLock.Lock()
+	defer p.addrLock.Unlock()
+	index := slices.IndexFunc(p.addresses, func(existing Address) bool {
+		return existing.IP == addr.IP && existing.Port == addr.Port
+	})
+	if index < 0 {
+		// A fallback address from AddrIP and Port, remembered from now on
+		p.addresses = append(p.addresses, addr)
+		index = len(p.addresses) - 1
+	}
+	update(&p.addresses[index])
+}
+
+// Route reaches a peer through a relay
+type Route struct {
+	// Via is the peer ID of the neighbour that forwards our envelopes
+	Via string
+	// Hops counts the connections an envelope takes to reach the peer
+	Hops    int
+	Expires time.Time
+}
+
+// SetRoute records how the peer can be reached through relays
+func (p *Peer) SetRoute(route Route) {
+	p.addrLock.Lock()
+	defer p.addrLock.Unlock()
+	p.route = &route
+}
+
+// ClearRoute forgets the relay route
+func (p *Peer) ClearRoute() {
+	p.addrLock.Lock()
+	defer p.addrLock.Unlock()
+	p.route = nil
+}
+
+// SetSignal sets how WebRTC offers reach the peer through relays, used
+// while the peer has a route
+func (p *Peer) SetSignal(signal transport.Signal) {
+	p.addrLock.Lock()
+	defer p.addrLock.Unlock()
+	p.signal = signal
+}
+
+// GetRoute returns the relay route to the peer, if there is one
+func (p *Peer) GetRoute() (Route, bool) {
+	p.addrLock.RLock()
+	defer p.addrLock.RUnlock()
+	if p.route == nil {
+		return Route{}, false
+	}
+	return *p.route, true
+}
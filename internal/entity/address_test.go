@@ -0,0 +1,95 @@
+package entity
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/crypto"
+)
+
+func TestPeer_AddressOrder(t *testing.T) {
+	now := time.Now()
+	peer := &Peer{}
+	peer.AddAddress(Address{IP: "203.0.113.1", Port: "1", Source: ConnectionInternet, LastSeen: now.Add(-time.Second)})
+	peer.AddAddress(Address{IP: "192.168.1.2", Port: "1", Source: ConnectionNAT, LastSeen: now.Add(-time.Minute)})
+	peer.AddAddress(Address{IP: "192.168.1.3", Port: "1", Source: ConnectionNAT, LastSeen: now})
+	// Seen again via a better source
+	peer.AddAddress(Address{IP: "203.0.113.1", Port: "1", Source: ConnectionNAT, LastSeen: now.Add(-time.Hour)})
+	peer.AddAddress(Address{IP: "", Port: "1", Source: ConnectionBLE})
+
+	hosts := func() []string {
+		var hosts []string
+		for _, addr := range peer.Addresses() {
+			hosts = append(hosts, addr.IP)
+		}
+		return hosts
+	}
+	assert.Equal(t, []string{"192.168.1.3", "203.0.113.1", "192.168.1.2"}, hosts(), "most recently seen first")
+
+	peer.recordConnected(Address{IP: "192.168.1.2", Port: "1"}, 5*time.Millisecond)
+	assert.Equal(t, []string{"192.168.1.2", "192.168.1.3", "203.0.113.1"}, hosts(), "measured first")
+
+	peer.recordFailure(Address{IP: "192.168.1.2", Port: "1"})
+	assert.Equal(t, []string{"192.168.1.3", "203.0.113.1", "192.168.1.2"}, hosts(), "failing last")
+	assert.True(t, peer.HasAddress("203.0.113.1"))
+	assert.False(t, peer.HasAddress("203.0.113.2"))
+}
+
+func TestPeer_FailsOverToNextAddress(t *testing.T) {
+	server := NewMockServer(t)
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, deadPort, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	keypair, _, _ := crypto.GenerateKeypair()
+	peer := &Peer{PeerID: "test-peer"}
+	peer.AddAddress(Address{IP: "127.0.0.1", Port: deadPort, Source: ConnectionNAT, LastSeen: time.Now()})
+	peer.AddAddress(Address{IP: "127.0.0.1", Port: server.Port, Source: ConnectionInternet, LastSeen: time.Now()})
+
+	require.NoError(t, peer.EstablishConnection(keypair))
+	defer peer.Close()
+	assert.Equal(t, server.Port, peer.connAddr.Port)
+
+	addresses := peer.Addresses()
+	require.Len(t, addresses, 2)
+	assert.Equal(t, server.Port, addresses[0].Port, "the working address is tried first from now on")
+	assert.NotZero(t, addresses[0].RTT)
+	assert.Equal(t, 1, addresses[1].Failures)
+}
+
+func TestPeer_AddressesAreCappedAndExpire(t *testing.T) {
+	now := time.Now()
+	peer := &Peer{AddrIP: "192.168.1.1", Port: "1"}
+	peer.AddAddress(Address{IP: "192.168.1.2", Port: "1", Source: ConnectionNAT, LastSeen: now.Add(-addressLifetime - time.Minute)})
+	assert.Equal(t, "192.168.1.1", peer.Addresses()[0].IP, "an expired address falls back to AddrIP")
+
+	peer.recordConnected(Address{IP: "192.168.1.3", Port: "1", Source: ConnectionNAT}, time.Millisecond)
+	for i := range 2 * maxAddresses {
+		peer.AddAddress(Address{IP: net.IPv4(203, 0, 113, byte(i)).String(), Port: "1", Source: ConnectionInternet, LastSeen: now})
+	}
+	addresses := peer.Addresses()
+	assert.Len(t, addresses, maxAddresses)
+	assert.Equal(t, "192.168.1.3", addresses[0].IP, "an address that worked survives a flood of announcements")
+	assert.False(t, peer.HasAddress("192.168.1.2"))
+}
+
+func TestPeer_RejectsSessionWithDifferentKey(t *testing.T) {
+	server := NewMockServer(t)
+	defer server.Close()
+
+	keypair, _, _ := crypto.GenerateKeypair()
+	expected, _, _ := crypto.GenerateKeypair()
+	peer := &Peer{PeerID: "test-peer", PublicKey: expected.Public}
+	peer.AddAddress(Address{IP: "127.0.0.1", Port: server.Port, Source: ConnectionNAT, LastSeen: time.Now()})
+
+	err := peer.EstablishConnection(keypair)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "different peer")
+}
@@ -0,0 +1,14 @@
+package entity
+
+// Diagnostics is a snapshot of the listener's connection counters, shown in
+// the diagnostics view
+type Diagnostics struct {
+	ActiveConnections int
+	// Rejections and violations since startup
+	RejectedConnections uint64 // global connection limit reached
+	RejectedPerIP       uint64 // per-IP connection limit reached
+	OversizedFrames     uint64
+	HandshakeTimeouts   uint64
+	IdleTimeouts        uint64
+	RateLimited         uint64 // messages delayed by the per-connection rate limit
+}
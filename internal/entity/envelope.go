@@ -0,0 +1,72 @@
+package entity
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EnvelopeKind says what an envelope on a chat session carries
+type EnvelopeKind string
+
+const (
+	EnvelopeText        EnvelopeKind = "text"
+	EnvelopeTypingStart EnvelopeKind = "typing-start"
+	EnvelopeTypingStop  EnvelopeKind = "typing-stop"
+	// EnvelopeRead tells the author that every message up to UpTo was read
+	EnvelopeRead EnvelopeKind = "read"
+	// EnvelopeEdit replaces the text of the message Ref, EnvelopeDelete
+	// removes it
+	EnvelopeEdit   EnvelopeKind = "edit"
+	EnvelopeDelete EnvelopeKind = "delete"
+	// EnvelopeReaction sets the sender's reaction to the message Ref to
+	// Text; empty Text takes it back
+	EnvelopeReaction EnvelopeKind = "reaction"
+	// EnvelopeTimer sets the disappearing messages timer of the
+	// conversation to the duration in Text
+	EnvelopeTimer EnvelopeKind = "timer"
+	// EnvelopeSync asks for the messages the recipient wrote after UpTo,
+	// the last of them the sender has
+	EnvelopeSync EnvelopeKind = "sync"
+)
+
+// TypingTimeout is how long a typing-start holds unless it is repeated, so
+// that a lost typing-stop does not leave the peer typing forever
+const TypingTimeout = 6 * time.Second
+
+// Envelope is what travels on a chat session, directly or relayed
+type Envelope struct {
+	Kind EnvelopeKind `json:"kind"`
+	// ID identifies a text message in both conversations
+	ID   string `json:"id,omitempty"`
+	Text string `json:"text,omitempty"`
+	// UpTo is the ID of the last message read
+	UpTo string `json:"up_to,omitempty"`
+	// Ref is the ID of the message an envelope refers to, or the one a
+	// text message replies to
+	Ref string `json:"ref,omitempty"`
+	// Time is when the sender wrote a message or made a change
+	Time time.Time `json:"time,omitzero"`
+	// Clock is the Lamport counter of a text message
+	Clock uint64 `json:"clock,omitempty"`
+	// Edited marks a text message sent again after it was edited
+	Edited bool `json:"edited,omitempty"`
+}
+
+// Encode returns the envelope as sent on the wire
+func (e Envelope) Encode() string {
+	data, _ := json.Marshal(e)
+	return string(data)
+}
+
+// DecodeEnvelope reads an envelope from the wire. Peers that predate
+// envelopes send bare text, which is read as a text message without ID.
+func DecodeEnvelope(data []byte) Envelope {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err == nil {
+		switch env.Kind {
+		case EnvelopeText, EnvelopeTypingStart, EnvelopeTypingStop, EnvelopeRead, EnvelopeEdit, EnvelopeDelete, EnvelopeReaction, EnvelopeTimer, EnvelopeSync:
+			return env
+		}
+	}
+	return Envelope{Kind: EnvelopeText, Text: string(data)}
+}
@@ -0,0 +1,78 @@
+package entity
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeer_ReceivesEnvelopes(t *testing.T) {
+	peer := &Peer{}
+	peer.AddOutgoing(Message{ID: "a", Text: "one", State: MessageSent})
+	peer.AddOutgoing(Message{ID: "b", Text: "two", State: MessageSent})
+	peer.AddOutgoing(Message{ID: "c", Text: "three", State: MessageQueued})
+
+	peer.Receive([]byte(Envelope{Kind: EnvelopeTypingStart}.Encode()), "bob")
+	assert.True(t, peer.Typing())
+	peer.Receive([]byte(Envelope{Kind: EnvelopeText, ID: "x", Text: "hi"}.Encode()), "bob")
+	assert.False(t, peer.Typing(), "a message ends typing")
+	// The outbox may deliver a message twice
+	peer.Receive([]byte(Envelope{Kind: EnvelopeText, ID: "x", Text: "hi"}.Encode()), "bob")
+	// Peers that predate envelopes send bare text
+	peer.Receive([]byte("plain"), "bob")
+	peer.Receive([]byte(`{"kind":"unknown"}`), "bob")
+	assert.Equal(t, "x", peer.LastReceived(), "bare text has no ID")
+
+	peer.Receive([]byte(Envelope{Kind: EnvelopeRead, UpTo: "b"}.Encode()), "bob")
+	peer.Receive([]byte(Envelope{Kind: EnvelopeRead, UpTo: "x"}.Encode()), "bob")
+	var texts []string
+	var read []bool
+	for _, m := range peer.GetMessages() {
+		texts = append(texts, m.Text)
+		read = append(read, m.Read)
+	}
+	assert.Equal(t, []string{"one", "two", "three", "hi", "plain", `{"kind":"unknown"}`}, texts)
+	assert.Equal(t, []bool{true, true, false, false, false, false}, read)
+}
+
+func TestPeer_EditAndDelete(t *testing.T) {
+	peer := &Peer{}
+	peer.AddOutgoing(Message{ID: "mine", Text: "helo", State: MessageSent})
+	peer.Receive([]byte(Envelope{Kind: EnvelopeText, ID: "theirs", Text: "hi"}.Encode()), "bob")
+
+	assert.True(t, peer.Edit("mine", "hello"))
+	assert.False(t, peer.Edit("theirs", "changed"), "only our own messages")
+	// Likewise the peer may only change its own messages
+	peer.Receive([]byte(Envelope{Kind: EnvelopeEdit, Ref: "mine", Text: "forged"}.Encode()), "bob")
+	peer.Receive([]byte(Envelope{Kind: EnvelopeDelete, Ref: "theirs"}.Encode()), "bob")
+	peer.Receive([]byte(Envelope{Kind: EnvelopeEdit, Ref: "theirs", Text: "back"}.Encode()), "bob")
+
+	messages := peer.GetMessages()
+	assert.Equal(t, "hello", messages[0].Text)
+	assert.True(t, messages[0].Edited)
+	assert.True(t, messages[1].Deleted, "a tombstone stays")
+	assert.Empty(t, messages[1].Text)
+}
+
+func TestPeer_RepliesAndReactions(t *testing.T) {
+	peer := &Peer{}
+	peer.AddOutgoing(Message{ID: "question", Text: "lunch?", State: MessageSent})
+	peer.Receive([]byte(Envelope{Kind: EnvelopeText, ID: "answer", Text: "sure", Ref: "question"}.Encode()), "bob")
+
+	assert.True(t, peer.React("answer", "👍", "me"))
+	peer.Receive([]byte(Envelope{Kind: EnvelopeReaction, Ref: "question", Text: "🍕"}.Encode()), "bob")
+	peer.Receive([]byte(Envelope{Kind: EnvelopeReaction, Ref: "question", Text: "🎉"}.Encode()), "bob")
+	peer.Receive([]byte(Envelope{Kind: EnvelopeReaction, Ref: "answer", Text: strings.Repeat("x", MaxReactionLength+1)}.Encode()), "bob")
+	assert.False(t, peer.React("unknown", "👍", "me"))
+
+	messages := peer.GetMessages()
+	assert.Equal(t, "question", messages[1].ReplyTo)
+	assert.Equal(t, map[string]string{"bob": "🎉"}, messages[0].Reactions, "one reaction per author")
+	assert.Equal(t, map[string]string{"me": "👍"}, messages[1].Reactions)
+
+	// Snapshots do not share reactions with the conversation
+	messages[1].Reactions["me"] = "changed"
+	assert.True(t, peer.React("answer", "", "me"))
+	assert.Empty(t, peer.GetMessages()[1].Reactions)
+}
@@ -0,0 +1,155 @@
+package entity
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Member is a peer in a group, as every other member knows it
+type Member struct {
+	PeerID    string `json:"peer_id"`
+	PublicKey []byte `json:"public_key"`
+	Username  string `json:"username,omitempty"`
+	// Admin members may remove, ban and promote others
+	Admin bool `json:"admin,omitempty"`
+}
+
+// Group is a named chat room with its own member list and history
+type Group struct {
+	ID   string
+	Name string
+
+	// version counts membership changes
+	version      int
+	inviteOnly   bool
+	members      []Member
+	membersLock  sync.RWMutex
+	messages     []*Message
+	messagesLock sync.RWMutex
+	// messagesVersion counts changes to messages, guarded by messagesLock
+	messagesVersion uint64
+}
+
+func NewGroup(id, name string, version int, members []Member) *Group {
+	return &Group{ID: id, Name: name, version: version, members: slices.Clone(members)}
+}
+
+// Members returns a copy of the member list
+func (g *Group) Members() []Member {
+	g.membersLock.RLock()
+	defer g.membersLock.RUnlock()
+	return slices.Clone(g.members)
+}
+
+// SetMembers replaces the member list after a membership change
+func (g *Group) SetMembers(version int, members []Member) {
+	g.membersLock.Lock()
+	defer g.membersLock.Unlock()
+	g.version = version
+	g.members = slices.Clone(members)
+}
+
+// Version returns the membership version
+func (g *Group) Version() int {
+	g.membersLock.RLock()
+	defer g.membersLock.RUnlock()
+	return g.version
+}
+
+// InviteOnly reports whether only admins and their invitees may join
+func (g *Group) InviteOnly() bool {
+	g.membersLock.RLock()
+	defer g.membersLock.RUnlock()
+	return g.inviteOnly
+}
+
+func (g *Group) SetInviteOnly(inviteOnly bool) {
+	g.membersLock.Lock()
+	defer g.membersLock.Unlock()
+	g.inviteOnly = inviteOnly
+}
+
+// Member returns the member with peerID
+func (g *Group) Member(peerID string) (Member, bool) {
+	g.membersLock.RLock()
+	defer g.membersLock.RUnlock()
+	i := slices.IndexFunc(g.members, func(m Member) bool { return m.PeerID == peerID })
+	if i < 0 {
+		return Member{}, false
+	}
+	return g.members[i], true
+}
+
+// IsMember reports whether peerID belongs to the group
+func (g *Group) IsMember(peerID string) bool {
+	_, ok := g.Member(peerID)
+	return ok
+}
+
+func (g *Group) AddMessage(text, author string) {
+	g.messagesLock.Lock()
+	defer g.messagesLock.Unlock()
+	g.messages = append(g.messages, &Message{Time: time.Now(), Text: text, Author: author})
+	g.messagesVersion++
+}
+
+// AddOutgoing adds a message written by us, unless one with the same ID is
+// already part of the conversation
+func (g *Group) AddOutgoing(message Message) {
+	g.messagesLock.Lock()
+	defer g.messagesLock.Unlock()
+	if slices.ContainsFunc(g.messages, func(m *Message) bool { return m.ID == message.ID }) {
+		return
+	}
+	message.Outgoing = true
+	g.messages = append(g.messages, &message)
+	g.messagesVersion++
+}
+
+// SetMessageState updates the state of the outgoing message with id
+func (g *Group) SetMessageState(id string, state MessageState) {
+	g.messagesLock.Lock()
+	defer g.messagesLock.Unlock()
+	for _, message := range g.messages {
+		if message.ID == id {
+			message.State = state
+			g.messagesVersion++
+			return
+		}
+	}
+}
+
+// Restore puts back the messages kept from an earlier run. Messages that
+// were still being sent then never will be.
+func (g *Group) Restore(messages []Message) {
+	g.messagesLock.Lock()
+	defer g.messagesLock.Unlock()
+	for _, message := range messages {
+		if message.Outgoing && (message.State == MessageQueued || message.State == MessageSending) {
+			message.State = MessageExpired
+		}
+		g.messages = append(g.messages, &message)
+	}
+	g.messagesVersion++
+}
+
+// MessagesVersion changes whenever the conversation does, so that it is
+// saved only when needed
+func (g *Group) MessagesVersion() uint64 {
+	g.messagesLock.RLock()
+	defer g.messagesLock.RUnlock()
+	return g.messagesVersion
+}
+
+// GetMessages returns a snapshot of the conversation
+func (g *Group) GetMessages() []*Message {
+	g.messagesLock.RLock()
+	defer g.messagesLock.RUnlock()
+	messages := make([]*Message, len(g.messages))
+	for i, message := range g.messages {
+		snapshot := *message
+		messages[i] = &snapshot
+	}
+	return messages
+}
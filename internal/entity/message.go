@@ -1,9 +1,118 @@
 package entity
 
-import "time"
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// MessageState tracks an outgoing message until it reaches the peer
+type MessageState int
+
+const (
+	// MessageSent is also the state of every received message
+	MessageSent MessageState = iota
+	MessageSending
+	// MessageQueued waits in the outbox until the peer can be reached
+	MessageQueued
+	// MessageExpired stayed in the outbox too long and was dropped
+	MessageExpired
+)
+
+// String returns a human-readable name for the message state
+func (s MessageState) String() string {
+	switch s {
+	case MessageSent:
+		return "sent"
+	case MessageSending:
+		return "sending"
+	case MessageQueued:
+		return "queued"
+	case MessageExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
 
 type Message struct {
-	Time   time.Time
-	Text   string
-	Author string
+	// ID identifies the message on both ends; messages from peers that
+	// predate envelopes have none
+	ID string `json:"id,omitempty"`
+	// Time is when the message was written here or arrived
+	Time time.Time `json:"time"`
+	// SentAt is when the author wrote the message, by the author's clock
+	SentAt time.Time `json:"sent_at,omitzero"`
+	// Lamport orders the conversation causally: a message comes after
+	// every message its author had seen
+	Lamport uint64       `json:"lamport,omitempty"`
+	Text    string       `json:"text"`
+	Author  string       `json:"author"`
+	State   MessageState `json:"state"`
+	// Outgoing marks the messages we wrote
+	Outgoing bool `json:"outgoing,omitempty"`
+	// Read is set on outgoing messages once the peer reported reading them
+	Read bool `json:"read,omitempty"`
+	// Edited is set once the author changed the text
+	Edited bool `json:"edited,omitempty"`
+	// Deleted leaves a tombstone without text where the message was
+	Deleted bool `json:"deleted,omitempty"`
+	// ReplyTo is the ID of the message this one answers
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Reactions holds the emoji each author reacted with
+	Reactions map[string]string `json:"reactions,omitempty"`
+	// Skewed flags a SentAt that cannot be right, because the author's
+	// clock is off
+	Skewed bool `json:"skewed,omitempty"`
+}
+
+// Written returns when the author wrote the message, as far as we know
+func (m *Message) Written() time.Time {
+	if m.SentAt.IsZero() {
+		return m.Time
+	}
+	return m.SentAt
+}
+
+// maxClockSkew is how far an author's clock may seem off before the times
+// of its messages are flagged
+const maxClockSkew = 2 * time.Minute
+
+// maxClockJump is how far past our Lamport counter a peer's may be. A peer
+// only gets ahead by messages we have not seen yet, so a counter beyond it
+// is taken as missing rather than let it pin the message last or wrap ours.
+const maxClockJump = 1 << 20
+
+// compareMessages orders a conversation the same way on both ends: by
+// Lamport counter, then by the author's time and finally by ID
+func compareMessages(a, b *Message) int {
+	if a.Lamport != b.Lamport {
+		return cmp.Compare(a.Lamport, b.Lamport)
+	}
+	if c := a.Written().Compare(b.Written()); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+// MaxReactionLength bounds a reaction, which is meant to be one emoji
+const MaxReactionLength = 32
+
+// messageIDSize is the number of random bytes in a message ID
+const messageIDSize = 16
+
+// NewMessageID returns a random identifier for an outgoing message
+func NewMessageID() string {
+	id := make([]byte, messageIDSize)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// ValidMessageID reports whether id has the form of NewMessageID, so that
+// an ID from a peer is safe to use in a file name
+func ValidMessageID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == messageIDSize && hex.EncodeToString(b) == id
 }
@@ -0,0 +1,54 @@
+package entity
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeer_CausalOrder(t *testing.T) {
+	now := time.Now()
+	peer := &Peer{}
+	receive := func(id string, clock uint64, sentAt time.Time) {
+		peer.Receive([]byte(Envelope{Kind: EnvelopeText, ID: id, Text: id, Time: sentAt, Clock: clock}.Encode()), "bob")
+	}
+	peer.AddOutgoing(Message{ID: "question", Time: now, SentAt: now, Lamport: peer.Tick(), Text: "question"})
+	// Bob's clock is ten minutes behind, but he answered after reading
+	receive("answer", 2, now.Add(-10*time.Minute))
+	// Written at the same time as the question, before Bob saw it
+	receive("concurrent", 1, now.Add(-time.Second))
+	receive("future", 3, now.Add(time.Hour))
+	peer.Receive([]byte("bare"), "bob")
+	peer.AddOutgoing(Message{ID: "next", Time: now, SentAt: now, Lamport: peer.Tick(), Text: "next"})
+
+	var order []string
+	var skewed []string
+	for _, m := range peer.GetMessages() {
+		order = append(order, m.Text)
+		if m.Skewed {
+			skewed = append(skewed, m.Text)
+		}
+	}
+	assert.Equal(t, []string{"concurrent", "question", "answer", "future", "bare", "next"}, order)
+	assert.Equal(t, []string{"answer", "future"}, skewed)
+}
+
+func TestPeer_BoundsPeerClock(t *testing.T) {
+	peer := &Peer{}
+	peer.AddOutgoing(Message{ID: "question", Time: time.Now(), Lamport: peer.Tick(), Text: "question"})
+	peer.Receive([]byte(Envelope{Kind: EnvelopeText, ID: "huge", Text: "huge", Clock: math.MaxUint64}.Encode()), "bob")
+	peer.Receive([]byte(Envelope{Kind: EnvelopeText, ID: "answer", Text: "answer", Clock: 3}.Encode()), "bob")
+
+	// The counter is taken as missing rather than pinning the message last
+	// or making ours wrap around
+	next := peer.Tick()
+	assert.Less(t, next, uint64(maxClockJump))
+	peer.AddOutgoing(Message{ID: "next", Time: time.Now(), Lamport: next, Text: "next"})
+	var order []string
+	for _, m := range peer.GetMessages() {
+		order = append(order, m.Text)
+	}
+	assert.Equal(t, []string{"question", "huge", "answer", "next"}, order)
+}
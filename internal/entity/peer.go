@@ -3,18 +3,33 @@ package entity
 import (
 	"errors"
 	"fmt"
-	"log"
-	"net/url"
+	"io"
+	"maps"
+	"slices"
 	"sync"
 	"time"
 
 	"p2p-messenger/internal/crypto"
-
-	"github.com/gorilla/websocket"
+	"p2p-messenger/internal/logging"
+	"p2p-messenger/internal/transport"
 )
 
 var ErrPeerIsDeleted = errors.New("peer disconnected")
 
+// errConnectionLost marks a message that was not sent because the
+// connection broke, so it can be retried on another one
+var errConnectionLost = errors.New("connection lost")
+
+var logger = logging.For("peer")
+
+const (
+	// handshakeTimeout bounds how long the responder may take to answer the
+	// first handshake message
+	handshakeTimeout = 10 * time.Second
+	// closeTimeout bounds how long a retired connection may take to drain
+	closeTimeout = 5 * time.Second
+)
+
 // ConnectionType represents how a peer is connected
 type ConnectionType int
 
@@ -22,6 +37,8 @@ const (
 	ConnectionBLE ConnectionType = iota
 	ConnectionNAT
 	ConnectionInternet
+	// ConnectionRelay reaches the peer only through other peers
+	ConnectionRelay
 )
 
 // String returns a human-readable name for the connection type
@@ -33,6 +50,8 @@ func (ct ConnectionType) String() string {
 		return "NAT"
 	case ConnectionInternet:
 		return "Internet"
+	case ConnectionRelay:
+		return "Relay"
 	default:
 		return "Unknown"
 	}
@@ -50,29 +69,364 @@ type Peer struct {
 	ConnectionTypes       []ConnectionType
 	PrimaryConnectionType ConnectionType
 	Session               *crypto.Session
-	conn                  *websocket.Conn
+	conn                  transport.Conn
+	connAddr              Address // Address conn was dialed at
 	connLock              sync.Mutex
-	sendLock              sync.Mutex // Serializes encryption and writing to socket
-	pendingMessage        string     // Message waiting for handshake to complete
-	pendingMessageLock    sync.Mutex
+	addresses             []Address
+	route                 *Route
+	signal                transport.Signal // Guarded by addrLock, like route
+	addrLock              sync.RWMutex
+	sendLock              sync.Mutex    // Serializes encryption and writing to socket
+	readerDone            chan struct{} // Closed when the reader of conn exits
+	messagesLock          sync.RWMutex
+	typingUntil           time.Time // Guarded by messagesLock
+	version               uint64    // Counts changes to Messages, guarded by messagesLock
+	timer                 time.Duration
+	timerSetAt            time.Time // Guarded by messagesLock, like timer
+	clock                 uint64    // Lamport counter, guarded by messagesLock
+	syncUpTo              *string   // Pending sync request, guarded by messagesLock
 }
 
 func (p *Peer) AddMessage(text, author string) {
-	p.Messages = append(p.Messages, &Message{
-		Time:   time.Now(),
-		Text:   text,
-		Author: author,
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	p.clock++
+	p.insertLocked(&Message{
+		Time:    time.Now(),
+		Text:    text,
+		Author:  author,
+		Lamport: p.clock,
 	})
 }
 
-func (p *Peer) EstablishConnection(privateKey crypto.NoiseKeypair) error {
-	// Get preferred address based on primary connection type
-	// Note: BLE is only for discovery - actual transport uses websocket
-	ip, port, err := p.GetPreferredAddress()
-	if err != nil {
-		return err
+// Tick advances the Lamport counter for a message we write and returns it
+func (p *Peer) Tick() uint64 {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	p.clock++
+	return p.clock
+}
+
+// insertLocked adds message at its place in the conversation
+func (p *Peer) insertLocked(message *Message) {
+	i, _ := slices.BinarySearchFunc(p.Messages, message, compareMessages)
+	p.Messages = slices.Insert(p.Messages, i, message)
+	p.version++
+}
+
+// skewedLocked reports whether the author's time on message cannot be
+// right: it lies in our future, or well before a message it follows
+func (p *Peer) skewedLocked(message *Message) bool {
+	if message.SentAt.IsZero() {
+		return false
+	}
+	if message.SentAt.Sub(message.Time) > maxClockSkew {
+		return true
+	}
+	i, _ := slices.BinarySearchFunc(p.Messages, message, compareMessages)
+	if i == 0 || p.Messages[i-1].Skewed {
+		return false
+	}
+	return p.Messages[i-1].Written().Sub(message.SentAt) > maxClockSkew
+}
+
+// Receive applies an envelope the peer sent us on a chat session: a text
+// message from author joins the conversation, unless it was delivered
+// already, and controls update the typing and read state
+func (p *Peer) Receive(data []byte, author string) {
+	env := DecodeEnvelope(data)
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	switch env.Kind {
+	case EnvelopeText:
+		if env.ID != "" && slices.ContainsFunc(p.Messages, func(m *Message) bool { return m.ID == env.ID }) {
+			return
+		}
+		message := &Message{
+			ID:      env.ID,
+			Time:    time.Now(),
+			SentAt:  env.Time,
+			Lamport: env.Clock,
+			Text:    env.Text,
+			Author:  author,
+			ReplyTo: env.Ref,
+			Edited:  env.Edited,
+		}
+		// Without a counter a message follows everything we have seen
+		if message.Lamport == 0 || message.Lamport > p.clock+maxClockJump {
+			message.Lamport = p.clock + 1
+		}
+		p.clock = max(p.clock, message.Lamport)
+		message.Skewed = p.skewedLocked(message)
+		p.insertLocked(message)
+		p.typingUntil = time.Time{}
+	case EnvelopeTypingStart:
+		p.typingUntil = time.Now().Add(TypingTimeout)
+	case EnvelopeTypingStop:
+		p.typingUntil = time.Time{}
+	case EnvelopeRead:
+		p.markReadLocked(env.UpTo)
+	case EnvelopeEdit:
+		p.changeLocked(env.Ref, false, env.Text, false)
+	case EnvelopeDelete:
+		p.changeLocked(env.Ref, false, "", true)
+	case EnvelopeReaction:
+		p.reactLocked(env.Ref, env.Text, author)
+	case EnvelopeTimer:
+		// A change dated far in the future would beat every later one
+		at := env.Time
+		if limit := time.Now().Add(maxClockSkew); at.After(limit) {
+			at = limit
+		}
+		if d, err := time.ParseDuration(env.Text); err == nil && ValidTimer(d) {
+			p.setTimerLocked(d, at)
+		}
+	case EnvelopeSync:
+		p.syncUpTo = &env.UpTo
+	}
+}
+
+// TakeSyncRequest returns the watermark of the latest sync request from the
+// peer, if one came since the last call
+func (p *Peer) TakeSyncRequest() (string, bool) {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	if p.syncUpTo == nil {
+		return "", false
+	}
+	upTo := *p.syncUpTo
+	p.syncUpTo = nil
+	return upTo, true
+}
+
+// SentSince returns the latest limit messages we sent after the one with ID
+// upTo, or before it if the peer has none of ours or one we do not know.
+// Deleted messages are left out.
+func (p *Peer) SentSince(upTo string, limit int) []Message {
+	p.messagesLock.RLock()
+	defer p.messagesLock.RUnlock()
+	start := 0
+	if i := slices.IndexFunc(p.Messages, func(m *Message) bool { return m.Outgoing && m.ID == upTo }); upTo != "" && i >= 0 {
+		start = i + 1
+	}
+	var sent []Message
+	for _, message := range p.Messages[start:] {
+		if message.Outgoing && message.ID != "" && message.State == MessageSent && !message.Deleted {
+			sent = append(sent, *message)
+		}
+	}
+	return sent[max(len(sent)-limit, 0):]
+}
+
+// SetTimer makes messages disappear from the conversation once they are
+// older than d; 0 keeps them. Of two changes the later one wins, so both
+// ends agree whatever order the changes arrive in.
+func (p *Peer) SetTimer(d time.Duration, at time.Time) bool {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	return p.setTimerLocked(d, at)
+}
+
+func (p *Peer) setTimerLocked(d time.Duration, at time.Time) bool {
+	if !at.After(p.timerSetAt) {
+		return false
+	}
+	p.timer, p.timerSetAt = d, at
+	p.version++
+	return true
+}
+
+// Timer returns the disappearing messages timer and when it was set
+func (p *Peer) Timer() (time.Duration, time.Time) {
+	p.messagesLock.RLock()
+	defer p.messagesLock.RUnlock()
+	return p.timer, p.timerSetAt
+}
+
+// Expire removes the messages that outlived the timer at now
+func (p *Peer) Expire(now time.Time) {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	if p.timer == 0 {
+		return
+	}
+	kept := slices.DeleteFunc(p.Messages, func(m *Message) bool { return now.Sub(m.Time) > p.timer })
+	if len(kept) != len(p.Messages) {
+		p.Messages = kept
+		p.version++
+	}
+}
+
+// React sets our reaction to the message with ID id, to be followed by a
+// reaction envelope to the peer. An empty emoji takes it back.
+func (p *Peer) React(id, emoji, author string) bool {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	return p.reactLocked(id, emoji, author)
+}
+
+func (p *Peer) reactLocked(id, emoji, author string) bool {
+	i := slices.IndexFunc(p.Messages, func(m *Message) bool { return m.ID == id })
+	if id == "" || i < 0 || p.Messages[i].Deleted || len(emoji) > MaxReactionLength {
+		return false
+	}
+	message := p.Messages[i]
+	if emoji == "" {
+		delete(message.Reactions, author)
+	} else {
+		if message.Reactions == nil {
+			message.Reactions = make(map[string]string)
+		}
+		message.Reactions[author] = emoji
+	}
+	p.version++
+	return true
+}
+
+// Edit replaces the text of our message with ID id, to be followed by an
+// edit envelope to the peer
+func (p *Peer) Edit(id, text string) bool {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	return p.changeLocked(id, true, text, false)
+}
+
+// Delete leaves a tombstone in place of our message with ID id, to be
+// followed by a delete envelope to the peer
+func (p *Peer) Delete(id string) bool {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	return p.changeLocked(id, true, "", true)
+}
+
+// changeLocked edits or deletes the message with ID id. Only the author of a
+// message may change it, so outgoing says whose message it must be.
+// Deleted messages stay deleted.
+func (p *Peer) changeLocked(id string, outgoing bool, text string, deleted bool) bool {
+	i := slices.IndexFunc(p.Messages, func(m *Message) bool { return m.ID == id && m.Outgoing == outgoing })
+	if id == "" || i < 0 || p.Messages[i].Deleted {
+		return false
+	}
+	message := p.Messages[i]
+	if deleted {
+		message.Text, message.Deleted, message.Reactions = "", true, nil
+	} else {
+		message.Text, message.Edited = text, true
+	}
+	p.version++
+	return true
+}
+
+// Restore adds messages kept from an earlier run to the conversation,
+// skipping those it holds already, and catches up with their Lamport
+// counters
+func (p *Peer) Restore(messages []Message) {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	for _, message := range messages {
+		// Messages from peers that predate envelopes have no ID, and are
+		// told apart by what else they carry
+		if slices.ContainsFunc(p.Messages, func(m *Message) bool {
+			if message.ID == "" {
+				return m.ID == "" && m.Time.Equal(message.Time) && m.Author == message.Author && m.Text == message.Text
+			}
+			return m.ID == message.ID
+		}) {
+			continue
+		}
+		p.Messages = append(p.Messages, &message)
+		p.clock = max(p.clock, message.Lamport)
 	}
+	slices.SortStableFunc(p.Messages, compareMessages)
+	p.version++
+}
 
+// Version changes whenever the conversation does, so that it is saved only
+// when needed
+func (p *Peer) Version() uint64 {
+	p.messagesLock.RLock()
+	defer p.messagesLock.RUnlock()
+	return p.version
+}
+
+// markReadLocked marks our messages up to the one with ID upTo as read
+func (p *Peer) markReadLocked(upTo string) {
+	last := slices.IndexFunc(p.Messages, func(m *Message) bool { return m.Outgoing && m.ID == upTo })
+	if upTo == "" || last < 0 {
+		return
+	}
+	for _, message := range p.Messages[:last+1] {
+		if message.Outgoing && message.State == MessageSent && !message.Read {
+			message.Read = true
+			p.version++
+		}
+	}
+}
+
+// Typing reports whether the peer is writing to us
+func (p *Peer) Typing() bool {
+	p.messagesLock.RLock()
+	defer p.messagesLock.RUnlock()
+	return time.Now().Before(p.typingUntil)
+}
+
+// LastReceived returns the ID of the latest message the peer sent us that
+// has one
+func (p *Peer) LastReceived() string {
+	p.messagesLock.RLock()
+	defer p.messagesLock.RUnlock()
+	for _, message := range slices.Backward(p.Messages) {
+		if !message.Outgoing && message.ID != "" {
+			return message.ID
+		}
+	}
+	return ""
+}
+
+// AddOutgoing adds a message written by us, unless one with the same ID is
+// already part of the conversation
+func (p *Peer) AddOutgoing(message Message) {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	if slices.ContainsFunc(p.Messages, func(m *Message) bool { return m.ID == message.ID }) {
+		return
+	}
+	message.Outgoing = true
+	if message.Lamport == 0 {
+		message.Lamport = p.clock + 1
+	}
+	p.clock = max(p.clock, message.Lamport)
+	p.insertLocked(&message)
+}
+
+// SetMessageState updates the state of the outgoing message with id
+func (p *Peer) SetMessageState(id string, state MessageState) {
+	p.messagesLock.Lock()
+	defer p.messagesLock.Unlock()
+	for _, message := range p.Messages {
+		if message.ID == id {
+			message.State = state
+			p.version++
+			return
+		}
+	}
+}
+
+// GetMessages returns a snapshot of the conversation that is safe to read
+// while messages keep arriving and changing state
+func (p *Peer) GetMessages() []*Message {
+	p.messagesLock.RLock()
+	defer p.messagesLock.RUnlock()
+	messages := make([]*Message, len(p.Messages))
+	for i, message := range p.Messages {
+		snapshot := *message
+		snapshot.Reactions = maps.Clone(message.Reactions)
+		messages[i] = &snapshot
+	}
+	return messages
+}
+
+func (p *Peer) EstablishConnection(privateKey crypto.NoiseKeypair, opts ...crypto.SessionOption) error {
 	// Check if connection already exists (with lock)
 	p.connLock.Lock()
 	if p.conn != nil && p.Session != nil {
@@ -82,17 +436,9 @@ func (p *Peer) EstablishConnection(privateKey crypto.NoiseKeypair) error {
 	p.connLock.Unlock()
 
 	// Establish connection outside of lock to avoid deadlock
-	// All connection types (BLE discovery, NAT, Internet) use websocket transport
-	u := url.URL{Scheme: "ws", Host: fmt.Sprintf("%s:%s", ip, port), Path: "/chat"}
-	log.Printf("peer %s: establishing connection via %s to %s:%s", p.PeerID, p.PrimaryConnectionType.String(), ip, port)
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		return fmt.Errorf("failed to dial websocket: %w", err)
-	}
-	session, err := crypto.NewInitiatorSession(privateKey)
+	conn, session, addr, err := p.dial(privateKey, opts...)
 	if err != nil {
-		conn.Close()
-		return fmt.Errorf("failed to create initiator session: %w", err)
+		return err
 	}
 
 	// Lock again to set connection
@@ -107,25 +453,169 @@ func (p *Peer) EstablishConnection(privateKey crypto.NoiseKeypair) error {
 
 	p.Session = session
 	p.conn = conn
-	go p.readMessages()
+	p.connAddr = addr
+	p.readerDone = make(chan struct{})
+	go p.readMessages(conn, session, p.readerDone)
 	return nil
 }
 
-func (p *Peer) readMessages() {
-	for {
-		p.connLock.Lock()
-		conn := p.conn
-		session := p.Session
-		p.connLock.Unlock()
-		if conn == nil || session == nil {
-			break
+// dial tries the peer's addresses in policy order until one connects and
+// completes a Noise handshake
+func (p *Peer) dial(privateKey crypto.NoiseKeypair, opts ...crypto.SessionOption) (transport.Conn, *crypto.Session, Address, error) {
+	addresses := p.Addresses()
+	signal := p.webrtcSignal()
+	if len(addresses) == 0 && signal == nil {
+		// Note: BLE is only for discovery - actual transport needs an IP address
+		if p.PrimaryConnectionType == ConnectionBLE {
+			return nil, nil, Address{}, errors.New("BLE peer needs NAT/Internet address for connection")
 		}
-		_, msg, err := conn.ReadMessage()
+		return nil, nil, Address{}, errors.New("peer address not available")
+	}
+
+	var errs []error
+	for _, addr := range addresses {
+		start := time.Now()
+		conn, session, err := p.dialAddress(addr, privateKey, opts...)
 		if err != nil {
-			log.Printf("peer %s: read error: %v", p.PeerID, err)
+			logger.Info("connection attempt failed", "peer", p.PeerID, "addr", addr.HostPort(), "err", err)
+			p.recordFailure(addr)
+			errs = append(errs, err)
+			continue
+		}
+		p.recordConnected(addr, time.Since(start))
+		return conn, session, addr, nil
+	}
+	if signal != nil {
+		// ICE may get through a NAT that kept the dials above out
+		logger.Info("establishing connection", "peer", p.PeerID, "via", ConnectionRelay.String(), "transport", transport.WebRTC)
+		offer := crypto.Offer(opts...)
+		conn, selected, err := transport.DialWebRTC(signal, offer, handshakeTimeout)
+		if err == nil {
+			var session *crypto.Session
+			if session, err = p.handshake(conn, offer, selected, privateKey, opts...); err == nil {
+				return conn, session, Address{}, nil
+			}
+		}
+		logger.Info("webrtc connection attempt failed", "peer", p.PeerID, "err", err)
+		errs = append(errs, err)
+	}
+	return nil, nil, Address{}, errors.Join(errs...)
+}
+
+// webrtcSignal returns how to reach the peer for a WebRTC connection when
+// its listener cannot be dialled, or nil if WebRTC is not in use
+func (p *Peer) webrtcSignal() transport.Signal {
+	if transport.Preferred() != transport.WebRTC && transport.PreferredInternet() != transport.WebRTC {
+		return nil
+	}
+	p.addrLock.RLock()
+	defer p.addrLock.RUnlock()
+	if p.route == nil {
+		return nil
+	}
+	return p.signal
+}
+
+// dialAddress connects to addr with the transport preferred for its source
+// and completes a Noise handshake on the connection
+func (p *Peer) dialAddress(address Address, privateKey crypto.NoiseKeypair, opts ...crypto.SessionOption) (transport.Conn, *crypto.Session, error) {
+	kind := address.Transport()
+	addr := address.HostPort()
+	logger.Info("establishing connection", "peer", p.PeerID, "via", address.Source.String(), "transport", kind, "addr", addr)
+	offer := crypto.Offer(opts...)
+	conn, selected, err := transport.Dial(kind, addr, offer, handshakeTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial %s: %w", kind, err)
+	}
+	session, err := p.handshake(conn, offer, selected, privateKey, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, session, nil
+}
+
+// handshake completes a Noise handshake as initiator on a new connection,
+// closing it if that fails
+func (p *Peer) handshake(conn transport.Conn, offer, selected string, privateKey crypto.NoiseKeypair, opts ...crypto.SessionOption) (*crypto.Session, error) {
+	session, err := crypto.NewInitiatorSession(privateKey, slices.Concat(opts, []crypto.SessionOption{crypto.WithNegotiation(offer, selected)})...)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create initiator session: %w", err)
+	}
+	// Run the whole handshake before the connection is used, so chat
+	// messages never travel in handshake payloads
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	err = session.Handshake(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s failed: %w", p.PeerID, err)
+	}
+	// Addresses come from unauthenticated announcements, so whoever answers
+	// there has to prove it holds the peer's key
+	if len(p.PublicKey) > 0 {
+		if remote, err := session.GetRemotePublicKey(); err != nil || !slices.Equal(remote, p.PublicKey) {
+			conn.Close()
+			return nil, fmt.Errorf("connection to %s reached a different peer", p.PeerID)
+		}
+	}
+	logger.Debug("handshake completed", "peer", p.PeerID, "mode", session.Mode(), "rekey", session.Framed())
+	return session, nil
+}
+
+// renewSession replaces the current connection with a freshly handshaken one
+// once the session has reached its lifetime limit. The old connection is shut
+// down with CloseWrite; the listener only closes its side after reading
+// everything sent before, so no message in flight is lost and the order is
+// kept. Must be called with sendLock held.
+func (p *Peer) renewSession(privateKey crypto.NoiseKeypair, opts ...crypto.SessionOption) (transport.Conn, *crypto.Session, error) {
+	conn, session, addr, err := p.dial(privateKey, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.connLock.Lock()
+	oldConn, oldDone := p.conn, p.readerDone
+	p.conn, p.Session, p.connAddr = conn, session, addr
+	p.readerDone = make(chan struct{})
+	done := p.readerDone
+	p.connLock.Unlock()
+
+	if oldConn != nil {
+		if err := oldConn.CloseWrite(); err == nil {
+			select {
+			case <-oldDone:
+			case <-time.After(closeTimeout):
+				logger.Warn("old session was not closed in time", "peer", p.PeerID)
+			}
+		}
+		oldConn.Close()
+	}
+
+	go p.readMessages(conn, session, done)
+	logger.Info("session renewed", "peer", p.PeerID)
+	return conn, session, nil
+}
+
+// readMessages handles everything the peer sends on conn until it closes
+func (p *Peer) readMessages(conn transport.Conn, session *crypto.Session, done chan<- struct{}) {
+	defer close(done)
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			dropped := !errors.Is(err, io.EOF)
+			if dropped {
+				logger.Warn("read error", "peer", p.PeerID, "err", err)
+			} else {
+				logger.Debug("connection closed", "peer", p.PeerID)
+			}
+			conn.Close()
 			p.connLock.Lock()
 			if p.conn == conn {
-				conn.Close()
+				// The next connection fails over to another address
+				if dropped {
+					p.recordFailure(p.connAddr)
+				}
 				p.conn = nil
 				p.Session = nil
 			}
@@ -133,114 +623,46 @@ func (p *Peer) readMessages() {
 			break
 		}
 
-		log.Printf("peer %s: received message (len=%d), handshake complete before: %v", p.PeerID, len(msg), session.IsHandshakeComplete())
-
-		// Check if handshake was in progress before reading
-		wasHandshaking := !session.IsHandshakeComplete()
+		logger.Debug("received message", "peer", p.PeerID, "len", len(msg))
 
 		decrypted, err := session.ReadMessage(msg)
 		if err != nil {
-			log.Printf("peer %s: decrypt error: %v", p.PeerID, err)
+			logger.Warn("decrypt error", "peer", p.PeerID, "err", err)
 			continue
 		}
-
-		// Check if handshake just completed
-		isHandshakeComplete := session.IsHandshakeComplete()
-		if wasHandshaking && isHandshakeComplete {
-			log.Printf("peer %s: handshake just completed!", p.PeerID)
-		}
-
 		if len(decrypted) == 0 {
-			log.Printf("peer %s: empty decrypted message (handshake message), handshake complete: %v", p.PeerID, isHandshakeComplete)
-			// If handshake just completed, we might need to send message 3 with payload
-			// But the noise library should handle this automatically on the next WriteMessage call
-			// For now, just continue - the payload will be sent when user sends next message
-			// or we can check for pending message here
-			if wasHandshaking && isHandshakeComplete {
-				log.Printf("peer %s: handshake completed after receiving handshake message!", p.PeerID)
-				// Check if there's a pending message to send in message 3
-				p.pendingMessageLock.Lock()
-				pending := p.pendingMessage
-				if pending != "" {
-					p.pendingMessage = ""
-					p.pendingMessageLock.Unlock()
-					log.Printf("peer %s: sending pending message in message 3", p.PeerID)
-					// Send message 3 with the pending payload
-					go func() {
-						if err := p.sendMessageInternal(pending); err != nil {
-							log.Printf("peer %s: failed to send pending message: %v", p.PeerID, err)
-						}
-					}()
-				} else {
-					p.pendingMessageLock.Unlock()
-				}
-			}
 			continue
 		}
 
-		log.Printf("peer %s: decrypted message: %s", p.PeerID, string(decrypted))
+		logger.Debug("decrypted message", "peer", p.PeerID, "text", logging.Redact(string(decrypted)))
 
 		author := p.Username
 		if author == "" {
 			author = p.PeerID
 		}
-		p.AddMessage(string(decrypted), author)
+		p.Receive(decrypted, author)
 	}
 }
 
-// sendMessageInternal sends a message without establishing connection (assumes it exists)
-func (p *Peer) sendMessageInternal(message string) error {
-	p.connLock.Lock()
-	session := p.Session
-	conn := p.conn
-	p.connLock.Unlock()
-
-	if session == nil || conn == nil {
-		return fmt.Errorf("connection not established")
-	}
-
-	// CRITICAL: Lock sending to ensure atomicity
-	p.sendLock.Lock()
-	defer p.sendLock.Unlock()
-
-	encrypted, err := session.WriteMessage([]byte(message))
-	if err != nil {
-		return fmt.Errorf("failed to encrypt message: %w", err)
-	}
-
-	if len(encrypted) == 0 {
-		return fmt.Errorf("empty encrypted message")
-	}
-
-	// Verify connection is still same
-	p.connLock.Lock()
-	if p.conn != conn {
-		p.connLock.Unlock()
-		return fmt.Errorf("connection was closed")
+// SendMessage sends an encrypted message using Noise Protocol. opts are used
+// if a new session has to be established. If the connection turns out to be
+// broken, the message is sent once more on a new connection, which fails
+// over to the next address.
+func (p *Peer) SendMessage(message string, privateKey crypto.NoiseKeypair, opts ...crypto.SessionOption) error {
+	err := p.sendMessage(message, privateKey, opts...)
+	if errors.Is(err, errConnectionLost) {
+		logger.Info("connection lost, resending on a new connection", "peer", p.PeerID)
+		err = p.sendMessage(message, privateKey, opts...)
 	}
-	p.connLock.Unlock()
-
-	if err := conn.WriteMessage(websocket.BinaryMessage, encrypted); err != nil {
-		p.connLock.Lock()
-		if p.conn == conn {
-			conn.Close()
-			p.conn = nil
-			p.Session = nil
-		}
-		p.connLock.Unlock()
-		return fmt.Errorf("failed to send message: %w", err)
-	}
-
-	return nil
+	return err
 }
 
-// SendMessage sends an encrypted message using Noise Protocol
-func (p *Peer) SendMessage(message string, privateKey crypto.NoiseKeypair) error {
+func (p *Peer) sendMessage(message string, privateKey crypto.NoiseKeypair, opts ...crypto.SessionOption) error {
 	p.connLock.Lock()
 	if p.conn == nil || p.Session == nil {
 		p.connLock.Unlock()
-		if err := p.EstablishConnection(privateKey); err != nil {
-			log.Printf("peer %s: failed to establish connection: %v", p.PeerID, err)
+		if err := p.EstablishConnection(privateKey, opts...); err != nil {
+			logger.Warn("failed to establish connection", "peer", p.PeerID, "err", err)
 			return fmt.Errorf("failed to establish connection: %w", err)
 		}
 		p.connLock.Lock()
@@ -260,69 +682,53 @@ func (p *Peer) SendMessage(message string, privateKey crypto.NoiseKeypair) error
 	p.sendLock.Lock()
 	defer p.sendLock.Unlock()
 
-	// Check handshake state with lock to ensure we have latest state
+	// Replace sessions that reached their age or message limit before they
+	// are used again; if that fails the old session is still valid
+	if session.NeedsRehandshake() {
+		if renewedConn, renewedSession, err := p.renewSession(privateKey, opts...); err != nil {
+			logger.Warn("failed to renew session, keeping the current one", "peer", p.PeerID, "err", err)
+		} else {
+			conn, session = renewedConn, renewedSession
+		}
+	}
+
 	// Note: We don't need connLock here because sendLock serializes all sends
 	// and we have local references to session/conn.
 	// If connection closes relative to us, the WriteMessage below will fail.
-
-	handshakeComplete := session.IsHandshakeComplete()
-	log.Printf("peer %s: sending message (len=%d), handshake complete: %v", p.PeerID, len(message), handshakeComplete)
-
-	// WriteMessage handles handshake automatically:
-	// - During handshake: includes payload in handshake message (message 1 or 3)
-	// - After handshake: encrypts and returns the message
+	// EstablishConnection has completed the handshake, so this only encrypts.
+	logger.Debug("sending message", "peer", p.PeerID, "len", len(message))
 	encrypted, err := session.WriteMessage([]byte(message))
 	if err != nil {
-		log.Printf("peer %s: failed to encrypt message: %v", p.PeerID, err)
+		logger.Error("failed to encrypt message", "peer", p.PeerID, "err", err)
 		return fmt.Errorf("failed to encrypt message: %w", err)
 	}
 
-	// After WriteMessage, check if handshake completed (it might have just completed)
-	handshakeCompleteAfter := session.IsHandshakeComplete()
-	if !handshakeComplete && handshakeCompleteAfter {
-		log.Printf("peer %s: handshake completed during WriteMessage!", p.PeerID)
-	}
-
-	// WriteMessage should always return data (either handshake message or encrypted message)
-	// If it's empty, the payload is queued for message 3 (happens in Noise XX when payload
-	// can't fit in message 1)
-	if len(encrypted) == 0 {
-		log.Printf("peer %s: payload queued for message 3, storing for later", p.PeerID)
-		// Store message to send in message 3 after handshake completes
-		p.pendingMessageLock.Lock()
-		p.pendingMessage = message
-		p.pendingMessageLock.Unlock()
-		// Message will be sent in message 3 when handshake completes (handled in readMessages)
-		return nil
-	}
-
-	log.Printf("peer %s: sending encrypted/handshake message (len=%d), handshake complete: %v", p.PeerID, len(encrypted), session.IsHandshakeComplete())
-
 	// Verify connection is still same (just in case)
 	p.connLock.Lock()
 	if p.conn != conn {
 		p.connLock.Unlock()
-		return fmt.Errorf("connection was closed")
+		return fmt.Errorf("connection was closed: %w", errConnectionLost)
 	}
 	p.connLock.Unlock()
 
-	if err := conn.WriteMessage(websocket.BinaryMessage, encrypted); err != nil {
-		log.Printf("peer %s: failed to send websocket message: %v", p.PeerID, err)
+	if err := conn.WriteMessage(encrypted); err != nil {
+		logger.Warn("failed to send message", "peer", p.PeerID, "err", err)
 
 		// If send fails, force close connection to reset state
 		// This is important because we might have incremented nonce but failed to send
 		p.connLock.Lock()
 		if p.conn == conn { // Only close if it's still the same connection we used
 			conn.Close()
+			p.recordFailure(p.connAddr)
 			p.conn = nil
 			p.Session = nil
 		}
 		p.connLock.Unlock()
 
-		return fmt.Errorf("failed to send message: %w", err)
+		return fmt.Errorf("failed to send message: %w: %w", errConnectionLost, err)
 	}
 
-	log.Printf("peer %s: message sent successfully", p.PeerID)
+	logger.Debug("message sent", "peer", p.PeerID)
 	return nil
 }
 
@@ -350,31 +756,41 @@ func (p *Peer) AddConnectionType(ct ConnectionType) {
 	}
 }
 
-// GetPreferredAddress returns the address to use based on primary connection type
-// BLE is only for discovery - actual connections use websocket (NAT/Internet)
+// RemoveConnectionType drops ct and picks the best remaining type as primary
+func (p *Peer) RemoveConnectionType(ct ConnectionType) {
+	p.ConnectionTypes = slices.DeleteFunc(p.ConnectionTypes, func(existing ConnectionType) bool { return existing == ct })
+	if len(p.ConnectionTypes) > 0 {
+		p.PrimaryConnectionType = slices.Min(p.ConnectionTypes)
+	}
+}
+
+// GetPreferredAddress returns the address that is tried first
+// BLE is only for discovery - actual connections need a NAT/Internet address
 func (p *Peer) GetPreferredAddress() (ip, port string, err error) {
-	// If primary is BLE but we have NAT/Internet address, use that (BLE is discovery only)
-	// Otherwise use the primary connection type's address
-	switch p.PrimaryConnectionType {
-	case ConnectionBLE:
-		// BLE is discovery only - need AddrIP/Port for websocket connection
-		// If we have AddrIP/Port, use it (peer was also discovered via NAT/Internet)
-		if p.AddrIP != "" && p.Port != "" {
-			return p.AddrIP, p.Port, nil
-		}
-		return "", "", errors.New("BLE peer needs NAT/Internet address for connection")
-	case ConnectionNAT, ConnectionInternet:
-		// NAT and Internet both use websocket with AddrIP/Port
-		if p.AddrIP == "" || p.Port == "" {
-			return "", "", errors.New("peer address not available")
-		}
-		return p.AddrIP, p.Port, nil
-	default:
-		return "", "", errors.New("unknown connection type")
+	addresses := p.Addresses()
+	if len(addresses) == 0 {
+		return "", "", errors.New("peer address not available")
+	}
+	return addresses[0].IP, addresses[0].Port, nil
+}
+
+// CurrentSession returns the session used for sending, or nil
+func (p *Peer) CurrentSession() *crypto.Session {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	return p.Session
+}
+
+// SessionMode returns the handshake mode of the current session, or "" when
+// there is no connection
+func (p *Peer) SessionMode() crypto.Mode {
+	if session := p.CurrentSession(); session != nil {
+		return session.Mode()
 	}
+	return ""
 }
 
-// HasActiveConnection returns true if the peer has an active websocket connection
+// HasActiveConnection returns true if the peer has an active chat connection
 func (p *Peer) HasActiveConnection() bool {
 	p.connLock.Lock()
 	defer p.connLock.Unlock()
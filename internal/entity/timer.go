@@ -0,0 +1,69 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinTimer is the shortest disappearing messages timer, so that a peer
+// cannot make messages vanish before they are read
+const MinTimer = time.Minute
+
+var ErrInvalidTimer = errors.New("timer must be off or at least 1m, like 1h, 1d or 1w")
+
+// ParseTimer reads a disappearing messages timer: "off", a number of days
+// like "1d", of weeks like "1w", or a Go duration like "1h30m"
+func ParseTimer(s string) (time.Duration, error) {
+	if s == "off" || s == "0" {
+		return 0, nil
+	}
+	var d time.Duration
+	var err error
+	switch {
+	case strings.HasSuffix(s, "d"), strings.HasSuffix(s, "w"):
+		unit := 24 * time.Hour
+		if strings.HasSuffix(s, "w") {
+			unit *= 7
+		}
+		var n int
+		n, err = strconv.Atoi(s[:len(s)-1])
+		d = time.Duration(n) * unit
+	default:
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || !ValidTimer(d) {
+		return 0, ErrInvalidTimer
+	}
+	return d, nil
+}
+
+// ValidTimer reports whether d may be used as a timer; 0 turns it off
+func ValidTimer(d time.Duration) bool {
+	return d == 0 || d >= MinTimer
+}
+
+// FormatTimer shows a timer in the largest unit that fits it exactly
+func FormatTimer(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "off"
+	case d%(7*24*time.Hour) == 0:
+		return fmt.Sprintf("%dw", d/(7*24*time.Hour))
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Minute != 0:
+		return d.String()
+	}
+	hours, minutes := d/time.Hour, d%time.Hour/time.Minute
+	switch {
+	case hours == 0:
+		return fmt.Sprintf("%dm", minutes)
+	case minutes == 0:
+		return fmt.Sprintf("%dh", hours)
+	default:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	}
+}
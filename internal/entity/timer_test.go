@@ -0,0 +1,55 @@
+package entity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimer(t *testing.T) {
+	for input, want := range map[string]time.Duration{"off": 0, "1h": time.Hour, "1d": 24 * time.Hour, "2w": 14 * 24 * time.Hour, "90m": 90 * time.Minute} {
+		d, err := ParseTimer(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, want, d, input)
+	}
+	for _, input := range []string{"", "10s", "-1d", "soon", "d"} {
+		_, err := ParseTimer(input)
+		assert.ErrorIs(t, err, ErrInvalidTimer, input)
+	}
+	assert.Equal(t, "1w", FormatTimer(7*24*time.Hour))
+	assert.Equal(t, "1d", FormatTimer(24*time.Hour))
+	assert.Equal(t, "1h", FormatTimer(time.Hour))
+	assert.Equal(t, "1h30m", FormatTimer(90*time.Minute))
+}
+
+func TestPeer_TimerRemovesOldMessages(t *testing.T) {
+	now := time.Now()
+	peer := &Peer{}
+	peer.AddOutgoing(Message{ID: "old", Time: now.Add(-2 * time.Hour), Text: "old"})
+	peer.AddOutgoing(Message{ID: "new", Time: now.Add(-time.Minute), Text: "new"})
+	peer.Expire(now)
+	assert.Len(t, peer.GetMessages(), 2, "kept without a timer")
+
+	assert.True(t, peer.SetTimer(time.Hour, now))
+	// The peer set it earlier, so ours wins
+	peer.Receive([]byte(Envelope{Kind: EnvelopeTimer, Text: "24h0m0s", Time: now.Add(-time.Second)}.Encode()), "bob")
+	peer.Receive([]byte(Envelope{Kind: EnvelopeTimer, Text: "1s", Time: now.Add(time.Second)}.Encode()), "bob")
+	timer, _ := peer.Timer()
+	assert.Equal(t, time.Hour, timer)
+
+	peer.Expire(now)
+	messages := peer.GetMessages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "new", messages[0].Text)
+
+	peer.Receive([]byte(Envelope{Kind: EnvelopeTimer, Text: "0s", Time: now.Add(time.Second)}.Encode()), "bob")
+	timer, _ = peer.Timer()
+	assert.Zero(t, timer, "a later change wins")
+
+	// A peer dating its change years ahead does not lock the timer
+	peer.Receive([]byte(Envelope{Kind: EnvelopeTimer, Text: "1h0m0s", Time: now.AddDate(10, 0, 0)}.Encode()), "bob")
+	_, setAt := peer.Timer()
+	assert.WithinDuration(t, time.Now().Add(maxClockSkew), setAt, time.Second)
+	assert.True(t, peer.SetTimer(24*time.Hour, time.Now().Add(maxClockSkew+time.Second)))
+}
@@ -0,0 +1,289 @@
+package groups
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+)
+
+// Kind says what a membership event does
+type Kind string
+
+const (
+	KindCreate  Kind = "create"
+	KindAdd     Kind = "add"
+	KindJoin    Kind = "join"
+	KindRemove  Kind = "remove"
+	KindBan     Kind = "ban"
+	KindPromote Kind = "promote"
+)
+
+var (
+	ErrNotAllowed = errors.New("not allowed in this group")
+	ErrBadEvent   = errors.New("invalid group event")
+	ErrBadInvite  = errors.New("invalid or expired invite")
+)
+
+// event is a signed change of the membership of a group. Every member
+// keeps the chain of events since the group was created and checks each
+// one against the state before it, so all members agree on who may do what.
+type event struct {
+	Group   string    `json:"group"`
+	Version int       `json:"version"`
+	Kind    Kind      `json:"kind"`
+	Author  string    `json:"author"`
+	Time    time.Time `json:"time"`
+	// Name, InviteOnly and Members are set by the create event; Members
+	// starts with the creator
+	Name       string          `json:"name,omitempty"`
+	InviteOnly bool            `json:"invite_only,omitempty"`
+	Members    []entity.Member `json:"members,omitempty"`
+	// Target is the member an event is about; a join is about its author
+	Target *entity.Member `json:"target,omitempty"`
+	// Invite admits the author of a join
+	Invite    *Invite          `json:"invite,omitempty"`
+	Signature crypto.Signature `json:"signature"`
+}
+
+// Invite lets Invitee join a group once, until it expires. It is signed by
+// a member who may add members.
+type Invite struct {
+	ID        string           `json:"id"`
+	Group     string           `json:"group"`
+	Name      string           `json:"name"`
+	Issuer    string           `json:"issuer"`
+	Invitee   entity.Member    `json:"invitee"`
+	Expires   time.Time        `json:"expires"`
+	Signature crypto.Signature `json:"signature"`
+}
+
+// signed returns the bytes a signature covers: everything but the signature
+func signed[T any](v T, clear func(*T)) []byte {
+	clear(&v)
+	data, err := json.Marshal(v)
+	if err != nil {
+		// Events and invites hold only plain values
+		panic(fmt.Sprintf("groups: encoding signed value: %v", err))
+	}
+	return data
+}
+
+func (e event) signedBytes() []byte {
+	return signed(e, func(e *event) { e.Signature = crypto.Signature{} })
+}
+
+func (i Invite) signedBytes() []byte {
+	return signed(i, func(i *Invite) { i.Signature = crypto.Signature{} })
+}
+
+// hash identifies an event when two chains are compared
+func (e event) hash() string {
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return string(sum[:])
+}
+
+// signedBy reports whether sig over data was made by the peer with peerID
+func signedBy(sig crypto.Signature, data []byte, peerID string) bool {
+	static, err := sig.Signer(data)
+	return err == nil && crypto.PeerID(static) == peerID
+}
+
+// state is what a chain of events says about a group
+type state struct {
+	name        string
+	inviteOnly  bool
+	members     []entity.Member // In the order they joined
+	banned      map[string]bool
+	usedInvites map[string]bool
+}
+
+func (s state) clone() state {
+	s.members = slices.Clone(s.members)
+	s.banned = maps.Clone(s.banned)
+	s.usedInvites = maps.Clone(s.usedInvites)
+	return s
+}
+
+func (s state) index(peerID string) int {
+	return slices.IndexFunc(s.members, func(m entity.Member) bool { return m.PeerID == peerID })
+}
+
+func (s state) isMember(peerID string) bool {
+	return s.index(peerID) >= 0
+}
+
+func (s state) isAdmin(peerID string) bool {
+	i := s.index(peerID)
+	return i >= 0 && s.members[i].Admin
+}
+
+// mayAdd reports whether peerID may add members or issue invites
+func (s state) mayAdd(peerID string) bool {
+	return s.isAdmin(peerID) || (!s.inviteOnly && s.isMember(peerID))
+}
+
+// validMember checks that a member entry names the owner of its key
+func validMember(m entity.Member) bool {
+	return len(m.PublicKey) > 0 && crypto.PeerID(m.PublicKey) == m.PeerID
+}
+
+// replay checks a whole chain and returns the state it leads to
+func replay(groupID string, events []event) (state, error) {
+	var s state
+	for i, e := range events {
+		next, err := s.apply(groupID, i+1, e)
+		if err != nil {
+			return s, err
+		}
+		s = next
+	}
+	return s, nil
+}
+
+// apply checks that e is the event at version of group groupID, signed by
+// its author and allowed in state s, and returns the state after it
+func (s state) apply(groupID string, version int, e event) (state, error) {
+	if e.Group != groupID || e.Version != version || (version == 1) != (e.Kind == KindCreate) {
+		return s, fmt.Errorf("%w: %s at version %d", ErrBadEvent, e.Kind, e.Version)
+	}
+	if !signedBy(e.Signature, e.signedBytes(), e.Author) {
+		return s, fmt.Errorf("%w: %s is not signed by its author", ErrBadEvent, e.Kind)
+	}
+	if e.Kind != KindCreate && e.Kind != KindJoin && (e.Target == nil || e.Target.PeerID == "") {
+		return s, fmt.Errorf("%w: %s without target", ErrBadEvent, e.Kind)
+	}
+
+	next := s.clone()
+	switch e.Kind {
+	case KindCreate:
+		if len(e.Members) == 0 || e.Members[0].PeerID != e.Author || e.Name == "" {
+			return s, fmt.Errorf("%w: create", ErrBadEvent)
+		}
+		next = state{name: e.Name, inviteOnly: e.InviteOnly, banned: make(map[string]bool), usedInvites: make(map[string]bool)}
+		for i, member := range e.Members {
+			if !validMember(member) || next.isMember(member.PeerID) {
+				return s, fmt.Errorf("%w: create with bad member %s", ErrBadEvent, member.PeerID)
+			}
+			member.Admin = i == 0
+			next.members = append(next.members, member)
+		}
+
+	case KindAdd:
+		if !s.mayAdd(e.Author) {
+			return s, fmt.Errorf("%w: %s may not add members", ErrNotAllowed, e.Author)
+		}
+		if err := s.admissible(*e.Target); err != nil {
+			return s, err
+		}
+		target := *e.Target
+		target.Admin = false
+		next.members = append(next.members, target)
+
+	case KindJoin:
+		invite := e.Invite
+		if invite == nil || invite.Group != groupID || invite.Invitee.PeerID != e.Author || s.usedInvites[invite.ID] ||
+			e.Time.After(invite.Expires) || !signedBy(invite.Signature, invite.signedBytes(), invite.Issuer) {
+			return s, ErrBadInvite
+		}
+		if !s.mayAdd(invite.Issuer) {
+			return s, fmt.Errorf("%w: %s may not invite", ErrNotAllowed, invite.Issuer)
+		}
+		if err := s.admissible(invite.Invitee); err != nil {
+			return s, err
+		}
+		target := invite.Invitee
+		target.Admin = false
+		next.members = append(next.members, target)
+		next.usedInvites[invite.ID] = true
+
+	case KindRemove:
+		i := s.index(e.Target.PeerID)
+		if i < 0 {
+			return s, fmt.Errorf("%w: %s is not a member", ErrBadEvent, e.Target.PeerID)
+		}
+		if e.Author != e.Target.PeerID && !s.isAdmin(e.Author) {
+			return s, fmt.Errorf("%w: %s may not remove members", ErrNotAllowed, e.Author)
+		}
+		next.members = slices.Delete(next.members, i, i+1)
+		if err := next.hasAdmin(); err != nil {
+			return s, err
+		}
+
+	case KindBan:
+		if !s.isAdmin(e.Author) || e.Target.PeerID == e.Author {
+			return s, fmt.Errorf("%w: %s may not ban %s", ErrNotAllowed, e.Author, e.Target.PeerID)
+		}
+		next.banned[e.Target.PeerID] = true
+		if i := next.index(e.Target.PeerID); i >= 0 {
+			next.members = slices.Delete(next.members, i, i+1)
+		}
+		if err := next.hasAdmin(); err != nil {
+			return s, err
+		}
+
+	case KindPromote:
+		i := s.index(e.Target.PeerID)
+		if !s.isAdmin(e.Author) || i < 0 {
+			return s, fmt.Errorf("%w: %s may not promote %s", ErrNotAllowed, e.Author, e.Target.PeerID)
+		}
+		next.members[i].Admin = true
+
+	default:
+		return s, fmt.Errorf("%w: unknown kind %q", ErrBadEvent, e.Kind)
+	}
+	return next, nil
+}
+
+// rank orders events made at the same version: a ban or removal by an
+// admin comes before any other change
+func (s state) rank(e event) int {
+	if (e.Kind == KindBan || e.Kind == KindRemove) && s.isAdmin(e.Author) {
+		return 1
+	}
+	return 0
+}
+
+// prevails reports whether the branch of a chain that starts with first
+// and leads to tip wins over the one that starts with other and leads to
+// otherTip, both following state fork. A branch that takes out the author
+// of the other wins, so that a removed or banned member cannot undo that by
+// forking the chain from before it; then moderation by an admin wins over
+// concurrent changes, and the lower hash over the rest.
+func prevails(fork state, first event, tip state, other event, otherTip state) bool {
+	if out, otherOut := !tip.isMember(other.Author), !otherTip.isMember(first.Author); out != otherOut {
+		return out
+	}
+	if rank, otherRank := fork.rank(first), fork.rank(other); rank != otherRank {
+		return rank > otherRank
+	}
+	return first.hash() < other.hash()
+}
+
+// admissible checks that m may become a member
+func (s state) admissible(m entity.Member) error {
+	switch {
+	case !validMember(m):
+		return fmt.Errorf("%w: bad member %s", ErrBadEvent, m.PeerID)
+	case s.banned[m.PeerID]:
+		return fmt.Errorf("%w: %s is banned", ErrNotAllowed, m.PeerID)
+	case s.isMember(m.PeerID):
+		return fmt.Errorf("%w: %s is already a member", ErrBadEvent, m.PeerID)
+	}
+	return nil
+}
+
+// hasAdmin keeps the last admin from leaving others without one
+func (s state) hasAdmin() error {
+	if len(s.members) > 0 && !slices.ContainsFunc(s.members, func(m entity.Member) bool { return m.Admin }) {
+		return fmt.Errorf("%w: promote another admin first", ErrNotAllowed)
+	}
+	return nil
+}
@@ -0,0 +1,788 @@
+package groups
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
+	"p2p-messenger/internal/repository"
+)
+
+var logger = logging.For("groups")
+
+const (
+	// maxPending bounds the messages of a group kept while their sender key
+	// is on its way
+	maxPending = 64
+	// pendingLifetime is how long such a message waits for its key
+	pendingLifetime = time.Minute
+	// keyGrace is how long a member's replaced sender key still opens
+	// messages, which may arrive after the new key
+	keyGrace = time.Minute
+	// inviteLifetime is how long an invite can be accepted
+	inviteLifetime = 24 * time.Hour
+	// saveInterval is how often groups with new messages are written
+	saveInterval = time.Second
+	// maxClockSkew is how far a joiner's clock may be behind ours when an
+	// invite runs out
+	maxClockSkew = 2 * time.Minute
+)
+
+var (
+	ErrNotMember = errors.New("not a member of this group")
+	ErrNoKey     = errors.New("peer has not completed a handshake yet")
+)
+
+// Sender hands data to peer over a pairwise Noise session
+type Sender func(peer *entity.Peer, data []byte) error
+
+// message is the plaintext of a message on a group session
+type message struct {
+	Group string `json:"group"`
+	// Events is the sender's chain of membership events
+	Events []event `json:"events,omitempty"`
+	// Invite lets the recipient join; it comes with Events
+	Invite *Invite `json:"invite,omitempty"`
+	// Key is the sender's current sender key for the group
+	Key *crypto.SenderKey `json:"key,omitempty"`
+	// KeyRequest asks for the sender key of the recipient
+	KeyRequest bool        `json:"key_request,omitempty"`
+	Text       *sealedText `json:"text,omitempty"`
+}
+
+// sealedText is a chat message encrypted with the sender key KeyID
+type sealedText struct {
+	KeyID  string `json:"key_id"`
+	Sealed []byte `json:"sealed"`
+}
+
+type pendingText struct {
+	from     string
+	text     sealedText
+	received time.Time
+}
+
+// replacedKey is a member's sender key that opens messages until expires
+type replacedKey struct {
+	key     crypto.SenderKey
+	expires time.Time
+}
+
+// keyring holds our sender key for a group and those of the other members
+type keyring struct {
+	own      crypto.SenderKey
+	members  map[string]crypto.SenderKey
+	previous map[string]replacedKey
+	pending  []pendingText
+}
+
+func newKeyring(own crypto.SenderKey, members map[string]crypto.SenderKey) *keyring {
+	if members == nil {
+		members = make(map[string]crypto.SenderKey)
+	}
+	return &keyring{own: own, members: members, previous: make(map[string]replacedKey)}
+}
+
+// senderKey returns the key with ID id of member from: the current one, or
+// the one it replaced during keyGrace
+func (r *keyring) senderKey(from, id string, now time.Time) (crypto.SenderKey, bool) {
+	if key, ok := r.members[from]; ok && key.ID == id {
+		return key, true
+	}
+	if replaced, ok := r.previous[from]; ok && replaced.key.ID == id && now.Before(replaced.expires) {
+		return replaced.key, true
+	}
+	return crypto.SenderKey{}, false
+}
+
+// saved is a group as kept on disk
+type saved struct {
+	ID         string                      `json:"id"`
+	Events     []event                     `json:"events"`
+	Key        crypto.SenderKey            `json:"key"`
+	MemberKeys map[string]crypto.SenderKey `json:"member_keys,omitempty"`
+	Messages   []entity.Message            `json:"messages,omitempty"`
+}
+
+// invitation is an invite we received, with the chain it extends
+type invitation struct {
+	invite Invite
+	events []event
+}
+
+// Manager keeps the groups we belong to. Every member encrypts its messages
+// with its own sender key and sends the ciphertext to each other member.
+// Membership changes are signed events that every member checks; sender
+// keys and events travel over pairwise Noise sessions, and every change of
+// the member list makes each member replace its key.
+type Manager struct {
+	path   string
+	self   entity.Member
+	signer ed25519.PrivateKey
+	peers  *repository.PeerRepository
+	send   Sender
+
+	mu      sync.Mutex
+	groups  map[string]*entity.Group
+	events  map[string][]event // By group ID
+	states  map[string]state
+	keys    map[string]*keyring // By group ID; none once we left
+	invites map[string]invitation
+	// saved is the version of the messages of each group on disk
+	saved map[string]uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Open loads the groups kept at path, with their messages, and writes them
+// there shortly after they change until Close. self is our own member
+// entry and signer the identity key its static key derives from.
+func Open(path string, self entity.Member, signer ed25519.PrivateKey, peers *repository.PeerRepository, send Sender) (*Manager, error) {
+	m := &Manager{
+		path:    path,
+		self:    self,
+		signer:  signer,
+		peers:   peers,
+		send:    send,
+		groups:  make(map[string]*entity.Group),
+		events:  make(map[string][]event),
+		states:  make(map[string]state),
+		keys:    make(map[string]*keyring),
+		invites: make(map[string]invitation),
+		saved:   make(map[string]uint64),
+		done:    make(chan struct{}),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read groups: %w", err)
+	}
+	if err == nil {
+		var groups []saved
+		if err := json.Unmarshal(data, &groups); err != nil {
+			return nil, fmt.Errorf("groups %s: %w", path, err)
+		}
+		for _, s := range groups {
+			st, err := replay(s.ID, s.Events)
+			if err != nil || len(s.Events) == 0 {
+				logger.Warn("dropping group with a broken event chain", "group", s.ID, "err", err)
+				continue
+			}
+			m.setStateLocked(s.ID, s.Events, st)
+			m.groups[s.ID].Restore(s.Messages)
+			m.saved[s.ID] = m.groups[s.ID].MessagesVersion()
+			if st.isMember(self.PeerID) {
+				m.keys[s.ID] = newKeyring(s.Key, s.MemberKeys)
+			}
+		}
+	}
+	go m.run()
+	return m, nil
+}
+
+// Close writes the messages that are not saved yet and stops saving
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.flush()
+	})
+}
+
+func (m *Manager) run() {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.flush()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// flush saves the groups if any got messages since they were last saved
+func (m *Manager) flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, g := range m.groups {
+		if g.MessagesVersion() != m.saved[id] {
+			if err := m.saveLocked(); err != nil {
+				logger.Warn("failed to save groups", "err", err)
+			}
+			return
+		}
+	}
+}
+
+// Groups returns every group, ordered by name
+func (m *Manager) Groups() []*entity.Group {
+	m.mu.Lock()
+	groups := slices.Collect(maps.Values(m.groups))
+	m.mu.Unlock()
+	slices.SortFunc(groups, func(a, b *entity.Group) int {
+		return strings.Compare(strings.ToLower(a.Name)+a.ID, strings.ToLower(b.Name)+b.ID)
+	})
+	return groups
+}
+
+func (m *Manager) Get(id string) (*entity.Group, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[id]
+	return g, ok
+}
+
+// Joined reports whether we are still a member of g
+func (m *Manager) Joined(g *entity.Group) bool {
+	return g.IsMember(m.self.PeerID)
+}
+
+// Create starts a group named name with us as its admin and members. Only
+// admins may add members to an invite-only group.
+func (m *Manager) Create(name string, inviteOnly bool, members []*entity.Peer) (*entity.Group, error) {
+	list := []entity.Member{m.self}
+	for _, peer := range members {
+		member, err := memberOf(peer)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(list, func(m entity.Member) bool { return m.PeerID == member.PeerID }) {
+			list = append(list, member)
+		}
+	}
+	id := entity.NewMessageID()
+	if err := m.publish(id, event{Kind: KindCreate, Name: name, InviteOnly: inviteOnly, Members: list}); err != nil {
+		return nil, err
+	}
+	logger.Info("group created", "group", id, "members", len(list), "invite_only", inviteOnly)
+	g, _ := m.Get(id)
+	return g, nil
+}
+
+// Add makes peer a member of g
+func (m *Manager) Add(g *entity.Group, peer *entity.Peer) error {
+	member, err := memberOf(peer)
+	if err != nil {
+		return err
+	}
+	return m.publish(g.ID, event{Kind: KindAdd, Target: &member})
+}
+
+// Remove takes the member with peerID out of g; only admins may remove
+// others
+func (m *Manager) Remove(g *entity.Group, peerID string) error {
+	return m.publish(g.ID, event{Kind: KindRemove, Target: &entity.Member{PeerID: peerID}})
+}
+
+// Ban removes the peer with peerID from g for good
+func (m *Manager) Ban(g *entity.Group, peerID string) error {
+	return m.publish(g.ID, event{Kind: KindBan, Target: &entity.Member{PeerID: peerID}})
+}
+
+// Promote makes the member with peerID an admin of g
+func (m *Manager) Promote(g *entity.Group, peerID string) error {
+	return m.publish(g.ID, event{Kind: KindPromote, Target: &entity.Member{PeerID: peerID}})
+}
+
+// Leave takes us out of g; its history stays
+func (m *Manager) Leave(g *entity.Group) error {
+	return m.Remove(g, m.self.PeerID)
+}
+
+// Invite sends peer a signed invite to g that it can accept with Join
+func (m *Manager) Invite(g *entity.Group, peer *entity.Peer) error {
+	invitee, err := memberOf(peer)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	st := m.states[g.ID]
+	events := slices.Clone(m.events[g.ID])
+	m.mu.Unlock()
+	if !st.mayAdd(m.self.PeerID) {
+		return fmt.Errorf("%w: only admins may invite", ErrNotAllowed)
+	}
+	if err := st.admissible(invitee); err != nil {
+		return err
+	}
+	invite := Invite{
+		ID:      entity.NewMessageID(),
+		Group:   g.ID,
+		Name:    g.Name,
+		Issuer:  m.self.PeerID,
+		Invitee: invitee,
+		Expires: time.Now().Add(inviteLifetime),
+	}
+	invite.Signature = crypto.Sign(m.signer, invite.signedBytes())
+	go m.sendTo(invitee.PeerID, message{Group: g.ID, Events: events, Invite: &invite})
+	return nil
+}
+
+// Invites returns the invites we received and have not accepted yet
+func (m *Manager) Invites() []Invite {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var invites []Invite
+	for _, inv := range m.invites {
+		invites = append(invites, inv.invite)
+	}
+	slices.SortFunc(invites, func(a, b Invite) int { return strings.Compare(a.Name+a.ID, b.Name+b.ID) })
+	return invites
+}
+
+// Join accepts the invite to the group with groupID
+func (m *Manager) Join(groupID string) (*entity.Group, error) {
+	m.mu.Lock()
+	inv, ok := m.invites[groupID]
+	delete(m.invites, groupID)
+	if ok && len(m.events[groupID]) < len(inv.events) {
+		st, err := replay(groupID, inv.events)
+		if err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+		m.setStateLocked(groupID, inv.events, st)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrBadInvite
+	}
+	if err := m.publish(groupID, event{Kind: KindJoin, Invite: &inv.invite}); err != nil {
+		return nil, err
+	}
+	g, _ := m.Get(groupID)
+	return g, nil
+}
+
+func memberOf(peer *entity.Peer) (entity.Member, error) {
+	if len(peer.PublicKey) == 0 {
+		return entity.Member{}, fmt.Errorf("%w: %s", ErrNoKey, peer.PeerID)
+	}
+	return entity.Member{PeerID: peer.PeerID, PublicKey: peer.PublicKey, Username: peer.Username}, nil
+}
+
+// publish signs e as the next event of the group, applies it and sends the
+// chain to the old and new members
+func (m *Manager) publish(groupID string, e event) error {
+	m.mu.Lock()
+	events := m.events[groupID]
+	e.Group = groupID
+	e.Version = len(events) + 1
+	e.Author = m.self.PeerID
+	e.Time = time.Now()
+	e.Signature = crypto.Sign(m.signer, e.signedBytes())
+	st, err := m.states[groupID].apply(groupID, e.Version, e)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	before := m.states[groupID].members
+	events = append(slices.Clone(events), e)
+	m.setStateLocked(groupID, events, st)
+	key, err := m.afterChangeLocked(groupID, before)
+	m.mu.Unlock()
+	if err != nil {
+		logger.Warn("failed to save groups", "err", err)
+	}
+	m.announce(groupID, events, before, st.members, key)
+	return nil
+}
+
+// announce sends the chain to everyone who was or is a member, and our
+// new sender key to the current members
+func (m *Manager) announce(groupID string, events []event, before, after []entity.Member, key *crypto.SenderKey) {
+	notified := map[string]bool{m.self.PeerID: true}
+	for _, member := range slices.Concat(after, before) {
+		if notified[member.PeerID] {
+			continue
+		}
+		notified[member.PeerID] = true
+		msg := message{Group: groupID, Events: events}
+		if slices.ContainsFunc(after, func(m entity.Member) bool { return m.PeerID == member.PeerID }) {
+			msg.Key = key
+		}
+		go m.sendTo(member.PeerID, msg)
+	}
+}
+
+// setStateLocked records a checked chain and shows its state on the group
+func (m *Manager) setStateLocked(groupID string, events []event, st state) {
+	m.events[groupID] = events
+	m.states[groupID] = st
+	g, ok := m.groups[groupID]
+	if !ok {
+		g = entity.NewGroup(groupID, st.name, 0, nil)
+		m.groups[groupID] = g
+	}
+	g.SetInviteOnly(st.inviteOnly)
+	g.SetMembers(len(events), st.members)
+}
+
+// afterChangeLocked replaces our sender key if the member list changed
+// from before, and saves the groups. It returns the new key, if any.
+func (m *Manager) afterChangeLocked(groupID string, before []entity.Member) (*crypto.SenderKey, error) {
+	after := m.states[groupID].members
+	same := len(before) == len(after)
+	for _, member := range before {
+		same = same && slices.ContainsFunc(after, func(m entity.Member) bool { return m.PeerID == member.PeerID })
+	}
+	if same {
+		return nil, m.saveLocked()
+	}
+	return m.rotateLocked(m.groups[groupID])
+}
+
+// rotateLocked replaces our sender key for g and forgets the keys of
+// former members. It returns the new key, or nil once we left.
+func (m *Manager) rotateLocked(g *entity.Group) (*crypto.SenderKey, error) {
+	if !g.IsMember(m.self.PeerID) {
+		delete(m.keys, g.ID)
+		return nil, m.saveLocked()
+	}
+	ring, ok := m.keys[g.ID]
+	if !ok {
+		ring = newKeyring(crypto.SenderKey{}, nil)
+		m.keys[g.ID] = ring
+	}
+	key, err := crypto.NewSenderKey()
+	if err != nil {
+		return nil, err
+	}
+	ring.own = key
+	maps.DeleteFunc(ring.members, func(peerID string, _ crypto.SenderKey) bool { return !g.IsMember(peerID) })
+	maps.DeleteFunc(ring.previous, func(peerID string, _ replacedKey) bool { return !g.IsMember(peerID) })
+	return &key, m.saveLocked()
+}
+
+// Send encrypts text with our sender key for g and sends it to every other
+// member. Members that cannot be reached right now miss it.
+func (m *Manager) Send(g *entity.Group, text, author string) error {
+	m.mu.Lock()
+	ring, ok := m.keys[g.ID]
+	if !ok {
+		m.mu.Unlock()
+		return ErrNotMember
+	}
+	key := ring.own
+	m.mu.Unlock()
+
+	sealed, err := key.Seal(associatedData(g.ID, m.self.PeerID), []byte(text))
+	if err != nil {
+		return err
+	}
+	outgoing := entity.Message{ID: entity.NewMessageID(), Time: time.Now(), Text: text, Author: author, State: entity.MessageSending}
+	g.AddOutgoing(outgoing)
+	go m.fanOut(g, outgoing.ID, message{Group: g.ID, Text: &sealedText{KeyID: key.ID, Sealed: sealed}})
+	return nil
+}
+
+func (m *Manager) fanOut(g *entity.Group, id string, msg message) {
+	var wg sync.WaitGroup
+	for _, member := range g.Members() {
+		if member.PeerID == m.self.PeerID {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.sendTo(member.PeerID, msg)
+		}()
+	}
+	wg.Wait()
+	g.SetMessageState(id, entity.MessageSent)
+}
+
+func (m *Manager) sendTo(peerID string, msg message) {
+	peer, ok := m.peers.Get(peerID)
+	if !ok {
+		logger.Info("group member not discovered", "group", msg.Group, "peer", peerID)
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if err := m.send(peer, data); err != nil {
+		logger.Info("group member unreachable", "group", msg.Group, "peer", peerID, "err", err)
+	}
+}
+
+// associatedData binds a sealed message to its group and sender
+func associatedData(groupID, peerID string) []byte {
+	return []byte(groupID + "/" + peerID)
+}
+
+// Receive handles a group message from the peer with ID from, whose
+// identity the Noise handshake of the session proved
+func (m *Manager) Receive(from string, plaintext []byte) {
+	var msg message
+	if err := json.Unmarshal(plaintext, &msg); err != nil {
+		logger.Debug("bad group message", "peer", from, "err", err)
+		return
+	}
+	if msg.Invite != nil {
+		m.handleInvite(from, msg.Group, *msg.Invite, msg.Events)
+	} else if msg.Events != nil {
+		m.handleEvents(from, msg.Group, msg.Events)
+	}
+	if msg.Key != nil {
+		m.handleKey(from, msg.Group, *msg.Key)
+	}
+	if msg.KeyRequest {
+		m.handleKeyRequest(from, msg.Group)
+	}
+	if msg.Text != nil {
+		m.handleText(from, msg.Group, *msg.Text)
+	}
+}
+
+// handleEvents merges the chain of events a peer sent with ours. Where
+// the chains differ, prevails picks the same one for every member, so they
+// all end up with the same chain; a peer on the losing side is sent ours.
+func (m *Manager) handleEvents(from, groupID string, incoming []event) {
+	m.mu.Lock()
+	current := m.events[groupID]
+	i := 0
+	for i < len(current) && i < len(incoming) && current[i].hash() == incoming[i].hash() {
+		i++
+	}
+	if i == len(incoming) {
+		m.mu.Unlock()
+		if i < len(current) {
+			go m.sendTo(from, message{Group: groupID, Events: current})
+		}
+		return
+	}
+
+	fork, err := replay(groupID, current[:i])
+	if err != nil {
+		m.mu.Unlock()
+		return
+	}
+	st := fork
+	accepted := slices.Clone(current[:i])
+	for _, e := range incoming[i:] {
+		next, err := st.apply(groupID, len(accepted)+1, e)
+		// The time of a join is the joiner's, who could backdate it to use an
+		// expired invite, so a join sent by the joiner must come in time by
+		// our clock too. Members passing it on have checked it themselves.
+		if err == nil && e.Kind == KindJoin && e.Author == from && time.Now().After(e.Invite.Expires.Add(maxClockSkew)) {
+			err = ErrBadInvite
+		}
+		if err != nil {
+			logger.Info("rejected group event", "group", groupID, "kind", e.Kind, "author", e.Author, "err", err)
+			break
+		}
+		st = next
+		accepted = append(accepted, e)
+	}
+	_, known := m.groups[groupID]
+	if len(accepted) == i || (!known && !st.isMember(m.self.PeerID)) {
+		m.mu.Unlock()
+		return
+	}
+	if i < len(current) && !prevails(fork, incoming[i], st, current[i], m.states[groupID]) {
+		m.mu.Unlock()
+		go m.sendTo(from, message{Group: groupID, Events: current})
+		return
+	}
+	before := m.states[groupID].members
+	m.setStateLocked(groupID, accepted, st)
+	key, err := m.afterChangeLocked(groupID, before)
+	g := m.groups[groupID]
+	m.mu.Unlock()
+	if err != nil {
+		logger.Warn("failed to save groups", "err", err)
+	}
+
+	switch {
+	case !known:
+		logger.Info("joined group", "group", groupID, "via", from)
+	case !st.isMember(m.self.PeerID):
+		logger.Info("removed from group", "group", groupID, "via", from)
+		return
+	}
+	if key == nil {
+		return
+	}
+	for _, member := range g.Members() {
+		if member.PeerID != m.self.PeerID {
+			go m.sendTo(member.PeerID, message{Group: groupID, Key: key})
+		}
+	}
+}
+
+// handleInvite keeps an invite addressed to us until it is accepted
+func (m *Manager) handleInvite(from, groupID string, invite Invite, events []event) {
+	if invite.Group != groupID || invite.Issuer != from || invite.Invitee.PeerID != m.self.PeerID ||
+		time.Now().After(invite.Expires) || !signedBy(invite.Signature, invite.signedBytes(), invite.Issuer) {
+		logger.Debug("ignoring invalid invite", "group", groupID, "peer", from)
+		return
+	}
+	st, err := replay(groupID, events)
+	if err != nil || !st.mayAdd(invite.Issuer) {
+		logger.Debug("ignoring invite with a bad event chain", "group", groupID, "peer", from, "err", err)
+		return
+	}
+	invite.Name = st.name
+	m.mu.Lock()
+	m.invites[groupID] = invitation{invite: invite, events: events}
+	m.mu.Unlock()
+	logger.Info("invited to group", "group", groupID, "by", from)
+}
+
+// handleKey stores the sender key of a member and opens the messages that
+// were waiting for it
+func (m *Manager) handleKey(from, groupID string, key crypto.SenderKey) {
+	m.mu.Lock()
+	g, ring, ok := m.memberLocked(from, groupID)
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if old, ok := ring.members[from]; ok && old.ID != key.ID {
+		ring.previous[from] = replacedKey{key: old, expires: now.Add(keyGrace)}
+	}
+	ring.members[from] = key
+	type ready struct {
+		key  crypto.SenderKey
+		text sealedText
+	}
+	var opened []ready
+	ring.pending = slices.DeleteFunc(ring.pending, func(p pendingText) bool {
+		if p.from != from {
+			return false
+		}
+		key, ok := ring.senderKey(from, p.text.KeyID, now)
+		if ok {
+			opened = append(opened, ready{key, p.text})
+		}
+		return ok
+	})
+	err := m.saveLocked()
+	m.mu.Unlock()
+	if err != nil {
+		logger.Warn("failed to save groups", "err", err)
+	}
+	for _, r := range opened {
+		m.open(g, from, r.key, r.text)
+	}
+}
+
+func (m *Manager) handleKeyRequest(from, groupID string) {
+	m.mu.Lock()
+	_, ring, ok := m.memberLocked(from, groupID)
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	key := ring.own
+	m.mu.Unlock()
+	go m.sendTo(from, message{Group: groupID, Key: &key})
+}
+
+// handleText opens a message from a member, or keeps it and asks for the
+// sender key it was sealed with
+func (m *Manager) handleText(from, groupID string, text sealedText) {
+	m.mu.Lock()
+	g, ring, ok := m.memberLocked(from, groupID)
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	key, known := ring.senderKey(from, text.KeyID, now)
+	if !known {
+		// Messages sealed with a key we will never get, such as one older
+		// than the replaced key, wait no longer than pendingLifetime
+		ring.pending = slices.DeleteFunc(ring.pending, func(p pendingText) bool { return now.Sub(p.received) > pendingLifetime })
+		if len(ring.pending) >= maxPending {
+			ring.pending = ring.pending[1:]
+		}
+		ring.pending = append(ring.pending, pendingText{from: from, text: text, received: now})
+		m.mu.Unlock()
+		go m.sendTo(from, message{Group: groupID, KeyRequest: true})
+		return
+	}
+	m.mu.Unlock()
+	m.open(g, from, key, text)
+}
+
+// memberLocked returns the group and our keys for it if both we and the
+// peer from are members
+func (m *Manager) memberLocked(from, groupID string) (*entity.Group, *keyring, bool) {
+	g, ok := m.groups[groupID]
+	if !ok || !g.IsMember(from) {
+		return g, nil, false
+	}
+	ring, ok := m.keys[groupID]
+	return g, ring, ok
+}
+
+func (m *Manager) open(g *entity.Group, from string, key crypto.SenderKey, text sealedText) {
+	plaintext, err := key.Open(associatedData(g.ID, from), text.Sealed)
+	if err != nil {
+		logger.Debug("cannot open group message", "group", g.ID, "peer", from, "err", err)
+		return
+	}
+	author := from
+	if member, ok := g.Member(from); ok && member.Username != "" {
+		author = member.Username
+	}
+	if peer, ok := m.peers.Get(from); ok && peer.Username != "" {
+		author = peer.Username
+	}
+	g.AddMessage(string(plaintext), author)
+	logger.Debug("group message received", "group", g.ID, "peer", from, "text", logging.Redact(string(plaintext)))
+}
+
+// saveLocked writes the groups, their messages and sender keys with
+// owner-only permissions, replacing the previous file only once the new one
+// is complete
+func (m *Manager) saveLocked() error {
+	groups := make([]saved, 0, len(m.groups))
+	versions := make(map[string]uint64, len(m.groups))
+	for id, g := range m.groups {
+		s := saved{ID: id, Events: m.events[id]}
+		versions[id] = g.MessagesVersion()
+		for _, message := range g.GetMessages() {
+			s.Messages = append(s.Messages, *message)
+		}
+		if ring, ok := m.keys[id]; ok {
+			s.Key = ring.own
+			s.MemberKeys = ring.members
+		}
+		groups = append(groups, s)
+	}
+	slices.SortFunc(groups, func(a, b saved) int { return strings.Compare(a.ID, b.ID) })
+	data, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return err
+	}
+	m.saved = versions
+	return nil
+}
@@ -0,0 +1,482 @@
+package groups
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/repository"
+)
+
+// fakeNetwork delivers group messages between managers in memory
+type fakeNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*Manager
+	// drop, if set, decides which messages are lost
+	drop func(from, to string, data []byte) bool
+	// inflight counts messages being handled
+	inflight atomic.Int32
+}
+
+// settle waits until no message has been in flight for a while, so that
+// nothing writes to a node's directory once the test is over
+func (n *fakeNetwork) settle() {
+	for quiet := 0; quiet < 5; {
+		time.Sleep(10 * time.Millisecond)
+		if n.inflight.Load() == 0 {
+			quiet++
+		} else {
+			quiet = 0
+		}
+	}
+}
+
+type node struct {
+	*Manager
+	member entity.Member
+	signer ed25519.PrivateKey
+	peers  *repository.PeerRepository
+	dir    string
+}
+
+func (n *fakeNetwork) sender(from string) Sender {
+	return func(peer *entity.Peer, data []byte) error {
+		n.mu.Lock()
+		to, ok := n.nodes[peer.PeerID]
+		dropped := n.drop != nil && n.drop(from, peer.PeerID, data)
+		n.mu.Unlock()
+		if !ok || dropped {
+			return assert.AnError
+		}
+		n.inflight.Add(1)
+		defer n.inflight.Add(-1)
+		to.Receive(from, data)
+		return nil
+	}
+}
+
+func (n *fakeNetwork) join(t *testing.T, username string) *node {
+	t.Helper()
+	identity, err := crypto.NewIdentity()
+	require.NoError(t, err)
+	keypair := identity.Keypair()
+	member := entity.Member{PeerID: crypto.PeerID(keypair.Public), PublicKey: keypair.Public, Username: username}
+	nd := &node{member: member, signer: identity.SigningKey(), peers: repository.NewPeerRepositoryWithValidation(time.Hour, 1), dir: t.TempDir()}
+	t.Cleanup(n.settle)
+	n.open(t, nd)
+	return nd
+}
+
+func (n *fakeNetwork) open(t *testing.T, nd *node) {
+	t.Helper()
+	manager, err := Open(filepath.Join(nd.dir, "groups.json"), nd.member, nd.signer, nd.peers, n.sender(nd.member.PeerID))
+	require.NoError(t, err)
+	t.Cleanup(manager.Close)
+	nd.Manager = manager
+	n.mu.Lock()
+	n.nodes[nd.member.PeerID] = manager
+	n.mu.Unlock()
+}
+
+// knows makes other a discovered peer of n
+func (nd *node) knows(other *node) *entity.Peer {
+	nd.peers.Add(&entity.Peer{PeerID: other.member.PeerID, PublicKey: other.member.PublicKey, Username: other.member.Username})
+	peer, _ := nd.peers.Get(other.member.PeerID)
+	return peer
+}
+
+func texts(g *entity.Group) []string {
+	var texts []string
+	for _, message := range g.GetMessages() {
+		texts = append(texts, message.Author+": "+message.Text)
+	}
+	return texts
+}
+
+func (nd *node) eventuallyReads(t *testing.T, groupID string, want ...string) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		g, ok := nd.Get(groupID)
+		return ok && assert.ObjectsAreEqual(want, texts(g))
+	}, time.Second, 10*time.Millisecond, nd.member.Username)
+}
+
+func newNetwork(t *testing.T) (*fakeNetwork, *node, *node, *node) {
+	network := &fakeNetwork{nodes: make(map[string]*Manager)}
+	alice, bob, carol := network.join(t, "alice"), network.join(t, "bob"), network.join(t, "carol")
+	for _, a := range []*node{alice, bob, carol} {
+		for _, b := range []*node{alice, bob, carol} {
+			if a != b {
+				a.knows(b)
+			}
+		}
+	}
+	return network, alice, bob, carol
+}
+
+func TestGroups_MessagesReachEveryMember(t *testing.T) {
+	_, alice, bob, carol := newNetwork(t)
+	toBob, _ := alice.peers.Get(bob.member.PeerID)
+	toCarol, _ := alice.peers.Get(carol.member.PeerID)
+	g, err := alice.Create("team", false, []*entity.Peer{toBob, toCarol})
+	require.NoError(t, err)
+
+	for _, nd := range []*node{bob, carol} {
+		require.Eventually(t, func() bool {
+			joined, ok := nd.Get(g.ID)
+			return ok && joined.Name == "team" && len(joined.Members()) == 3
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	require.NoError(t, alice.Send(g, "hi all", "alice"))
+	bob.eventuallyReads(t, g.ID, "alice: hi all")
+	carol.eventuallyReads(t, g.ID, "alice: hi all")
+
+	fromBob, _ := bob.Get(g.ID)
+	require.NoError(t, bob.Send(fromBob, "hi alice", "bob"))
+	alice.eventuallyReads(t, g.ID, "alice: hi all", "bob: hi alice")
+	carol.eventuallyReads(t, g.ID, "alice: hi all", "bob: hi alice")
+}
+
+func TestGroups_RemovedMemberCannotReadOn(t *testing.T) {
+	network, alice, bob, carol := newNetwork(t)
+	toBob, _ := alice.peers.Get(bob.member.PeerID)
+	toCarol, _ := alice.peers.Get(carol.member.PeerID)
+	g, err := alice.Create("team", false, []*entity.Peer{toBob, toCarol})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		joined, ok := carol.Get(g.ID)
+		return ok && carol.Joined(joined)
+	}, time.Second, 10*time.Millisecond)
+	alice.mu.Lock()
+	before := alice.keys[g.ID].own
+	alice.mu.Unlock()
+
+	require.NoError(t, alice.Remove(g, carol.member.PeerID))
+	require.Eventually(t, func() bool {
+		joined, _ := carol.Get(g.ID)
+		return !carol.Joined(joined)
+	}, time.Second, 10*time.Millisecond)
+	alice.mu.Lock()
+	assert.NotEqual(t, before.ID, alice.keys[g.ID].own.ID, "the key is replaced")
+	alice.mu.Unlock()
+
+	// Even a copy of the ciphertext is useless to carol now
+	var captured []byte
+	network.mu.Lock()
+	network.drop = func(from, to string, data []byte) bool {
+		var msg message
+		if to == bob.member.PeerID && json.Unmarshal(data, &msg) == nil && msg.Text != nil {
+			captured = data
+		}
+		return false
+	}
+	network.mu.Unlock()
+	require.NoError(t, alice.Send(g, "without carol", "alice"))
+	bob.eventuallyReads(t, g.ID, "alice: without carol")
+	network.mu.Lock()
+	data := captured
+	network.mu.Unlock()
+	carol.Receive(alice.member.PeerID, data)
+	joined, _ := carol.Get(g.ID)
+	assert.Empty(t, joined.GetMessages())
+	var sent message
+	require.NoError(t, json.Unmarshal(data, &sent))
+	_, err = before.Open(associatedData(g.ID, alice.member.PeerID), sent.Text.Sealed)
+	assert.Error(t, err)
+}
+
+func TestGroups_RequestsMissingKeyAndSurvivesRestart(t *testing.T) {
+	network, alice, bob, _ := newNetwork(t)
+	toBob, _ := alice.peers.Get(bob.member.PeerID)
+	g, err := alice.Create("pair", false, []*entity.Peer{toBob})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, ok := bob.Get(g.ID)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	// As if alice's key never reached bob
+	bob.mu.Lock()
+	delete(bob.keys[g.ID].members, alice.member.PeerID)
+	bob.mu.Unlock()
+
+	require.NoError(t, alice.Send(g, "are you there", "alice"))
+	bob.eventuallyReads(t, g.ID, "alice: are you there")
+
+	atBob, _ := bob.Get(g.ID)
+	require.NoError(t, bob.Send(atBob, "yes", "bob"))
+	alice.eventuallyReads(t, g.ID, "alice: are you there", "bob: yes")
+	require.Eventually(t, func() bool {
+		return atBob.GetMessages()[1].State == entity.MessageSent
+	}, time.Second, 10*time.Millisecond)
+
+	// Membership, keys and messages come back from disk
+	bob.Close()
+	network.open(t, bob)
+	restored, ok := bob.Get(g.ID)
+	require.True(t, ok)
+	assert.Equal(t, "pair", restored.Name)
+	assert.True(t, bob.Joined(restored))
+	messages := restored.GetMessages()
+	require.Len(t, messages, 2)
+	assert.True(t, messages[1].Outgoing)
+	assert.Equal(t, entity.MessageSent, messages[1].State)
+	require.NoError(t, alice.Send(g, "still here", "alice"))
+	bob.eventuallyReads(t, g.ID, "alice: are you there", "bob: yes", "alice: still here")
+}
+
+func TestGroups_OpensMessagesSealedWithReplacedKey(t *testing.T) {
+	network, alice, bob, _ := newNetwork(t)
+	toBob, _ := alice.peers.Get(bob.member.PeerID)
+	g, err := alice.Create("pair", false, []*entity.Peer{toBob})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		bob.mu.Lock()
+		defer bob.mu.Unlock()
+		ring, ok := bob.keys[g.ID]
+		return ok && ring.members[alice.member.PeerID].ID != ""
+	}, time.Second, 10*time.Millisecond)
+	// Key requests from bob get lost
+	network.mu.Lock()
+	network.drop = func(from, to string, data []byte) bool { return from == bob.member.PeerID }
+	network.mu.Unlock()
+
+	from := alice.member.PeerID
+	seal := func(key crypto.SenderKey, text string) sealedText {
+		sealed, err := key.Seal(associatedData(g.ID, from), []byte(text))
+		require.NoError(t, err)
+		return sealedText{KeyID: key.ID, Sealed: sealed}
+	}
+	bob.mu.Lock()
+	old := bob.keys[g.ID].members[from]
+	bob.mu.Unlock()
+	rotated, err := crypto.NewSenderKey()
+	require.NoError(t, err)
+
+	bob.handleKey(from, g.ID, rotated)
+	bob.handleText(from, g.ID, seal(old, "sent before the rotation"))
+	bob.eventuallyReads(t, g.ID, "alice: sent before the rotation")
+
+	// Messages whose key never comes don't keep newer ones out
+	for range maxPending {
+		stale, err := crypto.NewSenderKey()
+		require.NoError(t, err)
+		bob.handleText(from, g.ID, seal(stale, "never opened"))
+	}
+	next, err := crypto.NewSenderKey()
+	require.NoError(t, err)
+	bob.handleText(from, g.ID, seal(next, "sent after the next rotation"))
+	bob.handleKey(from, g.ID, next)
+	bob.eventuallyReads(t, g.ID, "alice: sent before the rotation", "alice: sent after the next rotation")
+}
+
+// eventuallyMembers waits until nd sees exactly the members named, with
+// admins marked by a trailing "*"
+func (nd *node) eventuallyMembers(t *testing.T, groupID string, want ...string) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		g, ok := nd.Get(groupID)
+		if !ok {
+			return false
+		}
+		var names []string
+		for _, member := range g.Members() {
+			name := member.Username
+			if member.Admin {
+				name += "*"
+			}
+			names = append(names, name)
+		}
+		return assert.ObjectsAreEqual(want, names)
+	}, time.Second, 10*time.Millisecond, nd.member.Username)
+}
+
+func TestGroups_OnlyAdminsModerate(t *testing.T) {
+	_, alice, bob, carol := newNetwork(t)
+	toBob, _ := alice.peers.Get(bob.member.PeerID)
+	g, err := alice.Create("open", false, []*entity.Peer{toBob})
+	require.NoError(t, err)
+	bob.eventuallyMembers(t, g.ID, "alice*", "bob")
+
+	// Any member may add to an open group, but only admins remove
+	atBob, _ := bob.Get(g.ID)
+	toCarol, _ := bob.peers.Get(carol.member.PeerID)
+	require.NoError(t, bob.Add(atBob, toCarol))
+	carol.eventuallyMembers(t, g.ID, "alice*", "bob", "carol")
+	alice.eventuallyMembers(t, g.ID, "alice*", "bob", "carol")
+	assert.ErrorIs(t, bob.Remove(atBob, carol.member.PeerID), ErrNotAllowed)
+	assert.ErrorIs(t, alice.Leave(g), ErrNotAllowed, "the last admin stays")
+
+	require.NoError(t, alice.Promote(g, bob.member.PeerID))
+	bob.eventuallyMembers(t, g.ID, "alice*", "bob*", "carol")
+	require.NoError(t, bob.Ban(atBob, carol.member.PeerID))
+	alice.eventuallyMembers(t, g.ID, "alice*", "bob*")
+	require.Eventually(t, func() bool {
+		atCarol, _ := carol.Get(g.ID)
+		return !carol.Joined(atCarol)
+	}, time.Second, 10*time.Millisecond)
+
+	toCarol, _ = alice.peers.Get(carol.member.PeerID)
+	assert.ErrorIs(t, alice.Add(g, toCarol), ErrNotAllowed, "banned")
+}
+
+func TestGroups_InviteOnlyJoinsWithInvite(t *testing.T) {
+	_, alice, bob, carol := newNetwork(t)
+	toBob, _ := alice.peers.Get(bob.member.PeerID)
+	g, err := alice.Create("private", true, []*entity.Peer{toBob})
+	require.NoError(t, err)
+	bob.eventuallyMembers(t, g.ID, "alice*", "bob")
+	atBob, _ := bob.Get(g.ID)
+	assert.True(t, atBob.InviteOnly())
+
+	toCarol, _ := bob.peers.Get(carol.member.PeerID)
+	assert.ErrorIs(t, bob.Add(atBob, toCarol), ErrNotAllowed)
+	assert.ErrorIs(t, bob.Invite(atBob, toCarol), ErrNotAllowed)
+
+	toCarol, _ = alice.peers.Get(carol.member.PeerID)
+	require.NoError(t, alice.Invite(g, toCarol))
+	require.Eventually(t, func() bool { return len(carol.Invites()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "private", carol.Invites()[0].Name)
+	_, err = carol.Join(g.ID)
+	require.NoError(t, err)
+	for _, nd := range []*node{alice, bob, carol} {
+		nd.eventuallyMembers(t, g.ID, "alice*", "bob", "carol")
+	}
+
+	// An invite is good for one join
+	alice.mu.Lock()
+	events := slices.Clone(alice.events[g.ID])
+	st := alice.states[g.ID]
+	alice.mu.Unlock()
+	join := events[len(events)-1]
+	require.Equal(t, KindJoin, join.Kind)
+	require.NoError(t, alice.Remove(g, carol.member.PeerID))
+	alice.mu.Lock()
+	st = alice.states[g.ID]
+	version := len(alice.events[g.ID]) + 1
+	alice.mu.Unlock()
+	join.Version = version
+	join.Signature = crypto.Sign(carol.signer, join.signedBytes())
+	_, err = st.apply(g.ID, version, join)
+	assert.ErrorIs(t, err, ErrBadInvite)
+	bob.eventuallyMembers(t, g.ID, "alice*", "bob")
+}
+
+func TestGroups_RejectsForgedEvents(t *testing.T) {
+	_, alice, bob, carol := newNetwork(t)
+	toBob, _ := alice.peers.Get(bob.member.PeerID)
+	toCarol, _ := alice.peers.Get(carol.member.PeerID)
+	g, err := alice.Create("team", false, []*entity.Peer{toBob, toCarol})
+	require.NoError(t, err)
+	carol.eventuallyMembers(t, g.ID, "alice*", "bob", "carol")
+
+	bob.mu.Lock()
+	events := slices.Clone(bob.events[g.ID])
+	bob.mu.Unlock()
+	// bob claims alice removed carol, and then tries it himself
+	forged := event{Group: g.ID, Version: len(events) + 1, Kind: KindRemove, Author: alice.member.PeerID,
+		Time: time.Now(), Target: &entity.Member{PeerID: carol.member.PeerID}}
+	forged.Signature = crypto.Sign(bob.signer, forged.signedBytes())
+	own := forged
+	own.Author = bob.member.PeerID
+	own.Signature = crypto.Sign(bob.signer, own.signedBytes())
+
+	for _, e := range []event{forged, own} {
+		data, err := json.Marshal(message{Group: g.ID, Events: append(slices.Clone(events), e)})
+		require.NoError(t, err)
+		carol.Receive(bob.member.PeerID, data)
+	}
+	atCarol, _ := carol.Get(g.ID)
+	assert.True(t, carol.Joined(atCarol))
+	assert.Len(t, atCarol.Members(), 3)
+}
+
+func TestGroups_RemovedMemberCannotFork(t *testing.T) {
+	network, alice, bob, carol := newNetwork(t)
+	dave := network.join(t, "dave")
+	toBob, _ := alice.peers.Get(bob.member.PeerID)
+	toCarol, _ := alice.peers.Get(carol.member.PeerID)
+	g, err := alice.Create("open", false, []*entity.Peer{toBob, toCarol})
+	require.NoError(t, err)
+	require.NoError(t, alice.Promote(g, carol.member.PeerID))
+	require.NoError(t, alice.Remove(g, bob.member.PeerID))
+	carol.eventuallyMembers(t, g.ID, "alice*", "carol*")
+
+	carol.mu.Lock()
+	events := slices.Clone(carol.events[g.ID])
+	carol.mu.Unlock()
+	require.Len(t, events, 3)
+	// bob, no longer a member, adds dave at a version where he still was
+	// one, picking a time that gives his event the lower hash
+	for _, version := range []int{2, 3} {
+		forged := event{Group: g.ID, Version: version, Kind: KindAdd, Author: bob.member.PeerID, Target: &dave.member}
+		for at := time.Now(); ; at = at.Add(time.Millisecond) {
+			forged.Time = at
+			forged.Signature = crypto.Sign(bob.signer, forged.signedBytes())
+			if forged.hash() < events[version-1].hash() {
+				break
+			}
+		}
+		data, err := json.Marshal(message{Group: g.ID, Events: append(slices.Clone(events[:version-1]), forged)})
+		require.NoError(t, err)
+		carol.Receive(bob.member.PeerID, data)
+		carol.eventuallyMembers(t, g.ID, "alice*", "carol*")
+	}
+}
+
+func TestPrevails_ModerationWinsOverConcurrentChanges(t *testing.T) {
+	network, alice, bob, carol := newNetwork(t)
+	dave := network.join(t, "dave")
+	g, err := alice.Create("open", false, []*entity.Peer{alice.knows(bob), alice.knows(carol)})
+	require.NoError(t, err)
+	alice.mu.Lock()
+	fork := alice.states[g.ID]
+	alice.mu.Unlock()
+
+	sign := func(nd *node, e event) (event, state) {
+		e.Group, e.Version, e.Author, e.Time = g.ID, 2, nd.member.PeerID, time.Now()
+		e.Signature = crypto.Sign(nd.signer, e.signedBytes())
+		st, err := fork.apply(g.ID, 2, e)
+		require.NoError(t, err)
+		return e, st
+	}
+	// carol adds dave while alice bans bob: the ban wins either way round
+	ban, banned := sign(alice, event{Kind: KindBan, Target: &entity.Member{PeerID: bob.member.PeerID}})
+	add, added := sign(carol, event{Kind: KindAdd, Target: &dave.member})
+	assert.True(t, prevails(fork, ban, banned, add, added))
+	assert.False(t, prevails(fork, add, added, ban, banned))
+}
+
+func TestGroups_RejectsBackdatedJoin(t *testing.T) {
+	_, alice, bob, carol := newNetwork(t)
+	g, err := alice.Create("private", true, []*entity.Peer{alice.knows(bob)})
+	require.NoError(t, err)
+	bob.eventuallyMembers(t, g.ID, "alice*", "bob")
+
+	invite := Invite{ID: entity.NewMessageID(), Group: g.ID, Issuer: alice.member.PeerID, Invitee: carol.member,
+		Expires: time.Now().Add(-time.Hour)}
+	invite.Signature = crypto.Sign(alice.signer, invite.signedBytes())
+	// carol dates her join to before the invite ran out
+	join := event{Group: g.ID, Version: 2, Kind: KindJoin, Author: carol.member.PeerID,
+		Time: invite.Expires.Add(-time.Minute), Invite: &invite}
+	join.Signature = crypto.Sign(carol.signer, join.signedBytes())
+	bob.mu.Lock()
+	events := append(slices.Clone(bob.events[g.ID]), join)
+	bob.mu.Unlock()
+	data, err := json.Marshal(message{Group: g.ID, Events: events})
+	require.NoError(t, err)
+
+	bob.Receive(carol.member.PeerID, data)
+	atBob, _ := bob.Get(g.ID)
+	assert.Len(t, atBob.Members(), 2)
+}
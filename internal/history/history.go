@@ -0,0 +1,358 @@
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
+	"p2p-messenger/internal/repository"
+)
+
+var logger = logging.For("history")
+
+const (
+	// saveInterval is how often changed conversations are written
+	saveInterval = time.Second
+	// pruneInterval is how often the files of peers that are not around
+	// are rid of expired messages
+	pruneInterval = time.Minute
+)
+
+// conversation is the file kept for one peer
+type conversation struct {
+	PeerID   string           `json:"peer_id"`
+	Messages []entity.Message `json:"messages"`
+	// Timer is the disappearing messages timer, agreed on at TimerSetAt
+	Timer      time.Duration `json:"timer,omitempty"`
+	TimerSetAt time.Time     `json:"timer_set_at,omitzero"`
+}
+
+// Conversation is the stored history with one peer
+type Conversation struct {
+	PeerID   string
+	Messages []entity.Message
+}
+
+// Store keeps the conversation with every peer in a file of its own, so
+// that it survives restarts and the peer dropping out of discovery. A
+// conversation is restored the first time discovery reports its peer, and
+// written shortly after it changes. Messages that outlived the timer of
+// their conversation are removed from memory and disk. When a peer comes
+// back after a restart or a while away, the two sides send each other the
+// messages the other missed.
+type Store struct {
+	dir   string
+	peers *repository.PeerRepository
+	send  Sender
+
+	mu sync.Mutex
+	// restored holds the peers whose conversation was loaded; a peer that
+	// was dropped and discovered again is a new one
+	restored map[string]*entity.Peer
+	// saved is the version of each conversation on disk
+	saved map[string]uint64
+	// seen is when discovery last reported each peer, syncDue when a sync
+	// request should next be sent to it and requested when one last was
+	seen      map[string]time.Time
+	syncDue   map[string]time.Time
+	requested map[string]time.Time
+	// flushing serializes writing the files
+	flushing sync.Mutex
+	index    *index
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Open keeps the history in dir and restores it into peers as they are
+// discovered. Missed messages are exchanged through send; nil leaves it out.
+func Open(dir string, peers *repository.PeerRepository, send Sender) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create history dir: %w", err)
+	}
+	s := &Store{
+		dir:       dir,
+		peers:     peers,
+		send:      send,
+		restored:  make(map[string]*entity.Peer),
+		saved:     make(map[string]uint64),
+		seen:      make(map[string]time.Time),
+		syncDue:   make(map[string]time.Time),
+		requested: make(map[string]time.Time),
+		done:      make(chan struct{}),
+	}
+	s.index = openIndex(dir, s.read)
+	s.prune(time.Now())
+	peers.OnSeen(s.restore)
+	go s.run()
+	return s, nil
+}
+
+// Close writes what changed and stops saving
+func (s *Store) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.Flush()
+		s.saveIndex()
+	})
+}
+
+func (s *Store) run() {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(pruneInterval)
+	defer pruneTicker.Stop()
+	indexTicker := time.NewTicker(indexInterval)
+	defer indexTicker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.expire(time.Now())
+			s.sync(time.Now())
+			s.Flush()
+		case <-pruneTicker.C:
+			s.prune(time.Now())
+		case <-indexTicker.C:
+			s.saveIndex()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// path names the file of a peer's conversation. Peer IDs come from the
+// network, so they are hashed rather than used as file names.
+func (s *Store) path(peerID string) string {
+	sum := sha256.Sum256([]byte(peerID))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// restore loads the conversation with peer the first time it is seen
+func (s *Store) restore(peer *entity.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.markSeen(peer, time.Now())
+	if s.restored[peer.PeerID] == peer {
+		return
+	}
+	s.restored[peer.PeerID] = peer
+	delete(s.saved, peer.PeerID)
+	conv, err := s.load(peer.PeerID)
+	if err != nil {
+		// Keep the file for a closer look instead of overwriting it
+		logger.Warn("failed to load history", "peer", peer.PeerID, "err", err)
+		os.Rename(s.path(peer.PeerID), s.path(peer.PeerID)+".broken")
+		return
+	}
+	if !conv.TimerSetAt.IsZero() {
+		peer.SetTimer(conv.Timer, conv.TimerSetAt)
+	}
+	peer.Restore(conv.Messages)
+	peer.Expire(time.Now())
+}
+
+// expire drops the messages that outlived the timer of their conversation
+func (s *Store) expire(now time.Time) {
+	for _, peer := range s.peers.GetPeers() {
+		peer.Expire(now)
+	}
+}
+
+func (s *Store) load(peerID string) (conversation, error) {
+	conv, err := s.read(s.path(peerID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return conversation{}, nil
+	}
+	if err != nil {
+		return conversation{}, err
+	}
+	if conv.PeerID != peerID {
+		return conversation{}, fmt.Errorf("history of %s found in file of %s", conv.PeerID, peerID)
+	}
+	return conv, nil
+}
+
+// read loads the conversation in path, which must be the file of its peer
+func (s *Store) read(path string) (conversation, error) {
+	var conv conversation
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return conv, err
+	}
+	if err := json.Unmarshal(data, &conv); err != nil {
+		return conv, err
+	}
+	if path != s.path(conv.PeerID) {
+		return conv, fmt.Errorf("history of %s found in %s", conv.PeerID, filepath.Base(path))
+	}
+	return conv, nil
+}
+
+// prune removes expired messages from the files of conversations whose
+// peers are not around to expire them
+func (s *Store) prune(now time.Time) {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		conv, err := s.read(path)
+		if err != nil || conv.Timer == 0 {
+			continue
+		}
+		peer, ok := s.peers.Get(conv.PeerID)
+		s.mu.Lock()
+		restored := ok && s.restored[conv.PeerID] == peer
+		s.mu.Unlock()
+		kept := slices.DeleteFunc(slices.Clone(conv.Messages), func(m entity.Message) bool { return now.Sub(m.Time) > conv.Timer })
+		if restored || len(kept) == len(conv.Messages) {
+			continue
+		}
+		conv.Messages = kept
+		if err := s.write(path, conv); err != nil {
+			logger.Warn("failed to prune history", "peer", conv.PeerID, "err", err)
+		}
+	}
+}
+
+// Flush writes every restored conversation that changed since it was last
+// written
+func (s *Store) Flush() {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	for _, peer := range s.peers.GetPeers() {
+		s.mu.Lock()
+		restored := s.restored[peer.PeerID] == peer
+		saved := s.saved[peer.PeerID]
+		s.mu.Unlock()
+		// A conversation that was not restored would overwrite its file
+		version := peer.Version()
+		if !restored || version == saved {
+			continue
+		}
+		if err := s.save(peer); err != nil {
+			logger.Warn("failed to save history", "peer", peer.PeerID, "err", err)
+			continue
+		}
+		s.mu.Lock()
+		s.saved[peer.PeerID] = version
+		s.mu.Unlock()
+	}
+}
+
+// save writes the conversation with peer with owner-only permissions,
+// replacing the previous file only once the new one is complete
+func (s *Store) save(peer *entity.Peer) error {
+	conv := conversation{PeerID: peer.PeerID}
+	conv.Timer, conv.TimerSetAt = peer.Timer()
+	for _, message := range peer.GetMessages() {
+		conv.Messages = append(conv.Messages, *message)
+	}
+	return s.write(s.path(peer.PeerID), conv)
+}
+
+func (s *Store) write(path string, conv conversation) error {
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	s.index.put(conv.PeerID, conv.Messages, info.ModTime())
+	return nil
+}
+
+// Conversations returns every stored conversation, or the one with peerID
+// if it is not empty, after writing what changed
+func (s *Store) Conversations(peerID string) ([]Conversation, error) {
+	s.Flush()
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var convs []Conversation
+	for _, path := range paths {
+		if peerID != "" && path != s.path(peerID) {
+			continue
+		}
+		conv, err := s.read(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+		}
+		convs = append(convs, Conversation{PeerID: conv.PeerID, Messages: conv.Messages})
+	}
+	slices.SortFunc(convs, func(a, b Conversation) int { return strings.Compare(a.PeerID, b.PeerID) })
+	return convs, nil
+}
+
+// Import adds the messages of conv to the history with its peer, leaving
+// out those it has already, and returns how many were added
+func (s *Store) Import(conv Conversation) (int, error) {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A conversation in memory is written with the next flush; writing its
+	// file now would be undone by that
+	if peer, ok := s.peers.Get(conv.PeerID); ok && s.restored[conv.PeerID] == peer {
+		before := len(peer.GetMessages())
+		peer.Restore(conv.Messages)
+		return len(peer.GetMessages()) - before, nil
+	}
+	stored, err := s.load(conv.PeerID)
+	if err != nil {
+		return 0, err
+	}
+	// A peer puts the messages in order and drops those it has
+	merged := &entity.Peer{PeerID: conv.PeerID}
+	merged.Restore(stored.Messages)
+	merged.Restore(conv.Messages)
+	before := len(stored.Messages)
+	stored.PeerID, stored.Messages = conv.PeerID, nil
+	for _, message := range merged.GetMessages() {
+		stored.Messages = append(stored.Messages, *message)
+	}
+	if before == len(stored.Messages) {
+		return 0, nil
+	}
+	if err := s.write(s.path(conv.PeerID), stored); err != nil {
+		return 0, err
+	}
+	return len(stored.Messages) - before, nil
+}
+
+// Search returns the stored messages matching q, the latest first. What
+// changed in the last second may not be found yet.
+func (s *Store) Search(q Query) []Hit {
+	return s.index.search(q)
+}
+
+func (s *Store) saveIndex() {
+	if err := s.index.save(); err != nil {
+		logger.Warn("failed to save search index", "err", err)
+	}
+}
@@ -0,0 +1,257 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/repository"
+)
+
+func open(t *testing.T, dir string) (*Store, *repository.PeerRepository) {
+	t.Helper()
+	peers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+	s, err := Open(dir, peers, nil)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	return s, peers
+}
+
+func texts(peer *entity.Peer) []string {
+	var texts []string
+	for _, m := range peer.GetMessages() {
+		texts = append(texts, m.Text)
+	}
+	return texts
+}
+
+func TestStore_RestoresConversations(t *testing.T) {
+	dir := t.TempDir()
+	first, peers := open(t, dir)
+	peer := &entity.Peer{PeerID: "bob"}
+	peers.Add(peer)
+	peer.AddOutgoing(entity.Message{ID: "a", Time: time.Now(), Text: "hi bob", State: entity.MessageSent})
+	peer.Receive([]byte(entity.Envelope{Kind: entity.EnvelopeText, ID: "b", Text: "hi"}.Encode()), "bob")
+	require.True(t, peer.Edit("a", "hello bob"))
+	first.Close()
+
+	_, peers = open(t, dir)
+	restored := &entity.Peer{PeerID: "bob"}
+	peers.Add(restored)
+	assert.Equal(t, []string{"hello bob", "hi"}, texts(restored))
+	assert.True(t, restored.GetMessages()[0].Edited)
+	assert.True(t, restored.GetMessages()[0].Outgoing)
+
+	// A peer dropped by discovery comes back with its conversation
+	peers.Delete("bob")
+	again := &entity.Peer{PeerID: "bob"}
+	peers.Add(again)
+	assert.Equal(t, []string{"hello bob", "hi"}, texts(again))
+	peers.Add(&entity.Peer{PeerID: "bob"})
+	assert.Len(t, again.GetMessages(), 2, "restored once")
+}
+
+func TestStore_KeepsBrokenFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, peers := open(t, dir)
+	require.NoError(t, os.WriteFile(s.path("bob"), []byte("{"), 0600))
+
+	peer := &entity.Peer{PeerID: "bob"}
+	peers.Add(peer)
+	peer.AddMessage("new", "bob")
+	s.Flush()
+
+	broken, err := os.ReadFile(s.path("bob") + ".broken")
+	require.NoError(t, err)
+	assert.Equal(t, "{", string(broken))
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestStore_ExpiresMessagesOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	s, peers := open(t, dir)
+	now := time.Now()
+	for _, id := range []string{"bob", "carol"} {
+		peer := &entity.Peer{PeerID: id}
+		peers.Add(peer)
+		peer.AddOutgoing(entity.Message{ID: id + "-old", Time: now.Add(-2 * time.Hour), Text: "old"})
+		peer.AddOutgoing(entity.Message{ID: id + "-new", Time: now, Text: "new"})
+		peer.SetTimer(time.Hour, now)
+	}
+	s.Flush()
+	// Carol is not around while her messages expire
+	peers.Delete("carol")
+
+	bob, _ := peers.Get("bob")
+	s.expire(now)
+	s.Flush()
+	s.prune(now)
+	assert.Equal(t, []string{"new"}, texts(bob))
+
+	s.Close()
+	_, peers = open(t, dir)
+	for _, id := range []string{"bob", "carol"} {
+		restored := &entity.Peer{PeerID: id}
+		peers.Add(restored)
+		assert.Equal(t, []string{"new"}, texts(restored), id)
+		timer, _ := restored.Timer()
+		assert.Equal(t, time.Hour, timer, id)
+	}
+}
+
+func TestStore_SyncsMissedMessages(t *testing.T) {
+	// Alice and Bob each keep the other as a peer; what one sends the
+	// other's copy of it receives
+	var alice, bob *entity.Peer
+	deliver := func(to **entity.Peer, author string) Sender {
+		return func(_ *entity.Peer, env entity.Envelope) error {
+			(*to).Receive([]byte(env.Encode()), author)
+			return nil
+		}
+	}
+	alicePeers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+	bobPeers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+	aliceStore, err := Open(t.TempDir(), alicePeers, deliver(&alice, "alice"))
+	require.NoError(t, err)
+	t.Cleanup(aliceStore.Close)
+	bobStore, err := Open(t.TempDir(), bobPeers, deliver(&bob, "bob"))
+	require.NoError(t, err)
+	t.Cleanup(bobStore.Close)
+
+	// alice is Bob's view of Alice, bob is Alice's view of Bob
+	alice, bob = &entity.Peer{PeerID: "alice"}, &entity.Peer{PeerID: "bob"}
+	now := time.Now()
+	sent := func(id string, lamport uint64) entity.Message {
+		return entity.Message{ID: id, Text: id, Time: now, SentAt: now, Lamport: lamport, State: entity.MessageSent}
+	}
+	for i, id := range []string{"a1", "a2", "a3"} {
+		bob.AddOutgoing(sent(id, uint64(i*2+1)))
+	}
+	alice.Receive([]byte(entity.Envelope{Kind: entity.EnvelopeText, ID: "a1", Text: "a1", Time: now, Clock: 1}.Encode()), "alice")
+	alice.AddOutgoing(sent("b1", 2))
+	bobPeers.Add(alice)
+	alicePeers.Add(bob)
+
+	require.Eventually(t, func() bool {
+		aliceStore.sync(time.Now())
+		bobStore.sync(time.Now())
+		return len(alice.GetMessages()) == 4 && len(bob.GetMessages()) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"a1", "b1", "a2", "a3"}, texts(alice))
+	assert.Equal(t, []string{"a1", "b1", "a2", "a3"}, texts(bob))
+
+	// Only what was missing went over again
+	assert.Empty(t, bob.SentSince("a3", maxSyncMessages))
+	assert.Len(t, bob.SentSince("a1", maxSyncMessages), 2)
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery("Lunch, tomorrow? peer:ab12 from:alice after:2026-01-31 before:2026-02-01")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lunch", "tomorrow"}, q.Words)
+	assert.Equal(t, "ab12", q.Peer)
+	assert.Equal(t, "alice", q.Author)
+	assert.Equal(t, time.Date(2026, 1, 31, 0, 0, 0, 0, time.Local), q.Since)
+	assert.Equal(t, time.Date(2026, 2, 2, 0, 0, 0, 0, time.Local), q.Until)
+
+	_, err = ParseQuery("after:yesterday")
+	assert.Error(t, err)
+	q, err = ParseQuery("  ")
+	require.NoError(t, err)
+	assert.True(t, q.Empty())
+}
+
+func TestStore_SearchesAllConversations(t *testing.T) {
+	dir := t.TempDir()
+	s, peers := open(t, dir)
+	day := time.Date(2026, 3, 14, 12, 0, 0, 0, time.Local)
+	bob := &entity.Peer{PeerID: "bob"}
+	carol := &entity.Peer{PeerID: "carol"}
+	peers.Add(bob)
+	peers.Add(carol)
+	bob.AddOutgoing(entity.Message{ID: "1", Author: "me", Time: day, Text: "Lunch tomorrow?"})
+	bob.AddOutgoing(entity.Message{ID: "2", Author: "me", Time: day.AddDate(0, 0, 1), Text: "Running late for lunch"})
+	carol.AddOutgoing(entity.Message{ID: "3", Author: "me", Time: day, Text: "lunchbox forgotten"})
+	carol.AddOutgoing(entity.Message{ID: "4", Author: "me", Time: day, Text: "secret"})
+	require.True(t, carol.Delete("4"))
+	s.Flush()
+
+	ids := func(s *Store, input string) []string {
+		q, err := ParseQuery(input)
+		require.NoError(t, err)
+		var ids []string
+		for _, hit := range s.Search(q) {
+			ids = append(ids, hit.PeerID+"/"+hit.Message.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"bob/2"}, ids(s, "late"))
+	assert.ElementsMatch(t, []string{"bob/1", "bob/2", "carol/3"}, ids(s, "LUNCH"))
+	assert.Equal(t, []string{"bob/2", "bob/1"}, ids(s, "lunch peer:bob"))
+	assert.Equal(t, []string{"bob/1"}, ids(s, "lunch tomorrow"))
+	assert.Equal(t, []string{"bob/2"}, ids(s, "lunch after:2026-03-15"))
+	assert.ElementsMatch(t, []string{"bob/1", "carol/3"}, ids(s, "lunch before:2026-03-14"))
+	assert.Empty(t, ids(s, "lunch from:bob"))
+	assert.Empty(t, ids(s, "secret"), "deleted messages are not found")
+
+	// The index is kept on disk, so peers need not be around to be searched
+	s.Close()
+	reopened, _ := open(t, dir)
+	assert.ElementsMatch(t, []string{"bob/1", "bob/2", "carol/3"}, ids(reopened, "lunch"))
+	reopened.Close()
+
+	// And it is made again from the history when it is lost
+	require.NoError(t, os.WriteFile(filepath.Join(dir, indexName), []byte("{"), 0600))
+	rebuilt, _ := open(t, dir)
+	assert.ElementsMatch(t, []string{"bob/1", "bob/2", "carol/3"}, ids(rebuilt, "lunch"))
+}
+
+func TestStore_ImportsConversations(t *testing.T) {
+	dir := t.TempDir()
+	s, peers := open(t, dir)
+	now := time.Now()
+	bob := &entity.Peer{PeerID: "bob"}
+	peers.Add(bob)
+	bob.AddOutgoing(entity.Message{ID: "2", Author: "me", Time: now, Lamport: 2, Text: "second"})
+	s.Flush()
+	peers.Delete("bob")
+
+	// Into the file of a peer that is not around
+	imported := []entity.Message{
+		{ID: "1", Author: "bob", Time: now.Add(-time.Minute), Lamport: 1, Text: "first"},
+		{ID: "2", Author: "me", Time: now, Lamport: 2, Text: "second"},
+		{Author: "bob", Time: now.Add(-time.Hour), Text: "legacy"},
+	}
+	added, err := s.Import(Conversation{PeerID: "bob", Messages: imported})
+	require.NoError(t, err)
+	assert.Equal(t, 2, added)
+	added, err = s.Import(Conversation{PeerID: "bob", Messages: imported})
+	require.NoError(t, err)
+	assert.Zero(t, added, "importing again adds nothing")
+
+	convs, err := s.Conversations("bob")
+	require.NoError(t, err)
+	require.Len(t, convs, 1)
+	assert.Len(t, convs[0].Messages, 3)
+
+	// And into the conversation of one that is
+	again := &entity.Peer{PeerID: "bob"}
+	peers.Add(again)
+	assert.Equal(t, []string{"legacy", "first", "second"}, texts(again))
+	added, err = s.Import(Conversation{PeerID: "bob", Messages: []entity.Message{{ID: "3", Author: "bob", Time: now, Lamport: 3, Text: "third"}}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, added)
+	convs, err = s.Conversations("")
+	require.NoError(t, err)
+	require.Len(t, convs, 1)
+	assert.Len(t, convs[0].Messages, 4)
+	q, _ := ParseQuery("third")
+	assert.Len(t, s.Search(q), 1)
+}
@@ -0,0 +1,251 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"p2p-messenger/internal/entity"
+)
+
+const (
+	// indexName is the file of the search index in the history dir. It
+	// does not end in .json so that it is not taken for a conversation.
+	indexName = "search.index"
+	// indexInterval is how often a changed index is written
+	indexInterval = 10 * time.Second
+	// maxHits bounds the messages a search returns
+	maxHits = 200
+)
+
+// Query selects messages by the words in them, the peer of their
+// conversation, their author and when they were written. Zero fields match
+// every message.
+type Query struct {
+	// Words must all start a word of the message, in any case
+	Words []string
+	// Peer is a peer ID or the start of one
+	Peer   string
+	Author string
+	// Since and Until bound the time the message was written
+	Since, Until time.Time
+}
+
+// ParseQuery reads a search typed by the user: words to look for and the
+// filters peer:<id>, from:<author>, after:<date> and before:<date>, with
+// dates as 2006-01-02 in the local zone. before: takes the whole day.
+func ParseQuery(input string) (Query, error) {
+	var q Query
+	for _, field := range strings.Fields(input) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok || value == "" {
+			q.Words = append(q.Words, words(field)...)
+			continue
+		}
+		switch key {
+		case "peer":
+			q.Peer = value
+		case "from":
+			q.Author = value
+		case "after", "before":
+			day, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+			if err != nil {
+				return Query{}, fmt.Errorf("%s: want a date like 2006-01-02", key)
+			}
+			if key == "after" {
+				q.Since = day
+			} else {
+				q.Until = day.AddDate(0, 0, 1)
+			}
+		default:
+			q.Words = append(q.Words, words(field)...)
+		}
+	}
+	return q, nil
+}
+
+// Empty reports whether q would match every message
+func (q Query) Empty() bool {
+	return len(q.Words) == 0 && q.Peer == "" && q.Author == "" && q.Since.IsZero() && q.Until.IsZero()
+}
+
+func (q Query) matches(message entity.Message) bool {
+	written := message.Written()
+	return (q.Author == "" || strings.EqualFold(message.Author, q.Author)) &&
+		(q.Since.IsZero() || !written.Before(q.Since)) &&
+		(q.Until.IsZero() || written.Before(q.Until))
+}
+
+// Hit is a message found by a search
+type Hit struct {
+	PeerID  string
+	Message entity.Message
+}
+
+// words splits text into the lower-case words it is indexed by
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// indexed is the part of the index for one conversation
+type indexed struct {
+	// Modified is the time of the history file the entry was made from
+	Modified time.Time        `json:"modified"`
+	Messages []entity.Message `json:"messages"`
+	// Terms maps each word to the positions in Messages of the messages
+	// containing it
+	Terms map[string][]int `json:"terms"`
+}
+
+// index finds messages in all stored conversations, including those of
+// peers that are not around. It is made from the history files and kept
+// next to them, so that it does not have to be rebuilt on every start.
+type index struct {
+	path string
+
+	mu            sync.RWMutex
+	conversations map[string]*indexed
+	changed       bool
+}
+
+// openIndex loads the index kept in dir and brings it up to date with the
+// history files there. An index that cannot be read is rebuilt.
+func openIndex(dir string, read func(path string) (conversation, error)) *index {
+	idx := &index{path: filepath.Join(dir, indexName), conversations: make(map[string]*indexed)}
+	data, err := os.ReadFile(idx.path)
+	if err == nil {
+		err = json.Unmarshal(data, &idx.conversations)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn("failed to read search index, rebuilding it", "err", err)
+		idx.conversations = make(map[string]*indexed)
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	found := make(map[string]bool)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		conv, err := read(path)
+		if err != nil {
+			continue
+		}
+		found[conv.PeerID] = true
+		if entry, ok := idx.conversations[conv.PeerID]; ok && entry.Modified.Equal(info.ModTime()) {
+			continue
+		}
+		idx.put(conv.PeerID, conv.Messages, info.ModTime())
+	}
+	for peerID := range idx.conversations {
+		if !found[peerID] {
+			delete(idx.conversations, peerID)
+			idx.changed = true
+		}
+	}
+	return idx
+}
+
+// put replaces what is indexed of the conversation with peerID
+func (idx *index) put(peerID string, messages []entity.Message, modified time.Time) {
+	entry := &indexed{Modified: modified, Terms: make(map[string][]int)}
+	for _, message := range messages {
+		if message.Deleted {
+			continue
+		}
+		i := len(entry.Messages)
+		entry.Messages = append(entry.Messages, message)
+		for _, word := range words(message.Text) {
+			if positions := entry.Terms[word]; len(positions) == 0 || positions[len(positions)-1] != i {
+				entry.Terms[word] = append(positions, i)
+			}
+		}
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.conversations[peerID] = entry
+	idx.changed = true
+}
+
+// search returns the messages matching q, the latest first
+func (idx *index) search(q Query) []Hit {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var hits []Hit
+	for peerID, entry := range idx.conversations {
+		if !strings.HasPrefix(peerID, q.Peer) {
+			continue
+		}
+		for _, i := range entry.find(q.Words) {
+			if message := entry.Messages[i]; q.matches(message) {
+				hits = append(hits, Hit{PeerID: peerID, Message: message})
+			}
+		}
+	}
+	slices.SortFunc(hits, func(a, b Hit) int { return b.Message.Written().Compare(a.Message.Written()) })
+	return hits[:min(len(hits), maxHits)]
+}
+
+// find returns the positions of the messages that have a word starting with
+// each of words
+func (entry *indexed) find(words []string) []int {
+	if len(words) == 0 {
+		positions := make([]int, len(entry.Messages))
+		for i := range positions {
+			positions[i] = i
+		}
+		return positions
+	}
+	var found []int
+	for n, word := range words {
+		matched := make(map[int]bool)
+		for term, positions := range entry.Terms {
+			if strings.HasPrefix(term, word) {
+				for _, i := range positions {
+					matched[i] = true
+				}
+			}
+		}
+		if n > 0 {
+			found = slices.DeleteFunc(found, func(i int) bool { return !matched[i] })
+			continue
+		}
+		for i := range matched {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// save writes the index if it changed, with owner-only permissions like the
+// history it is made from
+func (idx *index) save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.changed {
+		return nil
+	}
+	data, err := json.Marshal(idx.conversations)
+	if err != nil {
+		return err
+	}
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, idx.path); err != nil {
+		return err
+	}
+	idx.changed = false
+	return nil
+}
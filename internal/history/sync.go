@@ -0,0 +1,96 @@
+package history
+
+import (
+	"time"
+
+	"p2p-messenger/internal/entity"
+)
+
+const (
+	// syncGap is how long a peer goes unseen before its conversation is
+	// compared again when it is back
+	syncGap = 30 * time.Second
+	// maxSyncMessages bounds the messages sent in answer to one request
+	maxSyncMessages = 500
+)
+
+// syncRetry is how long a sync request that could not be sent waits for the
+// next try
+var syncRetry = 10 * time.Second
+
+// Sender hands an envelope to peer on its chat session
+type Sender func(peer *entity.Peer, env entity.Envelope) error
+
+// markSeen notes that discovery reported peer, and schedules comparing the
+// conversation with it if it is new or was away. Called with s.mu held.
+func (s *Store) markSeen(peer *entity.Peer, now time.Time) {
+	last, ok := s.seen[peer.PeerID]
+	s.seen[peer.PeerID] = now
+	if !ok || now.Sub(last) > syncGap || s.restored[peer.PeerID] != peer {
+		s.syncDue[peer.PeerID] = now
+	}
+}
+
+// sync answers the sync requests of peers and sends the ones that are due.
+// Either side asks for the messages written by the other after the last one
+// it has; since a peer's messages reach us in order, that watermark is all
+// it takes to find what went missing.
+func (s *Store) sync(now time.Time) {
+	if s.send == nil {
+		return
+	}
+	for _, peer := range s.peers.GetPeers() {
+		s.mu.Lock()
+		if upTo, ok := peer.TakeSyncRequest(); ok {
+			go s.answer(peer, upTo)
+			// What the peer missed of ours we may have missed of its
+			if _, due := s.syncDue[peer.PeerID]; !due && now.Sub(s.requested[peer.PeerID]) > syncGap {
+				s.syncDue[peer.PeerID] = now
+			}
+		}
+		due, ok := s.syncDue[peer.PeerID]
+		// Before its history is restored we would ask for all of it
+		if ok && !now.Before(due) && s.restored[peer.PeerID] == peer {
+			s.syncDue[peer.PeerID] = now.Add(syncRetry)
+			go s.request(peer)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// request asks peer for its messages after the last one we have
+func (s *Store) request(peer *entity.Peer) {
+	env := entity.Envelope{Kind: entity.EnvelopeSync, UpTo: peer.LastReceived()}
+	if err := s.send(peer, env); err != nil {
+		logger.Debug("failed to request sync", "peer", peer.PeerID, "err", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.syncDue, peer.PeerID)
+	s.requested[peer.PeerID] = time.Now()
+}
+
+// answer sends peer again the messages it lacks: those we sent after upTo.
+// The peer drops the ones it has and puts the rest in order.
+func (s *Store) answer(peer *entity.Peer, upTo string) {
+	sent := peer.SentSince(upTo, maxSyncMessages)
+	if len(sent) > 0 {
+		logger.Info("sending missed messages", "peer", peer.PeerID, "count", len(sent))
+	}
+	for _, message := range sent {
+		env := entity.Envelope{
+			Kind:   entity.EnvelopeText,
+			ID:     message.ID,
+			Text:   message.Text,
+			Ref:    message.ReplyTo,
+			Time:   message.Written(),
+			Clock:  message.Lamport,
+			Edited: message.Edited,
+		}
+		if err := s.send(peer, env); err != nil {
+			logger.Debug("failed to send missed message", "peer", peer.PeerID, "err", err)
+			return
+		}
+	}
+}
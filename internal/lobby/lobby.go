@@ -0,0 +1,134 @@
+package lobby
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
+	"p2p-messenger/internal/repository"
+)
+
+var logger = logging.For("lobby")
+
+const (
+	// ID names the lobby in the sidebar
+	ID = "lobby"
+	// seenLifetime is how long message IDs are remembered to drop repeats
+	seenLifetime = 10 * time.Minute
+	// maxTextLength keeps one chatty node from flooding every screen
+	maxTextLength = 4096
+)
+
+// Sender hands data to peer over a pairwise Noise session
+type Sender func(peer *entity.Peer, data []byte) error
+
+// message is the plaintext of a message on a lobby session
+type message struct {
+	ID       string    `json:"id"`
+	Text     string    `json:"text"`
+	Username string    `json:"username,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Lobby is the public room every node on the LAN joins. Its author sends
+// each message straight to every discovered peer over a Noise session, so
+// the author's static key authenticates it to each recipient; nobody
+// forwards messages they did not write.
+type Lobby struct {
+	peers *repository.PeerRepository
+	send  Sender
+	room  *entity.Group
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func New(peers *repository.PeerRepository, send Sender) *Lobby {
+	return &Lobby{
+		peers: peers,
+		send:  send,
+		room:  entity.NewGroup(ID, ID, 0, nil),
+		seen:  make(map[string]time.Time),
+	}
+}
+
+// Room holds the lobby history
+func (l *Lobby) Room() *entity.Group {
+	return l.room
+}
+
+// Send adds a message from author to the lobby and sends it to every peer
+// we can reach
+func (l *Lobby) Send(text, author string) {
+	msg := message{ID: entity.NewMessageID(), Text: text, Username: author, Time: time.Now()}
+	l.firstSeen(msg.ID, msg.Time)
+	l.room.AddOutgoing(entity.Message{ID: msg.ID, Time: msg.Time, Text: text, Author: author, State: entity.MessageSending})
+	go l.fanOut(msg)
+}
+
+func (l *Lobby) fanOut(msg message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range l.peers.GetPeers() {
+		if len(peer.PublicKey) == 0 || len(peer.Addresses()) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.send(peer, data); err != nil {
+				logger.Debug("peer missed lobby message", "peer", peer.PeerID, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+	l.room.SetMessageState(msg.ID, entity.MessageSent)
+}
+
+// Receive handles a lobby message from the peer with ID from, whose
+// identity the Noise handshake of the session proved
+func (l *Lobby) Receive(from string, plaintext []byte) {
+	var msg message
+	if err := json.Unmarshal(plaintext, &msg); err != nil || msg.ID == "" || msg.Text == "" {
+		logger.Debug("bad lobby message", "peer", from, "err", err)
+		return
+	}
+	if len(msg.Text) > maxTextLength {
+		logger.Debug("dropping oversized lobby message", "peer", from, "size", len(msg.Text))
+		return
+	}
+	if !l.firstSeen(from+"/"+msg.ID, time.Now()) {
+		return
+	}
+	// A known username beats the one the sender claims
+	author := msg.Username
+	if peer, ok := l.peers.Get(from); ok && peer.Username != "" {
+		author = peer.Username
+	}
+	if author == "" {
+		author = from
+	}
+	l.room.AddMessage(msg.Text, author)
+	logger.Debug("lobby message received", "peer", from, "text", logging.Redact(msg.Text))
+}
+
+// firstSeen records id and reports whether it was new, forgetting old IDs
+func (l *Lobby) firstSeen(id string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for seenID, at := range l.seen {
+		if now.Sub(at) > seenLifetime {
+			delete(l.seen, seenID)
+		}
+	}
+	if _, ok := l.seen[id]; ok {
+		return false
+	}
+	l.seen[id] = now
+	return true
+}
@@ -0,0 +1,65 @@
+package lobby
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/repository"
+)
+
+func texts(l *Lobby) []string {
+	var texts []string
+	for _, message := range l.Room().GetMessages() {
+		texts = append(texts, message.Author+": "+message.Text)
+	}
+	return texts
+}
+
+func TestLobby_ReachesEveryPeer(t *testing.T) {
+	lobbies := make(map[string]*Lobby)
+	for _, id := range []string{"a", "b", "c"} {
+		peers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+		for _, other := range []string{"a", "b", "c"} {
+			if other != id {
+				peers.Add(&entity.Peer{PeerID: other, PublicKey: []byte(other), Username: "user-" + other, AddrIP: "127.0.0.1", Port: "1"})
+			}
+		}
+		lobbies[id] = New(peers, func(peer *entity.Peer, data []byte) error {
+			lobbies[peer.PeerID].Receive(id, data)
+			return nil
+		})
+	}
+
+	lobbies["a"].Send("hello lan", "user-a")
+	for _, id := range []string{"b", "c"} {
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"user-a: hello lan"}, texts(lobbies[id]))
+		}, time.Second, 10*time.Millisecond, id)
+	}
+	assert.Eventually(t, func() bool {
+		return lobbies["a"].Room().GetMessages()[0].State == entity.MessageSent
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLobby_DropsRepeatsAndTrustsKnownNames(t *testing.T) {
+	peers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+	peers.Add(&entity.Peer{PeerID: "known", Username: "alice"})
+	l := New(peers, func(*entity.Peer, []byte) error { return nil })
+
+	data, err := json.Marshal(message{ID: "1", Text: "hi", Username: "admin", Time: time.Now()})
+	require.NoError(t, err)
+	l.Receive("known", data)
+	l.Receive("known", data)
+	l.Receive("stranger", data)
+
+	big, err := json.Marshal(message{ID: "2", Text: string(make([]byte, maxTextLength+1))})
+	require.NoError(t, err)
+	l.Receive("known", big)
+
+	assert.Equal(t, []string{"alice: hi", "admin: hi"}, texts(l))
+}
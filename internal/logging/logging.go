@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"p2p-messenger/internal/config"
+)
+
+// state is swapped atomically by Setup so loggers created at package init
+// pick up the configured output and levels without being recreated
+type state struct {
+	handler    slog.Handler
+	level      slog.Level
+	components map[string]slog.Level
+}
+
+var current atomic.Pointer[state]
+
+func init() {
+	current.Store(&state{
+		handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		level:   slog.LevelInfo,
+	})
+	redact.Store(true)
+}
+
+// For returns the logger for a component such as "network" or "ui". Each
+// record carries a component attribute and is filtered by that component's
+// configured level.
+func For(component string) *slog.Logger {
+	return slog.New(&componentHandler{component: component})
+}
+
+// Setup directs all logging, including the standard library log package, to
+// the rotating file described by cfg
+func Setup(cfg config.LogConfig) (io.Closer, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	components := make(map[string]slog.Level, len(cfg.Components))
+	for name, raw := range cfg.Components {
+		componentLevel, err := ParseLevel(raw)
+		if err != nil {
+			return nil, fmt.Errorf("log component %s: %w", name, err)
+		}
+		components[name] = componentLevel
+	}
+
+	file, err := OpenRotatingFile(cfg.Path, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	// Levels are enforced per component, so the base handler lets everything through
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	if cfg.Format == "json" {
+		handler = slog.NewJSONHandler(file, options)
+	} else {
+		handler = slog.NewTextHandler(file, options)
+	}
+
+	current.Store(&state{
+		handler:    handler,
+		level:      level,
+		components: components,
+	})
+	redact.Store(cfg.Redact)
+	slog.SetDefault(For("app"))
+
+	return file, nil
+}
+
+// ParseLevel accepts debug, info, warn and error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+type componentHandler struct {
+	component string
+	// with replays WithAttrs/WithGroup calls on whichever handler is current
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	s := current.Load()
+	if componentLevel, ok := s.components[h.component]; ok {
+		return level >= componentLevel
+	}
+	return level >= s.level
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler := current.Load().handler.WithAttrs([]slog.Attr{slog.String("component", h.component)})
+	for _, apply := range h.with {
+		handler = apply(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.extend(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *componentHandler) extend(apply func(slog.Handler) slog.Handler) *componentHandler {
+	with := make([]func(slog.Handler) slog.Handler, len(h.with), len(h.with)+1)
+	copy(with, h.with)
+	return &componentHandler{component: h.component, with: append(with, apply)}
+}
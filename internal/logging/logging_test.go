@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/config"
+)
+
+func setupTestLog(t *testing.T, mutate func(cfg *config.LogConfig)) string {
+	t.Helper()
+	cfg := config.Default().Log
+	cfg.Path = filepath.Join(t.TempDir(), "chat.log")
+	if mutate != nil {
+		mutate(&cfg)
+	}
+	closer, err := Setup(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { closer.Close() })
+	return cfg.Path
+}
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestSetup_ComponentLevels(t *testing.T) {
+	path := setupTestLog(t, func(cfg *config.LogConfig) {
+		cfg.Level = "warn"
+		cfg.Components = map[string]string{"network": "debug"}
+	})
+
+	For("network").Debug("network debug")
+	For("ui").Info("ui info")
+	For("ui").Warn("ui warn")
+
+	content := readLog(t, path)
+	assert.Contains(t, content, "network debug")
+	assert.Contains(t, content, "component=network")
+	assert.NotContains(t, content, "ui info")
+	assert.Contains(t, content, "ui warn")
+}
+
+func TestSetup_RedactsByDefault(t *testing.T) {
+	path := setupTestLog(t, nil)
+
+	For("peer").Info("decrypted", "text", Redact("meet at noon"), "key", RedactKey([]byte{1, 2, 3}))
+
+	content := readLog(t, path)
+	assert.NotContains(t, content, "meet at noon")
+	assert.Contains(t, content, "[redacted 12 bytes]")
+	assert.Contains(t, content, "[redacted 3 bytes]")
+
+	path = setupTestLog(t, func(cfg *config.LogConfig) { cfg.Redact = false })
+	For("peer").Info("decrypted", "text", Redact("meet at noon"))
+	assert.Contains(t, readLog(t, path), "meet at noon")
+}
+
+func TestSetup_InvalidLevel(t *testing.T) {
+	cfg := config.Default().Log
+	cfg.Path = filepath.Join(t.TempDir(), "chat.log")
+	cfg.Components = map[string]string{"ui": "loud"}
+	_, err := Setup(cfg)
+	assert.ErrorContains(t, err, "ui")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.log")
+	require.NoError(t, os.WriteFile(path, nil, 0666))
+
+	file, err := OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer file.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(logFileMode), info.Mode().Perm(), "existing log must be made private")
+
+	for _, line := range []string{"first-1\n", "second\n", "third-3\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, "fourth\n", readLog(t, path))
+	assert.Equal(t, "third-3\n", readLog(t, path+".1"))
+	assert.Equal(t, "second\n", readLog(t, path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only maxBackups files are kept")
+
+	info, err = os.Stat(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(logFileMode), info.Mode().Perm())
+	assert.False(t, strings.Contains(readLog(t, path), "first"))
+}
+
+func TestRotatingFile_KeepsLoggingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	file, err := OpenRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+	defer file.Close()
+	// A directory in the way of the backup makes the rename fail
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocker"), 0700))
+
+	_, err = file.Write([]byte("first-1\n"))
+	require.NoError(t, err)
+	// The lines are written, so the writes succeed
+	n, err := file.Write([]byte("second\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, len("second\n"), n)
+	_, err = file.Write([]byte("third\n"))
+	assert.NoError(t, err)
+
+	// Logging goes on in the current file, and rotates once it can
+	assert.Equal(t, "first-1\nsecond\nthird\n", readLog(t, path))
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = file.Write([]byte("fourth\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "fourth\n", readLog(t, path))
+}
+
+func TestRotatingFile_ReopensWhenCloseFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	file, err := OpenRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.Write([]byte("first-1\n"))
+	require.NoError(t, err)
+	// Closing an already closed file fails like a close on a full disk
+	require.NoError(t, file.file.Close())
+
+	n, err := file.Write([]byte("second\n"))
+	require.NoError(t, err, "logging goes on in a reopened file")
+	assert.Equal(t, len("second\n"), n)
+	n, err = file.Write([]byte("third\n"))
+	require.NoError(t, err)
+	assert.Equal(t, len("third\n"), n)
+	assert.Equal(t, "third\n", readLog(t, path), "and rotates again")
+	assert.Equal(t, "first-1\nsecond\n", readLog(t, path+".1"))
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// redact is on unless the config explicitly turns it off
+var redact atomic.Bool
+
+// Redact wraps a message body or other user content. It is logged as its
+// length only, unless redaction has been disabled for debugging.
+func Redact(text string) slog.LogValuer {
+	return redacted{value: text, size: len(text)}
+}
+
+// RedactKey wraps key material the same way as Redact, showing base64 when
+// redaction is off
+func RedactKey(key []byte) slog.LogValuer {
+	return redacted{value: base64.StdEncoding.EncodeToString(key), size: len(key)}
+}
+
+type redacted struct {
+	value string
+	size  int
+}
+
+func (r redacted) LogValue() slog.Value {
+	if redact.Load() {
+		return slog.StringValue(fmt.Sprintf("[redacted %d bytes]", r.size))
+	}
+	return slog.StringValue(r.value)
+}
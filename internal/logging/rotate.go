@@ -0,0 +1,153 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// logFileMode keeps logs private to the user; they contain peer metadata
+const logFileMode = 0600
+
+// RotatingFile is an io.WriteCloser that renames the file to path.1, path.2,
+// ... once it would grow past maxSize bytes, keeping at most maxBackups old
+// files. A maxSize of 0 disables rotation.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	// rotateFailed is set while rotation keeps failing, so that the failure
+	// is logged once
+	rotateFailed bool
+}
+
+var rotateLogger = For("logging")
+
+// OpenRotatingFile opens path for appending, creating it and its directory
+// if needed. Permissions of an existing file are tightened to owner-only.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	if dir := filepath.Dir(r.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create log directory: %w", err)
+		}
+	}
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, logFileMode)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	// OpenFile only applies the mode on creation; older logs were world-readable
+	if err := file.Chmod(logFileMode); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to restrict log file permissions: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would not fit. A failed rotation
+// does not fail the write; it is logged, and tried again on the next write.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	n, rotateErr, err := r.write(p)
+	if rotateErr != nil {
+		// Logged once the lock is released, since the record may come back here
+		rotateLogger.Warn("log rotation failed, logging on in the current file", "path", r.path, "err", rotateErr)
+	}
+	return n, err
+}
+
+// write returns the error of a failed rotation the first time it happens
+func (r *RotatingFile) write(p []byte) (n int, rotateErr, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, nil, fs.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if r.file == nil {
+			return 0, nil, err
+		}
+		if err != nil && !r.rotateFailed {
+			rotateErr = err
+		}
+		r.rotateFailed = err != nil
+	}
+	n, err = r.file.Write(p)
+	r.size += int64(n)
+	return n, rotateErr, err
+}
+
+func (r *RotatingFile) rotate() (err error) {
+	closeErr := r.file.Close()
+	r.file = nil
+	// Keep logging to the current path if the old file cannot be closed or
+	// moved
+	defer func() {
+		if r.file == nil {
+			err = errors.Join(err, r.open())
+		}
+	}()
+	if closeErr != nil {
+		return closeErr
+	}
+
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return r.open()
+	}
+
+	os.Remove(r.backupName(r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(r.backupName(i), r.backupName(i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.backupName(1)); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) backupName(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
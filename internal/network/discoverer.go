@@ -1,14 +1,15 @@
 package network
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
-	"log"
 	"net"
 	"time"
 
 	"p2p-messenger/internal/crypto"
 	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
 	"p2p-messenger/internal/proto"
 	"p2p-messenger/pkg/udp"
 )
@@ -16,8 +17,13 @@ import (
 const (
 	udpConnectionBufferSize = 1024
 	multicastString         = "me0w"
+	// sealedMulticastString prefixes announcements sealed with the workspace
+	// key: me0s:base64(sealed "me0w:..." announcement)
+	sealedMulticastString = "me0s"
 )
 
+var discovererLogger = logging.For("discoverer")
+
 type Discoverer struct {
 	Addr               *net.UDPAddr
 	MulticastFrequency time.Duration
@@ -47,7 +53,7 @@ func (d *Discoverer) startMulticasting() {
 		if err == nil {
 			break
 		}
-		log.Printf("discoverer: failed to create multicast connection: %v, retrying...", err)
+		discovererLogger.Warn("failed to create multicast connection, retrying", "err", err)
 		time.Sleep(2 * time.Second)
 	}
 
@@ -63,19 +69,24 @@ func (d *Discoverer) startMulticasting() {
 			d.Proto.PublicKeyStr,
 			d.Proto.Port,
 			d.Proto.Username)
+		payload, err := d.seal([]byte(msg))
+		if err != nil {
+			discovererLogger.Warn("failed to seal announcement", "err", err)
+			continue
+		}
 
-		_, err := conn.Write([]byte(msg))
+		_, err = conn.Write(payload)
 		if err != nil {
-			log.Printf("discoverer: multicast write error: %v, attempting to reconnect...", err)
+			discovererLogger.Warn("multicast write error, reconnecting", "err", err)
 			conn.Close()
 			// Retry connection
 			for {
 				conn, err = net.DialUDP("udp", nil, d.Addr)
 				if err == nil {
-					log.Printf("discoverer: reconnected successfully")
+					discovererLogger.Info("reconnected")
 					break
 				}
-				log.Printf("discoverer: reconnection failed: %v, retrying...", err)
+				discovererLogger.Warn("reconnection failed, retrying", "err", err)
 				time.Sleep(2 * time.Second)
 			}
 		}
@@ -92,20 +103,20 @@ func (d *Discoverer) listenMulticasting() {
 		if err == nil {
 			break
 		}
-		log.Printf("discoverer: failed to listen on multicast: %v, retrying...", err)
+		discovererLogger.Warn("failed to listen on multicast, retrying", "err", err)
 		time.Sleep(2 * time.Second)
 	}
 
 	err = conn.SetReadBuffer(udpConnectionBufferSize)
 	if err != nil {
-		log.Printf("discoverer: warning: failed to set read buffer: %v", err)
+		discovererLogger.Warn("failed to set read buffer", "err", err)
 		// Continue anyway, buffer size is not critical
 	}
 
 	for {
 		rawBytes, addr, err := udp.ReadFromUDPConnection(conn, udpConnectionBufferSize)
 		if err != nil {
-			log.Printf("discoverer: read error: %v, attempting to reconnect...", err)
+			discovererLogger.Warn("read error, reconnecting", "err", err)
 			conn.Close()
 			// Retry connection
 			for {
@@ -113,30 +124,36 @@ func (d *Discoverer) listenMulticasting() {
 				if err == nil {
 					err = conn.SetReadBuffer(udpConnectionBufferSize)
 					if err != nil {
-						log.Printf("discoverer: warning: failed to set read buffer after reconnect: %v", err)
+						discovererLogger.Warn("failed to set read buffer after reconnect", "err", err)
 					}
-					log.Printf("discoverer: reconnected successfully")
+					discovererLogger.Info("reconnected")
 					break
 				}
-				log.Printf("discoverer: reconnection failed: %v, retrying...", err)
+				discovererLogger.Warn("reconnection failed, retrying", "err", err)
 				time.Sleep(2 * time.Second)
 			}
 			continue
 		}
 
+		rawBytes, err = d.open(rawBytes)
+		if err != nil {
+			discovererLogger.Debug("ignoring announcement from outside the workspace", "from", addr.IP.String(), "err", err)
+			continue
+		}
+
 		message, err := entity.UDPMulticastMessageToPeer(rawBytes)
 		if err != nil {
 			// Log parse errors occasionally (not every time to avoid spam)
-			log.Printf("discoverer: failed to parse multicast message: %v, from %s", err, addr.IP.String())
+			discovererLogger.Debug("failed to parse multicast message", "from", addr.IP.String(), "err", err)
 			continue // Skip invalid messages, don't crash
 		}
 
-		log.Printf("discoverer: discovered peer from %s (Port=%s, Username=%s)", addr.IP.String(), message.Port, message.Username)
+		discovererLogger.Debug("discovered peer", "from", addr.IP.String(), "port", message.Port, "username", message.Username)
 
 		// Decode public key from base64
 		pubKeyBytes, err := base64.StdEncoding.DecodeString(message.PubKeyStr)
 		if err != nil || len(pubKeyBytes) != 32 {
-			log.Printf("discoverer: invalid public key format (not base64 or wrong length): %v", err)
+			discovererLogger.Debug("invalid public key format (not base64 or wrong length)", "from", addr.IP.String(), "err", err)
 			continue
 		}
 
@@ -150,9 +167,39 @@ func (d *Discoverer) listenMulticasting() {
 			Username:  message.Username,
 		}
 		peer.AddConnectionType(entity.ConnectionNAT)
+		peer.AddAddress(entity.Address{IP: addr.IP.String(), Port: message.Port, Source: entity.ConnectionNAT, LastSeen: time.Now()})
 
 		if message.PubKeyStr != d.Proto.PublicKeyStr {
 			d.Proto.Peers.Add(peer)
 		}
 	}
 }
+
+// seal wraps an announcement with the workspace key, if there is one
+func (d *Discoverer) seal(msg []byte) ([]byte, error) {
+	if d.Proto.Workspace == nil {
+		return msg, nil
+	}
+	sealed, err := d.Proto.Workspace.SealAnnouncement(msg, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return []byte(sealedMulticastString + ":" + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// open reverses seal. In a workspace only sealed announcements are accepted;
+// outside of one, sealed announcements simply fail to parse.
+func (d *Discoverer) open(raw []byte) ([]byte, error) {
+	if d.Proto.Workspace == nil {
+		return raw, nil
+	}
+	encoded, ok := bytes.CutPrefix(bytes.Trim(raw, "\x00"), []byte(sealedMulticastString+":"))
+	if !ok {
+		return nil, crypto.ErrBadAnnouncement
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, crypto.ErrBadAnnouncement
+	}
+	return d.Proto.Workspace.OpenAnnouncement(sealed, time.Now())
+}
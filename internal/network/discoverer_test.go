@@ -8,6 +8,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
 	"p2p-messenger/internal/proto"
 )
 
@@ -41,3 +43,40 @@ func TestDiscoverer(t *testing.T) {
 	assert.Equal(t, proto2.PublicKeyStr, string(peers1[0].PublicKey))
 	assert.Equal(t, proto1.PublicKeyStr, string(peers2[0].PublicKey))
 }
+
+func TestDiscoverer_WorkspaceAnnouncements(t *testing.T) {
+	team, err := crypto.DeriveWorkspaceKeys("team secret")
+	assert.NoError(t, err)
+	outsiders, err := crypto.DeriveWorkspaceKeys("other secret")
+	assert.NoError(t, err)
+
+	newDiscoverer := func(keys *crypto.WorkspaceKeys) *Discoverer {
+		p, err := proto.NewProto("25045")
+		assert.NoError(t, err)
+		p.Workspace = keys
+		return NewDiscoverer(nil, time.Second, p)
+	}
+	member, colleague := newDiscoverer(team), newDiscoverer(team)
+	outsider, open := newDiscoverer(outsiders), newDiscoverer(nil)
+
+	announcement := []byte("me0w:key:25045:alice")
+	sealed, err := member.seal(announcement)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealed), "alice")
+
+	// Received datagrams are padded with zeros up to the buffer size
+	padded := append(sealed, make([]byte, 16)...)
+	opened, err := colleague.open(padded)
+	assert.NoError(t, err)
+	assert.Equal(t, announcement, opened)
+
+	_, err = outsider.open(sealed)
+	assert.ErrorIs(t, err, crypto.ErrBadAnnouncement)
+	_, err = colleague.open(announcement)
+	assert.ErrorIs(t, err, crypto.ErrBadAnnouncement, "unsealed announcements are ignored in a workspace")
+
+	raw, err := open.open(sealed)
+	assert.NoError(t, err)
+	_, err = entity.UDPMulticastMessageToPeer(raw)
+	assert.ErrorIs(t, err, entity.ErrBadMulticastMessage, "nodes outside the workspace cannot parse sealed announcements")
+}
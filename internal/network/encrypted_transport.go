@@ -5,66 +5,109 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 
 	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/transport"
 )
 
 var (
 	ErrNoSession = errors.New("no encryption session")
 )
 
-// EncryptedConn wraps a connection with Noise Protocol encryption
+var _ net.Conn = (*EncryptedConn)(nil)
+
+// EncryptedConn is a net.Conn over a Noise session on a stream such as TCP.
+// Every Noise message travels in a length-prefixed frame, so the stream may
+// split or merge them freely. Writes larger than one Noise message are split
+// into several; reads return the plaintext as a byte stream.
 type EncryptedConn struct {
 	conn    net.Conn
+	framed  *transport.FramedConn
 	session *crypto.Session
+
+	handshakeMu sync.Mutex
+	readMu      sync.Mutex
+	pending     []byte // decrypted but not yet read
+	writeMu     sync.Mutex
 }
 
-// NewEncryptedConn creates a new encrypted connection
+// NewEncryptedConn creates a new encrypted connection. The handshake runs on
+// the first Read or Write unless Handshake is called before.
 func NewEncryptedConn(conn net.Conn, session *crypto.Session) *EncryptedConn {
 	return &EncryptedConn{
 		conn:    conn,
+		framed:  transport.NewFramedConn(conn),
 		session: session,
 	}
 }
 
-// Read reads and decrypts data
-func (e *EncryptedConn) Read(b []byte) (int, error) {
+// Handshake completes the Noise handshake if it has not run yet
+func (e *EncryptedConn) Handshake() error {
 	if e.session == nil {
-		return 0, ErrNoSession
+		return ErrNoSession
 	}
+	e.handshakeMu.Lock()
+	defer e.handshakeMu.Unlock()
+	if e.session.IsHandshakeComplete() {
+		return nil
+	}
+	if err := e.session.Handshake(e.framed); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	return nil
+}
 
-	// Read encrypted data
-	buffer := make([]byte, len(b)+64) // Add overhead for encryption
-	n, err := e.conn.Read(buffer)
-	if err != nil {
+// Read reads and decrypts data
+func (e *EncryptedConn) Read(b []byte) (int, error) {
+	if err := e.Handshake(); err != nil {
 		return 0, err
 	}
+	e.readMu.Lock()
+	defer e.readMu.Unlock()
 
-	// Decrypt
-	decrypted, err := e.session.ReadMessage(buffer[:n])
-	if err != nil {
-		return 0, fmt.Errorf("decrypt failed: %w", err)
+	for len(e.pending) == 0 {
+		message, err := e.framed.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		decrypted, err := e.session.ReadMessage(message)
+		if err != nil {
+			return 0, fmt.Errorf("decrypt failed: %w", err)
+		}
+		e.pending = decrypted
 	}
 
-	copy(b, decrypted)
-	return len(decrypted), nil
+	n := copy(b, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
 }
 
 // Write encrypts and writes data
 func (e *EncryptedConn) Write(b []byte) (int, error) {
-	if e.session == nil {
-		return 0, ErrNoSession
+	if err := e.Handshake(); err != nil {
+		return 0, err
 	}
-
-	encrypted, err := e.session.WriteMessage(b)
-	if err != nil {
-		return 0, fmt.Errorf("encrypt failed: %w", err)
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), e.session.MaxPayloadSize())]
+		encrypted, err := e.session.WriteMessage(chunk)
+		if err != nil {
+			return written, fmt.Errorf("encrypt failed: %w", err)
+		}
+		if err := e.framed.WriteMessage(encrypted); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
 	}
-
-	return e.conn.Write(encrypted)
+	return written, nil
 }
 
 // Close closes the underlying connection
@@ -72,6 +115,26 @@ func (e *EncryptedConn) Close() error {
 	return e.conn.Close()
 }
 
+func (e *EncryptedConn) LocalAddr() net.Addr {
+	return e.conn.LocalAddr()
+}
+
+func (e *EncryptedConn) RemoteAddr() net.Addr {
+	return e.conn.RemoteAddr()
+}
+
+func (e *EncryptedConn) SetDeadline(t time.Time) error {
+	return e.conn.SetDeadline(t)
+}
+
+func (e *EncryptedConn) SetReadDeadline(t time.Time) error {
+	return e.conn.SetReadDeadline(t)
+}
+
+func (e *EncryptedConn) SetWriteDeadline(t time.Time) error {
+	return e.conn.SetWriteDeadline(t)
+}
+
 // GetTLSConfig creates a TLS config for encrypted transport
 func GetTLSConfig() *tls.Config {
 	// Generate self-signed certificate for encrypted transport
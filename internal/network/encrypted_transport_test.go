@@ -0,0 +1,109 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/crypto"
+)
+
+// encryptedPair connects two EncryptedConns over loopback TCP
+func encryptedPair(t *testing.T) (client, server *EncryptedConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	clientKey, _, err := crypto.GenerateKeypair()
+	require.NoError(t, err)
+	serverKey, _, err := crypto.GenerateKeypair()
+	require.NoError(t, err)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	serverConn := <-accepted
+	require.NotNil(t, serverConn)
+
+	initiator, err := crypto.NewInitiatorSession(clientKey)
+	require.NoError(t, err)
+	responder, err := crypto.NewResponderSession(serverKey)
+	require.NoError(t, err)
+	client, server = NewEncryptedConn(conn, initiator), NewEncryptedConn(serverConn, responder)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	handshakeErr := make(chan error, 1)
+	go func() { handshakeErr <- server.Handshake() }()
+	require.NoError(t, client.Handshake())
+	require.NoError(t, <-handshakeErr)
+	return client, server
+}
+
+func TestEncryptedConn_StreamOverTCP(t *testing.T) {
+	client, server := encryptedPair(t)
+
+	// Larger than one Noise message, so the write is split into frames
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := client.Write(payload)
+		writeErr <- err
+	}()
+
+	// Reading through a small buffer must still return every byte in order
+	received := make([]byte, 0, len(payload))
+	buffer := make([]byte, 1000)
+	for len(received) < len(payload) {
+		n, err := server.Read(buffer)
+		require.NoError(t, err)
+		received = append(received, buffer[:n]...)
+	}
+	require.NoError(t, <-writeErr)
+	assert.True(t, bytes.Equal(payload, received))
+
+	// And back the other way
+	go server.Write([]byte("pong"))
+	reply := make([]byte, 4)
+	_, err := io.ReadFull(client, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(reply))
+}
+
+func TestEncryptedConn_TamperedFrameRejected(t *testing.T) {
+	client, server := encryptedPair(t)
+
+	// Write a valid frame header followed by garbage underneath the session
+	go client.conn.Write([]byte{0, 20, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20})
+	_, err := server.Read(make([]byte, 10))
+	assert.Error(t, err)
+}
+
+func TestEncryptedConn_DeadlinesAndAddresses(t *testing.T) {
+	client, server := encryptedPair(t)
+	assert.Equal(t, client.LocalAddr().String(), server.RemoteAddr().String())
+	assert.Equal(t, client.RemoteAddr().String(), server.LocalAddr().String())
+
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := server.Read(make([]byte, 10))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	require.NoError(t, client.Close())
+	require.NoError(t, server.SetReadDeadline(time.Time{}))
+	_, err = server.Read(make([]byte, 10))
+	assert.Error(t, err, "the peer closed the connection")
+}
@@ -0,0 +1,130 @@
+package network
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"p2p-messenger/internal/entity"
+)
+
+var (
+	ErrTooManyConnections      = errors.New("too many connections")
+	ErrTooManyConnectionsPerIP = errors.New("too many connections from this address")
+)
+
+// connLimiter caps simultaneous connections globally and per remote IP
+type connLimiter struct {
+	mu     sync.Mutex
+	max    int
+	maxIP  int
+	active int
+	byIP   map[string]int
+}
+
+func newConnLimiter(max, maxPerIP int) *connLimiter {
+	return &connLimiter{
+		max:   max,
+		maxIP: maxPerIP,
+		byIP:  make(map[string]int),
+	}
+}
+
+// acquire reserves a slot for ip. The returned release func must be called
+// exactly once when the connection ends.
+func (l *connLimiter) acquire(ip string) (release func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active >= l.max {
+		return nil, ErrTooManyConnections
+	}
+	if l.byIP[ip] >= l.maxIP {
+		return nil, ErrTooManyConnectionsPerIP
+	}
+	l.active++
+	l.byIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.active--
+			if l.byIP[ip]--; l.byIP[ip] <= 0 {
+				delete(l.byIP, ip)
+			}
+		})
+	}, nil
+}
+
+func (l *connLimiter) activeConnections() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// tokenBucket allows burst messages at once and rate messages per second
+// sustained. It is used by a single connection goroutine and is not locked.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// take consumes one token and returns how long the caller has to wait before
+// the token is actually available (zero if it was available immediately)
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// listenerStats counts limit violations; all fields are updated atomically
+type listenerStats struct {
+	rejectedConnections atomic.Uint64
+	rejectedPerIP       atomic.Uint64
+	oversizedFrames     atomic.Uint64
+	handshakeTimeouts   atomic.Uint64
+	idleTimeouts        atomic.Uint64
+	rateLimited         atomic.Uint64
+}
+
+func (s *listenerStats) rejected(err error) {
+	if errors.Is(err, ErrTooManyConnectionsPerIP) {
+		s.rejectedPerIP.Add(1)
+	} else {
+		s.rejectedConnections.Add(1)
+	}
+}
+
+func (s *listenerStats) snapshot(active int) entity.Diagnostics {
+	return entity.Diagnostics{
+		ActiveConnections:   active,
+		RejectedConnections: s.rejectedConnections.Load(),
+		RejectedPerIP:       s.rejectedPerIP.Load(),
+		OversizedFrames:     s.oversizedFrames.Load(),
+		HandshakeTimeouts:   s.handshakeTimeouts.Load(),
+		IdleTimeouts:        s.idleTimeouts.Load(),
+		RateLimited:         s.rateLimited.Load(),
+	}
+}
@@ -0,0 +1,49 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiter(t *testing.T) {
+	limiter := newConnLimiter(3, 2)
+
+	releaseA1, err := limiter.acquire("10.0.0.1")
+	require.NoError(t, err)
+	_, err = limiter.acquire("10.0.0.1")
+	require.NoError(t, err)
+
+	_, err = limiter.acquire("10.0.0.1")
+	assert.ErrorIs(t, err, ErrTooManyConnectionsPerIP)
+
+	_, err = limiter.acquire("10.0.0.2")
+	require.NoError(t, err)
+	_, err = limiter.acquire("10.0.0.3")
+	assert.ErrorIs(t, err, ErrTooManyConnections)
+	assert.Equal(t, 3, limiter.activeConnections())
+
+	releaseA1()
+	releaseA1() // releasing twice must not free a second slot
+	assert.Equal(t, 2, limiter.activeConnections())
+
+	_, err = limiter.acquire("10.0.0.1")
+	assert.NoError(t, err)
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(10, 2)
+	now := time.Now()
+
+	assert.Zero(t, bucket.take(now))
+	assert.Zero(t, bucket.take(now))
+	assert.Equal(t, 100*time.Millisecond, bucket.take(now))
+
+	// After a second the bucket is full again, but never above the burst
+	now = now.Add(time.Second)
+	assert.Zero(t, bucket.take(now))
+	assert.Zero(t, bucket.take(now))
+	assert.Greater(t, bucket.take(now), time.Duration(0))
+}
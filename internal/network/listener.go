@@ -1,60 +1,394 @@
 package network
 
 import (
-	"log"
+	"errors"
 	"net"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	"p2p-messenger/internal/config"
 	"p2p-messenger/internal/crypto"
 	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
 	"p2p-messenger/internal/proto"
+	"p2p-messenger/internal/transport"
 )
 
 var (
-	upgrader = websocket.Upgrader{}
+	listenerLogger = logging.For("listener")
 )
 
 type Listener struct {
-	proto *proto.Proto
-	addr  string
+	proto    *proto.Proto
+	addr     string
+	limits   config.LimitsConfig
+	upgrader websocket.Upgrader
+	conns    *connLimiter
+	stats    listenerStats
+	// relay handles /relay sessions; nil when relaying is disabled
+	relay *Relay
 }
 
-func NewListener(addr string, proto *proto.Proto) *Listener {
+func NewListener(addr string, proto *proto.Proto, limits config.LimitsConfig) *Listener {
 	return &Listener{
-		proto: proto,
-		addr:  addr,
+		proto:  proto,
+		addr:   addr,
+		limits: limits,
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout: limits.HandshakeTimeout.Std(),
+		},
+		conns: newConnLimiter(limits.MaxConnections, limits.MaxConnectionsPerIP),
 	}
 }
 
+// Diagnostics returns the current connection count and limit violation counters
+func (l *Listener) Diagnostics() entity.Diagnostics {
+	return l.stats.snapshot(l.conns.activeConnections())
+}
+
+// acquire reserves a connection slot for the remote address
+func (l *Listener) acquire(remote string) (release func(), err error) {
+	release, err = l.conns.acquire(hostOf(remote))
+	if err != nil {
+		l.stats.rejected(err)
+		listenerLogger.Debug("rejecting connection", "remote", remote, "err", err)
+	}
+	return release, err
+}
+
+// admit reserves a connection slot for the request's remote IP, answering
+// 503 when a limit is reached
+func (l *Listener) admit(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	release, err := l.acquire(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return release, true
+}
+
+// recordReadError counts reads that failed because a limit was hit
+func (l *Listener) recordReadError(err error, handshakeComplete bool) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, transport.ErrMessageTooLarge):
+		l.stats.oversizedFrames.Add(1)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		if handshakeComplete {
+			l.stats.idleTimeouts.Add(1)
+		} else {
+			l.stats.handshakeTimeouts.Add(1)
+		}
+	}
+}
+
+func hostOf(addr string) string {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ip
+}
+
 func (l *Listener) chat(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	release, ok := l.admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Answer the initiator's mode offer; initiators that predate negotiation
+	// send none and get no answer
+	offer := r.Header.Get(crypto.FeaturesHeader)
+	selected := crypto.Select(offer, l.proto.SessionOptions()...)
+	var header http.Header
+	if selected != "" {
+		header = http.Header{crypto.FeaturesHeader: {selected}}
+	}
+
+	conn, err := l.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return
+	}
+	listenerLogger.Debug("new websocket connection", "remote", r.RemoteAddr, "mode", selected)
+	l.serve(transport.NewWebsocketConn(conn), offer, selected)
+}
+
+// answerWebRTC answers a WebRTC offer that came through the relay. The data
+// channel that follows is served like any other chat connection and takes
+// its own connection slot.
+func (l *Listener) answerWebRTC(offer []byte) ([]byte, error) {
+	return transport.AnswerWebRTC(offer, l.limits.HandshakeTimeout.Std(), func(offer string) string {
+		return crypto.Select(offer, l.proto.SessionOptions()...)
+	}, func(channel transport.Conn, offer, selected string) {
+		release, err := l.acquire(channel.RemoteAddr().String())
+		if err != nil {
+			channel.Close()
+			return
+		}
+		defer release()
+		listenerLogger.Debug("new webrtc connection", "remote", channel.RemoteAddr(), "mode", selected)
+		l.serve(channel, offer, selected)
+	})
+}
+
+// acceptSession upgrades r to a websocket and completes a Noise handshake
+// as responder, for the short exchanges next to the chat connection
+func (l *Listener) acceptSession(w http.ResponseWriter, r *http.Request) (transport.Conn, *crypto.Session, bool) {
+	opts := l.proto.SessionOptions()
+	offer := r.Header.Get(crypto.FeaturesHeader)
+	selected := crypto.Select(offer, opts...)
+	var header http.Header
+	if selected != "" {
+		header = http.Header{crypto.FeaturesHeader: {selected}}
+	}
+	ws, err := l.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return nil, nil, false
+	}
+	conn := transport.NewWebsocketConn(ws)
+	session, ok := l.respond(conn, r.URL.Path, offer, selected)
+	if !ok {
+		conn.Close()
+		return nil, nil, false
+	}
+	return conn, session, true
+}
+
+// respond completes a Noise handshake as responder on a side session
+func (l *Listener) respond(conn transport.Conn, path, offer, selected string) (*crypto.Session, bool) {
+	conn.SetReadLimit(int64(l.limits.MaxFrameSize))
+	conn.SetReadDeadline(time.Now().Add(l.limits.HandshakeTimeout.Std()))
+	session, err := crypto.NewResponderSession(l.proto.PrivateKey, slices.Concat(l.proto.SessionOptions(), []crypto.SessionOption{crypto.WithNegotiation(offer, selected)})...)
+	if err != nil {
+		listenerLogger.Warn("failed to create responder session", "remote", conn.RemoteAddr(), "err", err)
+		return nil, false
+	}
+	if err := session.Handshake(conn); err != nil {
+		l.recordReadError(err, false)
+		listenerLogger.Debug("session handshake failed", "remote", conn.RemoteAddr(), "path", path, "err", err)
+		return nil, false
+	}
+	return session, true
+}
+
+// relaySession receives envelopes and route advertisements from a
+// neighbour
+func (l *Listener) relaySession(w http.ResponseWriter, r *http.Request) {
+	if l.relay == nil {
+		http.NotFound(w, r)
+		return
+	}
+	l.serveSession(w, r, l.relay.receive)
+}
+
+// groupSession receives membership changes, sender keys and messages of
+// the groups we share with the peer
+func (l *Listener) groupSession(w http.ResponseWriter, r *http.Request) {
+	if l.proto.Groups == nil {
+		http.NotFound(w, r)
+		return
+	}
+	l.serveSession(w, r, l.proto.Groups.Receive)
+}
+
+// lobbySession receives lobby messages written by the peer
+func (l *Listener) lobbySession(w http.ResponseWriter, r *http.Request) {
+	if l.proto.Lobby == nil {
+		http.NotFound(w, r)
+		return
+	}
+	l.serveSession(w, r, l.proto.Lobby.Receive)
+}
+
+// fileSession receives file offers from the peer and its answers to ours
+func (l *Listener) fileSession(w http.ResponseWriter, r *http.Request) {
+	if l.proto.Transfers == nil {
+		http.NotFound(w, r)
+		return
+	}
+	l.serveSession(w, r, l.proto.Transfers.Receive)
+}
+
+// fileDataSession receives the chunks of a file we accepted, confirming
+// each on the same session
+func (l *Listener) fileDataSession(w http.ResponseWriter, r *http.Request) {
+	if l.proto.Transfers == nil {
+		http.NotFound(w, r)
+		return
+	}
+	release, ok := l.admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	conn, session, ok := l.acceptSession(w, r)
+	if !ok {
+		return
+	}
+	defer conn.Close()
+	l.serveFileData(conn, session)
+}
+
+func (l *Listener) serveFileData(conn transport.Conn, session *crypto.Session) {
+	remoteKey, err := session.GetRemotePublicKey()
 	if err != nil {
 		return
 	}
+	l.proto.Transfers.Serve(crypto.PeerID(remoteKey), &stream{conn: conn, session: session, timeout: sessionTimeout})
+}
+
+// serveSession passes every message of a side session to receive, with the
+// peer ID the handshake proved, until the peer closes the session
+func (l *Listener) serveSession(w http.ResponseWriter, r *http.Request, receive func(from string, plaintext []byte)) {
+	release, ok := l.admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	conn, session, ok := l.acceptSession(w, r)
+	if !ok {
+		return
+	}
+	defer conn.Close()
+	l.receiveAll(conn, session, r.URL.Path, receive)
+}
+
+// receiveAll passes every message of a side session to receive until the
+// peer closes it
+func (l *Listener) receiveAll(conn transport.Conn, session *crypto.Session, path string, receive func(from string, plaintext []byte)) {
+	remoteKey, err := session.GetRemotePublicKey()
+	if err != nil {
+		return
+	}
+	from := crypto.PeerID(remoteKey)
+	bucket := newTokenBucket(l.limits.MessagesPerSecond, l.limits.MessageBurst)
+	for {
+		conn.SetReadDeadline(time.Now().Add(l.limits.IdleTimeout.Std()))
+		message, err := conn.ReadMessage()
+		if err != nil {
+			l.recordReadError(err, true)
+			return
+		}
+		// Throttled like chat: each message may cost a relay hop, a group
+		// key or a walk of the shared folders
+		if wait := bucket.take(time.Now()); wait > 0 {
+			l.stats.rateLimited.Add(1)
+			time.Sleep(wait)
+		}
+		plaintext, err := session.ReadMessage(message)
+		if err != nil {
+			listenerLogger.Debug("bad session message", "remote", conn.RemoteAddr(), "path", path, "err", err)
+			return
+		}
+		receive(from, plaintext)
+	}
+}
+
+// chatStream handles a raw TCP connection or QUIC stream, whose path, offer
+// and selection are exchanged in the first frames
+func (l *Listener) chatStream(conn net.Conn) {
 	defer conn.Close()
-	log.Printf("listener: new websocket connection from %s", r.RemoteAddr)
+	release, err := l.acquire(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	defer release()
+
+	conn.SetDeadline(time.Now().Add(l.limits.HandshakeTimeout.Std()))
+	framed, path, offer, selected, err := transport.AcceptTCP(conn, func(offer string) string {
+		return crypto.Select(offer, l.proto.SessionOptions()...)
+	})
+	if err != nil {
+		l.recordReadError(err, false)
+		listenerLogger.Debug("stream hello failed", "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+	conn.SetWriteDeadline(time.Time{})
+	listenerLogger.Debug("new stream connection", "remote", conn.RemoteAddr(), "path", path, "mode", selected)
+	if path == transport.ChatPath {
+		l.serve(framed, offer, selected)
+		return
+	}
+	l.streamSession(framed, path, offer, selected)
+}
+
+// streamSession serves a side endpoint on a raw TCP connection or QUIC
+// stream, as the websocket handlers do
+func (l *Listener) streamSession(conn transport.Conn, path, offer, selected string) {
+	var receive func(from string, plaintext []byte)
+	switch {
+	case path == relayPath && l.relay != nil:
+		receive = l.relay.receive
+	case path == groupPath && l.proto.Groups != nil:
+		receive = l.proto.Groups.Receive
+	case path == lobbyPath && l.proto.Lobby != nil:
+		receive = l.proto.Lobby.Receive
+	case path == filePath && l.proto.Transfers != nil:
+		receive = l.proto.Transfers.Receive
+	case path == fileDataPath && l.proto.Transfers != nil:
+		if session, ok := l.respond(conn, path, offer, selected); ok {
+			l.serveFileData(conn, session)
+		}
+		return
+	default:
+		listenerLogger.Debug("no such stream endpoint", "remote", conn.RemoteAddr(), "path", path)
+		return
+	}
+	session, ok := l.respond(conn, path, offer, selected)
+	if !ok {
+		return
+	}
+	l.receiveAll(conn, session, path, receive)
+}
+
+// serve runs the responder side of the chat protocol on conn until it closes
+func (l *Listener) serve(conn transport.Conn, offer, selected string) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	conn.SetReadLimit(int64(l.limits.MaxFrameSize))
+	// The Noise handshake must finish within the handshake timeout; after
+	// that the deadline is pushed forward by the idle timeout on every message
+	conn.SetReadDeadline(time.Now().Add(l.limits.HandshakeTimeout.Std()))
+	bucket := newTokenBucket(l.limits.MessagesPerSecond, l.limits.MessageBurst)
 
 	// Establish Noise Protocol session as responder
-	session, err := crypto.NewResponderSession(l.proto.PrivateKey)
+	opts := l.proto.SessionOptions()
+	session, err := crypto.NewResponderSession(l.proto.PrivateKey, slices.Concat(opts, []crypto.SessionOption{crypto.WithNegotiation(offer, selected)})...)
 	if err != nil {
+		listenerLogger.Warn("failed to create responder session", "remote", remote, "err", err)
 		return
 	}
 
 	// Store the peer once we identify it from the handshake
 	var peer *entity.Peer
 	peerID := ""
+	// The ICE candidate of a data channel says nothing about who is behind
+	// it, so only the handshake identifies the peer
+	byAddress := conn.RemoteAddr().Network() != string(transport.WebRTC)
 
 	for {
-		_, message, err := conn.ReadMessage()
+		message, err := conn.ReadMessage()
 		if err != nil {
+			l.recordReadError(err, session.IsHandshakeComplete())
+			listenerLogger.Debug("connection closed", "remote", remote, "err", err)
 			break
 		}
+		if session.IsHandshakeComplete() {
+			// Throttle rather than drop: skipping a message would desync the Noise nonces
+			if wait := bucket.take(time.Now()); wait > 0 {
+				l.stats.rateLimited.Add(1)
+				time.Sleep(wait)
+			}
+		}
 
 		// Decrypt using Noise Protocol (handshake happens on first message)
-		log.Printf("listener: received message from %s (len=%d), handshake complete before: %v", r.RemoteAddr, len(message), session.IsHandshakeComplete())
+		listenerLogger.Debug("received message", "remote", remote, "len", len(message), "handshake_complete", session.IsHandshakeComplete())
 		wasHandshaking := !session.IsHandshakeComplete()
 
 		decryptedMessage, err := session.ReadMessage(message)
@@ -65,37 +399,40 @@ func (l *Listener) chat(w http.ResponseWriter, r *http.Request) {
 			// 2. Nonce counter is out of sync
 			// 3. Session state was corrupted
 			if session.IsHandshakeComplete() {
-				log.Printf("listener: CRITICAL - decrypt failed after handshake complete: %v (message len=%d, from %s)", err, len(message), r.RemoteAddr)
+				listenerLogger.Error("decrypt failed after handshake complete", "remote", remote, "len", len(message), "err", err)
 				// After handshake, decryption failures are fatal - close connection
 				// The session state is corrupted and cannot be recovered
 				break
 			} else {
-				log.Printf("listener: decrypt error (handshake in progress): %v", err)
+				listenerLogger.Warn("decrypt error during handshake", "remote", remote, "err", err)
 			}
 			continue
 		}
 		handshakeCompleteAfter := session.IsHandshakeComplete()
+		if handshakeCompleteAfter {
+			conn.SetReadDeadline(time.Now().Add(l.limits.IdleTimeout.Std()))
+		}
 		if wasHandshaking && handshakeCompleteAfter {
-			log.Printf("listener: HANDSHAKE JUST COMPLETED! (decrypted len=%d)", len(decryptedMessage))
+			listenerLogger.Debug("handshake completed", "remote", remote, "len", len(decryptedMessage))
 		}
-		log.Printf("listener: decrypted message (len=%d), handshake complete after: %v", len(decryptedMessage), handshakeCompleteAfter)
+		listenerLogger.Debug("decrypted message", "remote", remote, "len", len(decryptedMessage), "handshake_complete", handshakeCompleteAfter)
 
 		// If handshake was in progress and we just received message 1, we need to send message 2
 		// In Noise Protocol XX, the responder must send message 2 after receiving message 1
 		if wasHandshaking && !handshakeCompleteAfter {
-			log.Printf("listener: sending handshake message 2 to complete handshake")
+			listenerLogger.Debug("sending handshake message 2", "remote", remote)
 			// Send message 2 (empty payload for handshake)
 			message2, err := session.WriteMessage(nil)
 			if err != nil {
-				log.Printf("listener: failed to create handshake message 2: %v", err)
+				listenerLogger.Warn("failed to create handshake message 2", "remote", remote, "err", err)
 			} else if len(message2) > 0 {
-				if err := conn.WriteMessage(websocket.BinaryMessage, message2); err != nil {
-					log.Printf("listener: failed to send handshake message 2: %v", err)
+				if err := conn.WriteMessage(message2); err != nil {
+					listenerLogger.Warn("failed to send handshake message 2", "remote", remote, "err", err)
 				} else {
-					log.Printf("listener: sent handshake message 2 (len=%d)", len(message2))
+					listenerLogger.Debug("sent handshake message 2", "remote", remote, "len", len(message2))
 					// Check if handshake is now complete
 					if session.IsHandshakeComplete() {
-						log.Printf("listener: handshake completed after sending message 2")
+						listenerLogger.Debug("handshake completed after sending message 2", "remote", remote)
 					}
 				}
 			}
@@ -115,44 +452,40 @@ func (l *Listener) chat(w http.ResponseWriter, r *http.Request) {
 					// Don't overwrite peer's session - the listener (responder) maintains its own session
 					// The peer's session is for the initiator side (sending messages)
 					// We just need to identify the peer, not share session state
-					log.Printf("listener: discovered peer %s via handshake", peerID)
-				} else {
+					listenerLogger.Debug("identified peer via handshake", "peer", peerID)
+					// The peer is back, so whatever we queued for it can go out
+					if l.proto.Outbox != nil {
+						l.proto.Outbox.DeliverNow(peer)
+					}
+				} else if byAddress {
 					// Peer not found by public key - might be a new peer or handshake not complete
 					// Try to find by IP as fallback
-					remoteAddr := r.RemoteAddr
-					ip, _, err := net.SplitHostPort(remoteAddr)
-					if err != nil {
-						ip = remoteAddr
-					}
+					ip := hostOf(remote)
 
 					peers := l.proto.Peers.GetPeers()
 					for _, p := range peers {
-						if p.AddrIP == ip {
+						if p.HasAddress(ip) {
 							peer = p
 							peerID = p.PeerID
 							// Don't overwrite peer's session - listener maintains its own session
-							log.Printf("listener: discovered peer %s via address %s (handshake in progress)", peerID, ip)
+							listenerLogger.Debug("identified peer via address during handshake", "peer", peerID, "ip", ip)
 							break
 						}
 					}
 				}
-			} else {
+			} else if byAddress {
 				// Handshake not complete yet - try to find peer by remote address
 				// This works even before handshake completes
-				remoteAddr := r.RemoteAddr
-				ip, _, err := net.SplitHostPort(remoteAddr)
-				if err != nil {
-					ip = remoteAddr
-				}
+				ip := hostOf(remote)
 
 				// Find peer by IP address
 				peers := l.proto.Peers.GetPeers()
 				for _, p := range peers {
-					if p.AddrIP == ip {
+					if p.HasAddress(ip) {
 						peer = p
 						peerID = p.PeerID
 						// Don't overwrite peer's session - listener maintains its own session
-						log.Printf("listener: discovered peer %s via address %s (before handshake)", peerID, ip)
+						listenerLogger.Debug("identified peer via address before handshake", "peer", peerID, "ip", ip)
 						break
 					}
 				}
@@ -176,34 +509,75 @@ func (l *Listener) chat(w http.ResponseWriter, r *http.Request) {
 			if author == "" {
 				author = peerID
 			}
-			peer.AddMessage(string(decryptedMessage), author)
-			log.Printf("listener: message from %s: %s", peerID, string(decryptedMessage))
+			peer.Receive(decryptedMessage, author)
+			listenerLogger.Debug("message received", "peer", peerID, "text", logging.Redact(string(decryptedMessage)))
 		}
 	}
 }
 
 func (l *Listener) meow(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	release, ok := l.admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	conn, err := l.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
 	conn.Close()
 }
 
+// serveQUIC accepts chat streams on the QUIC port. Without it QUIC peers
+// cannot reach us, but websocket and TCP keep working.
+func (l *Listener) serveQUIC() {
+	ln, err := transport.ListenQUIC(l.addr)
+	if err != nil {
+		listenerLogger.Warn("QUIC listener unavailable", "err", err)
+		return
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			listenerLogger.Error("QUIC listener stopped", "err", err)
+			return
+		}
+		go l.chatStream(conn)
+	}
+}
+
 func (l *Listener) Start() {
-	http.HandleFunc("/chat", l.chat)
-	http.HandleFunc("/meow", l.meow)
+	go l.serveQUIC()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(transport.ChatPath, l.chat)
+	mux.HandleFunc(relayPath, l.relaySession)
+	mux.HandleFunc(groupPath, l.groupSession)
+	mux.HandleFunc(lobbyPath, l.lobbySession)
+	mux.HandleFunc(filePath, l.fileSession)
+	mux.HandleFunc(fileDataPath, l.fileDataSession)
+	mux.HandleFunc("/meow", l.meow)
 
 	// Retry server startup if it fails (e.g., due to network changes)
 	for {
 		server := &http.Server{
-			Addr:    l.addr,
-			Handler: nil,
+			Handler:           mux,
+			ReadHeaderTimeout: l.limits.HandshakeTimeout.Std(),
 		}
 
-		err := server.ListenAndServe()
+		addr := l.addr
+		if addr == "" {
+			addr = ":http"
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			// Websocket and raw TCP chat connections share the port
+			err = server.Serve(newSniffListener(ln, l.limits.HandshakeTimeout.Std(), l.chatStream))
+		}
 		if err != nil {
-			log.Printf("listener: server error: %v, attempting to restart...", err)
+			listenerLogger.Error("server error, restarting", "err", err)
 			time.Sleep(2 * time.Second)
 			continue
 		}
@@ -0,0 +1,172 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/config"
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/proto"
+	"p2p-messenger/internal/transport"
+)
+
+// startListener serves the chat endpoint of a fresh node on every transport
+// like Start does, and returns the node and a peer entry pointing at it
+func startListener(t *testing.T, hybrid bool) (*proto.Proto, *entity.Peer) {
+	t.Helper()
+	node, err := proto.NewProto("0")
+	require.NoError(t, err)
+	node.Hybrid = hybrid
+
+	listener := NewListener("", node, config.Default().Limits)
+	mux := http.NewServeMux()
+	mux.HandleFunc(transport.ChatPath, listener.chat)
+	port := serveListener(t, listener, mux)
+	peer := &entity.Peer{
+		PeerID:                crypto.PeerID(node.PublicKey),
+		PublicKey:             node.PublicKey,
+		AddrIP:                "127.0.0.1",
+		Port:                  port,
+		PrimaryConnectionType: entity.ConnectionNAT,
+	}
+	return node, peer
+}
+
+// serveListener serves mux and raw TCP connections on one port, and QUIC
+// streams on the next, like Start does. It returns the port.
+func serveListener(t *testing.T, listener *Listener, mux *http.ServeMux) string {
+	t.Helper()
+	// The QUIC port follows the websocket port, so retry until both are free
+	var server *httptest.Server
+	var quicListener *transport.QUICListener
+	var err error
+	for attempt := 0; quicListener == nil; attempt++ {
+		server = httptest.NewUnstartedServer(mux)
+		server.Listener = newSniffListener(server.Listener, listener.limits.HandshakeTimeout.Std(), listener.chatStream)
+		server.Start()
+		quicListener, err = transport.ListenQUIC(server.Listener.Addr().String())
+		if err != nil {
+			server.Close()
+			require.Less(t, attempt, 5, "no free QUIC port: %v", err)
+		}
+	}
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { quicListener.Close() })
+	go func() {
+		for {
+			conn, err := quicListener.Accept()
+			if err != nil {
+				return
+			}
+			go listener.chatStream(conn)
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	return port
+}
+
+func TestListener_NegotiatesHandshakeMode(t *testing.T) {
+	tests := []struct {
+		name                         string
+		senderHybrid, receiverHybrid bool
+		want                         crypto.Mode
+	}{
+		{"both hybrid", true, true, crypto.ModeHybrid},
+		{"receiver classic", true, false, crypto.ModeClassic},
+		{"sender classic", false, true, crypto.ModeClassic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver, peer := startListener(t, tt.receiverHybrid)
+			sender, err := proto.NewProto("0")
+			require.NoError(t, err)
+			sender.Hybrid = tt.senderHybrid
+
+			// The receiver knows the sender, so incoming messages are attributed
+			senderEntry := &entity.Peer{PeerID: crypto.PeerID(sender.PublicKey), PublicKey: sender.PublicKey}
+			receiver.Peers.Add(senderEntry)
+
+			require.NoError(t, peer.SendMessage("hello", sender.PrivateKey, sender.SessionOptions()...))
+			defer peer.Close()
+			assert.Equal(t, tt.want, peer.SessionMode())
+
+			assert.Eventually(t, func() bool {
+				entry, ok := receiver.Peers.Get(senderEntry.PeerID)
+				if !ok {
+					return false
+				}
+				messages := entry.GetMessages()
+				return len(messages) == 1 && messages[0].Text == "hello"
+			}, 2*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// useTransport makes outgoing chat connections use kind for the rest of the test
+func useTransport(t *testing.T, kind transport.Kind) {
+	previous := transport.Preferred()
+	transport.SetPreferred(kind)
+	t.Cleanup(func() { transport.SetPreferred(previous) })
+}
+
+func TestListener_RekeyAndRenewKeepEveryMessage(t *testing.T) {
+	for _, kind := range transport.Kinds() {
+		t.Run(string(kind), func(t *testing.T) {
+			useTransport(t, kind)
+			receiver, peer := startListener(t, false)
+			sender, err := proto.NewProto("0")
+			require.NoError(t, err)
+			sender.SessionPolicy = crypto.RekeyPolicy{RekeyMessages: 2, MaxMessages: 5}
+			senderEntry := &entity.Peer{PeerID: crypto.PeerID(sender.PublicKey), PublicKey: sender.PublicKey}
+			receiver.Peers.Add(senderEntry)
+			defer peer.Close()
+
+			var want []string
+			sessions := make(map[*crypto.Session]bool)
+			for i := 0; i < 12; i++ {
+				text := fmt.Sprintf("message %d", i)
+				want = append(want, text)
+				require.NoError(t, peer.SendMessage(text, sender.PrivateKey, sender.SessionOptions()...))
+				sessions[peer.CurrentSession()] = true
+			}
+			assert.GreaterOrEqual(t, len(sessions), 3, "sessions must be renewed after MaxMessages")
+
+			assert.Eventually(t, func() bool {
+				var got []string
+				for _, message := range senderEntry.GetMessages() {
+					got = append(got, message.Text)
+				}
+				return assert.ObjectsAreEqual(want, got)
+			}, 2*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestListener_TCPTransport(t *testing.T) {
+	useTransport(t, transport.TCP)
+	receiver, peer := startListener(t, true)
+	sender, err := proto.NewProto("0")
+	require.NoError(t, err)
+	sender.Hybrid = true
+	senderEntry := &entity.Peer{PeerID: crypto.PeerID(sender.PublicKey), PublicKey: sender.PublicKey}
+	receiver.Peers.Add(senderEntry)
+
+	require.NoError(t, peer.SendMessage("over tcp", sender.PrivateKey, sender.SessionOptions()...))
+	defer peer.Close()
+	assert.Equal(t, crypto.ModeHybrid, peer.SessionMode())
+
+	assert.Eventually(t, func() bool {
+		messages := senderEntry.GetMessages()
+		return len(messages) == 1 && messages[0].Text == "over tcp"
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -2,25 +2,42 @@ package network
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os/exec"
-	"strconv"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/multiformats/go-multiaddr"
 
 	"p2p-messenger/internal/bluetooth"
+	"p2p-messenger/internal/config"
 	"p2p-messenger/internal/dht"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
 	"p2p-messenger/internal/proto"
+	"p2p-messenger/internal/transfer"
+	"p2p-messenger/internal/transport"
 )
 
+var logger = logging.For("network")
+
 const (
-	MulticastIP        = "224.0.0.1"
+	MulticastIP        = config.DefaultMulticastIP
 	ListenerIP         = "0.0.0.0"
-	MulticastFrequency = 1 * time.Second
+	MulticastFrequency = config.DefaultMulticastFrequency
+
+	// migrationTimeout bounds probing the new path of each QUIC connection
+	migrationTimeout = 5 * time.Second
+
+	groupPath = "/group"
+	lobbyPath = "/lobby"
+	// filePath carries file offers and answers, fileDataPath the chunks
+	filePath     = "/file"
+	fileDataPath = "/file/data"
 )
 
 type Manager struct {
@@ -29,30 +46,34 @@ type Manager struct {
 	Discoverer *Discoverer
 	BLE        *bluetooth.Manager
 	DHT        *dht.Manager
+	// Relay is nil unless mesh relaying is enabled
+	Relay *Relay
+
+	multicastIP          string
+	availabilityInterval time.Duration
 
 	// Cached availability status (updated periodically)
 	bleAvailable      bool
 	natAvailable      bool
 	internetAvailable bool
 	lastCheck         time.Time
-	checkMutex        sync.Mutex
+	// localAddrs is the set of local IPs seen by the last check
+	localAddrs string
+	checkMutex sync.Mutex
 }
 
-func NewManager(proto *proto.Proto) *Manager {
+// NewManager wires up the listener and every discovery transport enabled in cfg
+func NewManager(proto *proto.Proto, cfg *config.Config) *Manager {
 	multicastAddr, err := net.ResolveUDPAddr(
 		"udp",
-		fmt.Sprintf("%s:%s", MulticastIP, proto.Port))
+		fmt.Sprintf("%s:%s", cfg.Discovery.MulticastIP, proto.Port))
 	if err != nil {
-		log.Fatal(err)
+		// The config has already validated the multicast IP and port
+		panic(fmt.Sprintf("network: resolving multicast address: %v", err))
 	}
 
 	listenerAddr := fmt.Sprintf("%s:%s", ListenerIP, proto.Port)
 
-	portInt, err := strconv.Atoi(proto.Port)
-	if err != nil {
-		log.Fatalf("Invalid port: %v", err)
-	}
-
 	// DHT callback to add discovered peers
 	dhtPeerFoundCb := func(peerID string, addrs []multiaddr.Multiaddr) {
 		// Extract IP and port from multiaddr
@@ -86,23 +107,48 @@ func NewManager(proto *proto.Proto) *Manager {
 		}
 	}
 
-	dhtManager, err := dht.NewManager(portInt+1, dhtPeerFoundCb) // Use different port for DHT
-	if err != nil {
-		log.Printf("Warning: DHT initialization failed: %v", err)
+	manager := &Manager{
+		Proto:                proto,
+		Listener:             NewListener(listenerAddr, proto, cfg.Limits),
+		multicastIP:          cfg.Discovery.MulticastIP,
+		availabilityInterval: cfg.Discovery.AvailabilityInterval.Std(),
 	}
 
-	return &Manager{
-		Proto:      proto,
-		Listener:   NewListener(listenerAddr, proto),
-		Discoverer: NewDiscoverer(multicastAddr, MulticastFrequency, proto),
-		BLE:        bluetooth.NewManager(proto.PublicKeyStr, proto.Port, proto.Username, proto.Peers),
-		DHT:        dhtManager,
+	if cfg.Relay.Enabled {
+		manager.Relay = NewRelay(proto, cfg.Relay.MaxHops)
+		manager.Listener.relay = manager.Relay
+		manager.Relay.answer = manager.Listener.answerWebRTC
 	}
+	if cfg.Transports.Multicast {
+		manager.Discoverer = NewDiscoverer(multicastAddr, cfg.Discovery.MulticastFrequency.Std(), proto)
+	}
+	if cfg.Transports.BLE {
+		manager.BLE = bluetooth.NewManager(proto.PublicKeyStr, proto.Port, proto.Username, proto.Peers)
+		manager.BLE.SetWorkspace(proto.Workspace)
+	}
+	if cfg.Transports.DHT && cfg.Workspace.Enabled() {
+		// The DHT and mDNS advertise the node to anyone, workspace or not
+		logger.Info("DHT discovery disabled in workspace mode")
+	} else if cfg.Transports.DHT {
+		dhtManager, err := dht.NewManager(cfg.DHTPortOrDefault(), dhtPeerFoundCb) // Use different port for DHT
+		if err != nil {
+			logger.Warn("DHT initialization failed", "err", err)
+		} else {
+			manager.DHT = dhtManager
+		}
+	}
+
+	return manager
 }
 
 func (m *Manager) Start() {
 	go m.Listener.Start()
-	go m.Discoverer.Start()
+	if m.Relay != nil {
+		go m.Relay.Start()
+	}
+	if m.Discoverer != nil {
+		go m.Discoverer.Start()
+	}
 	if m.BLE != nil {
 		go m.BLE.Start()
 		// Give BLE manager a moment to initialize before checking
@@ -120,9 +166,54 @@ func (m *Manager) Start() {
 	go m.checkAvailabilityPeriodically()
 }
 
-// checkAvailabilityPeriodically checks availability of each mode every second
+// SendMessage sends text to peer over a direct connection, falling back to
+// the relay when the peer is only reachable through another node
+func (m *Manager) SendMessage(peer *entity.Peer, text string) error {
+	_, routed := peer.GetRoute()
+	var directErr error
+	if len(peer.Addresses()) > 0 || !routed {
+		directErr = peer.SendMessage(text, m.Proto.PrivateKey, m.Proto.SessionOptions()...)
+		if directErr == nil {
+			return nil
+		}
+	}
+	if m.Relay == nil || !routed {
+		return directErr
+	}
+	if err := m.Relay.Send(peer, text); err != nil {
+		return errors.Join(directErr, err)
+	}
+	return nil
+}
+
+// SendEnvelope sends a message or control on the chat session with peer
+func (m *Manager) SendEnvelope(peer *entity.Peer, env entity.Envelope) error {
+	return m.SendMessage(peer, env.Encode())
+}
+
+// SendGroup hands a group message to peer on a /group session
+func (m *Manager) SendGroup(peer *entity.Peer, data []byte) error {
+	return sendSession(m.Proto, peer, groupPath, data)
+}
+
+// SendLobby hands a lobby message to peer on a /lobby session
+func (m *Manager) SendLobby(peer *entity.Peer, data []byte) error {
+	return sendSession(m.Proto, peer, lobbyPath, data)
+}
+
+// SendFileControl hands a file offer or answer to peer on a file session
+func (m *Manager) SendFileControl(peer *entity.Peer, data []byte) error {
+	return sendSession(m.Proto, peer, filePath, data)
+}
+
+// DialFile opens a stream for the chunks of a file to peer
+func (m *Manager) DialFile(peer *entity.Peer) (transfer.Stream, error) {
+	return dialStream(m.Proto, peer, fileDataPath)
+}
+
+// checkAvailabilityPeriodically checks availability of each mode every availabilityInterval
 func (m *Manager) checkAvailabilityPeriodically() {
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := time.NewTicker(m.availabilityInterval)
 	defer ticker.Stop()
 
 	for {
@@ -146,7 +237,7 @@ func (m *Manager) updateAvailability() {
 		func() {
 			defer func() {
 				if r := recover(); r != nil {
-					log.Printf("network: BLE availability check panic: %v", r)
+					logger.Error("BLE availability check panic", "panic", r)
 					// On panic, read current value
 					m.checkMutex.Lock()
 					bleAvail = m.bleAvailable
@@ -172,7 +263,7 @@ func (m *Manager) updateAvailability() {
 	func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("network: NAT availability check panic: %v", r)
+				logger.Error("NAT availability check panic", "panic", r)
 				natAvail = currentNat
 			}
 		}()
@@ -184,7 +275,7 @@ func (m *Manager) updateAvailability() {
 	func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("network: Internet availability check panic: %v", r)
+				logger.Error("Internet availability check panic", "panic", r)
 				internetAvail = currentInternet
 			}
 		}()
@@ -192,11 +283,58 @@ func (m *Manager) updateAvailability() {
 	}()
 
 	// Update NAT and Internet atomically
+	addrs := localAddresses()
 	m.checkMutex.Lock()
 	m.natAvailable = natAvail
 	m.internetAvailable = internetAvail
 	m.lastCheck = time.Now()
+	changed := m.localAddrs != "" && addrs != "" && addrs != m.localAddrs
+	if addrs != "" {
+		m.localAddrs = addrs
+	}
 	m.checkMutex.Unlock()
+
+	// Outgoing QUIC connections follow us to the new network instead of
+	// timing out
+	if changed {
+		go migrateQUIC()
+	}
+}
+
+// localAddresses returns the sorted non-loopback IPs of all interfaces that
+// are up, or "" if there are none
+func localAddresses() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var ips []string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				ips = append(ips, ipNet.IP.String())
+			}
+		}
+	}
+	slices.Sort(ips)
+	return strings.Join(ips, ",")
+}
+
+func migrateQUIC() {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+	if err := transport.MigrateQUIC(ctx); err != nil {
+		logger.Warn("QUIC migration failed for some connections", "err", err)
+		return
+	}
+	logger.Info("network changed, migrated QUIC connections")
 }
 
 // checkNATAvailable checks if NAT/multicast is possible on current network
@@ -248,7 +386,7 @@ func (m *Manager) checkNATAvailable() bool {
 	// Now check if multicast actually works
 	// Try to create a test multicast connection
 	// If multicast is blocked (like on school WiFi), this will fail
-	testAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%s", MulticastIP, m.Proto.Port))
+	testAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%s", m.multicastIP, m.Proto.Port))
 	if err != nil {
 		return false
 	}
@@ -317,3 +455,8 @@ func (m *Manager) GetAvailableModes() (bleAvailable, natAvailable, internetAvail
 	defer m.checkMutex.Unlock()
 	return m.bleAvailable, m.natAvailable, m.internetAvailable
 }
+
+// GetDiagnostics returns the listener's connection and limit counters
+func (m *Manager) GetDiagnostics() entity.Diagnostics {
+	return m.Listener.Diagnostics()
+}
@@ -0,0 +1,22 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/config"
+	"p2p-messenger/internal/proto"
+)
+
+func TestNewManager_WorkspaceSkipsDHT(t *testing.T) {
+	node, err := proto.NewProto("0")
+	require.NoError(t, err)
+	cfg := config.Default()
+	cfg.Transports.Multicast, cfg.Transports.BLE = false, false
+	cfg.Workspace.Secret = "team secret"
+
+	m := NewManager(node, cfg)
+	assert.Nil(t, m.DHT, "outsiders must not find the node through the DHT or mDNS")
+}
@@ -0,0 +1,89 @@
+package network
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	"p2p-messenger/internal/transport"
+)
+
+// sniffListener shares one listening socket between HTTP and the raw TCP chat
+// protocol. It peeks at the first bytes of every connection: raw chat
+// connections are handed to raw, everything else is returned by Accept.
+type sniffListener struct {
+	net.Listener
+	timeout time.Duration
+	raw     func(net.Conn)
+	conns   chan net.Conn
+	done    chan struct{}
+	err     error // set before done is closed
+}
+
+func newSniffListener(ln net.Listener, timeout time.Duration, raw func(net.Conn)) *sniffListener {
+	s := &sniffListener{
+		Listener: ln,
+		timeout:  timeout,
+		raw:      raw,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *sniffListener) run() {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			s.err = err
+			close(s.done)
+			return
+		}
+		go s.sniff(conn)
+	}
+}
+
+// sniff waits at most timeout for the first bytes, so silent connections
+// cannot pile up
+func (s *sniffListener) sniff(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(s.timeout))
+	prefix, err := reader.Peek(transport.HelloSize)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	peeked := &peekedConn{Conn: conn, reader: reader}
+	if transport.IsTCPHello(prefix) {
+		s.raw(peeked)
+		return
+	}
+	select {
+	case s.conns <- peeked:
+	case <-s.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection that is not a raw chat connection
+func (s *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// peekedConn replays the bytes consumed while sniffing
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
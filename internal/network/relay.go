@@ -0,0 +1,568 @@
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
+	"p2p-messenger/internal/proto"
+	"p2p-messenger/internal/transport"
+)
+
+var relayLogger = logging.For("relay")
+
+const (
+	relayPath = "/relay"
+	// routeInterval is how often every neighbour is told our routes
+	routeInterval = 15 * time.Second
+	// routeLifetime drops routes whose advertiser went quiet
+	routeLifetime = 3 * routeInterval
+	// seenLifetime is how long envelopes are remembered to drop duplicates
+	seenLifetime = 5 * time.Minute
+	// maxRoutesPerNeighbour and maxRoutes bound the peers reached through
+	// one neighbour and through all of them
+	maxRoutesPerNeighbour = 64
+	maxRoutes             = 256
+	// adLifetime is how old a signed route ad may be when it arrives. It
+	// waits up to routeInterval at each hop, and clocks differ.
+	adLifetime = 2 * time.Minute
+)
+
+var ErrNoRoute = errors.New("no relay route to peer")
+
+// relayMessage is the plaintext of a message on a relay session
+type relayMessage struct {
+	Envelope *envelope `json:"envelope,omitempty"`
+	Routes   []routeAd `json:"routes,omitempty"`
+}
+
+// envelope carries a sealed chat message towards its recipient. Relays only
+// read the header; the payload is end-to-end encrypted.
+type envelope struct {
+	ID string `json:"id"`
+	To string `json:"to"`
+	// Hops is how many more connections the envelope may take
+	Hops    int    `json:"hops"`
+	Payload []byte `json:"payload"`
+}
+
+// sealedSignal is the sealed payload of an envelope that carries a WebRTC
+// offer or answer instead of a chat message
+type sealedSignal struct {
+	WebRTC *webrtcSignal `json:"webrtc"`
+}
+
+type webrtcSignal struct {
+	// Call pairs an answer with its offer
+	Call   string `json:"call"`
+	Offer  []byte `json:"offer,omitempty"`
+	Answer []byte `json:"answer,omitempty"`
+}
+
+// call is an offer waiting for the answer of peerID
+type call struct {
+	peerID string
+	answer chan []byte
+}
+
+// routeAd tells a neighbour that the advertiser reaches a peer in Hops
+// connections. The peer signs the ad itself, with Hops 0, and every relay
+// passes the signed ad on, so nobody can advertise a peer that isn't there.
+type routeAd struct {
+	PeerID    string           `json:"peer_id"`
+	PublicKey []byte           `json:"public_key"`
+	Username  string           `json:"username,omitempty"`
+	Hops      int              `json:"hops"`
+	Time      time.Time        `json:"time"`
+	Signature crypto.Signature `json:"signature"`
+}
+
+// signedBytes returns what the advertised peer signs; the hop count changes
+// on the way and is left out
+func (ad routeAd) signedBytes() []byte {
+	ad.Hops = 0
+	ad.Signature = crypto.Signature{}
+	data, _ := json.Marshal(ad)
+	return data
+}
+
+// authentic reports whether the advertised peer signed the ad recently
+func (ad routeAd) authentic(now time.Time) bool {
+	return ad.Hops >= 0 && crypto.PeerID(ad.PublicKey) == ad.PeerID && now.Sub(ad.Time).Abs() <= adLifetime &&
+		ad.Signature.Verify(ad.PublicKey, ad.signedBytes()) == nil
+}
+
+// Relay forwards sealed envelopes between peers that cannot reach each
+// other directly. Every node tells its neighbours, the peers it can reach
+// directly, which peers it can reach and how far away they are; routes are
+// kept on the peer entries.
+type Relay struct {
+	proto   *proto.Proto
+	maxHops int
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// ads holds the latest ad each neighbour or routed peer signed for
+	// itself; only peers with one are advertised further
+	ads   map[string]routeAd
+	calls map[string]call
+
+	// answer answers WebRTC offers that come through the relay; without it
+	// they are dropped
+	answer func(offer []byte) ([]byte, error)
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewRelay(proto *proto.Proto, maxHops int) *Relay {
+	return &Relay{
+		proto:   proto,
+		maxHops: maxHops,
+		seen:    make(map[string]time.Time),
+		ads:     make(map[string]routeAd),
+		calls:   make(map[string]call),
+		done:    make(chan struct{}),
+	}
+}
+
+// keep stores ad unless a newer one of the same peer is stored
+func (r *Relay) keep(ad routeAd) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.ads[ad.PeerID]; ok && !ad.Time.After(existing.Time) {
+		return
+	}
+	ad.Hops = 0
+	r.ads[ad.PeerID] = ad
+}
+
+func (r *Relay) signedAd(peerID string) (routeAd, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ad, ok := r.ads[peerID]
+	return ad, ok
+}
+
+// selfAd returns a freshly signed ad of ourselves
+func (r *Relay) selfAd() (routeAd, bool) {
+	if r.proto.SigningKey == nil {
+		return routeAd{}, false
+	}
+	ad := routeAd{PeerID: crypto.PeerID(r.proto.PublicKey), PublicKey: r.proto.PublicKey, Username: r.proto.Username, Time: time.Now()}
+	ad.Signature = crypto.Sign(r.proto.SigningKey, ad.signedBytes())
+	return ad, true
+}
+
+// routeCounts returns how many peers are reached through each neighbour,
+// and through all of them
+func (r *Relay) routeCounts() (map[string]int, int) {
+	counts := make(map[string]int)
+	total := 0
+	for _, peer := range r.proto.Peers.GetPeers() {
+		if route, ok := peer.GetRoute(); ok {
+			counts[route.Via]++
+			total++
+		}
+	}
+	return counts, total
+}
+
+// Start advertises routes and expires old ones until Close
+func (r *Relay) Start() {
+	ticker := time.NewTicker(routeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+		r.expire(time.Now())
+		r.advertise()
+	}
+}
+
+func (r *Relay) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
+
+// Send seals text for peer and hands it to the neighbour on its route
+func (r *Relay) Send(peer *entity.Peer, text string) error {
+	return r.send(peer, []byte(text))
+}
+
+// Signal returns a transport.Signal that takes a WebRTC offer to peer and
+// the answer back in sealed envelopes, so that ICE can connect peers that
+// only reach each other through relays
+func (r *Relay) Signal(peer *entity.Peer) transport.Signal {
+	return func(ctx context.Context, offer []byte) ([]byte, error) {
+		id := entity.NewMessageID()
+		answer := make(chan []byte, 1)
+		r.mu.Lock()
+		r.calls[id] = call{peerID: peer.PeerID, answer: answer}
+		r.mu.Unlock()
+		defer func() {
+			r.mu.Lock()
+			delete(r.calls, id)
+			r.mu.Unlock()
+		}()
+
+		data, err := json.Marshal(sealedSignal{WebRTC: &webrtcSignal{Call: id, Offer: offer}})
+		if err != nil {
+			return nil, err
+		}
+		if err := r.send(peer, data); err != nil {
+			return nil, err
+		}
+		select {
+		case sdp := <-answer:
+			return sdp, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *Relay) send(peer *entity.Peer, plaintext []byte) error {
+	route, ok := peer.GetRoute()
+	if !ok {
+		return ErrNoRoute
+	}
+	via, ok := r.proto.Peers.Get(route.Via)
+	if !ok {
+		return ErrNoRoute
+	}
+	payload, err := crypto.Seal(r.proto.PrivateKey, peer.PublicKey, plaintext, r.proto.SessionOptions()...)
+	if err != nil {
+		return err
+	}
+	env := &envelope{ID: entity.NewMessageID(), To: peer.PeerID, Hops: r.maxHops, Payload: payload}
+	r.firstSeen(env.ID, time.Now())
+	relayLogger.Debug("relaying message", "peer", peer.PeerID, "via", route.Via, "hops", route.Hops)
+	return r.sendTo(via, relayMessage{Envelope: env})
+}
+
+// neighbours returns the peers we can reach directly
+func (r *Relay) neighbours() []*entity.Peer {
+	var neighbours []*entity.Peer
+	for _, peer := range r.proto.Peers.GetPeers() {
+		if len(peer.PublicKey) > 0 && len(peer.Addresses()) > 0 {
+			neighbours = append(neighbours, peer)
+		}
+	}
+	return neighbours
+}
+
+// advertise tells every neighbour about ourselves and which peers we reach.
+// Routes are not advertised back to the neighbour they were learned from.
+func (r *Relay) advertise() {
+	neighbours := r.neighbours()
+	peers := r.proto.Peers.GetPeers()
+	self, signed := r.selfAd()
+	for _, neighbour := range neighbours {
+		var ads []routeAd
+		if signed {
+			ads = append(ads, self)
+		}
+		for _, peer := range peers {
+			if peer.PeerID == neighbour.PeerID {
+				continue
+			}
+			ad, ok := r.signedAd(peer.PeerID)
+			if !ok {
+				continue
+			}
+			ad.Hops = 1
+			if slices.Contains(neighbours, peer) {
+				ads = append(ads, ad)
+			} else if route, ok := peer.GetRoute(); ok && route.Via != neighbour.PeerID && route.Hops < r.maxHops {
+				ad.Hops = route.Hops
+				ads = append(ads, ad)
+			}
+		}
+		if len(ads) == 0 {
+			continue
+		}
+		if err := r.sendTo(neighbour, relayMessage{Routes: ads}); err != nil {
+			relayLogger.Debug("failed to advertise routes", "peer", neighbour.PeerID, "err", err)
+		}
+	}
+}
+
+// expire forgets routes that were not advertised again in time, and peers
+// that were only reachable through them
+func (r *Relay) expire(now time.Time) {
+	for _, peer := range r.proto.Peers.GetPeers() {
+		route, ok := peer.GetRoute()
+		if !ok || now.Before(route.Expires) {
+			continue
+		}
+		peer.ClearRoute()
+		if len(peer.Addresses()) == 0 {
+			relayLogger.Info("relay route lost", "peer", peer.PeerID)
+			r.proto.Peers.Delete(peer.PeerID)
+		} else {
+			peer.RemoveConnectionType(entity.ConnectionRelay)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, seen := range r.seen {
+		if now.Sub(seen) > seenLifetime {
+			delete(r.seen, id)
+		}
+	}
+	for id, ad := range r.ads {
+		if now.Sub(ad.Time) > adLifetime {
+			delete(r.ads, id)
+		}
+	}
+}
+
+// firstSeen records id and reports whether it was new
+func (r *Relay) firstSeen(id string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.seen[id]; ok {
+		return false
+	}
+	r.seen[id] = now
+	return true
+}
+
+// receive handles a message from the neighbour with peer ID from, whose
+// identity the Noise handshake of the relay session proved
+func (r *Relay) receive(from string, plaintext []byte) {
+	var msg relayMessage
+	if err := json.Unmarshal(plaintext, &msg); err != nil {
+		relayLogger.Debug("bad relay message", "peer", from, "err", err)
+		return
+	}
+	if len(msg.Routes) > 0 {
+		r.learn(from, msg.Routes)
+	}
+	if msg.Envelope != nil {
+		r.handleEnvelope(from, msg.Envelope)
+	}
+}
+
+// direct reports whether peer has an address on a local network. Peers known
+// only by internet addresses may be behind a NAT that keeps us out, so
+// routes to them are kept too.
+func direct(peer *entity.Peer) bool {
+	return slices.ContainsFunc(peer.Addresses(), func(addr entity.Address) bool {
+		return addr.Source != entity.ConnectionInternet
+	})
+}
+
+// learn records routes through the neighbour from to peers that we cannot
+// reach directly. A shorter route is kept until it expires. Only ads the
+// peer signed itself are taken, and only so many through one neighbour.
+func (r *Relay) learn(from string, ads []routeAd) {
+	if _, ok := r.proto.Peers.Get(from); !ok {
+		return
+	}
+	self := crypto.PeerID(r.proto.PublicKey)
+	now := time.Now()
+	expires := now.Add(routeLifetime)
+	counts, total := r.routeCounts()
+	for _, ad := range ads {
+		if !ad.authentic(now) {
+			continue
+		}
+		if ad.PeerID == from {
+			r.keep(ad)
+			continue
+		}
+		hops := ad.Hops + 1
+		if ad.PeerID == self || hops > r.maxHops {
+			continue
+		}
+		routed := false
+		if peer, ok := r.proto.Peers.Get(ad.PeerID); ok {
+			if direct(peer) {
+				continue
+			}
+			route, ok := peer.GetRoute()
+			if ok && route.Via != from && route.Hops < hops && time.Now().Before(route.Expires) {
+				continue
+			}
+			routed = ok
+			if ok && route.Via == from {
+				// Refreshing a route takes no more room
+				r.keep(ad)
+				r.addRouted(ad.PeerID, ad.PublicKey, ad.Username, entity.Route{Via: from, Hops: hops, Expires: expires})
+				continue
+			}
+		}
+		if counts[from] >= maxRoutesPerNeighbour || (!routed && total >= maxRoutes) {
+			relayLogger.Debug("route limit reached", "via", from, "peer", ad.PeerID)
+			continue
+		}
+		counts[from]++
+		if !routed {
+			total++
+		}
+		r.keep(ad)
+		r.addRouted(ad.PeerID, ad.PublicKey, ad.Username, entity.Route{Via: from, Hops: hops, Expires: expires})
+	}
+}
+
+// addRouted adds or updates a peer that is reached through route
+func (r *Relay) addRouted(peerID string, publicKey []byte, username string, route entity.Route) *entity.Peer {
+	entry := &entity.Peer{PeerID: peerID, PublicKey: publicKey, Username: username, Messages: make([]*entity.Message, 0)}
+	entry.AddConnectionType(entity.ConnectionRelay)
+	r.proto.Peers.Add(entry)
+	peer, ok := r.proto.Peers.Get(peerID)
+	if !ok {
+		return entry
+	}
+	if _, known := peer.GetRoute(); !known {
+		relayLogger.Info("learned relay route", "peer", peerID, "via", route.Via, "hops", route.Hops)
+		peer.SetSignal(r.Signal(peer))
+	}
+	peer.SetRoute(route)
+	return peer
+}
+
+func (r *Relay) handleEnvelope(from string, env *envelope) {
+	now := time.Now()
+	if !r.firstSeen(env.ID, now) {
+		return
+	}
+	if env.To == crypto.PeerID(r.proto.PublicKey) {
+		r.deliver(from, env, now)
+		return
+	}
+	if env.Hops <= 1 {
+		relayLogger.Debug("dropping envelope at hop limit", "to", env.To)
+		return
+	}
+	next, ok := r.nextHop(env.To, from)
+	if !ok {
+		relayLogger.Debug("no route for envelope", "to", env.To)
+		return
+	}
+	env.Hops--
+	if err := r.sendTo(next, relayMessage{Envelope: env}); err != nil {
+		relayLogger.Debug("failed to forward envelope", "to", env.To, "via", next.PeerID, "err", err)
+	}
+}
+
+// nextHop returns the peer an envelope to peerID is handed to, never
+// sending it back where it came from
+func (r *Relay) nextHop(peerID, from string) (*entity.Peer, bool) {
+	peer, ok := r.proto.Peers.Get(peerID)
+	if !ok {
+		return nil, false
+	}
+	route, routed := peer.GetRoute()
+	if direct(peer) || !routed {
+		return peer, len(peer.Addresses()) > 0
+	}
+	if route.Via == from {
+		return nil, false
+	}
+	return r.proto.Peers.Get(route.Via)
+}
+
+// deliver opens an envelope addressed to us and adds it to the conversation
+// with its sender
+func (r *Relay) deliver(from string, env *envelope, now time.Time) {
+	sender, plaintext, err := crypto.OpenSealed(r.proto.PrivateKey, env.Payload, r.proto.SessionOptions()...)
+	if err != nil {
+		relayLogger.Debug("cannot open envelope", "via", from, "err", err)
+		return
+	}
+	// A relay could replay the payload under a new envelope ID
+	digest := sha256.Sum256(env.Payload)
+	if !r.firstSeen(hex.EncodeToString(digest[:]), now) {
+		return
+	}
+
+	senderID := crypto.PeerID(sender)
+	peer, reachable := r.proto.Peers.Get(senderID)
+	if reachable {
+		_, routed := peer.GetRoute()
+		reachable = routed || direct(peer)
+	}
+	if !reachable {
+		if _, total := r.routeCounts(); total >= maxRoutes {
+			relayLogger.Debug("route limit reached, dropping envelope", "peer", senderID, "via", from)
+			return
+		}
+		// The reply takes the way the envelope came
+		hops := max(r.maxHops-env.Hops+1, 2)
+		peer = r.addRouted(senderID, sender, "", entity.Route{Via: from, Hops: hops, Expires: now.Add(routeLifetime)})
+	}
+	var signal sealedSignal
+	if json.Unmarshal(plaintext, &signal) == nil && signal.WebRTC != nil {
+		r.handleSignal(peer, *signal.WebRTC)
+		return
+	}
+	author := peer.Username
+	if author == "" {
+		author = senderID
+	}
+	peer.Receive(plaintext, author)
+	relayLogger.Debug("relayed message received", "peer", senderID, "via", from, "text", logging.Redact(string(plaintext)))
+}
+
+// handleSignal passes an answer to the offer waiting for it, and answers an
+// offer on the way the offer came
+func (r *Relay) handleSignal(peer *entity.Peer, signal webrtcSignal) {
+	if signal.Answer != nil {
+		r.mu.Lock()
+		c, ok := r.calls[signal.Call]
+		r.mu.Unlock()
+		if ok && c.peerID == peer.PeerID {
+			select {
+			case c.answer <- signal.Answer:
+			default:
+			}
+		}
+		return
+	}
+	if signal.Offer == nil || r.answer == nil {
+		return
+	}
+	go func() {
+		answer, err := r.answer(signal.Offer)
+		if err != nil {
+			relayLogger.Debug("failed to answer webrtc offer", "peer", peer.PeerID, "err", err)
+			return
+		}
+		data, err := json.Marshal(sealedSignal{WebRTC: &webrtcSignal{Call: signal.Call, Answer: answer}})
+		if err == nil {
+			err = r.send(peer, data)
+		}
+		if err != nil {
+			relayLogger.Debug("failed to send webrtc answer", "peer", peer.PeerID, "err", err)
+		}
+	}()
+}
+
+// sendTo hands msg to a neighbour over a relay session and waits until the
+// neighbour has read it
+func (r *Relay) sendTo(neighbour *entity.Peer, msg relayMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	err = sendSession(r.proto, neighbour, relayPath, data)
+	if errors.Is(err, errNoAddress) {
+		return fmt.Errorf("%w: %s has no address", ErrNoRoute, neighbour.PeerID)
+	}
+	return err
+}
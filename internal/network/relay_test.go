@@ -0,0 +1,222 @@
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/config"
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/proto"
+	"p2p-messenger/internal/transport"
+)
+
+const relayTestHops = 3
+
+// startRelay serves the relay endpoint of a fresh node and returns the node,
+// its relay and a peer entry pointing at it
+func startRelay(t *testing.T, username string) (*proto.Proto, *Relay, *entity.Peer) {
+	t.Helper()
+	node, err := proto.NewProto("0")
+	require.NoError(t, err)
+	node.Username = username
+	relay := NewRelay(node, relayTestHops)
+	t.Cleanup(relay.Close)
+
+	listener := NewListener("", node, config.Default().Limits)
+	listener.relay = relay
+	relay.answer = listener.answerWebRTC
+	mux := http.NewServeMux()
+	mux.HandleFunc(relayPath, listener.relaySession)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	return node, relay, &entity.Peer{
+		PeerID:                crypto.PeerID(node.PublicKey),
+		PublicKey:             node.PublicKey,
+		Username:              username,
+		AddrIP:                "127.0.0.1",
+		Port:                  port,
+		PrimaryConnectionType: entity.ConnectionNAT,
+		Messages:              make([]*entity.Message, 0),
+	}
+}
+
+// know adds a copy of entry to node's peers, making it a neighbour
+func know(node *proto.Proto, entry *entity.Peer) {
+	node.Peers.Add(&entity.Peer{
+		PeerID:                entry.PeerID,
+		PublicKey:             entry.PublicKey,
+		Username:              entry.Username,
+		AddrIP:                entry.AddrIP,
+		Port:                  entry.Port,
+		PrimaryConnectionType: entry.PrimaryConnectionType,
+		Messages:              make([]*entity.Message, 0),
+	})
+}
+
+// advertiseThrough has peer sign an ad of itself for relay, which then
+// advertises peer to its neighbours
+func advertiseThrough(t *testing.T, relay, peerRelay *Relay, peer *entity.Peer) {
+	t.Helper()
+	peerRelay.advertise()
+	require.Eventually(t, func() bool {
+		_, ok := relay.signedAd(peer.PeerID)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	relay.advertise()
+}
+
+func TestRelay_DeliversThroughMutualNeighbour(t *testing.T) {
+	a, relayA, peerA := startRelay(t, "alice")
+	b, relayB, peerB := startRelay(t, "bob")
+	c, relayC, peerC := startRelay(t, "carol")
+	// A and C only see B
+	know(a, peerB)
+	know(c, peerB)
+	know(b, peerA)
+	know(b, peerC)
+
+	advertiseThrough(t, relayB, relayC, peerC)
+	require.Eventually(t, func() bool {
+		peer, ok := a.Peers.Get(peerC.PeerID)
+		if !ok {
+			return false
+		}
+		route, ok := peer.GetRoute()
+		return ok && route.Via == peerB.PeerID && route.Hops == 2
+	}, time.Second, 10*time.Millisecond)
+	toC, _ := a.Peers.Get(peerC.PeerID)
+	assert.Equal(t, "carol", toC.Username)
+	assert.Contains(t, toC.ConnectionTypes, entity.ConnectionRelay)
+	assert.Empty(t, toC.Addresses())
+
+	require.NoError(t, relayA.Send(toC, "hello carol"))
+	var fromA *entity.Peer
+	require.Eventually(t, func() bool {
+		var ok bool
+		fromA, ok = c.Peers.Get(peerA.PeerID)
+		return ok && len(fromA.GetMessages()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "hello carol", fromA.GetMessages()[0].Text)
+	route, ok := fromA.GetRoute()
+	require.True(t, ok, "the reply goes back the same way")
+	assert.Equal(t, peerB.PeerID, route.Via)
+
+	// B forwarded the envelope but never saw the text
+	_, ok = b.Peers.Get(peerA.PeerID)
+	require.True(t, ok)
+	for _, peer := range b.Peers.GetPeers() {
+		assert.Empty(t, peer.GetMessages())
+	}
+}
+
+func TestRelay_SignalsWebRTC(t *testing.T) {
+	useTransport(t, transport.WebRTC)
+	a, _, peerA := startRelay(t, "alice")
+	b, relayB, peerB := startRelay(t, "bob")
+	c, relayC, peerC := startRelay(t, "carol")
+	know(a, peerB)
+	know(c, peerB)
+	know(b, peerA)
+	know(b, peerC)
+	advertiseThrough(t, relayB, relayC, peerC)
+	var toC *entity.Peer
+	require.Eventually(t, func() bool {
+		var ok bool
+		toC, ok = a.Peers.Get(peerC.PeerID)
+		return ok && len(toC.PublicKey) > 0
+	}, time.Second, 10*time.Millisecond)
+	require.Empty(t, toC.Addresses())
+
+	// A cannot dial C, so the offer and answer go through B and chat
+	// moves onto a data channel between A and C
+	require.NoError(t, toC.SendMessage("over webrtc", a.PrivateKey, a.SessionOptions()...))
+	defer toC.Close()
+	require.Eventually(t, func() bool {
+		fromA, ok := c.Peers.Get(peerA.PeerID)
+		return ok && len(fromA.GetMessages()) == 1 && fromA.GetMessages()[0].Text == "over webrtc"
+	}, 2*time.Second, 10*time.Millisecond)
+	for _, peer := range b.Peers.GetPeers() {
+		assert.Empty(t, peer.GetMessages())
+	}
+}
+
+func TestRelay_HopLimitAndDuplicates(t *testing.T) {
+	a, _, peerA := startRelay(t, "alice")
+	b, relayB, _ := startRelay(t, "bob")
+	c, _, peerC := startRelay(t, "carol")
+	know(b, peerC)
+	know(b, peerA)
+
+	send := func(id string, hops int) {
+		payload, err := crypto.Seal(a.PrivateKey, c.PublicKey, []byte(id))
+		require.NoError(t, err)
+		data, err := json.Marshal(relayMessage{Envelope: &envelope{ID: id, To: peerC.PeerID, Hops: hops, Payload: payload}})
+		require.NoError(t, err)
+		relayB.receive(peerA.PeerID, data)
+	}
+	received := func() []string {
+		var texts []string
+		if peer, ok := c.Peers.Get(peerA.PeerID); ok {
+			for _, message := range peer.GetMessages() {
+				texts = append(texts, message.Text)
+			}
+		}
+		return texts
+	}
+
+	send("spent", 1)
+	send("once", 2)
+	send("once", 2)
+	assert.Equal(t, []string{"once"}, received(), "the spent envelope and the duplicate are dropped")
+}
+
+func TestRelay_LearnsBoundedSignedRoutes(t *testing.T) {
+	a, relayA, _ := startRelay(t, "alice")
+	_, _, peerB := startRelay(t, "bob")
+	know(a, peerB)
+
+	ad := func(at time.Time) routeAd {
+		identity, err := crypto.NewIdentity()
+		require.NoError(t, err)
+		publicKey := identity.Keypair().Public
+		ad := routeAd{PeerID: crypto.PeerID(publicKey), PublicKey: publicKey, Time: at}
+		ad.Signature = crypto.Sign(identity.SigningKey(), ad.signedBytes())
+		ad.Hops = 1
+		return ad
+	}
+	_, publicKey, err := crypto.GenerateKeypair()
+	require.NoError(t, err)
+	forged := ad(time.Now())
+	forged.PeerID, forged.PublicKey = crypto.PeerID(publicKey), publicKey
+	stale := ad(time.Now().Add(-adLifetime - time.Minute))
+	renamed := ad(time.Now())
+	renamed.Username = "mallory"
+	relayA.learn(peerB.PeerID, []routeAd{forged, stale, renamed})
+	_, total := relayA.routeCounts()
+	assert.Zero(t, total, "ads the peer did not sign just now are dropped")
+
+	var ads []routeAd
+	for range maxRoutesPerNeighbour + 10 {
+		ads = append(ads, ad(time.Now()))
+	}
+	relayA.learn(peerB.PeerID, ads)
+	counts, total := relayA.routeCounts()
+	assert.Equal(t, maxRoutesPerNeighbour, counts[peerB.PeerID])
+	assert.Equal(t, maxRoutesPerNeighbour, total)
+
+	// Advertising them again refreshes the routes without taking more
+	relayA.learn(peerB.PeerID, ads)
+	_, total = relayA.routeCounts()
+	assert.Equal(t, maxRoutesPerNeighbour, total)
+}
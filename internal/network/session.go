@@ -0,0 +1,120 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/proto"
+	"p2p-messenger/internal/transport"
+)
+
+// sessionTimeout bounds handing one message to a peer on a side session
+const sessionTimeout = 10 * time.Second
+
+var errNoAddress = errors.New("peer has no address")
+
+// sendSession opens a Noise session with peer on path, trying its addresses
+// in order, sends data and waits until the peer has read it. Side sessions
+// like /relay and /group carry control messages next to the chat connection.
+func sendSession(proto *proto.Proto, peer *entity.Peer, path string, data []byte) error {
+	var errs []error
+	for _, addr := range peer.Addresses() {
+		err := sendSessionTo(proto, addr, path, peer.PublicKey, data)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errNoAddress
+	}
+	return errors.Join(errs...)
+}
+
+func sendSessionTo(proto *proto.Proto, addr entity.Address, path string, publicKey, data []byte) error {
+	conn, session, err := dialSessionTo(proto, addr, path, publicKey)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	encrypted, err := session.WriteMessage(data)
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(encrypted); err != nil {
+		return err
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return err
+	}
+	// The peer closes its side once it has handled everything
+	if _, err := conn.ReadMessage(); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s session with %s did not close cleanly: %w", path, addr.HostPort(), err)
+	}
+	return nil
+}
+
+// dialSessionTo opens a Noise session on path at addr, over the transport
+// chat uses there, and checks that it reached the owner of publicKey
+func dialSessionTo(proto *proto.Proto, addr entity.Address, path string, publicKey []byte) (transport.Conn, *crypto.Session, error) {
+	conn, session, err := transport.DialSession(addr.Transport(), addr.HostPort(), path, proto.PrivateKey, sessionTimeout, proto.SessionOptions()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if remote, err := session.GetRemotePublicKey(); err != nil || !slices.Equal(remote, publicKey) {
+		conn.Close()
+		return nil, nil, fmt.Errorf("%s session with %s reached a different peer", path, addr.HostPort())
+	}
+	return conn, session, nil
+}
+
+// stream is a side session that carries messages both ways, for exchanges
+// longer than one message. One goroutine may send while another receives.
+type stream struct {
+	conn    transport.Conn
+	session *crypto.Session
+	timeout time.Duration
+}
+
+// dialStream opens a stream with peer on path, trying its addresses in order
+func dialStream(proto *proto.Proto, peer *entity.Peer, path string) (*stream, error) {
+	var errs []error
+	for _, addr := range peer.Addresses() {
+		conn, session, err := dialSessionTo(proto, addr, path, peer.PublicKey)
+		if err == nil {
+			return &stream{conn: conn, session: session, timeout: sessionTimeout}, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, errNoAddress
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *stream) Send(data []byte) error {
+	encrypted, err := s.session.WriteMessage(data)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(encrypted)
+}
+
+// Receive waits for the next message, failing if none arrives in time
+func (s *stream) Receive() ([]byte, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	message, err := s.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return s.session.ReadMessage(message)
+}
+
+func (s *stream) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/config"
+	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/proto"
+	"p2p-messenger/internal/transfer"
+	"p2p-messenger/internal/transport"
+)
+
+// startFiles serves the file endpoints of a fresh node and returns the node
+// and a peer entry pointing at it
+func startFiles(t *testing.T) (*proto.Proto, *entity.Peer) {
+	t.Helper()
+	node, err := proto.NewProto("0")
+	require.NoError(t, err)
+	m := &Manager{Proto: node}
+	node.Transfers = transfer.New(filepath.Join(t.TempDir(), "downloads"), node.Peers, m.SendFileControl, m.DialFile)
+
+	listener := NewListener("", node, config.Default().Limits)
+	mux := http.NewServeMux()
+	mux.HandleFunc(filePath, listener.fileSession)
+	mux.HandleFunc(fileDataPath, listener.fileDataSession)
+	port := serveListener(t, listener, mux)
+	return node, &entity.Peer{
+		PeerID:    crypto.PeerID(node.PublicKey),
+		PublicKey: node.PublicKey,
+		AddrIP:    "127.0.0.1",
+		Port:      port,
+		Messages:  make([]*entity.Message, 0),
+	}
+}
+
+func TestFiles_TravelOverNoiseSessions(t *testing.T) {
+	// Offers and chunks take the transport chat uses
+	for _, kind := range []transport.Kind{transport.Websocket, transport.TCP, transport.QUIC} {
+		t.Run(string(kind), func(t *testing.T) {
+			useTransport(t, kind)
+			a, peerA := startFiles(t)
+			b, peerB := startFiles(t)
+			know(a, peerB)
+			know(b, peerA)
+
+			data := bytes.Repeat([]byte("chunk of a file "), 10000)
+			path := filepath.Join(t.TempDir(), "notes.txt")
+			require.NoError(t, os.WriteFile(path, data, 0600))
+			toB, _ := a.Peers.Get(peerB.PeerID)
+			_, err := a.Transfers.Offer(toB, path)
+			require.NoError(t, err)
+
+			require.Eventually(t, func() bool { return len(b.Transfers.Transfers(peerA.PeerID)) == 1 }, 5*time.Second, 10*time.Millisecond)
+			offered := b.Transfers.Transfers(peerA.PeerID)[0]
+			require.NoError(t, b.Transfers.Accept(offered.ID))
+
+			require.Eventually(t, func() bool {
+				return b.Transfers.Transfers(peerA.PeerID)[0].State == transfer.StateDone
+			}, 5*time.Second, 10*time.Millisecond)
+			kept, err := os.ReadFile(b.Transfers.Transfers(peerA.PeerID)[0].Path)
+			require.NoError(t, err)
+			assert.Equal(t, data, kept)
+		})
+	}
+}
+
+func TestSideSessions_AreRateLimited(t *testing.T) {
+	node, err := proto.NewProto("0")
+	require.NoError(t, err)
+	limits := config.Default().Limits
+	limits.MessagesPerSecond, limits.MessageBurst = 20, 2
+	listener := NewListener("", node, limits)
+	var received atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc(lobbyPath, func(w http.ResponseWriter, r *http.Request) {
+		listener.serveSession(w, r, func(string, []byte) { received.Add(1) })
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	sender, err := proto.NewProto("0")
+	require.NoError(t, err)
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	conn, session, err := dialSessionTo(sender, entity.Address{IP: host, Port: port, Source: entity.ConnectionNAT}, lobbyPath, node.PublicKey)
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	for range 6 {
+		encrypted, err := session.WriteMessage([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(encrypted))
+	}
+	require.Eventually(t, func() bool { return received.Load() == 6 }, 5*time.Second, 5*time.Millisecond)
+	// Past the burst every message waits for its token
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.EqualValues(t, 4, listener.stats.rateLimited.Load())
+}
@@ -0,0 +1,352 @@
+package outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
+	"p2p-messenger/internal/repository"
+)
+
+var logger = logging.For("outbox")
+
+const (
+	// retryDelay keeps a peer that is still discovered but cannot be reached
+	// from being dialed on every announcement
+	retryDelay = 10 * time.Second
+	// sweepInterval is how often queued messages are retried and expired
+	sweepInterval = 30 * time.Second
+)
+
+// ErrUnknownMessage is returned for a message that is not part of the
+// conversation, or not ours to change
+var ErrUnknownMessage = errors.New("no such message")
+
+// Sender hands an envelope to peer on its chat session
+type Sender func(peer *entity.Peer, env entity.Envelope) error
+
+// entry is a message, or a change to one, waiting for its peer, as kept on
+// disk
+type entry struct {
+	ID     string    `json:"id"`
+	PeerID string    `json:"peer_id"`
+	Text   string    `json:"text"`
+	Author string    `json:"author"`
+	Time   time.Time `json:"time"`
+	// Kind is empty for messages queued before changes were
+	Kind entity.EnvelopeKind `json:"kind,omitempty"`
+	// Ref is the message a change applies to, or the one a message replies
+	// to
+	Ref string `json:"ref,omitempty"`
+	// Clock is the Lamport counter of a message
+	Clock uint64 `json:"clock,omitempty"`
+}
+
+func (e entry) message(state entity.MessageState) entity.Message {
+	return entity.Message{ID: e.ID, Time: e.Time, SentAt: e.Time, Lamport: e.Clock, Text: e.Text, Author: e.Author, State: state, ReplyTo: e.Ref}
+}
+
+// isText reports whether e is a message rather than a change to one
+func (e entry) isText() bool {
+	return e.Kind == "" || e.Kind == entity.EnvelopeText
+}
+
+func (e entry) envelope() entity.Envelope {
+	if e.isText() {
+		return entity.Envelope{Kind: entity.EnvelopeText, ID: e.ID, Text: e.Text, Ref: e.Ref, Time: e.Time, Clock: e.Clock}
+	}
+	return entity.Envelope{Kind: e.Kind, Ref: e.Ref, Text: e.Text, Time: e.Time}
+}
+
+// Outbox is a persistent per-peer queue of outgoing messages. Every message
+// goes through it; those that cannot be sent right away are delivered in
+// order once discovery sees their peer again or its session comes back.
+// A message is removed only after it was sent, so a crash in between may
+// deliver it twice.
+type Outbox struct {
+	path       string
+	expiry     time.Duration
+	retryDelay time.Duration
+	peers      *repository.PeerRepository
+	send       Sender
+
+	mu       sync.Mutex
+	entries  []entry // Oldest first
+	flushing map[string]bool
+	retryAt  map[string]time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Open loads the outbox kept at path and starts delivering its messages to
+// peers as they are discovered. Messages older than expiry are dropped; 0
+// keeps them until they are sent.
+func Open(path string, expiry time.Duration, peers *repository.PeerRepository, send Sender) (*Outbox, error) {
+	o := &Outbox{
+		path:       path,
+		expiry:     expiry,
+		retryDelay: retryDelay,
+		peers:      peers,
+		send:       send,
+		flushing:   make(map[string]bool),
+		retryAt:    make(map[string]time.Time),
+		done:       make(chan struct{}),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &o.entries); err != nil {
+			return nil, fmt.Errorf("outbox %s: %w", path, err)
+		}
+	}
+
+	peers.OnSeen(o.Deliver)
+	go o.sweep()
+	return o, nil
+}
+
+// Close stops the periodic retries
+func (o *Outbox) Close() {
+	o.closeOnce.Do(func() { close(o.done) })
+}
+
+// Send adds a message from author to the conversation with peer and
+// delivers it, queueing it if the peer cannot be reached
+func (o *Outbox) Send(peer *entity.Peer, text, author string) {
+	o.Reply(peer, "", text, author)
+}
+
+// Reply is Send for a message answering the message ref
+func (o *Outbox) Reply(peer *entity.Peer, ref, text, author string) {
+	e := entry{ID: entity.NewMessageID(), PeerID: peer.PeerID, Text: text, Author: author, Time: time.Now(), Kind: entity.EnvelopeText, Ref: ref, Clock: peer.Tick()}
+	peer.AddOutgoing(e.message(entity.MessageSending))
+	o.enqueue(peer, e)
+}
+
+// React sets the reaction of author to the message id, ours or the peer's,
+// and sends it to the peer. An empty emoji takes the reaction back.
+func (o *Outbox) React(peer *entity.Peer, id, emoji, author string) error {
+	if !peer.React(id, emoji, author) {
+		return ErrUnknownMessage
+	}
+	o.enqueue(peer, entry{ID: entity.NewMessageID(), PeerID: peer.PeerID, Text: emoji, Author: author, Time: time.Now(), Kind: entity.EnvelopeReaction, Ref: id})
+	return nil
+}
+
+// Edit changes the text of our message id to peer and sends the edit after
+// the message
+func (o *Outbox) Edit(peer *entity.Peer, id, text string) error {
+	if !peer.Edit(id, text) {
+		return ErrUnknownMessage
+	}
+	o.enqueue(peer, entry{ID: entity.NewMessageID(), PeerID: peer.PeerID, Text: text, Time: time.Now(), Kind: entity.EnvelopeEdit, Ref: id})
+	return nil
+}
+
+// Delete replaces our message id to peer with a tombstone on both ends
+func (o *Outbox) Delete(peer *entity.Peer, id string) error {
+	if !peer.Delete(id) {
+		return ErrUnknownMessage
+	}
+	o.enqueue(peer, entry{ID: entity.NewMessageID(), PeerID: peer.PeerID, Time: time.Now(), Kind: entity.EnvelopeDelete, Ref: id})
+	return nil
+}
+
+// SetTimer makes messages with peer disappear on both ends once they are
+// older than d; 0 keeps them
+func (o *Outbox) SetTimer(peer *entity.Peer, d time.Duration) error {
+	if !entity.ValidTimer(d) {
+		return entity.ErrInvalidTimer
+	}
+	now := time.Now()
+	peer.SetTimer(d, now)
+	o.enqueue(peer, entry{ID: entity.NewMessageID(), PeerID: peer.PeerID, Text: d.String(), Time: now, Kind: entity.EnvelopeTimer})
+	return nil
+}
+
+// enqueue keeps e until it is sent and starts sending it
+func (o *Outbox) enqueue(peer *entity.Peer, e entry) {
+	o.mu.Lock()
+	o.entries = append(o.entries, e)
+	err := o.saveLocked()
+	o.mu.Unlock()
+	if err != nil {
+		logger.Warn("failed to save outbox", "err", err)
+	}
+	// The user is waiting for this one, so do not hold it back
+	o.DeliverNow(peer)
+}
+
+// Deliver starts sending the messages queued for peer, unless that is
+// already under way or the last attempt failed moments ago
+func (o *Outbox) Deliver(peer *entity.Peer) {
+	o.mu.Lock()
+	queued := o.queuedLocked(peer.PeerID)
+	if len(queued) == 0 || o.flushing[peer.PeerID] || time.Now().Before(o.retryAt[peer.PeerID]) {
+		o.mu.Unlock()
+		return
+	}
+	o.flushing[peer.PeerID] = true
+	o.mu.Unlock()
+
+	// Messages restored from disk are not part of the conversation yet
+	for _, e := range queued {
+		if e.isText() {
+			peer.AddOutgoing(e.message(entity.MessageQueued))
+		}
+	}
+	go o.flush(peer)
+}
+
+// DeliverNow is Deliver without waiting out the delay after a failed
+// attempt, for when the peer is known to be back
+func (o *Outbox) DeliverNow(peer *entity.Peer) {
+	o.mu.Lock()
+	delete(o.retryAt, peer.PeerID)
+	o.mu.Unlock()
+	o.Deliver(peer)
+}
+
+// flush sends the peer's messages one by one and stops at the first failure,
+// so they arrive in the order they were written
+func (o *Outbox) flush(peer *entity.Peer) {
+	for {
+		o.mu.Lock()
+		queued := o.queuedLocked(peer.PeerID)
+		if len(queued) == 0 {
+			delete(o.flushing, peer.PeerID)
+			o.mu.Unlock()
+			return
+		}
+		o.mu.Unlock()
+
+		next := queued[0]
+		if o.expired(next, time.Now()) {
+			o.remove(next.ID)
+			peer.SetMessageState(next.ID, entity.MessageExpired)
+			continue
+		}
+		peer.SetMessageState(next.ID, entity.MessageSending)
+		if err := o.send(peer, next.envelope()); err != nil {
+			logger.Info("peer unreachable, keeping messages queued", "peer", peer.PeerID, "queued", len(queued), "err", err)
+			o.mu.Lock()
+			o.retryAt[peer.PeerID] = time.Now().Add(o.retryDelay)
+			delete(o.flushing, peer.PeerID)
+			o.mu.Unlock()
+			for _, e := range queued {
+				peer.SetMessageState(e.ID, entity.MessageQueued)
+			}
+			return
+		}
+		o.remove(next.ID)
+		peer.SetMessageState(next.ID, entity.MessageSent)
+	}
+}
+
+// sweep periodically drops expired messages and retries known peers
+func (o *Outbox) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.done:
+			return
+		}
+		o.expire(time.Now())
+
+		o.mu.Lock()
+		var peerIDs []string
+		for _, e := range o.entries {
+			if !slices.Contains(peerIDs, e.PeerID) {
+				peerIDs = append(peerIDs, e.PeerID)
+			}
+		}
+		o.mu.Unlock()
+		for _, peerID := range peerIDs {
+			if peer, ok := o.peers.Get(peerID); ok {
+				o.Deliver(peer)
+			}
+		}
+	}
+}
+
+// expire drops every message older than the expiry
+func (o *Outbox) expire(now time.Time) {
+	o.mu.Lock()
+	var expired []entry
+	o.entries = slices.DeleteFunc(o.entries, func(e entry) bool {
+		if o.expired(e, now) {
+			expired = append(expired, e)
+			return true
+		}
+		return false
+	})
+	var err error
+	if len(expired) > 0 {
+		err = o.saveLocked()
+	}
+	o.mu.Unlock()
+	if err != nil {
+		logger.Warn("failed to save outbox", "err", err)
+	}
+
+	for _, e := range expired {
+		logger.Info("undelivered message expired", "peer", e.PeerID, "queued", e.Time)
+		if peer, ok := o.peers.Get(e.PeerID); ok {
+			peer.SetMessageState(e.ID, entity.MessageExpired)
+		}
+	}
+}
+
+func (o *Outbox) expired(e entry, now time.Time) bool {
+	return o.expiry > 0 && now.Sub(e.Time) > o.expiry
+}
+
+func (o *Outbox) queuedLocked(peerID string) []entry {
+	var queued []entry
+	for _, e := range o.entries {
+		if e.PeerID == peerID {
+			queued = append(queued, e)
+		}
+	}
+	return queued
+}
+
+func (o *Outbox) remove(id string) {
+	o.mu.Lock()
+	o.entries = slices.DeleteFunc(o.entries, func(e entry) bool { return e.ID == id })
+	err := o.saveLocked()
+	o.mu.Unlock()
+	if err != nil {
+		logger.Warn("failed to save outbox", "err", err)
+	}
+}
+
+// saveLocked writes the outbox with owner-only permissions, replacing the
+// previous file only once the new one is complete
+func (o *Outbox) saveLocked() error {
+	data, err := json.Marshal(o.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(o.path), 0700); err != nil {
+		return err
+	}
+	tmp := o.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path)
+}
@@ -0,0 +1,162 @@
+package outbox
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/repository"
+)
+
+// fakeSender records delivered texts and fails while the peer is offline
+type fakeSender struct {
+	mu        sync.Mutex
+	online    bool
+	delivered []string
+}
+
+func (f *fakeSender) send(peer *entity.Peer, env entity.Envelope) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.online {
+		return errors.New("peer unreachable")
+	}
+	f.delivered = append(f.delivered, env.Text)
+	return nil
+}
+
+func (f *fakeSender) setOnline(online bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.online = online
+}
+
+func (f *fakeSender) texts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.delivered...)
+}
+
+func openOutbox(t *testing.T, path string, expiry time.Duration, peers *repository.PeerRepository, sender *fakeSender) *Outbox {
+	t.Helper()
+	o, err := Open(path, expiry, peers, sender.send)
+	require.NoError(t, err)
+	o.retryDelay = 0
+	t.Cleanup(o.Close)
+	return o
+}
+
+func states(peer *entity.Peer) []entity.MessageState {
+	var states []entity.MessageState
+	for _, message := range peer.GetMessages() {
+		states = append(states, message.State)
+	}
+	return states
+}
+
+func TestOutbox_DeliversWhenPeerIsSeenAgain(t *testing.T) {
+	peers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+	sender := &fakeSender{}
+	o := openOutbox(t, filepath.Join(t.TempDir(), "outbox.json"), 0, peers, sender)
+
+	peer := &entity.Peer{PeerID: "peer"}
+	peers.Add(peer)
+	o.Send(peer, "one", "me")
+	o.Send(peer, "two", "me")
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]entity.MessageState{entity.MessageQueued, entity.MessageQueued}, states(peer))
+	}, time.Second, 10*time.Millisecond)
+
+	sender.setOnline(true)
+	peers.Add(&entity.Peer{PeerID: "peer"})
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]entity.MessageState{entity.MessageSent, entity.MessageSent}, states(peer))
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"one", "two"}, sender.texts())
+}
+
+func TestOutbox_SurvivesRestartAndExpires(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	sender := &fakeSender{}
+	first := openOutbox(t, path, time.Hour, repository.NewPeerRepositoryWithValidation(time.Hour, 1), sender)
+	first.Send(&entity.Peer{PeerID: "peer"}, "kept", "me")
+	first.Send(&entity.Peer{PeerID: "other"}, "too old", "me")
+	assert.Eventually(t, func() bool {
+		first.mu.Lock()
+		defer first.mu.Unlock()
+		return len(first.flushing) == 0
+	}, time.Second, 10*time.Millisecond)
+	first.Close()
+
+	peers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+	sender.setOnline(true)
+	second := openOutbox(t, path, time.Hour, peers, sender)
+	second.mu.Lock()
+	require.Len(t, second.entries, 2)
+	second.entries[1].Time = time.Now().Add(-2 * time.Hour)
+	second.mu.Unlock()
+
+	peer := &entity.Peer{PeerID: "peer"}
+	other := &entity.Peer{PeerID: "other"}
+	peers.Add(peer)
+	peers.Add(other)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]entity.MessageState{entity.MessageSent}, states(peer)) &&
+			assert.ObjectsAreEqual([]entity.MessageState{entity.MessageExpired}, states(other))
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "kept", peer.GetMessages()[0].Text)
+	assert.Equal(t, []string{"kept"}, sender.texts())
+
+	second.mu.Lock()
+	defer second.mu.Unlock()
+	assert.Empty(t, second.entries)
+}
+
+func TestOutbox_SendsChangesAfterTheMessage(t *testing.T) {
+	peers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+	sender := &fakeSender{}
+	o := openOutbox(t, filepath.Join(t.TempDir(), "outbox.json"), 0, peers, sender)
+
+	peer := &entity.Peer{PeerID: "peer"}
+	peers.Add(peer)
+	o.Send(peer, "helo", "me")
+	o.Send(peer, "oops", "me")
+	messages := peer.GetMessages()
+	require.NoError(t, o.Edit(peer, messages[0].ID, "hello"))
+	require.NoError(t, o.Delete(peer, messages[1].ID))
+	assert.ErrorIs(t, o.Edit(peer, "unknown", "x"), ErrUnknownMessage)
+	assert.Len(t, peer.GetMessages(), 2, "changes are not messages")
+
+	sender.setOnline(true)
+	o.DeliverNow(peer)
+	assert.Eventually(t, func() bool { return len(sender.texts()) == 4 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"helo", "oops", "hello", ""}, sender.texts())
+	messages = peer.GetMessages()
+	assert.Equal(t, "hello", messages[0].Text)
+	assert.True(t, messages[1].Deleted)
+}
+
+func TestOutbox_RepliesAndReactions(t *testing.T) {
+	peers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+	sender := &fakeSender{online: true}
+	o := openOutbox(t, filepath.Join(t.TempDir(), "outbox.json"), 0, peers, sender)
+
+	peer := &entity.Peer{PeerID: "peer"}
+	peers.Add(peer)
+	peer.Receive([]byte(entity.Envelope{Kind: entity.EnvelopeText, ID: "theirs", Text: "lunch?"}.Encode()), "peer")
+	o.Reply(peer, "theirs", "sure", "me")
+	require.NoError(t, o.React(peer, "theirs", "🍕", "me"))
+	assert.ErrorIs(t, o.React(peer, "unknown", "🍕", "me"), ErrUnknownMessage)
+
+	assert.Eventually(t, func() bool { return len(sender.texts()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"sure", "🍕"}, sender.texts())
+	messages := peer.GetMessages()
+	assert.Equal(t, "theirs", messages[1].ReplyTo)
+	assert.Equal(t, map[string]string{"me": "🍕"}, messages[0].Reactions)
+}
@@ -0,0 +1,107 @@
+package presence
+
+import (
+	"sync"
+	"time"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
+)
+
+var logger = logging.For("presence")
+
+// typingRefresh repeats typing-start while the user keeps typing, well
+// before the peer lets it lapse
+const typingRefresh = entity.TypingTimeout / 2
+
+// typingIdle is how long after the last keystroke typing-stop is sent
+var typingIdle = 5 * time.Second
+
+// Sender hands a control to peer on its chat session
+type Sender func(peer *entity.Peer, env entity.Envelope) error
+
+// Notifier tells peers when we are typing to them and how far we read
+// their messages. Either can be turned off, in which case nothing about it
+// is sent.
+type Notifier struct {
+	send   Sender
+	typing bool
+	read   bool
+
+	mu sync.Mutex
+	// typingSent is when typing-start last went to each peer
+	typingSent map[string]time.Time
+	idle       map[string]*time.Timer
+	// readSent is the last message ID reported read to each peer
+	readSent map[string]string
+}
+
+// New creates a Notifier sending typing indicators and read receipts as
+// enabled
+func New(send Sender, typing, read bool) *Notifier {
+	return &Notifier{
+		send:       send,
+		typing:     typing,
+		read:       read,
+		typingSent: make(map[string]time.Time),
+		idle:       make(map[string]*time.Timer),
+		readSent:   make(map[string]string),
+	}
+}
+
+// Typing is called on every change to a message being written to peer. The
+// peer hears typing-start at most every typingRefresh, and typing-stop once
+// the user stops for typingIdle.
+func (n *Notifier) Typing(peer *entity.Peer) {
+	if !n.typing {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if timer, ok := n.idle[peer.PeerID]; ok {
+		timer.Stop()
+	}
+	n.idle[peer.PeerID] = time.AfterFunc(typingIdle, func() { n.StopTyping(peer) })
+	if time.Since(n.typingSent[peer.PeerID]) < typingRefresh {
+		return
+	}
+	n.typingSent[peer.PeerID] = time.Now()
+	go n.notify(peer, entity.Envelope{Kind: entity.EnvelopeTypingStart})
+}
+
+// StopTyping tells peer we stopped typing, if it heard that we started
+func (n *Notifier) StopTyping(peer *entity.Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if timer, ok := n.idle[peer.PeerID]; ok {
+		timer.Stop()
+		delete(n.idle, peer.PeerID)
+	}
+	if _, ok := n.typingSent[peer.PeerID]; !ok {
+		return
+	}
+	delete(n.typingSent, peer.PeerID)
+	go n.notify(peer, entity.Envelope{Kind: entity.EnvelopeTypingStop})
+}
+
+// Read reports to peer that we read its messages up to the latest one,
+// unless that was reported already
+func (n *Notifier) Read(peer *entity.Peer) {
+	if !n.read {
+		return
+	}
+	last := peer.LastReceived()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if last == "" || n.readSent[peer.PeerID] == last {
+		return
+	}
+	n.readSent[peer.PeerID] = last
+	go n.notify(peer, entity.Envelope{Kind: entity.EnvelopeRead, UpTo: last})
+}
+
+func (n *Notifier) notify(peer *entity.Peer, env entity.Envelope) {
+	if err := n.send(peer, env); err != nil {
+		logger.Debug("failed to send control", "peer", peer.PeerID, "kind", env.Kind, "err", err)
+	}
+}
@@ -0,0 +1,81 @@
+package presence
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"p2p-messenger/internal/entity"
+)
+
+// recorder keeps the controls sent to a peer
+type recorder struct {
+	mu   sync.Mutex
+	sent []entity.Envelope
+}
+
+func (r *recorder) send(peer *entity.Peer, env entity.Envelope) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, env)
+	return nil
+}
+
+func (r *recorder) kinds() []entity.EnvelopeKind {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var kinds []entity.EnvelopeKind
+	for _, env := range r.sent {
+		kinds = append(kinds, env.Kind)
+	}
+	return kinds
+}
+
+func TestNotifier_Typing(t *testing.T) {
+	defer func(idle time.Duration) { typingIdle = idle }(typingIdle)
+	typingIdle = 50 * time.Millisecond
+	r := &recorder{}
+	n := New(r.send, true, true)
+	peer := &entity.Peer{PeerID: "bob"}
+
+	for range 5 {
+		n.Typing(peer)
+	}
+	assert.Eventually(t, func() bool { return len(r.kinds()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []entity.EnvelopeKind{entity.EnvelopeTypingStart, entity.EnvelopeTypingStop}, r.kinds(), "one start, then a stop once idle")
+
+	n.StopTyping(peer)
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(t, r.kinds(), 2, "no stop without a start")
+}
+
+func TestNotifier_ReadOncePerMessage(t *testing.T) {
+	r := &recorder{}
+	n := New(r.send, true, true)
+	peer := &entity.Peer{PeerID: "bob"}
+
+	n.Read(peer)
+	peer.Receive([]byte(entity.Envelope{Kind: entity.EnvelopeText, ID: "x", Text: "hi"}.Encode()), "bob")
+	n.Read(peer)
+	n.Read(peer)
+	assert.Eventually(t, func() bool { return len(r.kinds()) == 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	r.mu.Lock()
+	assert.Equal(t, []entity.Envelope{{Kind: entity.EnvelopeRead, UpTo: "x"}}, r.sent)
+	r.mu.Unlock()
+}
+
+func TestNotifier_Disabled(t *testing.T) {
+	r := &recorder{}
+	n := New(r.send, false, false)
+	peer := &entity.Peer{PeerID: "bob"}
+	peer.Receive([]byte(entity.Envelope{Kind: entity.EnvelopeText, ID: "x", Text: "hi"}.Encode()), "bob")
+
+	n.Typing(peer)
+	n.Read(peer)
+	n.StopTyping(peer)
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, r.kinds())
+}
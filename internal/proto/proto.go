@@ -1,10 +1,18 @@
 package proto
 
 import (
+	"crypto/ed25519"
 	"encoding/base64"
 	
 	"p2p-messenger/internal/crypto"
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/groups"
+	"p2p-messenger/internal/history"
+	"p2p-messenger/internal/lobby"
+	"p2p-messenger/internal/outbox"
+	"p2p-messenger/internal/presence"
 	"p2p-messenger/internal/repository"
+	"p2p-messenger/internal/transfer"
 )
 
 type Proto struct {
@@ -14,22 +22,54 @@ type Proto struct {
 	PublicKey []byte
 	// PrivateKey is the Noise Protocol private key (for responder sessions)
 	PrivateKey crypto.NoiseKeypair
+	// SigningKey is the identity key the Noise keypair is derived from; it
+	// signs group membership changes
+	SigningKey ed25519.PrivateKey
 	Peers      *repository.PeerRepository
 	Port       string
 	// Username is the display name for this peer
 	Username string
+	// Workspace holds the keys derived from the workspace secret; nil when
+	// the node is not restricted to a workspace
+	Workspace *crypto.WorkspaceKeys
+	// Hybrid offers and accepts the ML-KEM hybrid handshake
+	Hybrid bool
+	// SessionPolicy sets rekeying and lifetime limits of every session
+	SessionPolicy crypto.RekeyPolicy
+	// History keeps every peer conversation across restarts
+	History *history.Store
+	// Outbox sends messages and keeps those for unreachable peers
+	Outbox *outbox.Outbox
+	// Groups keeps the group chats we belong to
+	Groups *groups.Manager
+	// Lobby is the public LAN room; nil when it is disabled
+	Lobby *lobby.Lobby
+	// Presence sends typing indicators and read receipts to peers
+	Presence *presence.Notifier
+	// Transfers offers files to peers and receives the ones we accept
+	Transfers *transfer.Manager
 	// NetworkManager is set after creation to allow UI access
 	NetworkManager interface {
 		GetAvailableModes() (bleAvailable, natAvailable, internetAvailable bool)
+		GetDiagnostics() entity.Diagnostics
 	}
 }
 
 func NewProto(port string) (*Proto, error) {
-	keypair, pubKey, err := crypto.GenerateKeypair()
+	identity, err := crypto.NewIdentity()
 	if err != nil {
 		return nil, err
 	}
 
+	p := New(port, identity.Keypair(), repository.NewPeerRepository())
+	p.SigningKey = identity.SigningKey()
+	return p, nil
+}
+
+// New creates a Proto around an existing keypair and peer repository
+func New(port string, keypair crypto.NoiseKeypair, peers *repository.PeerRepository) *Proto {
+	pubKey := keypair.Public
+
 	// Generate a default username from peer ID (first 8 chars)
 	peerID := crypto.PeerID(pubKey)
 	username := peerID
@@ -42,10 +82,19 @@ func NewProto(port string) (*Proto, error) {
 		PublicKeyStr: base64.StdEncoding.EncodeToString(pubKey),
 		PublicKey:    pubKey,
 		PrivateKey:   keypair,
-		Peers:        repository.NewPeerRepository(),
+		Peers:        peers,
 		Port:         port,
 		Username:     username,
-	}, nil
+	}
+}
+
+// SessionOptions returns the options every Noise session of this node uses
+func (p *Proto) SessionOptions() []crypto.SessionOption {
+	opts := []crypto.SessionOption{crypto.WithHybrid(p.Hybrid), crypto.WithRekeyPolicy(p.SessionPolicy)}
+	if p.Workspace != nil {
+		opts = append(opts, crypto.WithPSK(p.Workspace.PSK))
+	}
+	return opts
 }
 
 // SetUsername sets the display username for this peer
@@ -1,7 +1,6 @@
 package repository
 
 import (
-	"fmt"
 	"net"
 	"net/url"
 	"sort"
@@ -23,13 +22,24 @@ type PeerRepository struct {
 	peers              map[string]*entity.Peer
 	failureCounts      map[string]int // Track consecutive validation failures
 	failureCountsMutex sync.Mutex
+	validationInterval time.Duration
+	validationRetries  int
+	onSeen             []func(peer *entity.Peer)
 }
 
 func NewPeerRepository() *PeerRepository {
+	return NewPeerRepositoryWithValidation(peerValidationTimeOut, peerValidationRetries)
+}
+
+// NewPeerRepositoryWithValidation creates a repository whose liveness checks
+// run every interval and drop a peer after retries consecutive failures
+func NewPeerRepositoryWithValidation(interval time.Duration, retries int) *PeerRepository {
 	peerRepository := &PeerRepository{
-		rwMutex:       &sync.RWMutex{},
-		peers:         make(map[string]*entity.Peer),
-		failureCounts: make(map[string]int),
+		rwMutex:            &sync.RWMutex{},
+		peers:              make(map[string]*entity.Peer),
+		failureCounts:      make(map[string]int),
+		validationInterval: interval,
+		validationRetries:  retries,
 	}
 
 	peerRepository.peersValidator()
@@ -37,58 +47,60 @@ func NewPeerRepository() *PeerRepository {
 	return peerRepository
 }
 
+// OnSeen registers fn to be called, outside the repository lock, whenever
+// discovery reports a peer, whether it is new or already known. Functions
+// are called in the order they were registered.
+func (p *PeerRepository) OnSeen(fn func(peer *entity.Peer)) {
+	p.rwMutex.Lock()
+	defer p.rwMutex.Unlock()
+	p.onSeen = append(p.onSeen, fn)
+}
+
 func (p *PeerRepository) Add(peer *entity.Peer) {
+	seen, onSeen := p.add(peer)
+	for _, fn := range onSeen {
+		fn(seen)
+	}
+}
+
+// add merges peer into the repository and returns the stored peer
+func (p *PeerRepository) add(peer *entity.Peer) (*entity.Peer, []func(*entity.Peer)) {
 	p.rwMutex.Lock()
 	defer p.rwMutex.Unlock()
 
 	existing, found := p.peers[peer.PeerID]
 	if !found {
 		p.peers[peer.PeerID] = peer
-	} else {
-		// Only use the BEST connection type (either/or, not combined)
-		// Priority: BLE (0) > NAT (1) > Internet (2)
-		// If new peer has a better connection type, replace existing
-		// Otherwise, keep existing (don't add worse connection types)
-		if len(peer.ConnectionTypes) > 0 {
-			newConnectionType := peer.ConnectionTypes[0] // New peer has one connection type
-			if newConnectionType < existing.PrimaryConnectionType {
-				// New connection type is better - replace with new one only
-				existing.ConnectionTypes = []entity.ConnectionType{newConnectionType}
-				existing.PrimaryConnectionType = newConnectionType
-				// Update address fields when switching to better connection type
-				if peer.AddrIP != "" {
-					existing.AddrIP = peer.AddrIP
-				}
-				if peer.Port != "" {
-					existing.Port = peer.Port
-				}
-				if peer.BLEAddr != "" {
-					existing.BLEAddr = peer.BLEAddr
-				}
-			}
-			// If new connection type is same or worse, don't change connection type
-			// But still update address fields if missing (for same connection type)
-			if newConnectionType == existing.PrimaryConnectionType {
-				if existing.AddrIP == "" && peer.AddrIP != "" {
-					existing.AddrIP = peer.AddrIP
-				}
-				if existing.Port == "" && peer.Port != "" {
-					existing.Port = peer.Port
-				}
-				if existing.BLEAddr == "" && peer.BLEAddr != "" {
-					existing.BLEAddr = peer.BLEAddr
-				}
-			}
-		}
+		return peer, p.onSeen
+	}
 
-		if len(existing.PublicKey) == 0 && len(peer.PublicKey) > 0 {
-			existing.PublicKey = peer.PublicKey
-		}
-		// Update username if provided (can change)
-		if peer.Username != "" {
-			existing.Username = peer.Username
-		}
+	// Keep every connection type and address the peer was seen with, so
+	// connections can fail over between them. The primary connection
+	// type stays the best one: BLE (0) > NAT (1) > Internet (2)
+	for _, ct := range peer.ConnectionTypes {
+		existing.AddConnectionType(ct)
+	}
+	for _, addr := range peer.Addresses() {
+		existing.AddAddress(addr)
+	}
+	if existing.AddrIP == "" && peer.AddrIP != "" {
+		existing.AddrIP = peer.AddrIP
+	}
+	if existing.Port == "" && peer.Port != "" {
+		existing.Port = peer.Port
 	}
+	if peer.BLEAddr != "" {
+		existing.BLEAddr = peer.BLEAddr
+	}
+
+	if len(existing.PublicKey) == 0 && len(peer.PublicKey) > 0 {
+		existing.PublicKey = peer.PublicKey
+	}
+	// Update username if provided (can change)
+	if peer.Username != "" {
+		existing.Username = peer.Username
+	}
+	return existing, p.onSeen
 }
 
 func (p *PeerRepository) Delete(peerID string) {
@@ -126,7 +138,7 @@ func (p *PeerRepository) GetPeers() []*entity.Peer {
 }
 
 func (p *PeerRepository) peersValidator() {
-	ticker := time.NewTicker(peerValidationTimeOut)
+	ticker := time.NewTicker(p.validationInterval)
 
 	go func() {
 		for {
@@ -144,7 +156,8 @@ func (p *PeerRepository) peersValidator() {
 				if peer.PrimaryConnectionType == entity.ConnectionBLE {
 					continue
 				}
-				if peer.AddrIP == "" || peer.Port == "" {
+				addresses := peer.Addresses()
+				if len(addresses) == 0 {
 					continue
 				}
 
@@ -159,15 +172,7 @@ func (p *PeerRepository) peersValidator() {
 				}
 
 				// Only validate peers without active connections
-				u := url.URL{Scheme: "ws", Host: fmt.Sprintf("%s:%s", peer.AddrIP, peer.Port), Path: "/meow"}
-
-				// Use a short timeout to avoid hanging on network issues
-				dialer := &websocket.Dialer{
-					HandshakeTimeout: 2 * time.Second,
-				}
-
-				c, _, err := dialer.Dial(u.String(), nil)
-				if c == nil || err != nil {
+				if err := ping(addresses); err != nil {
 					// Increment failure count
 					p.failureCountsMutex.Lock()
 					failures := p.failureCounts[peer.PeerID] + 1
@@ -175,7 +180,7 @@ func (p *PeerRepository) peersValidator() {
 					p.failureCountsMutex.Unlock()
 
 					// Only delete after multiple consecutive failures
-					if failures >= peerValidationRetries {
+					if failures >= p.validationRetries {
 						// Check if it's a network error that might be temporary
 						shouldDelete := true
 						if err != nil {
@@ -196,8 +201,6 @@ func (p *PeerRepository) peersValidator() {
 					}
 					continue
 				}
-				c.Close()
-
 				// Reset failure count on successful validation
 				p.failureCountsMutex.Lock()
 				p.failureCounts[peer.PeerID] = 0
@@ -206,3 +209,23 @@ func (p *PeerRepository) peersValidator() {
 		}
 	}()
 }
+
+// ping checks whether the peer answers at any of its addresses
+func ping(addresses []entity.Address) error {
+	// Use a short timeout to avoid hanging on network issues
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: 2 * time.Second,
+	}
+
+	var err error
+	for _, addr := range addresses {
+		u := url.URL{Scheme: "ws", Host: addr.HostPort(), Path: "/meow"}
+		var c *websocket.Conn
+		c, _, err = dialer.Dial(u.String(), nil)
+		if err == nil {
+			c.Close()
+			return nil
+		}
+	}
+	return err
+}
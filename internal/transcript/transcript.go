@@ -0,0 +1,284 @@
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/history"
+)
+
+// Format is how a transcript is written
+type Format string
+
+const (
+	// JSONLines writes a record per line and can be imported again
+	JSONLines Format = "jsonl"
+	Markdown  Format = "md"
+	Text      Format = "txt"
+)
+
+// ErrUnknownFormat is returned for a format that is not one of the above
+var ErrUnknownFormat = errors.New("unknown transcript format, want jsonl, md or txt")
+
+// ParseFormat reads a format by name or by a common alias of its name
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "jsonl", "json":
+		return JSONLines, nil
+	case "md", "markdown":
+		return Markdown, nil
+	case "txt", "text":
+		return Text, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// timeLayout shows times in the local zone with its offset, so that a
+// transcript read elsewhere is not ambiguous
+const timeLayout = "2006-01-02 15:04:05 -07:00"
+
+// Status values of a record; an outgoing message has the state of its
+// delivery, a received one is "received"
+const (
+	StatusReceived = "received"
+	StatusRead     = "read"
+	StatusDeleted  = "deleted"
+)
+
+// Record is one message in a JSON Lines transcript
+type Record struct {
+	// Peer is the fingerprint of the peer of the conversation: the hash of
+	// its public key that is also its ID
+	Peer     string `json:"peer"`
+	ID       string `json:"id,omitempty"`
+	Author   string `json:"author"`
+	Outgoing bool   `json:"outgoing,omitempty"`
+	// SentAt is when the author wrote the message by its clock, ReceivedAt
+	// when it was written or arrived here
+	SentAt     time.Time `json:"sent_at,omitzero"`
+	ReceivedAt time.Time `json:"received_at"`
+	Status     string    `json:"status"`
+	Edited     bool      `json:"edited,omitempty"`
+	Text       string    `json:"text"`
+	ReplyTo    string    `json:"reply_to,omitempty"`
+	Lamport    uint64    `json:"lamport,omitempty"`
+	// Reactions holds the emoji each author reacted with
+	Reactions map[string]string `json:"reactions,omitempty"`
+}
+
+// status names where a message stands
+func status(message entity.Message) string {
+	switch {
+	case message.Deleted:
+		return StatusDeleted
+	case !message.Outgoing:
+		return StatusReceived
+	case message.State == entity.MessageSent && message.Read:
+		return StatusRead
+	}
+	return message.State.String()
+}
+
+func newRecord(peerID string, message entity.Message) Record {
+	return Record{
+		Peer:       peerID,
+		ID:         message.ID,
+		Author:     message.Author,
+		Outgoing:   message.Outgoing,
+		SentAt:     message.SentAt,
+		ReceivedAt: message.Time,
+		Status:     status(message),
+		Edited:     message.Edited,
+		Text:       message.Text,
+		ReplyTo:    message.ReplyTo,
+		Lamport:    message.Lamport,
+		Reactions:  message.Reactions,
+	}
+}
+
+// Message turns the record back into a message. Messages that were waiting
+// in an outbox are not in the one they are imported next to, so they are
+// restored as expired.
+func (r Record) Message() entity.Message {
+	message := entity.Message{
+		ID:        r.ID,
+		Time:      r.ReceivedAt,
+		SentAt:    r.SentAt,
+		Lamport:   r.Lamport,
+		Text:      r.Text,
+		Author:    r.Author,
+		Outgoing:  r.Outgoing,
+		Edited:    r.Edited,
+		ReplyTo:   r.ReplyTo,
+		Reactions: r.Reactions,
+	}
+	switch r.Status {
+	case StatusDeleted:
+		message.Deleted, message.Text, message.Reactions = true, "", nil
+	case StatusRead:
+		message.Read = true
+	case entity.MessageQueued.String(), entity.MessageSending.String(), entity.MessageExpired.String():
+		message.State = entity.MessageExpired
+	}
+	return message
+}
+
+// Write writes the conversations to w in format
+func Write(w io.Writer, format Format, convs []history.Conversation) error {
+	bw := bufio.NewWriter(w)
+	var err error
+	switch format {
+	case JSONLines:
+		err = writeJSONLines(bw, convs)
+	case Markdown:
+		writeMarkdown(bw, convs)
+	case Text:
+		writeText(bw, convs)
+	default:
+		return ErrUnknownFormat
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeJSONLines(w *bufio.Writer, convs []history.Conversation) error {
+	encoder := json.NewEncoder(w)
+	for _, conv := range convs {
+		for _, message := range conv.Messages {
+			if err := encoder.Encode(newRecord(conv.PeerID, message)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markdownEscaper keeps authors from being read as formatting
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "#", `\#`)
+
+func writeMarkdown(w *bufio.Writer, convs []history.Conversation) {
+	for i, conv := range convs {
+		if i > 0 {
+			w.WriteString("\n")
+		}
+		fmt.Fprintf(w, "# Conversation with %s\n\nPeer fingerprint: `%s`\n", conv.PeerID, conv.PeerID)
+		byID := messagesByID(conv.Messages)
+		for _, message := range conv.Messages {
+			fmt.Fprintf(w, "\n- **%s**, %s\n", markdownEscaper.Replace(message.Author), details(message))
+			if quoted, ok := byID[message.ReplyTo]; ok {
+				fmt.Fprintf(w, "  > ↪ %s: %s\n  >\n", markdownEscaper.Replace(quoted.Author), quote(quoted))
+			}
+			if message.Deleted {
+				w.WriteString("  > *message deleted*\n")
+				continue
+			}
+			for line := range strings.Lines(message.Text) {
+				fmt.Fprintf(w, "  > %s\n", strings.TrimRight(line, "\n"))
+			}
+		}
+	}
+}
+
+func writeText(w *bufio.Writer, convs []history.Conversation) {
+	for i, conv := range convs {
+		if i > 0 {
+			w.WriteString("\n")
+		}
+		fmt.Fprintf(w, "Conversation with %s\n", conv.PeerID)
+		byID := messagesByID(conv.Messages)
+		for _, message := range conv.Messages {
+			text := message.Text
+			if message.Deleted {
+				text = "(message deleted)"
+			}
+			if quoted, ok := byID[message.ReplyTo]; ok {
+				text = fmt.Sprintf("(↪ %s: %s) %s", quoted.Author, quote(quoted), text)
+			}
+			// Continuation lines are indented so that they are not taken
+			// for messages
+			text = strings.ReplaceAll(text, "\n", "\n    ")
+			fmt.Fprintf(w, "%s (%s): %s\n", message.Author, details(message), text)
+		}
+	}
+}
+
+// details shows when a message was sent and, if it came from the peer,
+// received, and its status
+func details(message entity.Message) string {
+	parts := []string{"sent " + message.Written().Local().Format(timeLayout)}
+	if !message.Outgoing {
+		parts = append(parts, "received "+message.Time.Local().Format(timeLayout))
+	}
+	parts = append(parts, status(message))
+	if message.Edited && !message.Deleted {
+		parts = append(parts, "edited")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// quoteLength is the number of characters of a message quoted by a reply
+const quoteLength = 60
+
+func quote(message entity.Message) string {
+	if message.Deleted {
+		return "message deleted"
+	}
+	text := []rune(strings.ReplaceAll(message.Text, "\n", " "))
+	if len(text) > quoteLength {
+		text = append(text[:quoteLength], '…')
+	}
+	return string(text)
+}
+
+func messagesByID(messages []entity.Message) map[string]entity.Message {
+	byID := make(map[string]entity.Message, len(messages))
+	for _, message := range messages {
+		if message.ID != "" {
+			byID[message.ID] = message
+		}
+	}
+	return byID
+}
+
+// maxLine bounds a line of a JSON Lines transcript
+const maxLine = 1 << 20
+
+// Read reads a JSON Lines transcript, one conversation per peer in the
+// order they first appear
+func Read(r io.Reader) ([]history.Conversation, error) {
+	var convs []history.Conversation
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLine)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if record.Peer == "" {
+			return nil, fmt.Errorf("line %d: no peer", n)
+		}
+		i, ok := index[record.Peer]
+		if !ok {
+			i = len(convs)
+			index[record.Peer] = i
+			convs = append(convs, history.Conversation{PeerID: record.Peer})
+		}
+		convs[i].Messages = append(convs[i].Messages, record.Message())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return convs, nil
+}
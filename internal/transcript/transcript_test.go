@@ -0,0 +1,85 @@
+package transcript
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/history"
+)
+
+func conversations() []history.Conversation {
+	sent := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+	return []history.Conversation{{
+		PeerID: "0a1b2c",
+		Messages: []entity.Message{
+			{ID: "1", Author: "bob", Time: sent.Add(time.Second), SentAt: sent, Lamport: 1, Text: "Lunch?\nAt noon"},
+			{ID: "2", Author: "me", Outgoing: true, Time: sent.Add(time.Minute), SentAt: sent.Add(time.Minute), Lamport: 2,
+				Text: "Sure", ReplyTo: "1", Read: true, Edited: true, Reactions: map[string]string{"bob": "👍"}},
+			{ID: "3", Author: "me", Outgoing: true, Time: sent.Add(2 * time.Minute), Lamport: 3, Text: "still there?", State: entity.MessageQueued},
+			{ID: "4", Author: "bob", Time: sent.Add(3 * time.Minute), Lamport: 4, Deleted: true},
+		},
+	}, {
+		PeerID:   "3d4e5f",
+		Messages: []entity.Message{{Author: "carol", Time: sent, Text: "hi"}},
+	}}
+}
+
+func TestJSONLines_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, JSONLines, conversations()))
+	assert.Equal(t, 5, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), `"peer":"0a1b2c"`)
+	assert.Contains(t, buf.String(), `"status":"read"`)
+
+	convs, err := Read(&buf)
+	require.NoError(t, err)
+	want := conversations()
+	// What sat in an outbox is not in the one it is imported next to
+	want[0].Messages[2].State = entity.MessageExpired
+	assert.Equal(t, len(want), len(convs))
+	for i := range want {
+		assert.Equal(t, want[i].PeerID, convs[i].PeerID)
+		require.Len(t, convs[i].Messages, len(want[i].Messages))
+		for j, message := range want[i].Messages {
+			assert.True(t, message.Time.Equal(convs[i].Messages[j].Time))
+			convs[i].Messages[j].Time, convs[i].Messages[j].SentAt = message.Time, message.SentAt
+			assert.Equal(t, message, convs[i].Messages[j])
+		}
+	}
+
+	_, err = Read(strings.NewReader("{\"author\":\"bob\"}\n"))
+	assert.ErrorContains(t, err, "line 1: no peer")
+	_, err = Read(strings.NewReader("\nnot json\n"))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestWrite_ReadableFormats(t *testing.T) {
+	var md bytes.Buffer
+	require.NoError(t, Write(&md, Markdown, conversations()))
+	assert.Contains(t, md.String(), "# Conversation with 0a1b2c\n\nPeer fingerprint: `0a1b2c`\n")
+	assert.Contains(t, md.String(), "  > Lunch?\n  > At noon\n")
+	assert.Contains(t, md.String(), "  > ↪ bob: Lunch? At noon\n")
+	assert.Contains(t, md.String(), "read, edited\n")
+	assert.Contains(t, md.String(), "  > *message deleted*\n")
+
+	var txt bytes.Buffer
+	require.NoError(t, Write(&txt, Text, conversations()))
+	lines := strings.Split(strings.TrimSpace(txt.String()), "\n")
+	assert.Equal(t, "Conversation with 0a1b2c", lines[0])
+	assert.Regexp(t, `^bob \(sent 2026-03-1\d .*, received .*, received\): Lunch\?$`, lines[1])
+	assert.Equal(t, "    At noon", lines[2])
+	assert.Contains(t, lines[4], ", queued): still there?")
+	assert.Contains(t, txt.String(), "(↪ bob: Lunch? At noon) Sure")
+	assert.Contains(t, txt.String(), "carol (sent ")
+
+	assert.ErrorIs(t, Write(&txt, "pdf", nil), ErrUnknownFormat)
+	format, err := ParseFormat("Markdown")
+	require.NoError(t, err)
+	assert.Equal(t, Markdown, format)
+}
@@ -0,0 +1,321 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"p2p-messenger/internal/entity"
+)
+
+const (
+	// indexPageSize keeps a page of an index inside one Noise message
+	indexPageSize = 100
+	// maxIndexEntries bounds the index of one peer
+	maxIndexEntries = 10000
+	// maxEntryPath bounds the path of an index entry
+	maxEntryPath = 300
+)
+
+var (
+	ErrNoShare   = errors.New("no such shared folder")
+	ErrShareName = errors.New("already sharing a folder with this name")
+)
+
+// Share is a directory whose files some peers and group members may browse
+// and download
+type Share struct {
+	Name string `json:"name"`
+	Dir  string `json:"dir"`
+	// Peers and Groups hold the peer and group IDs allowed to browse
+	Peers  []string `json:"peers,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Entry is a file in the index of a peer's shares
+type Entry struct {
+	Share string `json:"share"`
+	// Path is slash separated and relative to the share
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// hashed caches the hash of a file until it changes
+type hashed struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// index is what a browsed peer has sent of its index so far
+type index struct {
+	id      string
+	entries []Entry
+	// total is -1 until the first page arrives
+	total int
+}
+
+// fetch is a shared file we asked a peer for
+type fetch struct {
+	peerID string
+	entry  Entry
+}
+
+// LoadShares loads the shares kept at path. member reports whether a peer
+// belongs to a group, for shares opened to groups.
+func (m *Manager) LoadShares(path string, member func(groupID, peerID string) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sharesPath, m.member = path, member
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read shares: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.shares); err != nil {
+		return fmt.Errorf("shares %s: %w", path, err)
+	}
+	return nil
+}
+
+// Shares returns our shares, ordered by name
+func (m *Manager) Shares() []Share {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.shares)
+}
+
+// AddShare shares dir with the peers and group members named by ID, or
+// changes who may browse it if it is shared already
+func (m *Manager) AddShare(dir string, peers, groups []string) (Share, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return Share{}, err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return Share{}, err
+	}
+	if !info.IsDir() {
+		return Share{}, fmt.Errorf("%s is not a directory", dir)
+	}
+	share := Share{Name: filepath.Base(dir), Dir: dir, Peers: slices.Clone(peers), Groups: slices.Clone(groups)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.shares, func(s Share) bool { return s.Name == share.Name })
+	switch {
+	case i < 0:
+		m.shares = append(m.shares, share)
+		slices.SortFunc(m.shares, func(a, b Share) int { return strings.Compare(a.Name, b.Name) })
+	case m.shares[i].Dir != dir:
+		return Share{}, fmt.Errorf("%w: %s", ErrShareName, share.Name)
+	default:
+		m.shares[i] = share
+	}
+	return share, m.saveSharesLocked()
+}
+
+// RemoveShare stops sharing the folder name
+func (m *Manager) RemoveShare(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.shares, func(s Share) bool { return s.Name == name })
+	if i < 0 {
+		return ErrNoShare
+	}
+	m.shares = slices.Delete(m.shares, i, i+1)
+	return m.saveSharesLocked()
+}
+
+// saveSharesLocked writes the shares with owner-only permissions, replacing
+// the previous file only once the new one is complete
+func (m *Manager) saveSharesLocked() error {
+	data, err := json.Marshal(m.shares)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.sharesPath), 0700); err != nil {
+		return err
+	}
+	tmp := m.sharesPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.sharesPath)
+}
+
+// allowed reports whether peerID may browse share
+func (m *Manager) allowed(share Share, peerID string) bool {
+	if slices.Contains(share.Peers, peerID) {
+		return true
+	}
+	return m.member != nil && slices.ContainsFunc(share.Groups, func(groupID string) bool {
+		return m.member(groupID, peerID)
+	})
+}
+
+// Browse asks peer for the index of the shares it opened to us
+func (m *Manager) Browse(peer *entity.Peer) error {
+	id := entity.NewMessageID()
+	m.mu.Lock()
+	m.indexes[peer.PeerID] = &index{id: id, total: -1}
+	m.mu.Unlock()
+	return m.control(peer.PeerID, control{ID: id, Kind: kindIndexRequest})
+}
+
+// Index returns what peerID has sent of its index since the last Browse,
+// and whether that is all of it
+func (m *Manager) Index(peerID string) ([]Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx, ok := m.indexes[peerID]
+	if !ok {
+		return nil, false
+	}
+	return slices.Clone(idx.entries), len(idx.entries) == idx.total
+}
+
+// addIndexPageLocked adds a page of the index of the peer with ID from and
+// asks for the next one
+func (m *Manager) addIndexPageLocked(from string, msg control) {
+	idx, ok := m.indexes[from]
+	if !ok || idx.id != msg.ID || msg.Offset != len(idx.entries) || msg.Total > maxIndexEntries ||
+		len(msg.Entries) > indexPageSize || msg.Offset+len(msg.Entries) > msg.Total {
+		return
+	}
+	for _, entry := range msg.Entries {
+		if !validEntry(entry) {
+			logger.Debug("bad index entry", "peer", from)
+			return
+		}
+	}
+	idx.entries = append(idx.entries, msg.Entries...)
+	idx.total = msg.Total
+	if len(idx.entries) < idx.total && len(msg.Entries) > 0 {
+		go m.control(from, control{ID: msg.ID, Kind: kindIndexRequest, Offset: len(idx.entries)})
+	}
+}
+
+// sendIndex sends the page at offset of the index of the shares peerID
+// may browse
+func (m *Manager) sendIndex(peerID, id string, offset int) {
+	entries := m.indexFor(peerID)
+	if offset < 0 || offset > len(entries) {
+		return
+	}
+	page := entries[offset:min(offset+indexPageSize, len(entries))]
+	if err := m.control(peerID, control{ID: id, Kind: kindIndex, Entries: page, Offset: offset, Total: len(entries)}); err != nil {
+		logger.Debug("failed to send index", "peer", peerID, "err", err)
+	}
+}
+
+// indexFor lists the files of every share peerID may browse. Hidden files
+// and anything but regular files are left out, and symbolic links are not
+// followed.
+func (m *Manager) indexFor(peerID string) []Entry {
+	var entries []Entry
+	for _, share := range m.Shares() {
+		if !m.allowed(share, peerID) {
+			continue
+		}
+		filepath.WalkDir(share.Dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if path != share.Dir && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || len(entries) >= maxIndexEntries {
+				return nil
+			}
+			rel, err := filepath.Rel(share.Dir, path)
+			if err != nil || len(rel) > maxEntryPath {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			hash, err := m.hash(path, info)
+			if err != nil {
+				return nil
+			}
+			entries = append(entries, Entry{Share: share.Name, Path: filepath.ToSlash(rel), Size: info.Size(), Hash: hash})
+			return nil
+		})
+	}
+	return entries
+}
+
+// hash returns the hash of the file at path, hashing it again only when
+// its size or modification time changed
+func (m *Manager) hash(path string, info fs.FileInfo) (string, error) {
+	m.mu.Lock()
+	cached, ok := m.hashes[path]
+	m.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.hash, nil
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.hashes[path] = hashed{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	m.mu.Unlock()
+	return hash, nil
+}
+
+// Download asks peerID for a file of its index. It is accepted as soon as
+// the peer offers it.
+func (m *Manager) Download(peerID string, entry Entry) error {
+	id := entity.NewMessageID()
+	m.mu.Lock()
+	m.fetches[id] = fetch{peerID: peerID, entry: entry}
+	m.mu.Unlock()
+	return m.control(peerID, control{ID: id, Kind: kindFetch, Share: entry.Share, Path: entry.Path})
+}
+
+// serveFetch offers peerID the shared file it asked for, if its index
+// holds that file
+func (m *Manager) serveFetch(peerID string, msg control) {
+	var entry *Entry
+	for _, e := range m.indexFor(peerID) {
+		if e.Share == msg.Share && e.Path == msg.Path {
+			entry = &e
+			break
+		}
+	}
+	peer, ok := m.peers.Get(peerID)
+	if entry == nil || !ok {
+		logger.Debug("refused fetch of unshared file", "peer", peerID)
+		return
+	}
+	i := slices.IndexFunc(m.Shares(), func(s Share) bool { return s.Name == entry.Share })
+	if i < 0 {
+		return
+	}
+	path := filepath.Join(m.Shares()[i].Dir, filepath.FromSlash(entry.Path))
+	if _, err := m.offer(peer, path, msg.ID); err != nil {
+		logger.Debug("failed to offer shared file", "peer", peerID, "err", err)
+	}
+}
+
+// validEntry checks an index entry from a peer before it is shown
+func validEntry(e Entry) bool {
+	return e.Share != "" && e.Path != "" && len(e.Path) <= maxEntryPath && e.Size >= 0 &&
+		filepath.IsLocal(filepath.FromSlash(e.Path)) && validHash(e.Hash)
+}
@@ -0,0 +1,106 @@
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shareDir creates a folder named name holding files
+func shareDir(t *testing.T, name string, files map[string]string) string {
+	dir := filepath.Join(t.TempDir(), name)
+	for path, content := range files {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+	return dir
+}
+
+func browse(t *testing.T, browser, owner *node) []Entry {
+	t.Helper()
+	peer, _ := browser.peers.Get("sender")
+	require.NoError(t, browser.Browse(peer))
+	var entries []Entry
+	require.Eventually(t, func() bool {
+		var complete bool
+		entries, complete = browser.Index("sender")
+		return complete
+	}, 5*time.Second, 10*time.Millisecond)
+	return entries
+}
+
+func paths(entries []Entry) []string {
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Share+"/"+e.Path)
+	}
+	return paths
+}
+
+func TestShares_BrowseAndDownload(t *testing.T) {
+	sender, receiver := newPair(t)
+	require.NoError(t, sender.LoadShares(filepath.Join(sender.dir, "shares.json"), nil))
+	dir := shareDir(t, "music", map[string]string{"a.txt": "first", "albums/b.bin": "second", ".secret": "hidden", ".git/config": "hidden"})
+	_, err := sender.AddShare(dir, []string{"receiver"}, nil)
+	require.NoError(t, err)
+
+	entries := browse(t, receiver, sender)
+	assert.ElementsMatch(t, []string{"music/a.txt", "music/albums/b.bin"}, paths(entries))
+
+	for _, e := range entries {
+		if e.Path == "albums/b.bin" {
+			assert.Equal(t, int64(len("second")), e.Size)
+			require.NoError(t, receiver.Download("sender", e))
+		}
+	}
+	received := eventuallyState(t, receiver, "sender", StateDone)
+	kept, err := os.ReadFile(received.Path)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(kept))
+
+	// Shares survive a restart
+	reloaded := New(sender.dir, sender.peers, nil, nil)
+	require.NoError(t, reloaded.LoadShares(filepath.Join(sender.dir, "shares.json"), nil))
+	assert.Equal(t, sender.Shares(), reloaded.Shares())
+}
+
+func TestShares_AccessPerPeerAndGroup(t *testing.T) {
+	sender, receiver := newPair(t)
+	inTeam := true
+	member := func(groupID, peerID string) bool { return groupID == "team" && peerID == "receiver" && inTeam }
+	require.NoError(t, sender.LoadShares(filepath.Join(sender.dir, "shares.json"), member))
+	_, err := sender.AddShare(shareDir(t, "team", map[string]string{"plan.txt": "plan"}), nil, []string{"team"})
+	require.NoError(t, err)
+	_, err = sender.AddShare(shareDir(t, "private", map[string]string{"diary.txt": "dear diary"}), []string{"someone-else"}, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"team/plan.txt"}, paths(browse(t, receiver, sender)))
+
+	// Files outside the index are not offered, whatever the request says
+	for _, e := range []Entry{{Share: "private", Path: "diary.txt"}, {Share: "team", Path: "../private/diary.txt"}} {
+		sender.serveFetch("receiver", control{ID: "x", Kind: kindFetch, Share: e.Share, Path: e.Path})
+	}
+	assert.Empty(t, sender.Transfers("receiver"))
+
+	inTeam = false
+	assert.Empty(t, browse(t, receiver, sender))
+}
+
+func TestShares_IndexArrivesInPages(t *testing.T) {
+	sender, receiver := newPair(t)
+	require.NoError(t, sender.LoadShares(filepath.Join(sender.dir, "shares.json"), nil))
+	files := make(map[string]string)
+	for i := range 2*indexPageSize + 50 {
+		files[fmt.Sprintf("f%03d", i)] = fmt.Sprint(i)
+	}
+	_, err := sender.AddShare(shareDir(t, "many", files), []string{"receiver"}, nil)
+	require.NoError(t, err)
+
+	assert.Len(t, browse(t, receiver, sender), 2*indexPageSize+50)
+}
@@ -0,0 +1,722 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/logging"
+	"p2p-messenger/internal/repository"
+)
+
+var logger = logging.For("transfer")
+
+const (
+	// chunkSize keeps a chunk, encoded in a frame, well inside one Noise
+	// message
+	chunkSize = 16 * 1024
+	// window is how many chunks may be on their way before the receiver
+	// confirms them
+	window = 16
+	// maxAttempts bounds how often a sender resumes an interrupted stream
+	// on its own before the receiver has to accept it again
+	maxAttempts = 3
+)
+
+// retryDelay is the pause before a sender resumes a stream
+var retryDelay = 2 * time.Second
+
+var (
+	ErrUnknown      = errors.New("no such file transfer")
+	ErrNoKey        = errors.New("peer has not completed a handshake yet")
+	ErrRejected     = errors.New("file transfer rejected by peer")
+	ErrBadFrame     = errors.New("invalid file transfer frame")
+	ErrHashMismatch = errors.New("received file does not match its hash")
+)
+
+// Sender hands a control message to peer over a pairwise Noise session
+type Sender func(peer *entity.Peer, data []byte) error
+
+// Stream is a Noise session with a peer that carries messages both ways.
+// One goroutine may send while another receives.
+type Stream interface {
+	Send(data []byte) error
+	Receive() ([]byte, error)
+	Close() error
+}
+
+// Dialer opens a stream for the chunks of a file to peer
+type Dialer func(peer *entity.Peer) (Stream, error)
+
+// State is where a transfer stands
+type State string
+
+const (
+	StateOffered     State = "offered"
+	StateActive      State = "active"
+	StateInterrupted State = "interrupted"
+	StateDone        State = "done"
+	StateDeclined    State = "declined"
+	StateFailed      State = "failed"
+)
+
+// Transfer is a file offered to or by a peer
+type Transfer struct {
+	ID       string
+	PeerID   string
+	Name     string
+	Size     int64
+	Hash     string
+	Incoming bool
+	State    State
+	Time     time.Time
+	// Confirmed counts the bytes the receiver has written
+	Confirmed int64
+	// Path is the file we send, or where a received file was kept
+	Path string
+	Err  string
+}
+
+// control is the plaintext of a message on a file session
+type control struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Name, Size and the hex SHA-256 Hash describe an offered file
+	Name string `json:"name,omitempty"`
+	Size int64  `json:"size,omitempty"`
+	Hash string `json:"hash,omitempty"`
+	// Request is the ID of the fetch an offer answers
+	Request string `json:"request,omitempty"`
+	// Share and Path name a shared file to fetch
+	Share string `json:"share,omitempty"`
+	Path  string `json:"path,omitempty"`
+	// Entries is the page of an index starting at Offset, out of Total
+	Entries []Entry `json:"entries,omitempty"`
+	Offset  int     `json:"offset,omitempty"`
+	Total   int     `json:"total,omitempty"`
+}
+
+const (
+	kindOffer        = "offer"
+	kindAccept       = "accept"
+	kindDecline      = "decline"
+	kindIndexRequest = "index-request"
+	kindIndex        = "index"
+	kindFetch        = "fetch"
+)
+
+// frame is a message on a chunk stream. The sender opens with the transfer
+// ID and the receiver answers with the offset to resume from. Then the
+// sender sends chunks at Offset and the receiver confirms each with the
+// offset it has written up to, and finally with Done or Error.
+type frame struct {
+	ID     string `json:"id,omitempty"`
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Manager offers files to peers and receives the files it accepted. A
+// file only travels after the receiver accepts it, in chunks over its own
+// Noise session with a bounded number of unconfirmed chunks. Received
+// chunks are kept in a partial file, so an interrupted transfer resumes
+// from the last confirmed chunk, and the whole file is checked against the
+// hash in the offer before it is kept.
+type Manager struct {
+	dir   string
+	peers *repository.PeerRepository
+	send  Sender
+	dial  Dialer
+
+	mu        sync.Mutex
+	transfers map[string]*Transfer
+	// sending holds the outgoing transfers being streamed
+	sending map[string]bool
+	// receiving holds every incoming transfer being streamed
+	receiving map[string]*receipt
+
+	// sharesPath keeps shares across restarts; member reports whether a
+	// peer belongs to a group
+	sharesPath string
+	member     func(groupID, peerID string) bool
+	shares     []Share
+	hashes     map[string]hashed
+	// indexes holds the index of every peer we browse
+	indexes map[string]*index
+	// fetches holds the shared files we asked for, by request ID
+	fetches map[string]fetch
+}
+
+// New creates a manager keeping received files in dir
+func New(dir string, peers *repository.PeerRepository, send Sender, dial Dialer) *Manager {
+	return &Manager{
+		dir:       dir,
+		peers:     peers,
+		send:      send,
+		dial:      dial,
+		transfers: make(map[string]*Transfer),
+		sending:   make(map[string]bool),
+		receiving: make(map[string]*receipt),
+		hashes:    make(map[string]hashed),
+		indexes:   make(map[string]*index),
+		fetches:   make(map[string]fetch),
+	}
+}
+
+// Transfers returns the transfers with peerID, oldest first
+func (m *Manager) Transfers(peerID string) []Transfer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var transfers []Transfer
+	for _, t := range m.transfers {
+		if t.PeerID == peerID {
+			transfers = append(transfers, *t)
+		}
+	}
+	slices.SortFunc(transfers, func(a, b Transfer) int { return a.Time.Compare(b.Time) })
+	return transfers
+}
+
+// Offer tells peer about the file at path. It is sent once the peer accepts.
+func (m *Manager) Offer(peer *entity.Peer, path string) (Transfer, error) {
+	return m.offer(peer, path, "")
+}
+
+// offer offers the file at path, answering the fetch request if set
+func (m *Manager) offer(peer *entity.Peer, path, request string) (Transfer, error) {
+	if len(peer.PublicKey) == 0 {
+		return Transfer{}, ErrNoKey
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return Transfer{}, fmt.Errorf("%s is not a regular file", path)
+	}
+	hash, err := m.hash(path, info)
+	if err != nil {
+		return Transfer{}, err
+	}
+	t := &Transfer{
+		ID:     entity.NewMessageID(),
+		PeerID: peer.PeerID,
+		Name:   filepath.Base(path),
+		Size:   info.Size(),
+		Hash:   hash,
+		State:  StateOffered,
+		Time:   time.Now(),
+		Path:   path,
+	}
+	// The answer may come in before the offer is sent
+	snapshot := *t
+	m.mu.Lock()
+	m.transfers[t.ID] = t
+	m.mu.Unlock()
+
+	err = m.control(peer.PeerID, control{ID: snapshot.ID, Kind: kindOffer, Name: snapshot.Name, Size: snapshot.Size, Hash: snapshot.Hash, Request: request})
+	if err != nil {
+		m.setState(snapshot.ID, StateFailed, err)
+		return Transfer{}, err
+	}
+	logger.Info("file offered", "peer", peer.PeerID, "id", snapshot.ID, "size", snapshot.Size)
+	return snapshot, nil
+}
+
+// Accept asks the sender of an offered or interrupted transfer to send it
+func (m *Manager) Accept(id string) error {
+	m.mu.Lock()
+	t, ok := m.transfers[id]
+	if !ok || !t.Incoming || (t.State != StateOffered && t.State != StateInterrupted) {
+		m.mu.Unlock()
+		return ErrUnknown
+	}
+	t.State, t.Err = StateActive, ""
+	peerID := t.PeerID
+	m.mu.Unlock()
+
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		m.setState(id, StateInterrupted, err)
+		return err
+	}
+	if err := m.control(peerID, control{ID: id, Kind: kindAccept}); err != nil {
+		m.setState(id, StateInterrupted, err)
+		return err
+	}
+	return nil
+}
+
+// Decline turns down an offered transfer and drops what was received of it
+func (m *Manager) Decline(id string) error {
+	m.mu.Lock()
+	t, ok := m.transfers[id]
+	if !ok || !t.Incoming || (t.State != StateOffered && t.State != StateInterrupted) {
+		m.mu.Unlock()
+		return ErrUnknown
+	}
+	t.State = StateDeclined
+	peerID := t.PeerID
+	if r, ok := m.receiving[id]; ok {
+		r.stream.Close()
+	}
+	m.mu.Unlock()
+
+	os.Remove(m.partPath(id))
+	return m.control(peerID, control{ID: id, Kind: kindDecline})
+}
+
+func (m *Manager) control(peerID string, msg control) error {
+	peer, ok := m.peers.Get(peerID)
+	if !ok {
+		return fmt.Errorf("peer %s is gone", peerID)
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return m.send(peer, data)
+}
+
+// Receive handles a control message from the peer with ID from, whose
+// identity the Noise handshake of the session proved
+func (m *Manager) Receive(from string, plaintext []byte) {
+	var msg control
+	// The ID names the partial file, so it must be one of ours
+	if err := json.Unmarshal(plaintext, &msg); err != nil || !entity.ValidMessageID(msg.ID) {
+		logger.Debug("bad file transfer message", "peer", from, "err", err)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, known := m.transfers[msg.ID]
+	if known && t.PeerID != from {
+		return
+	}
+	switch msg.Kind {
+	case kindOffer:
+		if known || !validName(msg.Name) || msg.Size < 0 || !validHash(msg.Hash) {
+			logger.Debug("bad file offer", "peer", from, "id", msg.ID)
+			return
+		}
+		m.transfers[msg.ID] = &Transfer{
+			ID:       msg.ID,
+			PeerID:   from,
+			Name:     msg.Name,
+			Size:     msg.Size,
+			Hash:     msg.Hash,
+			Incoming: true,
+			State:    StateOffered,
+			Time:     time.Now(),
+		}
+		logger.Info("file offered to us", "peer", from, "id", msg.ID, "size", msg.Size)
+		// A file we fetched from a share needs no answer
+		if f, ok := m.fetches[msg.Request]; ok && f.peerID == from && f.entry.Hash == msg.Hash {
+			delete(m.fetches, msg.Request)
+			go m.Accept(msg.ID)
+		}
+
+	case kindAccept:
+		if !known || t.Incoming || (t.State != StateOffered && t.State != StateInterrupted) || m.sending[t.ID] {
+			return
+		}
+		t.State, t.Err = StateActive, ""
+		m.sending[t.ID] = true
+		go m.run(t.ID)
+
+	case kindDecline:
+		if known && !t.Incoming && (t.State == StateOffered || t.State == StateInterrupted) {
+			t.State = StateDeclined
+		}
+
+	case kindIndexRequest:
+		go m.sendIndex(from, msg.ID, msg.Offset)
+
+	case kindIndex:
+		m.addIndexPageLocked(from, msg)
+
+	case kindFetch:
+		go m.serveFetch(from, msg)
+	}
+}
+
+// run sends an accepted file, resuming the stream when it breaks
+func (m *Manager) run(id string) {
+	var err error
+	for attempt := range maxAttempts {
+		if attempt > 0 {
+			time.Sleep(retryDelay)
+		}
+		if err = m.sendFile(id); err == nil || errors.Is(err, ErrRejected) {
+			break
+		}
+		logger.Debug("file transfer interrupted", "id", id, "attempt", attempt+1, "err", err)
+	}
+	switch {
+	case err == nil:
+		m.finish(id, StateDone, nil)
+		logger.Info("file sent", "id", id)
+	case errors.Is(err, ErrRejected):
+		m.finish(id, StateFailed, err)
+	default:
+		m.finish(id, StateInterrupted, err)
+	}
+}
+
+// sendFile streams the file of an outgoing transfer from where the
+// receiver asks to resume
+func (m *Manager) sendFile(id string) error {
+	t, ok := m.get(id)
+	if !ok {
+		return ErrUnknown
+	}
+	peer, ok := m.peers.Get(t.PeerID)
+	if !ok {
+		return fmt.Errorf("peer %s is gone", t.PeerID)
+	}
+	s, err := m.dial(peer)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := sendFrame(s, frame{ID: id}); err != nil {
+		return err
+	}
+	start, err := receiveFrame(s)
+	if err != nil {
+		return err
+	}
+	if start.Error != "" {
+		return fmt.Errorf("%w: %s", ErrRejected, start.Error)
+	}
+	if start.Offset < 0 || start.Offset > t.Size {
+		return fmt.Errorf("%w: resume at %d", ErrBadFrame, start.Offset)
+	}
+
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(start.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	m.setConfirmed(id, start.Offset)
+
+	// Confirmations are read while chunks go out
+	replies := make(chan frame)
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			reply, err := receiveFrame(s)
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case replies <- reply:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sent, confirmed := start.Offset, start.Offset
+	buf := make([]byte, chunkSize)
+	for {
+		if sent < t.Size && sent-confirmed < window*chunkSize {
+			n, err := io.ReadFull(f, buf[:min(chunkSize, t.Size-sent)])
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", t.Path, err)
+			}
+			if err := sendFrame(s, frame{Offset: sent, Data: buf[:n]}); err != nil {
+				return err
+			}
+			sent += int64(n)
+			continue
+		}
+		select {
+		case reply := <-replies:
+			switch {
+			case reply.Error != "":
+				return fmt.Errorf("%w: %s", ErrRejected, reply.Error)
+			case reply.Done && confirmed == t.Size:
+				return nil
+			case reply.Done || reply.Offset <= confirmed || reply.Offset > sent:
+				return fmt.Errorf("%w: confirmed %d of %d sent", ErrBadFrame, reply.Offset, sent)
+			}
+			confirmed = reply.Offset
+			m.setConfirmed(id, confirmed)
+		case err := <-failed:
+			return err
+		}
+	}
+}
+
+// Serve receives the chunks of an accepted transfer from the peer with ID
+// from, whose identity the Noise handshake of s proved
+func (m *Manager) Serve(from string, s Stream) {
+	start, err := receiveFrame(s)
+	if err != nil {
+		logger.Debug("bad file stream", "peer", from, "err", err)
+		return
+	}
+	r, t, ok := m.claim(from, start.ID, s)
+	if !ok {
+		sendFrame(s, frame{Error: "transfer was not accepted"})
+		return
+	}
+
+	switch err := m.receiveFile(s, t); {
+	case err == nil:
+		m.finishReceive(t.ID, r, StateDone, nil)
+		logger.Info("file received", "peer", from, "id", t.ID)
+	case errors.Is(err, ErrHashMismatch):
+		m.finishReceive(t.ID, r, StateFailed, err)
+		logger.Warn("received file does not match its hash", "peer", from, "id", t.ID)
+	default:
+		m.finishReceive(t.ID, r, StateInterrupted, err)
+		logger.Debug("file stream interrupted", "peer", from, "id", t.ID, "err", err)
+	}
+}
+
+// claim marks an accepted incoming transfer as receiving on s. A transfer
+// that broke off may be resumed by its sender without being accepted again,
+// and a new stream replaces one whose connection silently went away.
+func (m *Manager) claim(from, id string, s Stream) (*receipt, Transfer, bool) {
+	for {
+		m.mu.Lock()
+		t, ok := m.transfers[id]
+		if !ok || !t.Incoming || t.PeerID != from || (t.State != StateActive && t.State != StateInterrupted) {
+			m.mu.Unlock()
+			return nil, Transfer{}, false
+		}
+		old, busy := m.receiving[id]
+		if !busy {
+			t.State, t.Err = StateActive, ""
+			r := &receipt{stream: s, done: make(chan struct{})}
+			m.receiving[id] = r
+			m.mu.Unlock()
+			return r, *t, true
+		}
+		m.mu.Unlock()
+		// The old stream must stop writing before the partial file is
+		// picked up again
+		old.stream.Close()
+		<-old.done
+	}
+}
+
+// receipt is an incoming transfer being streamed
+type receipt struct {
+	stream Stream
+	done   chan struct{}
+}
+
+// finish leaves an outgoing transfer in state once it is no longer sent
+func (m *Manager) finish(id string, state State, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sending, id)
+	m.setStateLocked(id, state, err)
+}
+
+// finishReceive leaves an incoming transfer in state once r ends, unless
+// it was declined meanwhile
+func (m *Manager) finishReceive(id string, r *receipt, state State, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.receiving, id)
+	close(r.done)
+	if t, ok := m.transfers[id]; ok && t.State != StateDeclined {
+		m.setStateLocked(id, state, err)
+	}
+}
+
+// receiveFile writes the chunks of t to its partial file, confirming each,
+// and keeps the file once it is complete and matches its hash
+func (m *Manager) receiveFile(s Stream, t Transfer) error {
+	part := m.partPath(t.ID)
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		sendFrame(s, frame{Error: "cannot store file"})
+		return err
+	}
+	defer f.Close()
+
+	// A chunk cut short by a crash is sent again
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := min(info.Size(), t.Size) / chunkSize * chunkSize
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	m.setConfirmed(t.ID, offset)
+	if err := sendFrame(s, frame{Offset: offset}); err != nil {
+		return err
+	}
+
+	for offset < t.Size {
+		chunk, err := receiveFrame(s)
+		if err != nil {
+			return err
+		}
+		if chunk.Offset != offset || len(chunk.Data) == 0 || len(chunk.Data) > chunkSize || offset+int64(len(chunk.Data)) > t.Size {
+			return fmt.Errorf("%w: chunk at %d", ErrBadFrame, chunk.Offset)
+		}
+		if _, err := f.Write(chunk.Data); err != nil {
+			return err
+		}
+		offset += int64(len(chunk.Data))
+		m.setConfirmed(t.ID, offset)
+		if err := sendFrame(s, frame{Offset: offset}); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	hash, err := hashFile(part)
+	if err != nil {
+		return err
+	}
+	if hash != t.Hash {
+		os.Remove(part)
+		sendFrame(s, frame{Error: "hash mismatch"})
+		return ErrHashMismatch
+	}
+	path, err := m.keep(part, t.Name)
+	if err != nil {
+		sendFrame(s, frame{Error: "cannot store file"})
+		return err
+	}
+	m.mu.Lock()
+	if t, ok := m.transfers[t.ID]; ok {
+		t.Path = path
+	}
+	m.mu.Unlock()
+	// The file is kept even if the sender misses this
+	sendFrame(s, frame{Done: true})
+	return nil
+}
+
+// keep moves a verified partial file to the first free name in the
+// download directory
+func (m *Manager) keep(part, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		path := filepath.Join(m.dir, name)
+		if i > 0 {
+			path = filepath.Join(m.dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+			return path, os.Rename(part, path)
+		}
+	}
+}
+
+// partPath is where the chunks of an incoming transfer are kept until it
+// completes
+func (m *Manager) partPath(id string) string {
+	return filepath.Join(m.dir, "."+id+".part")
+}
+
+func (m *Manager) get(id string) (Transfer, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.transfers[id]
+	if !ok {
+		return Transfer{}, false
+	}
+	return *t, true
+}
+
+func (m *Manager) setState(id string, state State, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setStateLocked(id, state, err)
+}
+
+func (m *Manager) setStateLocked(id string, state State, err error) {
+	if t, ok := m.transfers[id]; ok {
+		t.State = state
+		t.Err = ""
+		if err != nil {
+			t.Err = err.Error()
+		}
+	}
+}
+
+func (m *Manager) setConfirmed(id string, confirmed int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.transfers[id]; ok {
+		t.Confirmed = confirmed
+	}
+}
+
+func sendFrame(s Stream, f frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return s.Send(data)
+}
+
+func receiveFrame(s Stream) (frame, error) {
+	var f frame
+	data, err := s.Receive()
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("%w: %v", ErrBadFrame, err)
+	}
+	return f, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// validName accepts a plain file name that cannot leave the download
+// directory
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, `/\`) && filepath.Base(name) == name && len(name) <= 255
+}
+
+func validHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
@@ -0,0 +1,248 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/repository"
+)
+
+var errBroken = errors.New("stream broken")
+
+// pipe is one end of an in-memory stream
+type pipe struct {
+	in     <-chan []byte
+	out    chan<- []byte
+	closed chan struct{}
+	once   *sync.Once
+	// breakAfter closes the stream after that many sends; 0 never does
+	breakAfter int
+	sent       int
+}
+
+func newPipe() (*pipe, *pipe) {
+	ab, ba := make(chan []byte, 32), make(chan []byte, 32)
+	closed, once := make(chan struct{}), new(sync.Once)
+	return &pipe{in: ba, out: ab, closed: closed, once: once}, &pipe{in: ab, out: ba, closed: closed, once: once}
+}
+
+func (p *pipe) Send(data []byte) error {
+	p.sent++
+	if p.breakAfter > 0 && p.sent > p.breakAfter {
+		p.Close()
+		return errBroken
+	}
+	select {
+	case <-p.closed:
+		return errBroken
+	default:
+	}
+	// Like a socket, the buffer holds what was sent before the stream broke
+	p.out <- bytes.Clone(data)
+	return nil
+}
+
+func (p *pipe) Receive() ([]byte, error) {
+	select {
+	case data := <-p.in:
+		return data, nil
+	default:
+	}
+	select {
+	case data := <-p.in:
+		return data, nil
+	case <-p.closed:
+		return nil, errBroken
+	case <-time.After(time.Second):
+		return nil, errors.New("timeout")
+	}
+}
+
+func (p *pipe) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+type node struct {
+	*Manager
+	dir string
+	// breaks is how many sends each new stream may make before it breaks
+	breaks []int
+	mu     sync.Mutex
+}
+
+func TestMain(m *testing.M) {
+	retryDelay = 0
+	os.Exit(m.Run())
+}
+
+// newPair connects a sender and a receiver manager in memory
+func newPair(t *testing.T) (sender, receiver *node) {
+	sender, receiver = &node{dir: t.TempDir()}, &node{dir: t.TempDir()}
+	nodes := map[string]*node{"sender": sender, "receiver": receiver}
+	for id, nd := range nodes {
+		peers := repository.NewPeerRepositoryWithValidation(time.Hour, 1)
+		for other := range nodes {
+			if other != id {
+				peers.Add(&entity.Peer{PeerID: other, PublicKey: []byte(other), AddrIP: "127.0.0.1", Port: "1"})
+			}
+		}
+		send := func(peer *entity.Peer, data []byte) error {
+			go nodes[peer.PeerID].Receive(id, data)
+			return nil
+		}
+		dial := func(peer *entity.Peer) (Stream, error) {
+			local, remote := newPipe()
+			nd.mu.Lock()
+			if len(nd.breaks) > 0 {
+				local.breakAfter, nd.breaks = nd.breaks[0], nd.breaks[1:]
+			}
+			nd.mu.Unlock()
+			go nodes[peer.PeerID].Serve(id, remote)
+			return local, nil
+		}
+		nd.Manager = New(filepath.Join(nd.dir, "downloads"), peers, send, dial)
+	}
+	return sender, receiver
+}
+
+func writeFile(t *testing.T, dir string, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(dir, "photo.jpg")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path, data
+}
+
+// offer offers path from sender and returns the receiver's copy of it
+func offer(t *testing.T, sender, receiver *node, path string) Transfer {
+	peer, _ := sender.peers.Get("receiver")
+	sent, err := sender.Offer(peer, path)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(receiver.Transfers("sender")) == 1 }, time.Second, 10*time.Millisecond)
+	offered := receiver.Transfers("sender")[0]
+	assert.Equal(t, sent.ID, offered.ID)
+	assert.Equal(t, StateOffered, offered.State)
+	return offered
+}
+
+func eventuallyState(t *testing.T, nd *node, peerID string, state State) Transfer {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		transfers := nd.Transfers(peerID)
+		return len(transfers) > 0 && transfers[0].State == state
+	}, 5*time.Second, 10*time.Millisecond)
+	return nd.Transfers(peerID)[0]
+}
+
+func TestTransfer_SendsAcceptedFile(t *testing.T) {
+	sender, receiver := newPair(t)
+	path, data := writeFile(t, sender.dir, 5*chunkSize+123)
+	offered := offer(t, sender, receiver, path)
+	assert.Equal(t, "photo.jpg", offered.Name)
+	assert.Equal(t, int64(len(data)), offered.Size)
+	assert.Equal(t, StateOffered, sender.Transfers("receiver")[0].State, "nothing moves before accept")
+
+	require.NoError(t, receiver.Accept(offered.ID))
+	received := eventuallyState(t, receiver, "sender", StateDone)
+	sent := eventuallyState(t, sender, "receiver", StateDone)
+	assert.Equal(t, sent.Size, sent.Confirmed)
+
+	kept, err := os.ReadFile(received.Path)
+	require.NoError(t, err)
+	assert.Equal(t, data, kept)
+	assert.Equal(t, filepath.Join(receiver.dir, "downloads", "photo.jpg"), received.Path)
+}
+
+func TestTransfer_ResumesFromLastConfirmedChunk(t *testing.T) {
+	sender, receiver := newPair(t)
+	path, data := writeFile(t, sender.dir, 40*chunkSize)
+	// The first stream breaks after the start frame and 20 chunks
+	sender.breaks = []int{21}
+	offered := offer(t, sender, receiver, path)
+	require.NoError(t, receiver.Accept(offered.ID))
+
+	received := eventuallyState(t, receiver, "sender", StateDone)
+	kept, err := os.ReadFile(received.Path)
+	require.NoError(t, err)
+	assert.Equal(t, data, kept)
+	assert.Equal(t, StateDone, eventuallyState(t, sender, "receiver", StateDone).State)
+}
+
+func TestTransfer_AcceptResumesAfterSenderGivesUp(t *testing.T) {
+	sender, receiver := newPair(t)
+	path, data := writeFile(t, sender.dir, 10*chunkSize)
+	sender.breaks = []int{3, 1, 1}
+	offered := offer(t, sender, receiver, path)
+	require.NoError(t, receiver.Accept(offered.ID))
+
+	eventuallyState(t, sender, "receiver", StateInterrupted)
+	interrupted := eventuallyState(t, receiver, "sender", StateInterrupted)
+	// At most the two chunks sent before the break made it
+	assert.Contains(t, []int64{chunkSize, 2 * chunkSize}, interrupted.Confirmed)
+	part, err := os.Stat(receiver.partPath(offered.ID))
+	require.NoError(t, err)
+	assert.Equal(t, interrupted.Confirmed, part.Size())
+
+	require.NoError(t, receiver.Accept(offered.ID))
+	received := eventuallyState(t, receiver, "sender", StateDone)
+	kept, err := os.ReadFile(received.Path)
+	require.NoError(t, err)
+	assert.Equal(t, data, kept)
+}
+
+func TestTransfer_RejectsFileNotMatchingHash(t *testing.T) {
+	sender, receiver := newPair(t)
+	path, data := writeFile(t, sender.dir, 3*chunkSize)
+	offered := offer(t, sender, receiver, path)
+
+	data[0] ^= 1
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	require.NoError(t, receiver.Accept(offered.ID))
+
+	failed := eventuallyState(t, receiver, "sender", StateFailed)
+	assert.Contains(t, failed.Err, ErrHashMismatch.Error())
+	eventuallyState(t, sender, "receiver", StateFailed)
+	entries, err := os.ReadDir(filepath.Join(receiver.dir, "downloads"))
+	require.NoError(t, err)
+	assert.Empty(t, entries, "nothing is kept")
+}
+
+func TestTransfer_DeclineAndBadOffers(t *testing.T) {
+	sender, receiver := newPair(t)
+	path, _ := writeFile(t, sender.dir, 10)
+	offered := offer(t, sender, receiver, path)
+	require.NoError(t, receiver.Decline(offered.ID))
+	eventuallyState(t, sender, "receiver", StateDeclined)
+	assert.ErrorIs(t, receiver.Accept(offered.ID), ErrUnknown)
+
+	for _, name := range []string{"../evil", "a/b", "..", ""} {
+		receiver.Receive("sender", []byte(`{"id":"`+entity.NewMessageID()+`","kind":"offer","name":"`+name+`","size":1,"hash":"`+offered.Hash+`"}`))
+	}
+	assert.Len(t, receiver.Transfers("sender"), 1)
+
+	// An ID that names a file outside the download directory is refused
+	// before anything is written or removed there
+	outside := filepath.Join(receiver.dir, "outside.part")
+	require.NoError(t, os.WriteFile(outside, []byte("keep"), 0600))
+	for _, id := range []string{"/../../outside", "../outside", offered.ID + "/..", strings.ToUpper(entity.NewMessageID())} {
+		receiver.Receive("sender", []byte(`{"id":"`+id+`","kind":"offer","name":"evil.txt","size":1,"hash":"`+offered.Hash+`"}`))
+		assert.ErrorIs(t, receiver.Accept(id), ErrUnknown, id)
+		assert.ErrorIs(t, receiver.Decline(id), ErrUnknown, id)
+	}
+	assert.Len(t, receiver.Transfers("sender"), 1)
+	data, err := os.ReadFile(outside)
+	require.NoError(t, err)
+	assert.Equal(t, "keep", string(data))
+}
@@ -0,0 +1,360 @@
+package transport
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// QUICPortOffset places the QUIC listener on UDP chat port + 1, since
+	// multicast discovery already uses the chat port's UDP side
+	QUICPortOffset = 1
+	quicALPN       = "localchat"
+	// quicIdleTimeout is how long a connection survives without any packet
+	// getting through, e.g. while the network is down
+	quicIdleTimeout = time.Minute
+	quicKeepAlive   = 10 * time.Second
+	// quicMaxStreams bounds concurrent conversations and transfers per connection
+	quicMaxStreams = 32
+)
+
+var quicConfig = &quic.Config{
+	MaxIdleTimeout:     quicIdleTimeout,
+	KeepAlivePeriod:    quicKeepAlive,
+	MaxIncomingStreams: quicMaxStreams,
+}
+
+// QUICAddr returns the UDP address of the QUIC listener for a chat address
+func QUICAddr(chatAddr string) (string, error) {
+	host, port, err := net.SplitHostPort(chatAddr)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+QUICPortOffset)), nil
+}
+
+// quicServerTLS returns a TLS config with a throwaway self-signed certificate.
+// QUIC requires TLS, but peers are authenticated by the Noise handshake on
+// every stream, so the certificate is never checked.
+var quicServerTLS = sync.OnceValues(func() (*tls.Config, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{quicALPN},
+	}, nil
+})
+
+var quicClientTLS = &tls.Config{
+	InsecureSkipVerify: true, // Noise authenticates the peer
+	NextProtos:         []string{quicALPN},
+}
+
+// quicSession is an outgoing QUIC connection together with every UDP
+// socket it has used; all of them are closed when the connection ends
+type quicSession struct {
+	conn       *quic.Conn
+	transports []*quic.Transport
+}
+
+// quicClient shares one QUIC connection per remote address between all
+// streams, so a conversation and a file transfer to the same peer run side
+// by side without blocking each other
+type quicClient struct {
+	mu       sync.Mutex
+	sessions map[string]*quicSession
+}
+
+func newQUICClient() *quicClient {
+	return &quicClient{sessions: make(map[string]*quicSession)}
+}
+
+var defaultQUICClient = newQUICClient()
+
+// connection returns the live connection to addr, dialing a new one if needed
+func (c *quicClient) connection(ctx context.Context, addr string) (*quic.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if session, ok := c.sessions[addr]; ok && session.conn.Context().Err() == nil {
+		return session.conn, nil
+	}
+
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udp}
+	conn, err := tr.Dial(ctx, remote, quicClientTLS, quicConfig)
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+
+	session := &quicSession{conn: conn, transports: []*quic.Transport{tr}}
+	c.sessions[addr] = session
+	go func() {
+		<-conn.Context().Done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.sessions[addr] == session {
+			delete(c.sessions, addr)
+		}
+		for _, tr := range session.transports {
+			tr.Close()
+		}
+	}()
+	return conn, nil
+}
+
+// migrate moves every connection to a fresh UDP socket, probing the new
+// paths in parallel
+func (c *quicClient) migrate(ctx context.Context) error {
+	c.mu.Lock()
+	sessions := slices.Collect(maps.Values(c.sessions))
+	c.mu.Unlock()
+
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for i, session := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.migrateSession(ctx, session)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (c *quicClient) migrateSession(ctx context.Context, session *quicSession) error {
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: udp}
+
+	// The connection registers with the new socket, so it may only be
+	// closed together with the connection
+	c.mu.Lock()
+	if session.conn.Context().Err() != nil {
+		c.mu.Unlock()
+		tr.Close()
+		return nil
+	}
+	session.transports = append(session.transports, tr)
+	c.mu.Unlock()
+
+	path, err := session.conn.AddPath(tr)
+	if err != nil {
+		return err
+	}
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		return fmt.Errorf("probing new path to %s: %w", session.conn.RemoteAddr(), err)
+	}
+	return path.Switch()
+}
+
+// MigrateQUIC moves outgoing QUIC connections to a new local socket after the
+// network changed, keeping their streams alive. Connections that cannot be
+// migrated are left alone and are replaced on the next dial if they die.
+func MigrateQUIC(ctx context.Context) error {
+	return defaultQUICClient.migrate(ctx)
+}
+
+// DialQUIC opens a new stream on the QUIC connection to the listener of the
+// chat address addr and exchanges the feature offer like DialTCP
+func DialQUIC(addr, offer string, timeout time.Duration) (Conn, string, error) {
+	return dialQUIC(addr, ChatPath, offer, timeout)
+}
+
+func dialQUIC(addr, path, offer string, timeout time.Duration) (Conn, string, error) {
+	quicAddr, err := QUICAddr(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := defaultQUICClient.connection(ctx, quicAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return clientHello(&quicStream{Stream: stream, conn: conn}, path, offer, timeout)
+}
+
+// QUICListener accepts streams of incoming QUIC connections as net.Conns
+// that speak the raw TCP chat protocol
+type QUICListener struct {
+	transport *quic.Transport
+	listener  *quic.Listener
+	streams   chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	conns map[*quic.Conn]struct{}
+}
+
+var _ net.Listener = (*QUICListener)(nil)
+
+// ListenQUIC listens on the QUIC address belonging to the chat address addr
+func ListenQUIC(addr string) (*QUICListener, error) {
+	quicAddr, err := QUICAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := quicServerTLS()
+	if err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", quicAddr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udp}
+	listener, err := tr.Listen(tlsConfig, quicConfig)
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+
+	l := &QUICListener{
+		transport: tr,
+		listener:  listener,
+		streams:   make(chan net.Conn),
+		done:      make(chan struct{}),
+		conns:     make(map[*quic.Conn]struct{}),
+	}
+	go l.acceptConnections()
+	return l, nil
+}
+
+func (l *QUICListener) acceptConnections() {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+		l.mu.Lock()
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *QUICListener) acceptStreams(conn *quic.Conn) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+	}()
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &quicStream{Stream: stream, conn: conn}:
+		case <-l.done:
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+	}
+}
+
+// Accept returns the next incoming stream
+func (l *QUICListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener and closes every incoming connection
+func (l *QUICListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.listener.Close()
+		l.mu.Lock()
+		for conn := range l.conns {
+			conn.CloseWithError(0, "listener closed")
+		}
+		l.mu.Unlock()
+		l.transport.Close()
+	})
+	return nil
+}
+
+func (l *QUICListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// quicStream presents one QUIC stream as a net.Conn
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// Close ends both directions; quic.Stream.Close only ends the sending one
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// CloseWrite finishes the sending direction after everything written so far
+func (s *quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenQUIC starts a QUIC listener on loopback and returns it with the chat
+// address that DialQUIC expects. Outgoing connections of the test are kept
+// apart from those of other tests.
+func listenQUIC(t *testing.T) (*QUICListener, string) {
+	t.Helper()
+	previous := defaultQUICClient
+	defaultQUICClient = newQUICClient()
+	t.Cleanup(func() { defaultQUICClient = previous })
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	udp.Close()
+
+	chatAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port-QUICPortOffset))
+	ln, err := ListenQUIC(chatAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	return ln, chatAddr
+}
+
+// dialStream opens a stream to the listener and returns both of its ends.
+// The listener echoes the offer as its selection.
+func dialStream(t *testing.T, ln *QUICListener, addr, offer string) (client Conn, selected string, server *FramedConn) {
+	t.Helper()
+	type accepted struct {
+		conn *FramedConn
+		err  error
+	}
+	result := make(chan accepted, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			result <- accepted{err: err}
+			return
+		}
+		framed, _, _, _, err := AcceptTCP(conn, func(offer string) string { return offer })
+		result <- accepted{framed, err}
+	}()
+
+	client, selected, err := DialQUIC(addr, offer, time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	res := <-result
+	require.NoError(t, res.err)
+	t.Cleanup(func() { res.conn.Close() })
+	return client, selected, res.conn
+}
+
+func TestQUIC_StreamsDoNotBlockEachOther(t *testing.T) {
+	ln, addr := listenQUIC(t)
+
+	// The receiving end is never read, so the transfer stalls on flow control
+	transfer, selected, _ := dialStream(t, ln, addr, "rekey")
+	assert.Equal(t, "rekey", selected)
+
+	transferDone := make(chan struct{})
+	go func() {
+		defer close(transferDone)
+		chunk := make([]byte, MaxMessageSize)
+		for i := 0; i < 200; i++ {
+			if transfer.WriteMessage(chunk) != nil {
+				return
+			}
+		}
+	}()
+
+	chat, _, receiver := dialStream(t, ln, addr, "")
+	assert.Equal(t, transfer.RemoteAddr(), chat.RemoteAddr(), "streams share the connection")
+
+	require.NoError(t, chat.WriteMessage([]byte("hello")))
+	message, err := receiver.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(message))
+
+	select {
+	case <-transferDone:
+		t.Fatal("transfer should still be blocked")
+	default:
+	}
+}
+
+func TestQUIC_MigrationKeepsStreams(t *testing.T) {
+	ln, addr := listenQUIC(t)
+
+	client, _, server := dialStream(t, ln, addr, "")
+
+	require.NoError(t, client.WriteMessage([]byte("before")))
+	message, err := server.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "before", string(message))
+	before := server.RemoteAddr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, MigrateQUIC(ctx))
+
+	require.NoError(t, client.WriteMessage([]byte("after")))
+	message, err = server.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after", string(message))
+	require.NoError(t, server.WriteMessage([]byte("reply")))
+	message, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(message))
+	assert.NotEqual(t, before, server.RemoteAddr().String(), "the client moved to a new socket")
+}
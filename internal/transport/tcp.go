@@ -0,0 +1,179 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpHello opens every raw TCP chat connection. It lets a listener tell the
+// raw protocol apart from HTTP on the same port.
+const tcpHello = "LCT1"
+
+// streamHello opens a raw connection to one of the side endpoints instead,
+// whose path follows in the first frame
+const streamHello = "LCS1"
+
+// HelloSize is how many bytes IsTCPHello needs to see
+const HelloSize = len(tcpHello)
+
+var ErrBadHello = errors.New("not a chat connection")
+
+// IsTCPHello reports whether a connection starting with prefix speaks the raw
+// TCP chat protocol
+func IsTCPHello(prefix []byte) bool {
+	return bytes.Equal(prefix, []byte(tcpHello)) || bytes.Equal(prefix, []byte(streamHello))
+}
+
+// FramedConn sends messages over a stream, each prefixed with its length as
+// a big-endian uint16, which caps messages at MaxMessageSize
+type FramedConn struct {
+	conn      net.Conn
+	readLimit int
+	writeMu   sync.Mutex
+}
+
+// NewFramedConn frames messages on conn
+func NewFramedConn(conn net.Conn) *FramedConn {
+	return &FramedConn{conn: conn, readLimit: MaxMessageSize}
+}
+
+// DialTCP connects to addr and exchanges the feature offer in the first frames
+func DialTCP(addr, offer string, timeout time.Duration) (Conn, string, error) {
+	return dialTCP(addr, ChatPath, offer, timeout)
+}
+
+func dialTCP(addr, path, offer string, timeout time.Duration) (Conn, string, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	return clientHello(conn, path, offer, timeout)
+}
+
+// clientHello sends the hello, the path unless it is ChatPath, and the offer
+// on a fresh stream and reads the selection, closing conn if that fails
+func clientHello(conn net.Conn, path, offer string, timeout time.Duration) (Conn, string, error) {
+	framed := NewFramedConn(conn)
+	conn.SetDeadline(time.Now().Add(timeout))
+	hello := tcpHello
+	if path != ChatPath {
+		hello = streamHello
+	}
+	if _, err := io.WriteString(conn, hello); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	if hello == streamHello {
+		if err := framed.WriteMessage([]byte(path)); err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+	}
+	if err := framed.WriteMessage([]byte(offer)); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	selected, err := framed.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	conn.SetDeadline(time.Time{})
+	return framed, string(selected), nil
+}
+
+// AcceptTCP reads the hello, path and offer from a raw TCP connection and
+// answers with what negotiate selects. Chat connections have ChatPath. The
+// caller sets deadlines.
+func AcceptTCP(conn net.Conn, negotiate func(offer string) string) (framed *FramedConn, path, offer, selected string, err error) {
+	hello := make([]byte, HelloSize)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, "", "", "", err
+	}
+	if !IsTCPHello(hello) {
+		return nil, "", "", "", ErrBadHello
+	}
+	framed = NewFramedConn(conn)
+	path = ChatPath
+	if string(hello) == streamHello {
+		pathBytes, err := framed.ReadMessage()
+		if err != nil {
+			return nil, "", "", "", err
+		}
+		path = string(pathBytes)
+	}
+	offerBytes, err := framed.ReadMessage()
+	if err != nil {
+		return nil, "", "", "", err
+	}
+	offer = string(offerBytes)
+	selected = negotiate(offer)
+	if err := framed.WriteMessage([]byte(selected)); err != nil {
+		return nil, "", "", "", err
+	}
+	return framed, path, offer, selected, nil
+}
+
+// ReadMessage reads one frame. It is not safe for concurrent use.
+func (f *FramedConn) ReadMessage() ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(f.conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > f.readLimit {
+		return nil, ErrMessageTooLarge
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(f.conn, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// WriteMessage writes message as one frame
+func (f *FramedConn) WriteMessage(message []byte) error {
+	if len(message) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	frame := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(frame, uint16(len(message)))
+	copy(frame[2:], message)
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	_, err := f.conn.Write(frame)
+	return err
+}
+
+func (f *FramedConn) SetReadLimit(limit int64) {
+	f.readLimit = int(min(limit, MaxMessageSize))
+}
+
+func (f *FramedConn) SetReadDeadline(t time.Time) error {
+	return f.conn.SetReadDeadline(t)
+}
+
+// CloseWrite half-closes the stream where possible
+func (f *FramedConn) CloseWrite() error {
+	if conn, ok := f.conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return f.conn.Close()
+}
+
+func (f *FramedConn) Close() error {
+	return f.conn.Close()
+}
+
+func (f *FramedConn) RemoteAddr() net.Addr {
+	return f.conn.RemoteAddr()
+}
@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpPair dials a loopback listener and returns both ends after the hello
+func tcpPair(t *testing.T, offer string) (client Conn, selected string, server *FramedConn, gotOffer string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	type accepted struct {
+		conn  *FramedConn
+		offer string
+		err   error
+	}
+	result := make(chan accepted, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			result <- accepted{err: err}
+			return
+		}
+		framed, _, offer, _, err := AcceptTCP(conn, func(offer string) string { return "selected:" + offer })
+		result <- accepted{framed, offer, err}
+	}()
+
+	client, selected, err = DialTCP(ln.Addr().String(), offer, time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	res := <-result
+	require.NoError(t, res.err)
+	t.Cleanup(func() { res.conn.Close() })
+	return client, selected, res.conn, res.offer
+}
+
+func TestTCP_HelloAndFraming(t *testing.T) {
+	client, selected, server, offer := tcpPair(t, "hybrid-mlkem768,classic")
+	assert.Equal(t, "hybrid-mlkem768,classic", offer)
+	assert.Equal(t, "selected:hybrid-mlkem768,classic", selected)
+
+	messages := [][]byte{[]byte("one"), {}, bytes.Repeat([]byte{7}, MaxMessageSize), []byte("last")}
+	go func() {
+		for _, message := range messages {
+			client.WriteMessage(message)
+		}
+	}()
+	for _, want := range messages {
+		got, err := server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, len(want), len(got))
+		assert.True(t, bytes.Equal(want, got))
+	}
+}
+
+func TestTCP_SizeLimits(t *testing.T) {
+	client, _, server, _ := tcpPair(t, "")
+	assert.ErrorIs(t, client.WriteMessage(make([]byte, MaxMessageSize+1)), ErrMessageTooLarge)
+
+	server.SetReadLimit(16)
+	require.NoError(t, client.WriteMessage(make([]byte, 17)))
+	_, err := server.ReadMessage()
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+func TestTCP_BadHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("GET / HTTP/1.1\r\n"))
+	_, _, _, _, err := AcceptTCP(server, func(string) string { return "" })
+	assert.ErrorIs(t, err, ErrBadHello)
+}
+
+func TestTCP_SideEndpointPath(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	paths := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, path, _, _, err := AcceptTCP(conn, func(offer string) string { return offer })
+			if err == nil {
+				paths <- path
+			}
+			conn.Close()
+		}
+	}()
+
+	for _, path := range []string{ChatPath, "/group"} {
+		conn, selected, err := dialPath(TCP, ln.Addr().String(), path, "classic", time.Second)
+		require.NoError(t, err)
+		conn.Close()
+		assert.Equal(t, "classic", selected)
+		assert.Equal(t, path, <-paths)
+	}
+}
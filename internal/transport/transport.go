@@ -0,0 +1,126 @@
+// Package transport carries Noise messages between two nodes. Every
+// transport preserves message boundaries, so the chat protocol sees the same
+// sequence of messages no matter how it travels.
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// Kind names a chat transport
+type Kind string
+
+const (
+	// Websocket sends each Noise message in a binary websocket message
+	Websocket Kind = "websocket"
+	// TCP sends each Noise message with a 2-byte length prefix on a raw stream
+	TCP Kind = "tcp"
+	// QUIC runs the TCP framing on a stream of a QUIC connection shared by
+	// everything sent to the same peer
+	QUIC Kind = "quic"
+	// WebRTC sends each Noise message in a data channel message of a direct
+	// peer connection that was negotiated through a Signal
+	WebRTC Kind = "webrtc"
+)
+
+// MaxMessageSize is the largest message any transport carries, the Noise limit
+const MaxMessageSize = noise.MaxMsgLen
+
+// ChatPath is the listener endpoint of chat connections
+const ChatPath = "/chat"
+
+var (
+	ErrMessageTooLarge  = errors.New("message exceeds size limit")
+	ErrUnknownTransport = errors.New("unknown transport")
+	ErrNeedsSignal      = errors.New("transport needs signalling, use DialWebRTC")
+)
+
+// Conn is a reliable, ordered, message-oriented connection
+type Conn interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(message []byte) error
+	// SetReadLimit makes ReadMessage fail for messages larger than limit
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	// CloseWrite tells the other side that nothing more will be sent. Once
+	// it has read everything before, its ReadMessage returns io.EOF and it
+	// closes the connection, which ends our reads too.
+	CloseWrite() error
+	Close() error
+	RemoteAddr() net.Addr
+}
+
+// Kinds lists the supported transports
+func Kinds() []Kind {
+	return []Kind{Websocket, TCP, QUIC, WebRTC}
+}
+
+// ParseKind validates a transport name
+func ParseKind(name string) (Kind, error) {
+	for _, kind := range Kinds() {
+		if string(kind) == name {
+			return kind, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownTransport, name)
+}
+
+var preferred, preferredInternet atomic.Value
+
+// SetPreferred selects the transport used for outgoing chat connections
+func SetPreferred(kind Kind) {
+	preferred.Store(kind)
+}
+
+// Preferred returns the transport for outgoing chat connections, websocket
+// unless configured otherwise
+func Preferred() Kind {
+	if kind, ok := preferred.Load().(Kind); ok {
+		return kind
+	}
+	return Websocket
+}
+
+// SetPreferredInternet selects the transport used for peers that are only
+// reachable over the internet
+func SetPreferredInternet(kind Kind) {
+	preferredInternet.Store(kind)
+}
+
+// PreferredInternet returns the transport for internet peers, Preferred
+// unless configured otherwise
+func PreferredInternet() Kind {
+	if kind, ok := preferredInternet.Load().(Kind); ok {
+		return kind
+	}
+	return Preferred()
+}
+
+// Dial connects to the chat endpoint at addr (host:port) and exchanges the
+// feature offer, returning the responder's selection. timeout bounds the
+// connection setup.
+func Dial(kind Kind, addr, offer string, timeout time.Duration) (Conn, string, error) {
+	return dialPath(kind, addr, ChatPath, offer, timeout)
+}
+
+// dialPath connects to the listener endpoint path at addr
+func dialPath(kind Kind, addr, path, offer string, timeout time.Duration) (Conn, string, error) {
+	switch kind {
+	case Websocket:
+		return dialWebsocket(addr, path, offer, timeout)
+	case TCP:
+		return dialTCP(addr, path, offer, timeout)
+	case QUIC:
+		return dialQUIC(addr, path, offer, timeout)
+	case WebRTC:
+		return nil, "", ErrNeedsSignal
+	default:
+		return nil, "", fmt.Errorf("%w: %q", ErrUnknownTransport, kind)
+	}
+}
@@ -0,0 +1,279 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/webrtc/v4"
+)
+
+// dataChannelLabel names the single data channel of a chat peer connection
+const dataChannelLabel = "localchat"
+
+var ErrDataChannelNotOpened = errors.New("data channel did not open")
+
+// Signal delivers an SDP offer to the remote node and returns its answer.
+// It has to take another way than a connection to the remote listener,
+// which would need no ICE; the relay carries it between nodes that reach
+// each other only through others.
+type Signal func(ctx context.Context, offer []byte) (answer []byte, err error)
+
+var iceServers atomic.Value
+
+// SetICEServers sets the STUN/TURN URLs used to gather WebRTC candidates.
+// Without any, only host candidates are used.
+func SetICEServers(urls []string) {
+	iceServers.Store(slices.Clone(urls))
+}
+
+func newPeerConnection() (*webrtc.PeerConnection, error) {
+	var settings webrtc.SettingEngine
+	settings.DetachDataChannels()
+	// Lets two nodes on one machine connect, and the tests run on loopback
+	settings.SetIncludeLoopbackCandidate(true)
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+
+	var config webrtc.Configuration
+	if urls, _ := iceServers.Load().([]string); len(urls) > 0 {
+		config.ICEServers = []webrtc.ICEServer{{URLs: urls}}
+	}
+	return api.NewPeerConnection(config)
+}
+
+// localDescription completes ICE gathering and returns the SDP with every
+// candidate, so a single offer/answer round trip is enough
+func localDescription(ctx context.Context, pc *webrtc.PeerConnection, description webrtc.SessionDescription) ([]byte, error) {
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(description); err != nil {
+		return nil, err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return json.Marshal(pc.LocalDescription())
+}
+
+func setRemoteDescription(pc *webrtc.PeerConnection, encoded []byte) error {
+	var description webrtc.SessionDescription
+	if err := json.Unmarshal(encoded, &description); err != nil {
+		return fmt.Errorf("bad session description: %w", err)
+	}
+	return pc.SetRemoteDescription(description)
+}
+
+// DialWebRTC sets up a peer connection through signal, opens a data channel
+// on it and exchanges the feature offer as its first messages
+func DialWebRTC(signal Signal, offer string, timeout time.Duration) (_ Conn, _ string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pc, err := newPeerConnection()
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err != nil {
+			pc.Close()
+		}
+	}()
+
+	channel, err := pc.CreateDataChannel(dataChannelLabel, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	opened := make(chan struct{})
+	channel.OnOpen(func() { close(opened) })
+
+	sdpOffer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, "", err
+	}
+	encoded, err := localDescription(ctx, pc, sdpOffer)
+	if err != nil {
+		return nil, "", err
+	}
+	answer, err := signal(ctx, encoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("signalling failed: %w", err)
+	}
+	if err := setRemoteDescription(pc, answer); err != nil {
+		return nil, "", err
+	}
+
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		return nil, "", ErrDataChannelNotOpened
+	}
+	conn, err := newDataChannelConn(pc, channel)
+	if err != nil {
+		return nil, "", err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	if err := conn.WriteMessage([]byte(offer)); err != nil {
+		return nil, "", err
+	}
+	selected, err := conn.ReadMessage()
+	if err != nil {
+		return nil, "", err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, string(selected), nil
+}
+
+// AnswerWebRTC answers an SDP offer from DialWebRTC. Once the initiator's
+// data channel opens, its feature offer is answered with what negotiate
+// selects and handle takes over the connection. The peer connection is
+// dropped if that does not happen within timeout.
+func AnswerWebRTC(offer []byte, timeout time.Duration, negotiate func(offer string) string, handle func(conn Conn, offer, selected string)) ([]byte, error) {
+	pc, err := newPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	var accepted atomic.Bool
+	pc.OnDataChannel(func(channel *webrtc.DataChannel) {
+		if channel.Label() != dataChannelLabel || !accepted.CompareAndSwap(false, true) {
+			channel.Close()
+			return
+		}
+		channel.OnOpen(func() {
+			go answerChannel(pc, channel, timeout, negotiate, handle)
+		})
+	})
+	time.AfterFunc(timeout, func() {
+		if !accepted.Load() {
+			pc.Close()
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := setRemoteDescription(pc, offer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	sdpAnswer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	encoded, err := localDescription(ctx, pc, sdpAnswer)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return encoded, nil
+}
+
+func answerChannel(pc *webrtc.PeerConnection, channel *webrtc.DataChannel, timeout time.Duration, negotiate func(string) string, handle func(Conn, string, string)) {
+	conn, err := newDataChannelConn(pc, channel)
+	if err != nil {
+		pc.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	offer, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	selected := negotiate(string(offer))
+	if err := conn.WriteMessage([]byte(selected)); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	handle(conn, string(offer), selected)
+}
+
+// dataChannelConn adapts a detached data channel to Conn. Data channel
+// messages keep their boundaries, so no framing is needed.
+type dataChannelConn struct {
+	pc        *webrtc.PeerConnection
+	channel   datachannel.ReadWriteCloserDeadliner
+	remote    net.Addr
+	readLimit int
+	writeMu   sync.Mutex
+}
+
+func newDataChannelConn(pc *webrtc.PeerConnection, channel *webrtc.DataChannel) (*dataChannelConn, error) {
+	detached, err := channel.DetachWithDeadline()
+	if err != nil {
+		return nil, err
+	}
+	remote := webrtcAddr("unknown")
+	if pair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+		remote = webrtcAddr(net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port))))
+	}
+	return &dataChannelConn{pc: pc, channel: detached, remote: remote, readLimit: MaxMessageSize}, nil
+}
+
+func (d *dataChannelConn) ReadMessage() ([]byte, error) {
+	// One larger than allowed, so oversized messages are detected
+	buffer := make([]byte, MaxMessageSize+1)
+	n, _, err := d.channel.ReadDataChannel(buffer)
+	if errors.Is(err, io.ErrShortBuffer) {
+		return nil, ErrMessageTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n > d.readLimit {
+		return nil, ErrMessageTooLarge
+	}
+	return buffer[:n], nil
+}
+
+func (d *dataChannelConn) WriteMessage(message []byte) error {
+	if len(message) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	_, err := d.channel.WriteDataChannel(message, false)
+	return err
+}
+
+func (d *dataChannelConn) SetReadLimit(limit int64) {
+	d.readLimit = int(min(limit, MaxMessageSize))
+}
+
+func (d *dataChannelConn) SetReadDeadline(t time.Time) error {
+	return d.channel.SetReadDeadline(t)
+}
+
+// CloseWrite closes the data channel; the other side reads io.EOF after
+// every message sent before
+func (d *dataChannelConn) CloseWrite() error {
+	return d.channel.Close()
+}
+
+func (d *dataChannelConn) Close() error {
+	d.channel.Close()
+	return d.pc.Close()
+}
+
+func (d *dataChannelConn) RemoteAddr() net.Addr {
+	return d.remote
+}
+
+// webrtcAddr is the remote ICE candidate address of a data channel
+type webrtcAddr string
+
+func (a webrtcAddr) Network() string { return "webrtc" }
+func (a webrtcAddr) String() string  { return string(a) }
@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webrtcPair connects two data channels on loopback host candidates. The
+// signal hands the offer straight to the answering side, like a rendezvous.
+func webrtcPair(t *testing.T) (client Conn, selected string, server Conn) {
+	t.Helper()
+	accepted := make(chan Conn, 1)
+	signal := func(ctx context.Context, offer []byte) ([]byte, error) {
+		return AnswerWebRTC(offer, 5*time.Second, func(offer string) string {
+			return "selected:" + offer
+		}, func(conn Conn, offer, selected string) {
+			accepted <- conn
+		})
+	}
+
+	client, selected, err := DialWebRTC(signal, "classic", 5*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	server = <-accepted
+	t.Cleanup(func() { server.Close() })
+	return client, selected, server
+}
+
+func TestWebRTC_DataChannel(t *testing.T) {
+	client, selected, server := webrtcPair(t)
+	assert.Equal(t, "selected:classic", selected)
+	assert.Equal(t, "webrtc", client.RemoteAddr().Network())
+
+	large := make([]byte, MaxMessageSize)
+	for _, message := range [][]byte{[]byte("ping"), {}, large} {
+		require.NoError(t, client.WriteMessage(message))
+		got, err := server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, len(message), len(got))
+	}
+	require.NoError(t, server.WriteMessage([]byte("pong")))
+	got, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(got))
+
+	assert.ErrorIs(t, client.WriteMessage(make([]byte, MaxMessageSize+1)), ErrMessageTooLarge)
+	server.SetReadLimit(8)
+	require.NoError(t, client.WriteMessage(make([]byte, 9)))
+	_, err = server.ReadMessage()
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+func TestWebRTC_CloseWriteDeliversPendingMessages(t *testing.T) {
+	client, _, server := webrtcPair(t)
+
+	for _, text := range []string{"one", "two", "three"} {
+		require.NoError(t, client.WriteMessage([]byte(text)))
+	}
+	require.NoError(t, client.CloseWrite())
+
+	for _, want := range []string{"one", "two", "three"} {
+		got, err := server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, want, string(got))
+	}
+	_, err := server.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+}
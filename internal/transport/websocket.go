@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"p2p-messenger/internal/crypto"
+)
+
+// websocketConn adapts a websocket to Conn
+type websocketConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+// NewWebsocketConn wraps an established websocket
+func NewWebsocketConn(conn *websocket.Conn) Conn {
+	return &websocketConn{conn: conn}
+}
+
+// DialWebsocket opens ws://addr/chat, sending offer in the features header
+func DialWebsocket(addr, offer string, timeout time.Duration) (Conn, string, error) {
+	return dialWebsocket(addr, ChatPath, offer, timeout)
+}
+
+// DialSession opens the endpoint path of the chat listener at addr over
+// kind and completes a Noise handshake as initiator, for exchanges next to
+// the chat connection. Over QUIC each session is a stream of the connection
+// chat uses. Reads stay bound to the timeout.
+func DialSession(kind Kind, addr, path string, keypair crypto.NoiseKeypair, timeout time.Duration, opts ...crypto.SessionOption) (Conn, *crypto.Session, error) {
+	deadline := time.Now().Add(timeout)
+	features := crypto.Offer(opts...)
+	conn, selected, err := dialPath(kind, addr, path, features, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := crypto.NewInitiatorSession(keypair, slices.Concat(opts, []crypto.SessionOption{crypto.WithNegotiation(features, selected)})...)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetReadDeadline(deadline)
+	if err := session.Handshake(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, session, nil
+}
+
+func dialWebsocket(addr, path, offer string, timeout time.Duration) (Conn, string, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: timeout}
+	u := url.URL{Scheme: "ws", Host: addr, Path: path}
+	conn, resp, err := dialer.Dial(u.String(), http.Header{crypto.FeaturesHeader: {offer}})
+	if err != nil {
+		return nil, "", err
+	}
+	return NewWebsocketConn(conn), resp.Header.Get(crypto.FeaturesHeader), nil
+}
+
+// ReadMessage returns the next data message; a normal close reads as io.EOF
+func (w *websocketConn) ReadMessage() ([]byte, error) {
+	_, message, err := w.conn.ReadMessage()
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return nil, io.EOF
+	}
+	if err == websocket.ErrReadLimit {
+		return nil, ErrMessageTooLarge
+	}
+	return message, err
+}
+
+func (w *websocketConn) WriteMessage(message []byte) error {
+	if len(message) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.conn.WriteMessage(websocket.BinaryMessage, message)
+}
+
+func (w *websocketConn) SetReadLimit(limit int64) {
+	w.conn.SetReadLimit(limit)
+}
+
+func (w *websocketConn) SetReadDeadline(t time.Time) error {
+	return w.conn.SetReadDeadline(t)
+}
+
+// CloseWrite starts the websocket close handshake
+func (w *websocketConn) CloseWrite() error {
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	return w.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+}
+
+func (w *websocketConn) Close() error {
+	return w.conn.Close()
+}
+
+func (w *websocketConn) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
@@ -0,0 +1,60 @@
+package ui
+
+import (
+	"fmt"
+
+	"github.com/rivo/tview"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/transfer"
+)
+
+// Browser lists the files a peer shares with us
+type Browser struct {
+	View    *tview.Table
+	Peer    *entity.Peer
+	entries []transfer.Entry
+}
+
+func NewBrowser() *Browser {
+	view := tview.NewTable().SetSelectable(true, false)
+	view.SetBorder(true)
+	return &Browser{View: view}
+}
+
+// Open starts browsing peer
+func (b *Browser) Open(peer *entity.Peer) {
+	name := peer.Username
+	if name == "" {
+		name = peer.PeerID
+	}
+	b.Peer = peer
+	b.View.SetTitle(fmt.Sprintf("Shared by %s (Enter to download, Esc to close)", name))
+	b.Update(nil, false)
+	b.View.Select(0, 0)
+}
+
+// Update shows the index received so far, keeping the selection
+func (b *Browser) Update(entries []transfer.Entry, complete bool) {
+	b.entries = entries
+	b.View.Clear()
+	for i, entry := range entries {
+		b.View.SetCell(i, 0, tview.NewTableCell(tview.Escape(entry.Share+"/"+entry.Path)).SetExpansion(1))
+		b.View.SetCell(i, 1, tview.NewTableCell(formatSize(entry.Size)).SetAlign(tview.AlignRight))
+	}
+	switch {
+	case !complete:
+		b.View.SetCell(len(entries), 0, tview.NewTableCell("[gray]loading…").SetSelectable(false))
+	case len(entries) == 0:
+		b.View.SetCell(0, 0, tview.NewTableCell("[gray]nothing is shared with you").SetSelectable(false))
+	}
+}
+
+// Selected returns the entry under the cursor
+func (b *Browser) Selected() (transfer.Entry, bool) {
+	row, _ := b.View.GetSelection()
+	if row < 0 || row >= len(b.entries) {
+		return transfer.Entry{}, false
+	}
+	return b.entries[row], true
+}
@@ -2,15 +2,21 @@ package ui
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/rivo/tview"
 
 	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/transfer"
 )
 
+// progressWidth is the number of cells of a transfer progress bar
+const progressWidth = 20
+
 const (
-	timeFormat        = "15:04:05"
 	maxMessagesInView = 100
 )
 
@@ -18,14 +24,21 @@ type Chat struct {
 	View       *tview.Flex
 	InputField *tview.InputField
 	Messages   *tview.TextView
+	timeFormat string
+	// ids are the messages shown that can be selected, oldest first
+	ids []string
+	// selected is the ID of the selected message; the view follows new
+	// messages while it is empty
+	selected string
 }
 
-func NewChat() *Chat {
+func NewChat(timeFormat string) *Chat {
 	view := tview.NewFlex().SetDirection(tview.FlexRow)
 	view.SetTitle("chat").SetBorder(true)
 
 	messages := tview.NewTextView().SetText("").
-		SetDynamicColors(true)
+		SetDynamicColors(true).
+		SetRegions(true)
 
 	inputField := tview.NewInputField().
 		SetFieldBackgroundColor(tview.Styles.PrimitiveBackgroundColor).
@@ -43,29 +56,126 @@ func NewChat() *Chat {
 		View:       view,
 		InputField: inputField,
 		Messages:   messages,
+		timeFormat: timeFormat,
 	}
 }
 
 func (c *Chat) RenderMessages(messages []*entity.Message, protoName string) {
+	c.RenderConversation(messages, nil, protoName)
+}
+
+// RenderConversation shows the messages with a peer followed by the files
+// offered either way, each with its progress
+func (c *Chat) RenderConversation(messages []*entity.Message, transfers []transfer.Transfer, protoName string) {
 	text := strings.Repeat("\n", maxMessagesInView)
+	c.ids = c.ids[:0]
+	byID := make(map[string]*entity.Message, len(messages))
+	for _, message := range messages {
+		if message.ID != "" {
+			byID[message.ID] = message
+		}
+	}
+	var day time.Time
 	for _, message := range messages {
+		if written := message.Written().Local(); !sameDay(written, day) {
+			day = written
+			text += formatDay(day) + "\n"
+		}
 		isAuthor := false
 		if message.Author == protoName {
 			isAuthor = true
 		}
 
-		text += fmt.Sprintf("%s %s: %s\n",
-			formatTime(message),
+		line := fmt.Sprintf("%s %s: %s%s",
+			formatTime(message, c.timeFormat),
 			formatAuthor(message, isAuthor),
-			formatText(message))
+			formatText(message),
+			formatState(message))
+		if message.ReplyTo != "" {
+			line = formatQuote(byID[message.ReplyTo]) + "\n" + line
+		}
+		if reactions := formatReactions(message.Reactions); reactions != "" {
+			line += "\n" + reactions
+		}
+		if message.ID != "" {
+			c.ids = append(c.ids, message.ID)
+			line = fmt.Sprintf(`["%s"]%s[""]`, message.ID, line)
+		}
+		text += line + "\n"
+	}
+	for _, t := range transfers {
+		text += fmt.Sprintf("[blue]%s %s\n", t.Time.Local().Format(c.timeFormat), formatTransfer(t))
+	}
+
+	c.Messages.SetText(text[:len(text)-1])
+	if !slices.Contains(c.ids, c.selected) {
+		c.selected = ""
+	}
+	if c.selected == "" {
+		c.Messages.Highlight().ScrollToEnd()
+		return
+	}
+	c.Messages.Highlight(c.selected).ScrollToHighlight()
+}
+
+// Select moves the selection by delta messages. Moving up without a
+// selection selects the latest message, moving past it clears the
+// selection.
+func (c *Chat) Select(delta int) {
+	i := slices.Index(c.ids, c.selected)
+	if i < 0 {
+		i = len(c.ids)
+	}
+	i = max(i+delta, 0)
+	c.selected = ""
+	if i < len(c.ids) {
+		c.selected = c.ids[i]
+		c.Messages.Highlight(c.selected).ScrollToHighlight()
+		return
+	}
+	c.Messages.Highlight().ScrollToEnd()
+}
+
+// SelectID selects the message with id, if it is shown
+func (c *Chat) SelectID(id string) bool {
+	if !slices.Contains(c.ids, id) {
+		return false
 	}
+	c.selected = id
+	c.Messages.Highlight(id).ScrollToHighlight()
+	return true
+}
 
-	c.Messages.SetText(text[:len(text)-1]).ScrollToEnd()
+// Selected returns the ID of the selected message, or "" if there is none
+func (c *Chat) Selected() string {
+	return c.selected
 }
 
-func formatTime(message *entity.Message) string {
-	now := message.Time.UTC()
-	return fmt.Sprintf("%s%s", "[blue]", now.Format(timeFormat))
+// ClearSelection goes back to following new messages
+func (c *Chat) ClearSelection() {
+	c.selected = ""
+	c.Messages.Highlight().ScrollToEnd()
+}
+
+// formatTime shows when the author wrote a message in the local zone, and
+// flags times from a clock that is off
+func formatTime(message *entity.Message, timeFormat string) string {
+	written := message.Written().Local()
+	if message.Skewed {
+		return fmt.Sprintf("%s%s ⚠", "[yellow]", written.Format(timeFormat))
+	}
+	return fmt.Sprintf("%s%s", "[blue]", written.Format(timeFormat))
+}
+
+// formatDay separates the messages of one day from those of the day before
+func formatDay(day time.Time) string {
+	return fmt.Sprintf("[gray]──── %s ────", day.Format("Mon, 2 Jan 2006"))
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
 }
 
 func formatAuthor(message *entity.Message, isAuthor bool) string {
@@ -76,5 +186,126 @@ func formatAuthor(message *entity.Message, isAuthor bool) string {
 }
 
 func formatText(message *entity.Message) string {
+	if message.Deleted {
+		return "[gray]message deleted"
+	}
+	if message.Edited {
+		return fmt.Sprintf("%s%s [gray](edited)", "[white]", message.Text)
+	}
 	return fmt.Sprintf("%s%s", "[white]", message.Text)
 }
+
+// quoteLength is the number of characters of a message quoted by a reply
+const quoteLength = 60
+
+// formatQuote shows the start of the message a reply answers, above the
+// reply
+func formatQuote(quoted *entity.Message) string {
+	if quoted == nil {
+		return "[gray]  ┌ message not available"
+	}
+	text := []rune(quoted.Text)
+	if len(text) > quoteLength {
+		text = append(text[:quoteLength], '…')
+	}
+	if quoted.Deleted {
+		text = []rune("message deleted")
+	}
+	return fmt.Sprintf("[gray]  ┌ %s: %s", quoted.Author, string(text))
+}
+
+// formatReactions counts the reactions to a message, the most frequent first
+func formatReactions(reactions map[string]string) string {
+	counts := make(map[string]int)
+	for _, emoji := range reactions {
+		counts[emoji]++
+	}
+	emojis := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(emojis, func(a, b string) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return strings.Compare(a, b)
+	})
+	var parts []string
+	for _, emoji := range emojis {
+		parts = append(parts, fmt.Sprintf("%s %d", tview.Escape(emoji), counts[emoji]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "[gray]  " + strings.Join(parts, "  ")
+}
+
+// formatState marks outgoing messages that have not reached the peer yet,
+// and those the peer read
+func formatState(message *entity.Message) string {
+	switch message.State {
+	case entity.MessageSent:
+		if message.Read {
+			return " [gray](read)"
+		}
+		return ""
+	case entity.MessageSending:
+		return " [gray](sending)"
+	case entity.MessageQueued:
+		return " [yellow](queued)"
+	case entity.MessageExpired:
+		return " [red](expired)"
+	default:
+		return ""
+	}
+}
+
+// formatTransfer shows a file transfer with what can be done about it
+func formatTransfer(t transfer.Transfer) string {
+	arrow := "[green]⇧"
+	if t.Incoming {
+		arrow = "[red]⇩"
+	}
+	line := fmt.Sprintf("%s [white]%s (%s) ", arrow, t.Name, formatSize(t.Size))
+	switch {
+	case t.State == transfer.StateOffered && t.Incoming:
+		return line + "[yellow]offered, /accept or /decline"
+	case t.State == transfer.StateOffered:
+		return line + "[gray]waiting for the peer to accept"
+	case t.State == transfer.StateActive:
+		return line + formatProgress(t)
+	case t.State == transfer.StateInterrupted && t.Incoming:
+		return line + formatProgress(t) + " [yellow]interrupted, /accept to resume"
+	case t.State == transfer.StateInterrupted:
+		return line + formatProgress(t) + " [yellow]interrupted"
+	case t.State == transfer.StateDone && t.Incoming:
+		return line + "[green]saved to " + tview.Escape(t.Path)
+	case t.State == transfer.StateDone:
+		return line + "[green]sent"
+	case t.State == transfer.StateDeclined:
+		return line + "[gray]declined"
+	default:
+		return line + "[red]failed: " + tview.Escape(t.Err)
+	}
+}
+
+// formatProgress draws a bar of the bytes the receiver has confirmed
+func formatProgress(t transfer.Transfer) string {
+	done := 1.0
+	if t.Size > 0 {
+		done = float64(t.Confirmed) / float64(t.Size)
+	}
+	filled := int(done * progressWidth)
+	return fmt.Sprintf("[aqua]%s[gray]%s [white]%3d%%",
+		strings.Repeat("█", filled), strings.Repeat("░", progressWidth-filled), int(done*100))
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
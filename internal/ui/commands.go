@@ -0,0 +1,352 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rivo/tview"
+
+	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/transcript"
+	"p2p-messenger/internal/transfer"
+)
+
+// runCommand handles input starting with "/" and reports whether it was a
+// command. Peers are named by username or peer ID.
+func (app *App) runCommand(input string) bool {
+	if !strings.HasPrefix(input, "/") {
+		return false
+	}
+	args := strings.Fields(input)
+	var err error
+	switch args[0] {
+	case "/group":
+		err = app.createGroup(args[1:])
+	case "/add":
+		err = app.changeGroup(args[1:], func(group *entity.Group, name string) error {
+			peer, err := app.findPeer(name)
+			if err != nil {
+				return err
+			}
+			return app.Proto.Groups.Add(group, peer)
+		})
+	case "/remove":
+		err = app.changeMember(args[1:], app.Proto.Groups.Remove)
+	case "/ban":
+		err = app.changeMember(args[1:], app.Proto.Groups.Ban)
+	case "/promote":
+		err = app.changeMember(args[1:], app.Proto.Groups.Promote)
+	case "/invite":
+		err = app.changeGroup(args[1:], func(group *entity.Group, name string) error {
+			peer, err := app.findPeer(name)
+			if err != nil {
+				return err
+			}
+			return app.Proto.Groups.Invite(group, peer)
+		})
+	case "/join":
+		err = app.joinGroup(args[1:])
+	case "/send-file":
+		err = app.sendFile(strings.TrimSpace(strings.TrimPrefix(input, args[0])))
+	case "/accept":
+		err = app.answerFile(args[1:], app.Proto.Transfers.Accept)
+	case "/decline":
+		err = app.answerFile(args[1:], app.Proto.Transfers.Decline)
+	case "/share":
+		err = app.share(args[1:])
+	case "/unshare":
+		if len(args) != 2 {
+			err = fmt.Errorf("usage: /unshare <name>")
+		} else {
+			err = app.Proto.Transfers.RemoveShare(args[1])
+		}
+	case "/browse":
+		err = app.browse()
+	case "/react":
+		if len(args) > 2 {
+			err = fmt.Errorf("usage: /react [emoji]")
+		} else {
+			err = app.react(strings.Join(args[1:], ""))
+		}
+	case "/timer":
+		err = app.setTimer(args[1:])
+	case "/export":
+		err = app.exportTranscript(strings.TrimSpace(strings.TrimPrefix(input, args[0])))
+	case "/import":
+		err = app.importTranscript(strings.TrimSpace(strings.TrimPrefix(input, args[0])))
+	case "/leave":
+		if app.CurrentGroup == nil {
+			err = fmt.Errorf("select a group first")
+		} else {
+			err = app.Proto.Groups.Leave(app.CurrentGroup)
+		}
+	default:
+		err = fmt.Errorf("unknown command %s", args[0])
+	}
+	if err != nil {
+		app.InfoField.View.SetText(fmt.Sprintf("[red]%s", err))
+	}
+	return true
+}
+
+// createGroup handles /group [-invite-only] <name> <peer>...
+func (app *App) createGroup(args []string) error {
+	inviteOnly := len(args) > 0 && args[0] == "-invite-only"
+	if inviteOnly {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("usage: /group [-invite-only] <name> <peer>...")
+	}
+	var members []*entity.Peer
+	for _, name := range args[1:] {
+		peer, err := app.findPeer(name)
+		if err != nil {
+			return err
+		}
+		members = append(members, peer)
+	}
+	group, err := app.Proto.Groups.Create(args[0], inviteOnly, members)
+	if err != nil {
+		return err
+	}
+	app.CurrentPeer, app.CurrentGroup, app.InLobby = nil, group, false
+	return nil
+}
+
+// joinGroup handles /join <name>, accepting an invite to the group name
+func (app *App) joinGroup(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /join <name>")
+	}
+	for _, invite := range app.Proto.Groups.Invites() {
+		if invite.Name == args[0] || invite.Group == args[0] {
+			group, err := app.Proto.Groups.Join(invite.Group)
+			if err != nil {
+				return err
+			}
+			app.CurrentPeer, app.CurrentGroup, app.InLobby = nil, group, false
+			return nil
+		}
+	}
+	return fmt.Errorf("no invite to %s", args[0])
+}
+
+// changeMember applies change to the members of the current group named in
+// args
+func (app *App) changeMember(args []string, change func(group *entity.Group, peerID string) error) error {
+	return app.changeGroup(args, func(group *entity.Group, name string) error {
+		for _, member := range group.Members() {
+			if member.PeerID == name || member.Username == name {
+				return change(group, member.PeerID)
+			}
+		}
+		return fmt.Errorf("%s is not a member", name)
+	})
+}
+
+// sendFile handles /send-file <path>. Hashing a large file takes a while,
+// so the offer is made in the background.
+func (app *App) sendFile(path string) error {
+	peer := app.CurrentPeer
+	if peer == nil {
+		return fmt.Errorf("select a peer first")
+	}
+	if path == "" {
+		return fmt.Errorf("usage: /send-file <path>")
+	}
+	path = expandHome(path)
+	go func() {
+		if _, err := app.Proto.Transfers.Offer(peer, path); err != nil {
+			app.UI.QueueUpdateDraw(func() {
+				app.InfoField.View.SetText(fmt.Sprintf("[red]%s", err))
+			})
+		}
+	}()
+	return nil
+}
+
+// answerFile applies answer to the file offered by the current peer named
+// in args, or to the oldest one waiting for an answer
+func (app *App) answerFile(args []string, answer func(id string) error) error {
+	if app.CurrentPeer == nil {
+		return fmt.Errorf("select a peer first")
+	}
+	name := strings.Join(args, " ")
+	for _, t := range app.Proto.Transfers.Transfers(app.CurrentPeer.PeerID) {
+		waiting := t.State == transfer.StateOffered || t.State == transfer.StateInterrupted
+		if t.Incoming && waiting && (name == "" || t.Name == name) {
+			return answer(t.ID)
+		}
+	}
+	return fmt.Errorf("no file waiting for an answer")
+}
+
+// share handles /share <folder> <peer|#group>...
+func (app *App) share(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: /share <folder> <peer|#group>...")
+	}
+	var peers, groups []string
+	for _, name := range args[1:] {
+		if groupName, ok := strings.CutPrefix(name, "#"); ok {
+			i := slices.IndexFunc(app.Proto.Groups.Groups(), func(g *entity.Group) bool { return g.Name == groupName })
+			if i < 0 {
+				return fmt.Errorf("no group named %s", groupName)
+			}
+			groups = append(groups, app.Proto.Groups.Groups()[i].ID)
+			continue
+		}
+		peer, err := app.findPeer(name)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, peer.PeerID)
+	}
+	share, err := app.Proto.Transfers.AddShare(expandHome(args[0]), peers, groups)
+	if err != nil {
+		return err
+	}
+	app.InfoField.View.SetText(fmt.Sprintf("Sharing %s", tview.Escape(share.Name)))
+	return nil
+}
+
+// browse handles /browse, opening the folders the current peer shares
+func (app *App) browse() error {
+	if app.CurrentPeer == nil {
+		return fmt.Errorf("select a peer first")
+	}
+	if err := app.Proto.Transfers.Browse(app.CurrentPeer); err != nil {
+		return err
+	}
+	app.Browser.Open(app.CurrentPeer)
+	app.View.SwitchToPage("browse")
+	app.UI.SetFocus(app.Browser.View)
+	return nil
+}
+
+// setTimer sets the disappearing messages timer of the conversation with
+// the current peer, for both ends
+func (app *App) setTimer(args []string) error {
+	if app.CurrentPeer == nil {
+		return fmt.Errorf("select a peer first")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /timer <1h|1d|1w|off>")
+	}
+	d, err := entity.ParseTimer(args[0])
+	if err != nil {
+		return err
+	}
+	return app.Proto.Outbox.SetTimer(app.CurrentPeer, d)
+}
+
+// exportTranscript handles /export [-all] <jsonl|md|txt> <path>, writing
+// the conversation with the current peer, or every stored one
+func (app *App) exportTranscript(args string) error {
+	rest, all := strings.CutPrefix(args, "-all ")
+	// The path is the rest of the input, spaces and all
+	name, path, ok := strings.Cut(strings.TrimSpace(rest), " ")
+	path = expandHome(strings.TrimSpace(path))
+	if !ok || path == "" {
+		return fmt.Errorf("usage: /export [-all] <jsonl|md|txt> <path>")
+	}
+	if app.Proto.History == nil {
+		return fmt.Errorf("history is not kept, so there is nothing to export")
+	}
+	format, err := transcript.ParseFormat(name)
+	if err != nil {
+		return err
+	}
+	peerID := ""
+	if !all {
+		if app.CurrentPeer == nil {
+			return fmt.Errorf("select a peer first, or export -all")
+		}
+		peerID = app.CurrentPeer.PeerID
+	}
+	convs, err := app.Proto.History.Conversations(peerID)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := transcript.Write(file, format, convs); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	app.InfoField.View.SetText(fmt.Sprintf("Exported %d conversations to %s", len(convs), tview.Escape(path)))
+	return nil
+}
+
+// importTranscript handles /import <path>, adding the messages of a JSON
+// Lines transcript to the history
+func (app *App) importTranscript(path string) error {
+	if path == "" {
+		return fmt.Errorf("usage: /import <path>")
+	}
+	if app.Proto.History == nil {
+		return fmt.Errorf("history is not kept, so there is nothing to import into")
+	}
+	file, err := os.Open(expandHome(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	convs, err := transcript.Read(file)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, conv := range convs {
+		n, err := app.Proto.History.Import(conv)
+		if err != nil {
+			return err
+		}
+		added += n
+	}
+	app.InfoField.View.SetText(fmt.Sprintf("Imported %d messages into %d conversations", added, len(convs)))
+	return nil
+}
+
+// expandHome resolves a path starting with ~/ in the home directory
+func expandHome(path string) string {
+	if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(path, "~/") {
+		return filepath.Join(home, path[2:])
+	}
+	return path
+}
+
+// changeGroup applies change to the current group for every peer named in
+// args
+func (app *App) changeGroup(args []string, change func(group *entity.Group, name string) error) error {
+	if app.CurrentGroup == nil {
+		return fmt.Errorf("select a group first")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("name at least one peer")
+	}
+	for _, name := range args {
+		if err := change(app.CurrentGroup, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *App) findPeer(name string) (*entity.Peer, error) {
+	for _, peer := range app.Proto.Peers.GetPeers() {
+		if peer.PeerID == name || peer.Username == name {
+			return peer, nil
+		}
+	}
+	return nil, fmt.Errorf("no peer named %s", name)
+}
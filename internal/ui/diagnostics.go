@@ -0,0 +1,39 @@
+package ui
+
+import (
+	"fmt"
+
+	"github.com/rivo/tview"
+
+	"p2p-messenger/internal/entity"
+)
+
+type DiagnosticsView struct {
+	View *tview.TextView
+}
+
+func NewDiagnosticsView() *DiagnosticsView {
+	view := tview.NewTextView().SetDynamicColors(true)
+	view.SetTitle("Diagnostics (Ctrl-D to close)").SetBorder(true)
+
+	return &DiagnosticsView{View: view}
+}
+
+// Update shows the listener's connection counters
+func (d *DiagnosticsView) Update(diag entity.Diagnostics) {
+	d.View.SetText(fmt.Sprintf(`Active connections:          %d
+
+Rejected (connection limit): %d
+Rejected (per-IP limit):     %d
+Oversized frames:            %d
+Handshake timeouts:          %d
+Idle timeouts:               %d
+Rate limited messages:       %d`,
+		diag.ActiveConnections,
+		diag.RejectedConnections,
+		diag.RejectedPerIP,
+		diag.OversizedFrames,
+		diag.HandshakeTimeouts,
+		diag.IdleTimeouts,
+		diag.RateLimited))
+}
@@ -0,0 +1,62 @@
+package ui
+
+import (
+	"github.com/rivo/tview"
+
+	"p2p-messenger/internal/history"
+)
+
+// Search finds messages in the history of every conversation
+type Search struct {
+	View    *tview.Flex
+	Input   *tview.InputField
+	Results *tview.Table
+	hits    []history.Hit
+}
+
+func NewSearch() *Search {
+	input := tview.NewInputField().
+		SetLabel("search: ").
+		SetPlaceholder("words peer:<id> from:<author> after:<date> before:<date>").
+		SetFieldBackgroundColor(tview.Styles.PrimitiveBackgroundColor).
+		SetFieldTextColor(tview.Styles.PrimaryTextColor)
+	results := tview.NewTable().SetSelectable(true, false)
+	view := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(input, 1, 0, true).
+		AddItem(results, 0, 1, false)
+	view.SetTitle("Search (Enter to open, Esc to close)").SetBorder(true)
+	return &Search{View: view, Input: input, Results: results}
+}
+
+// Update shows the messages found, naming peers with name
+func (s *Search) Update(hits []history.Hit, name func(peerID string) string, timeFormat string) {
+	s.hits = hits
+	s.Results.Clear()
+	for i, hit := range hits {
+		message := hit.Message
+		s.Results.SetCell(i, 0, tview.NewTableCell("[blue]"+message.Written().Local().Format(timeFormat)))
+		s.Results.SetCell(i, 1, tview.NewTableCell(tview.Escape(name(hit.PeerID))))
+		s.Results.SetCell(i, 2, tview.NewTableCell("[red]"+tview.Escape(message.Author)))
+		s.Results.SetCell(i, 3, tview.NewTableCell(tview.Escape(message.Text)).SetExpansion(1))
+	}
+	if len(hits) == 0 {
+		s.Results.SetCell(0, 0, tview.NewTableCell("[gray]no messages found").SetSelectable(false))
+	}
+	s.Results.Select(0, 0).ScrollToBeginning()
+}
+
+// Error shows why the search could not be run
+func (s *Search) Error(err error) {
+	s.hits = nil
+	s.Results.Clear()
+	s.Results.SetCell(0, 0, tview.NewTableCell("[red]"+tview.Escape(err.Error())).SetSelectable(false))
+}
+
+// Selected returns the message under the cursor
+func (s *Search) Selected() (history.Hit, bool) {
+	row, _ := s.Results.GetSelection()
+	if row < 0 || row >= len(s.hits) {
+		return history.Hit{}, false
+	}
+	return s.hits[row], true
+}
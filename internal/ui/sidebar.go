@@ -7,22 +7,36 @@ import (
 	"github.com/rivo/tview"
 
 	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/groups"
+	"p2p-messenger/internal/lobby"
 	"p2p-messenger/internal/repository"
 )
 
+// groupItemPrefix marks the secondary text of group entries, which holds
+// the group ID where peer entries hold the peer ID
+const groupItemPrefix = "group:"
+
+// inviteItemPrefix marks pending invites, which are accepted with /join
+// rather than selected
+const inviteItemPrefix = "invite:"
+
 type Sidebar struct {
 	View             *tview.List
 	peerRepo         *repository.PeerRepository
+	groups           *groups.Manager
+	lobby            *lobby.Lobby
 	currentPeerCount int
 }
 
-func NewSidebar(peerRepo *repository.PeerRepository) *Sidebar {
+func NewSidebar(peerRepo *repository.PeerRepository, groups *groups.Manager, lobby *lobby.Lobby) *Sidebar {
 	view := tview.NewList()
 	view.SetTitle("peers").SetBorder(true)
 
 	return &Sidebar{
 		View:             view,
 		peerRepo:         peerRepo,
+		groups:           groups,
+		lobby:            lobby,
 		currentPeerCount: -1,
 	}
 }
@@ -36,6 +50,24 @@ func (s *Sidebar) Reprint() {
 
 	s.View.Clear()
 
+	// The lobby is pinned to the top, then come the groups, each with its
+	// own conversation
+	if s.lobby != nil {
+		s.View.AddItem("[yellow]#[white]lobby", lobby.ID, 0, nil)
+	}
+	if s.groups != nil {
+		for _, group := range s.groups.Groups() {
+			displayText := fmt.Sprintf("[aqua]#[white]%s (%d)", group.Name, len(group.Members()))
+			if !s.groups.Joined(group) {
+				displayText = fmt.Sprintf("[gray]#%s (left)", group.Name)
+			}
+			s.View.AddItem(displayText, groupItemPrefix+group.ID, 0, nil)
+		}
+		for _, invite := range s.groups.Invites() {
+			s.View.AddItem(fmt.Sprintf("[gray]#%s (invited, /join)", invite.Name), inviteItemPrefix+invite.Group, 0, nil)
+		}
+	}
+
 	for _, peer := range peers {
 		// Display username only (no ID)
 		displayName := peer.Username
@@ -67,6 +99,8 @@ func (s *Sidebar) formatConnectionTypes(peer *entity.Peer) string {
 			indicators = append(indicators, "[yellow]●[white]NAT")
 		case entity.ConnectionInternet:
 			indicators = append(indicators, "[blue]●[white]Internet")
+		case entity.ConnectionRelay:
+			indicators = append(indicators, "[magenta]●[white]Relay")
 		}
 	}
 	
@@ -2,47 +2,71 @@ package ui
 
 import (
 	"fmt"
-	"log"
+	"strings"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 
+	"p2p-messenger/internal/config"
 	"p2p-messenger/internal/crypto"
 	"p2p-messenger/internal/entity"
+	"p2p-messenger/internal/history"
+	"p2p-messenger/internal/lobby"
+	"p2p-messenger/internal/logging"
 	"p2p-messenger/internal/proto"
+	"p2p-messenger/internal/transfer"
 )
 
-const (
-	reprintFrequency = 50 * time.Millisecond
-)
+var logger = logging.For("ui")
+
+// defaultReaction is the reaction sent with a single key
+const defaultReaction = "👍"
 
 type App struct {
 	Proto           *proto.Proto
 	Chat            *Chat
 	Sidebar         *Sidebar
 	InfoField       *InformationField
+	Diagnostics     *DiagnosticsView
+	Browser         *Browser
+	Search          *Search
 	View            *tview.Pages
 	UI              *tview.Application
 	CurrentPeer     *entity.Peer
+	CurrentGroup    *entity.Group
+	InLobby         bool
 	tutorial        *tview.TextView
 	tutorialVisible bool
+	config          config.UIConfig
+	// editing is the ID of the message the input field changes, "" while
+	// writing a new one
+	editing string
+	// replyTo is the ID of the message the input field answers
+	replyTo string
 }
 
-func NewApp(proto *proto.Proto) *App {
+func NewApp(proto *proto.Proto, cfg config.UIConfig) *App {
 	app := &App{
 		Proto:           proto,
-		Chat:            NewChat(),
-		Sidebar:         NewSidebar(proto.Peers),
+		Chat:            NewChat(cfg.TimeFormat),
+		Sidebar:         NewSidebar(proto.Peers, proto.Groups, proto.Lobby),
 		InfoField:       NewInformationField(),
+		Diagnostics:     NewDiagnosticsView(),
+		Browser:         NewBrowser(),
+		Search:          NewSearch(),
 		View:            tview.NewPages(),
 		UI:              tview.NewApplication(),
 		CurrentPeer:     nil,
 		tutorialVisible: false,
+		config:          cfg,
 	}
 	app.tutorial = newTutorialView()
 
 	app.initView()
+	if cfg.ShowTutorial {
+		app.toggleTutorial()
+	}
 	app.initUI()
 	app.initBindings()
 
@@ -54,11 +78,29 @@ func NewApp(proto *proto.Proto) *App {
 func newTutorialView() *tview.TextView {
 	view := tview.NewTextView()
 	view.SetText(`Controls:
-- Arrow keys: Navigate the peer list and messages
+- Arrow keys: Navigate the peer list and select messages
+- e, d: Edit or delete the selected message you sent
+- r: Reply to the selected message, +: React to it with 👍
+- /react [emoji]: React to the selected message, or take your reaction back
+- /timer <1h|1d|1w|off>: Make messages with the selected peer disappear after a while
+- /export [-all] <jsonl|md|txt> <path>: Save the conversation with the selected peer, or all of them
+- /import <path>: Add the messages of an exported .jsonl transcript to the history
 - Enter: Select a peer and start a chat
 - j: Focus the message input field
 - h: Focus the peer list
-- Ctrl-T: Show/hide this tutorial`)
+- Ctrl-T: Show/hide this tutorial
+- Ctrl-D: Show/hide connection diagnostics
+- Ctrl-F: Search all conversations, e.g. "lunch from:alice after:2026-01-31"
+- /group [-invite-only] <name> <peer>...: Start a group chat
+- /add, /remove <peer>: Change the members of the selected group
+- /ban, /promote <peer>: Ban a member or make them an admin
+- /invite <peer>, /join <name>: Invite to an invite-only group, accept an invite
+- /leave: Leave the selected group
+- /send-file <path>: Offer a file to the selected peer
+- /accept, /decline [name]: Answer a file offered by the selected peer
+- /share <folder> <peer|#group>...: Let peers and group members browse a folder
+- /unshare <name>: Stop sharing a folder
+- /browse: Browse and download the folders the selected peer shares with you`)
 	view.SetBorder(true)
 	view.SetTitle("Tutorial")
 	return view
@@ -77,6 +119,9 @@ func (app *App) initView() {
 
 	app.View.AddPage("main", mainView, true, true)
 	app.View.AddPage("tutorial", app.tutorial, true, false)
+	app.View.AddPage("diagnostics", app.Diagnostics.View, true, false)
+	app.View.AddPage("browse", app.Browser.View, true, false)
+	app.View.AddPage("search", app.Search.View, true, false)
 }
 
 func (app *App) initUI() {
@@ -89,9 +134,40 @@ func (app *App) initBindings() {
 			app.toggleTutorial()
 			return nil
 		}
+		if event.Key() == tcell.KeyCtrlD {
+			app.toggleDiagnostics()
+			return nil
+		}
+		if event.Key() == tcell.KeyCtrlF {
+			app.toggleSearch()
+			return nil
+		}
 		return event
 	})
 
+	app.Search.Input.SetChangedFunc(app.search)
+	app.Search.Input.SetDoneFunc(func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEnter, tcell.KeyTab, tcell.KeyDown:
+			app.UI.SetFocus(app.Search.Results)
+		case tcell.KeyEscape:
+			app.toggleSearch()
+		}
+	})
+	app.Search.Results.SetSelectedFunc(func(int, int) {
+		if hit, ok := app.Search.Selected(); ok {
+			app.jumpTo(hit)
+		}
+	})
+	app.Search.Results.SetDoneFunc(func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEscape:
+			app.toggleSearch()
+		case tcell.KeyTab, tcell.KeyBacktab:
+			app.UI.SetFocus(app.Search.Input)
+		}
+	})
+
 	app.Sidebar.View.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		if event.Rune() == 'l' {
 			app.UI.SetFocus(app.Chat.Messages)
@@ -99,7 +175,9 @@ func (app *App) initBindings() {
 
 		if event.Key() == tcell.KeyEnter {
 			if app.Sidebar.View.GetItemCount() > 0 {
-				app.CurrentPeer = app.getCurrentPeer()
+				app.CurrentPeer, app.CurrentGroup, app.InLobby = app.getCurrentSelection()
+				app.Chat.ClearSelection()
+				app.stopEditing()
 				app.UI.SetFocus(app.Chat.Messages)
 			}
 		}
@@ -107,54 +185,118 @@ func (app *App) initBindings() {
 		return event
 	})
 
+	app.Browser.View.SetSelectedFunc(func(int, int) {
+		entry, ok := app.Browser.Selected()
+		if !ok {
+			return
+		}
+		if err := app.Proto.Transfers.Download(app.Browser.Peer.PeerID, entry); err != nil {
+			app.InfoField.View.SetText(fmt.Sprintf("[red]%s", err))
+			return
+		}
+		app.InfoField.View.SetText(fmt.Sprintf("Downloading %s", tview.Escape(entry.Path)))
+	})
+	app.Browser.View.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			app.View.SwitchToPage("main")
+			app.UI.SetFocus(app.Chat.Messages)
+		}
+	})
+
 	app.Chat.Messages.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp:
+			app.Chat.Select(-1)
+			return nil
+		case tcell.KeyDown:
+			app.Chat.Select(1)
+			return nil
+		case tcell.KeyEscape:
+			app.Chat.ClearSelection()
+			return nil
+		}
 		switch event.Rune() {
 		case 'h':
 			app.UI.SetFocus(app.Sidebar.View)
 		case 'j':
 			app.UI.SetFocus(app.Chat.InputField)
+		case 'e':
+			app.editSelected()
+		case 'd':
+			app.deleteSelected()
+		case 'r':
+			app.replyToSelected()
+		case '+':
+			if err := app.react(defaultReaction); err != nil {
+				app.InfoField.View.SetText(fmt.Sprintf("[red]%s", err))
+			}
 		}
 
 		return event
 	})
 
+	// Commands are not messages, so they do not count as typing
+	app.Chat.InputField.SetChangedFunc(func(text string) {
+		if app.CurrentPeer == nil || app.Proto.Presence == nil || app.editing != "" {
+			return
+		}
+		if text == "" || strings.HasPrefix(text, "/") {
+			app.Proto.Presence.StopTyping(app.CurrentPeer)
+			return
+		}
+		app.Proto.Presence.Typing(app.CurrentPeer)
+	})
+
 	app.Chat.InputField.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		if event.Key() == tcell.KeyUp {
 			app.UI.SetFocus(app.Chat.Messages)
 		}
+		if event.Key() == tcell.KeyEscape && (app.editing != "" || app.replyTo != "") {
+			app.stopEditing()
+			return nil
+		}
 
 		if event.Key() == tcell.KeyEnter {
-			if app.CurrentPeer == nil {
-				app.InfoField.View.SetText("Please select a peer to chat with")
+			if app.Chat.InputField.GetText() == "" {
 				return event
 			}
-			if app.Chat.InputField.GetText() == "" {
+			if app.editing != "" {
+				app.finishEditing()
+				return event
+			}
+			if app.runCommand(app.Chat.InputField.GetText()) {
+				app.Chat.InputField.SetText("")
+				return event
+			}
+			if app.CurrentPeer == nil && app.CurrentGroup == nil && !app.InLobby {
+				app.InfoField.View.SetText("Please select a peer to chat with")
 				return event
 			}
 
 			message := app.Chat.InputField.GetText()
 			peer := app.CurrentPeer
 
-			// Use username for sent messages (fallback to peer ID if username not set)
-			author := app.Proto.Username
-			if author == "" {
-				author = crypto.PeerID(app.Proto.PublicKey)
-			}
+			author := app.author()
 
-			// Add message immediately to show on sender's screen
-			peer.AddMessage(message, author)
-
-			go func() {
-				if err := peer.SendMessage(message, app.Proto.PrivateKey); err != nil {
-					// Don't delete peer on temporary errors - log and continue
-					// Only delete on permanent connection failures
-					// The peer validator will handle cleanup of truly dead peers
-					log.Printf("ui: failed to send message to %s: %v", peer.PeerID, err)
-					// Don't clear the chat - let user see the message they sent
-					// The peer validator will remove truly dead peers
+			if app.InLobby {
+				app.Proto.Lobby.Send(message, author)
+				app.Chat.InputField.SetText("")
+				return event
+			}
+			if app.CurrentGroup != nil {
+				if err := app.Proto.Groups.Send(app.CurrentGroup, message, author); err != nil {
+					app.InfoField.View.SetText(fmt.Sprintf("[red]%s", err))
+					return event
 				}
-			}()
+				app.Chat.InputField.SetText("")
+				return event
+			}
 
+			// Shows the message right away; if the peer cannot be reached
+			// it stays queued and is marked as such
+			app.Proto.Outbox.Reply(peer, app.replyTo, message, author)
+
+			app.stopEditing()
 			app.Chat.InputField.SetText("")
 		}
 
@@ -162,6 +304,110 @@ func (app *App) initBindings() {
 	})
 }
 
+// author names us on the messages and reactions we send: the username, or
+// the peer ID if it is not set
+func (app *App) author() string {
+	if app.Proto.Username == "" {
+		return crypto.PeerID(app.Proto.PublicKey)
+	}
+	return app.Proto.Username
+}
+
+// selectedMessage returns the selected message of the conversation with
+// the current peer, and tells the user if there is none
+func (app *App) selectedMessage() (*entity.Message, bool) {
+	id := app.Chat.Selected()
+	if id == "" {
+		app.InfoField.View.SetText("Select a message with the arrow keys first")
+		return nil, false
+	}
+	if app.CurrentPeer == nil {
+		app.InfoField.View.SetText("Only messages with a peer can be answered or changed")
+		return nil, false
+	}
+	for _, message := range app.CurrentPeer.GetMessages() {
+		if message.ID == id && !message.Deleted {
+			return message, true
+		}
+	}
+	return nil, false
+}
+
+// selectedOutgoing is selectedMessage for the messages we sent
+func (app *App) selectedOutgoing() (*entity.Message, bool) {
+	message, ok := app.selectedMessage()
+	if ok && !message.Outgoing {
+		app.InfoField.View.SetText("Only your own messages can be changed")
+		return nil, false
+	}
+	return message, ok
+}
+
+// replyToSelected makes the next message an answer to the selected one
+func (app *App) replyToSelected() {
+	message, ok := app.selectedMessage()
+	if !ok {
+		return
+	}
+	app.stopEditing()
+	app.replyTo = message.ID
+	app.Chat.InputField.SetLabel(fmt.Sprintf("reply to %s: ", message.Author))
+	app.UI.SetFocus(app.Chat.InputField)
+}
+
+// react sets our reaction to the selected message; an empty emoji takes it
+// back
+func (app *App) react(emoji string) error {
+	message, ok := app.selectedMessage()
+	if !ok {
+		return nil
+	}
+	return app.Proto.Outbox.React(app.CurrentPeer, message.ID, emoji, app.author())
+}
+
+// editSelected loads the selected message into the input field, where Enter
+// sends the new text and Esc cancels
+func (app *App) editSelected() {
+	message, ok := app.selectedOutgoing()
+	if !ok {
+		return
+	}
+	app.editing = message.ID
+	app.Chat.InputField.SetLabel("edit: ").SetText(message.Text)
+	app.UI.SetFocus(app.Chat.InputField)
+}
+
+func (app *App) finishEditing() {
+	if err := app.Proto.Outbox.Edit(app.CurrentPeer, app.editing, app.Chat.InputField.GetText()); err != nil {
+		app.InfoField.View.SetText(fmt.Sprintf("[red]%s", err))
+	}
+	app.stopEditing()
+}
+
+// stopEditing goes back to writing a new message
+func (app *App) stopEditing() {
+	if app.editing == "" && app.replyTo == "" {
+		return
+	}
+	if app.editing != "" {
+		app.Chat.InputField.SetText("")
+	}
+	app.editing, app.replyTo = "", ""
+	app.Chat.InputField.SetLabel("")
+}
+
+// deleteSelected replaces the selected message with a tombstone here and at
+// the peer
+func (app *App) deleteSelected() {
+	message, ok := app.selectedOutgoing()
+	if !ok {
+		return
+	}
+	if err := app.Proto.Outbox.Delete(app.CurrentPeer, message.ID); err != nil {
+		app.InfoField.View.SetText(fmt.Sprintf("[red]%s", err))
+	}
+}
+
 func (app *App) toggleTutorial() {
 	if app.tutorialVisible {
 		app.View.SwitchToPage("main")
@@ -171,14 +417,100 @@ func (app *App) toggleTutorial() {
 	app.tutorialVisible = !app.tutorialVisible
 }
 
+func (app *App) toggleDiagnostics() {
+	if name, _ := app.View.GetFrontPage(); name == "diagnostics" {
+		app.View.SwitchToPage("main")
+		return
+	}
+	app.tutorialVisible = false
+	app.updateDiagnostics()
+	app.View.SwitchToPage("diagnostics")
+}
+
+func (app *App) toggleSearch() {
+	if name, _ := app.View.GetFrontPage(); name == "search" {
+		app.View.SwitchToPage("main")
+		app.UI.SetFocus(app.Chat.Messages)
+		return
+	}
+	if app.Proto.History == nil {
+		app.InfoField.View.SetText("[red]history is not kept, so there is nothing to search")
+		return
+	}
+	app.tutorialVisible = false
+	app.View.SwitchToPage("search")
+	app.search(app.Search.Input.GetText())
+	app.UI.SetFocus(app.Search.Input)
+}
+
+// search shows the stored messages matching what was typed so far
+func (app *App) search(input string) {
+	query, err := history.ParseQuery(input)
+	if err != nil {
+		app.Search.Error(err)
+		return
+	}
+	// Peers can be named like anywhere else while they are around
+	if peer, err := app.findPeer(query.Peer); query.Peer != "" && err == nil {
+		query.Peer = peer.PeerID
+	}
+	var hits []history.Hit
+	if !query.Empty() {
+		hits = app.Proto.History.Search(query)
+	}
+	app.Search.Update(hits, app.peerName, time.DateOnly+" "+app.config.TimeFormat)
+}
+
+// peerName is the username of a peer that is around, or its ID
+func (app *App) peerName(peerID string) string {
+	if peer, ok := app.Proto.Peers.Get(peerID); ok && peer.Username != "" {
+		return peer.Username
+	}
+	return peerID
+}
+
+// jumpTo opens the conversation of a message found by a search and selects
+// the message
+func (app *App) jumpTo(hit history.Hit) {
+	peer, ok := app.Proto.Peers.Get(hit.PeerID)
+	if !ok {
+		app.InfoField.View.SetText(fmt.Sprintf("%s is not around, its conversation cannot be opened", tview.Escape(hit.PeerID)))
+		return
+	}
+	app.CurrentPeer, app.CurrentGroup, app.InLobby = peer, nil, false
+	app.stopEditing()
+	app.View.SwitchToPage("main")
+	app.renderMessages()
+	if !app.Chat.SelectID(hit.Message.ID) {
+		app.InfoField.View.SetText("The message is no longer in the conversation")
+	}
+	app.UI.SetFocus(app.Chat.Messages)
+}
+
 func (app *App) renderMessages() {
+	if app.InLobby {
+		app.renderLobby()
+		return
+	}
+	if app.CurrentGroup != nil {
+		app.renderGroup(app.CurrentGroup)
+		return
+	}
 	if app.CurrentPeer != nil {
 		// Use current user's username/ID for author comparison
 		currentUserID := app.Proto.Username
 		if currentUserID == "" {
 			currentUserID = crypto.PeerID(app.Proto.PublicKey)
 		}
-		app.Chat.RenderMessages(app.CurrentPeer.Messages, currentUserID)
+		var transfers []transfer.Transfer
+		if app.Proto.Transfers != nil {
+			transfers = app.Proto.Transfers.Transfers(app.CurrentPeer.PeerID)
+		}
+		app.Chat.RenderConversation(app.CurrentPeer.GetMessages(), transfers, currentUserID)
+		// What is on screen counts as read
+		if app.Proto.Presence != nil {
+			app.Proto.Presence.Read(app.CurrentPeer)
+		}
 		// Display full peer ID in title with connection type
 		title := app.CurrentPeer.PeerID
 
@@ -187,27 +519,98 @@ func (app *App) renderMessages() {
 			primaryType := app.CurrentPeer.PrimaryConnectionType.String()
 			title = fmt.Sprintf("%s [%s]", title, primaryType)
 		}
+		// Name the node relaying the conversation when there is no direct path
+		if route, ok := app.CurrentPeer.GetRoute(); ok && len(app.CurrentPeer.Addresses()) == 0 {
+			via := route.Via
+			if peer, ok := app.Proto.Peers.Get(route.Via); ok && peer.Username != "" {
+				via = peer.Username
+			}
+			title = fmt.Sprintf("%s [via %s]", title, via)
+		}
+		// And the handshake mode once our session with the peer is up
+		if mode := app.CurrentPeer.SessionMode(); mode != "" {
+			title = fmt.Sprintf("%s [%s]", title, mode)
+		}
+		if timer, _ := app.CurrentPeer.Timer(); timer > 0 {
+			title = fmt.Sprintf("%s [⏱ %s]", title, entity.FormatTimer(timer))
+		}
+		if app.CurrentPeer.Typing() {
+			title += " typing…"
+		}
 
 		app.Chat.View.SetTitle(title)
 	}
 }
 
-func (app *App) getCurrentPeer() *entity.Peer {
-	_, peerID := app.Sidebar.View.GetItemText(
+// renderLobby shows the public room with the number of peers it reaches
+func (app *App) renderLobby() {
+	currentUserID := app.Proto.Username
+	if currentUserID == "" {
+		currentUserID = crypto.PeerID(app.Proto.PublicKey)
+	}
+	app.Chat.RenderMessages(app.Proto.Lobby.Room().GetMessages(), currentUserID)
+	app.Chat.View.SetTitle(fmt.Sprintf("#lobby [%d peers]", len(app.Proto.Peers.GetPeers())))
+}
+
+// renderGroup shows the conversation of a group, with its members in the
+// title
+func (app *App) renderGroup(group *entity.Group) {
+	currentUserID := app.Proto.Username
+	if currentUserID == "" {
+		currentUserID = crypto.PeerID(app.Proto.PublicKey)
+	}
+	app.Chat.RenderMessages(group.GetMessages(), currentUserID)
+
+	var names []string
+	for _, member := range group.Members() {
+		name := member.Username
+		if name == "" {
+			name = member.PeerID
+		}
+		if member.Admin {
+			name = "★" + name
+		}
+		names = append(names, name)
+	}
+	title := fmt.Sprintf("#%s [%s]", group.Name, strings.Join(names, ", "))
+	if group.InviteOnly() {
+		title += " [invite-only]"
+	}
+	if !app.Proto.Groups.Joined(group) {
+		title = fmt.Sprintf("#%s [left]", group.Name)
+	}
+	app.Chat.View.SetTitle(title)
+}
+
+// getCurrentSelection returns the peer or group selected in the sidebar,
+// or whether it is the lobby
+func (app *App) getCurrentSelection() (*entity.Peer, *entity.Group, bool) {
+	_, id := app.Sidebar.View.GetItemText(
 		app.Sidebar.View.GetCurrentItem())
 
-	peer, found := app.Proto.Peers.Get(peerID)
+	if id == lobby.ID && app.Proto.Lobby != nil {
+		return nil, nil, true
+	}
+	if groupID, ok := strings.CutPrefix(id, groupItemPrefix); ok {
+		group, found := app.Proto.Groups.Get(groupID)
+		if !found {
+			return nil, nil, false
+		}
+		return nil, group, false
+	}
+
+	peer, found := app.Proto.Peers.Get(id)
 	if !found {
-		return nil
+		return nil, nil, false
 	}
 
-	return peer
+	return peer, nil, false
 }
 
 func (app *App) run() {
 	app.updateModeIndicators() // Initial update
 
-	ticker := time.NewTicker(reprintFrequency)
+	ticker := time.NewTicker(app.config.RefreshInterval.Std())
 	go func() {
 		for {
 			<-ticker.C
@@ -221,6 +624,8 @@ func (app *App) run() {
 		for {
 			<-networkTicker.C
 			app.UI.QueueUpdateDraw(app.updateModeIndicators)
+			app.UI.QueueUpdateDraw(app.updateDiagnostics)
+			app.UI.QueueUpdateDraw(app.updateBrowser)
 		}
 	}()
 }
@@ -231,3 +636,17 @@ func (app *App) updateModeIndicators() {
 		app.InfoField.UpdateModes(bleAvail, natAvail, internetAvail)
 	}
 }
+
+// updateBrowser shows the index of the peer being browsed as it arrives
+func (app *App) updateBrowser() {
+	if name, _ := app.View.GetFrontPage(); name != "browse" || app.Browser.Peer == nil {
+		return
+	}
+	app.Browser.Update(app.Proto.Transfers.Index(app.Browser.Peer.PeerID))
+}
+
+func (app *App) updateDiagnostics() {
+	if app.Proto.NetworkManager != nil {
+		app.Diagnostics.Update(app.Proto.NetworkManager.GetDiagnostics())
+	}
+}